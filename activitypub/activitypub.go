@@ -0,0 +1,604 @@
+package activitypub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kanosaki/dumper/timeline"
+)
+
+var (
+	DefaultPageSize     = 20
+	DefaultMaxAttempts  = 8
+	DefaultRetryBackoff = 30 * time.Second
+	DefaultTimeout      = 10 * time.Second
+	DefaultWorkers      = 4
+	DefaultQueueSize    = 1000
+	// Inbox requests larger than this are rejected.
+	MaxActivitySize int64 = 1 << 20
+
+	ErrUnknownActor = errors.New("Unknown actor")
+	ErrNotFound     = errors.New("Not found")
+	ErrBadActivity  = errors.New("Invalid activity")
+	ErrQueueFull    = errors.New("Delivery queue is full")
+)
+
+var actorNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// A topic followed as an actor named Name.
+type ActorConfig struct {
+	Name  string `yaml:"name"`
+	Topic string `yaml:"topic"`
+	// Title and Summary of the actor, title and description of the topic by default.
+	Title   string `yaml:"title"`
+	Summary string `yaml:"summary"`
+}
+
+// activitypub.yaml
+//   base_url: https://dumper.example.com
+//   actors:
+//     - name: pixiv_daily
+//       topic: /pixiv/ranking/daily
+//       title: pixiv daily ranking
+//     - name: cats
+//       topic: /saved/cats
+type Config struct {
+	// Public URL of web.Server, which should be reachable from remote servers.
+	BaseURL string `yaml:"base_url"`
+	// Number of items in a page of outbox.
+	PageSize int `yaml:"page_size"`
+	// Failed deliveries are retried with exponential backoff, up to MaxAttempts.
+	MaxAttempts  int           `yaml:"max_attempts"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	Timeout      time.Duration `yaml:"timeout"`
+	// Number of concurrent deliveries, and deliveries waiting for them.
+	Workers   int           `yaml:"workers"`
+	QueueSize int           `yaml:"queue_size"`
+	Actors    []ActorConfig `yaml:"actors"`
+}
+
+// Publisher serves topics as ActivityPub actors, and delivers their items to followers.
+// Followers and keys of actors are stored in database. Deliveries are kept only in memory,
+// so items published while stopped are not delivered.
+type Publisher struct {
+	db     *sql.DB
+	tl     *timeline.Service
+	conf   Config
+	host   string
+	actors map[string]*actor
+	client *http.Client
+	queue  chan *delivery
+}
+
+type actor struct {
+	ActorConfig
+	id  string
+	key *rsa.PrivateKey
+	pem string
+}
+
+type delivery struct {
+	actor *actor
+	inbox string
+	body  []byte
+}
+
+// Tables are created in db, and keys of actors are generated if missing.
+func New(db *sql.DB, tl *timeline.Service, conf Config) (*Publisher, error) {
+	if conf.PageSize <= 0 {
+		conf.PageSize = DefaultPageSize
+	}
+	if conf.MaxAttempts <= 0 {
+		conf.MaxAttempts = DefaultMaxAttempts
+	}
+	if conf.RetryBackoff <= 0 {
+		conf.RetryBackoff = DefaultRetryBackoff
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = DefaultTimeout
+	}
+	if conf.Workers <= 0 {
+		conf.Workers = DefaultWorkers
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = DefaultQueueSize
+	}
+	conf.BaseURL = strings.TrimRight(conf.BaseURL, "/")
+	base, err := url.Parse(conf.BaseURL)
+	if err != nil || base.Host == "" || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid base_url of activitypub: %q", conf.BaseURL)
+	}
+	p := &Publisher{
+		db:     db,
+		tl:     tl,
+		conf:   conf,
+		host:   base.Host,
+		actors: make(map[string]*actor),
+		client: &http.Client{Timeout: conf.Timeout},
+		queue:  make(chan *delivery, conf.QueueSize),
+	}
+	ctx := context.Background()
+	if err := initStore(ctx, db); err != nil {
+		return nil, err
+	}
+	for _, ac := range conf.Actors {
+		if !actorNamePattern.MatchString(ac.Name) || ac.Topic == "" {
+			return nil, fmt.Errorf("Invalid activitypub actor %q, name of [a-zA-Z0-9_] and topic are required", ac.Name)
+		}
+		if _, ok := p.actors[ac.Name]; ok {
+			return nil, fmt.Errorf("Duplicated activitypub actor: %s", ac.Name)
+		}
+		key, err := loadKey(ctx, db, ac.Name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load key of %s: %v", ac.Name, err)
+		}
+		pem, err := encodePublicKey(&key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		p.actors[ac.Name] = &actor{
+			ActorConfig: ac,
+			id:          conf.BaseURL + "/ap/actors/" + ac.Name,
+			key:         key,
+			pem:         pem,
+		}
+	}
+	return p, nil
+}
+
+// Replace HTTP client, used for delivery and fetching remote actors.
+func (p *Publisher) SetClient(c *http.Client) {
+	p.client = c
+}
+
+func (p *Publisher) actor(name string) (*actor, error) {
+	a, ok := p.actors[name]
+	if !ok {
+		return nil, ErrUnknownActor
+	}
+	return a, nil
+}
+
+// Resolve acct:name@host, or the actor URL.
+func (p *Publisher) WebFinger(resource string) (*JRD, error) {
+	var a *actor
+	if strings.HasPrefix(resource, "acct:") {
+		acct := strings.TrimPrefix(resource, "acct:")
+		at := strings.LastIndex(acct, "@")
+		if at < 0 || !strings.EqualFold(acct[at+1:], p.host) {
+			return nil, ErrUnknownActor
+		}
+		a = p.actors[acct[:at]]
+	} else {
+		for _, v := range p.actors {
+			if v.id == resource {
+				a = v
+			}
+		}
+	}
+	if a == nil {
+		return nil, ErrUnknownActor
+	}
+	return &JRD{
+		Subject: fmt.Sprintf("acct:%s@%s", a.Name, p.host),
+		Aliases: []string{a.id},
+		Links:   []JRDLink{{Rel: "self", Type: ContentType, Href: a.id}},
+	}, nil
+}
+
+// Actor document, title and icon of the topic are used unless configured.
+func (p *Publisher) Actor(ctx context.Context, name string) (*Actor, error) {
+	a, err := p.actor(name)
+	if err != nil {
+		return nil, err
+	}
+	doc := &Actor{
+		Context:           contextURIs,
+		ID:                a.id,
+		Type:              "Service",
+		PreferredUsername: a.Name,
+		Name:              a.Title,
+		Summary:           a.Summary,
+		Inbox:             a.id + "/inbox",
+		Outbox:            a.id + "/outbox",
+		Followers:         a.id + "/followers",
+		PublicKey:         &PublicKey{ID: a.id + "#main-key", Owner: a.id, PublicKeyPem: a.pem},
+	}
+	if t, ok := p.tl.Topic(a.Topic); ok {
+		info := t.Info()
+		if doc.Name == "" {
+			doc.Name = info.Title
+		}
+		if doc.Summary == "" {
+			doc.Summary = info.Description
+		}
+		if info.IconURL != "" {
+			doc.Icon = &Image{Type: "Image", MediaType: imageType(info.IconURL), URL: info.IconURL}
+		}
+	}
+	if doc.Name == "" {
+		doc.Name = a.Topic
+	}
+	return doc, nil
+}
+
+// Outbox collection, or its page of Create activities when page is true.
+// Pages are ordered from newest, and items after maxID are skipped if maxID > 0.
+func (p *Publisher) Outbox(ctx context.Context, name string, page bool, maxID int64) (*OrderedCollection, error) {
+	a, err := p.actor(name)
+	if err != nil {
+		return nil, err
+	}
+	outbox := a.id + "/outbox"
+	if !page {
+		counts, err := p.tl.Count(ctx, &timeline.Query{Topics: []string{a.Topic}})
+		if err != nil {
+			return nil, err
+		}
+		var total int64
+		for _, n := range counts {
+			total += n
+		}
+		return &OrderedCollection{
+			Context:    contextURIs,
+			ID:         outbox,
+			Type:       "OrderedCollection",
+			TotalItems: total,
+			First:      outbox + "?page=true",
+		}, nil
+	}
+	items, err := p.tl.Fetch(ctx, &timeline.Query{Topics: []string{a.Topic}, MaxID: int(maxID), Limit: p.conf.PageSize})
+	if err != nil {
+		return nil, err
+	}
+	id := outbox + "?page=true"
+	if maxID > 0 {
+		id += "&max_id=" + strconv.FormatInt(maxID, 10)
+	}
+	col := &OrderedCollection{
+		Context: contextURIs,
+		ID:      id,
+		Type:    "OrderedCollectionPage",
+		PartOf:  outbox,
+		Items:   make([]interface{}, 0, len(items)),
+	}
+	for _, it := range items {
+		col.Items = append(col.Items, a.activity(timeline.ItemEvent{Kind: timeline.ItemAdded, Item: it}))
+	}
+	if len(items) == p.conf.PageSize && items[len(items)-1].ID > 1 {
+		col.Next = fmt.Sprintf("%s?page=true&max_id=%d", outbox, items[len(items)-1].ID-1)
+	}
+	return col, nil
+}
+
+// Followers collection of the actor, members are listed in orderedItems.
+func (p *Publisher) Followers(ctx context.Context, name string) (*OrderedCollection, error) {
+	a, err := p.actor(name)
+	if err != nil {
+		return nil, err
+	}
+	followers, err := loadFollowers(ctx, p.db, a.Name)
+	if err != nil {
+		return nil, err
+	}
+	col := &OrderedCollection{
+		Context:    contextURIs,
+		ID:         a.id + "/followers",
+		Type:       "OrderedCollection",
+		TotalItems: int64(len(followers)),
+		Items:      make([]interface{}, 0, len(followers)),
+	}
+	for _, f := range followers {
+		col.Items = append(col.Items, f.ID)
+	}
+	return col, nil
+}
+
+// Note of an item in the topic of the actor. ErrNotFound if the item is deleted.
+func (p *Publisher) Note(ctx context.Context, name string, id int64) (*Note, error) {
+	a, err := p.actor(name)
+	if err != nil {
+		return nil, err
+	}
+	items, err := p.tl.Fetch(ctx, &timeline.Query{Topics: []string{a.Topic}, MinID: int(id), MaxID: int(id), Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrNotFound
+	}
+	n := a.note(items[0])
+	n.Context = contextURIs
+	return n, nil
+}
+
+// Process an activity posted to inbox of the actor. Signature of the request is verified
+// by the key of the sender, which is fetched from the remote server.
+// Follow and Undo of Follow are handled, and other activities are ignored.
+func (p *Publisher) HandleInbox(ctx context.Context, name string, r *http.Request) error {
+	a, err := p.actor(name)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxActivitySize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > MaxActivitySize {
+		return ErrBadActivity
+	}
+	var act struct {
+		ID     string          `json:"id"`
+		Type   string          `json:"type"`
+		Actor  string          `json:"actor"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := json.Unmarshal(body, &act); err != nil || act.Type == "" || act.Actor == "" {
+		return ErrBadActivity
+	}
+	sender, err := p.verifySender(ctx, a, r, body)
+	if err != nil {
+		return err
+	}
+	if sender.ID != act.Actor {
+		return &SignatureError{Reason: "signed by " + sender.ID + ", not by the actor"}
+	}
+	switch act.Type {
+	case "Follow":
+		if objectID(act.Object) != a.id {
+			return ErrBadActivity
+		}
+		if sender.Inbox == "" {
+			return ErrBadActivity
+		}
+		if err := addFollower(ctx, p.db, a.Name, &Follower{ID: sender.ID, Inbox: sender.Inbox, CreatedAt: time.Now()}); err != nil {
+			return err
+		}
+		accept := &Activity{
+			Context: contextURIs,
+			ID:      fmt.Sprintf("%s#accepts/%d", a.id, time.Now().UnixNano()),
+			Type:    "Accept",
+			Actor:   a.id,
+			Object:  json.RawMessage(body),
+		}
+		return p.enqueue(a, []string{sender.Inbox}, accept)
+	case "Undo":
+		var undone struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := json.Unmarshal(act.Object, &undone); err != nil {
+			// referred by ID, which is not known
+			return nil
+		}
+		if undone.Type == "Follow" && objectID(undone.Object) == a.id {
+			return removeFollower(ctx, p.db, a.Name, sender.ID)
+		}
+	}
+	return nil
+}
+
+// ID of an object which is embedded or referred by ID.
+func objectID(raw json.RawMessage) string {
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return id
+	}
+	var obj struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(raw, &obj)
+	return obj.ID
+}
+
+// Fetch the actor who owns keyId of the signature, then verify the request by its key.
+func (p *Publisher) verifySender(ctx context.Context, a *actor, r *http.Request, body []byte) (*Actor, error) {
+	keyID, err := KeyID(r)
+	if err != nil {
+		return nil, err
+	}
+	actorURL := keyID
+	if i := strings.Index(actorURL, "#"); i >= 0 {
+		actorURL = actorURL[:i]
+	}
+	sender, err := p.fetchActor(ctx, a, actorURL)
+	if err != nil {
+		return nil, &SignatureError{Reason: fmt.Sprintf("failed to fetch %s: %v", actorURL, err)}
+	}
+	// the document may claim any ID, so it should be the one which is fetched
+	if sender.ID != actorURL {
+		return nil, &SignatureError{Reason: fmt.Sprintf("%s is served as %s", sender.ID, actorURL)}
+	}
+	if sender.PublicKey == nil || sender.PublicKey.ID != keyID || sender.PublicKey.Owner != sender.ID {
+		return nil, &SignatureError{Reason: "unknown key " + keyID}
+	}
+	key, err := ParsePublicKey(sender.PublicKey.PublicKeyPem)
+	if err != nil {
+		return nil, &SignatureError{Reason: err.Error()}
+	}
+	if err := Verify(r, body, key); err != nil {
+		return nil, err
+	}
+	return sender, nil
+}
+
+// GET a remote actor document, signed by a for servers which require authorized fetch.
+func (p *Publisher) fetchActor(ctx context.Context, a *actor, u string) (*Actor, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", ContentType)
+	if err := Sign(req, nil, a.id+"#main-key", a.key); err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	var doc Actor
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MaxActivitySize)).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// Queue the activity for each inbox, without waiting for delivery.
+func (p *Publisher) enqueue(a *actor, inboxes []string, act *Activity) error {
+	body, err := json.Marshal(act)
+	if err != nil {
+		return err
+	}
+	for _, inbox := range inboxes {
+		select {
+		case p.queue <- &delivery{actor: a, inbox: inbox, body: body}:
+		default:
+			return ErrQueueFull
+		}
+	}
+	return nil
+}
+
+// Listen topics of actors and deliver activities to followers until ctx is done.
+// Errors which don't stop the publisher are passed to onError if not nil.
+func (p *Publisher) Start(ctx context.Context, onError func(error)) error {
+	report := func(err error) {
+		if err != nil && err != context.Canceled && onError != nil {
+			onError(err)
+		}
+	}
+	listeners := make(map[*actor]*timeline.Listener, len(p.actors))
+	for _, a := range p.actors {
+		lis, err := p.tl.Listen(a.Topic)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("activitypub %s: %v", a.Name, err)
+		}
+		listeners[a] = lis
+	}
+	var wg sync.WaitGroup
+	for a, lis := range listeners {
+		wg.Add(1)
+		go func(a *actor, lis *timeline.Listener) {
+			defer wg.Done()
+			defer lis.Close()
+			if err := p.announce(ctx, a, lis, report); err != nil {
+				report(fmt.Errorf("activitypub %s: %v", a.Name, err))
+			}
+		}(a, lis)
+	}
+	for i := 0; i < p.conf.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case d := <-p.queue:
+					report(p.deliver(ctx, d))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// Queue activities of published, updated and deleted items for followers of a.
+func (p *Publisher) announce(ctx context.Context, a *actor, lis *timeline.Listener, report func(error)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-lis.C:
+			if !ok {
+				return lis.Err()
+			}
+			followers, err := loadFollowers(ctx, p.db, a.Name)
+			if err != nil {
+				report(err)
+				continue
+			}
+			inboxes := make([]string, 0, len(followers))
+			seen := make(map[string]bool, len(followers))
+			for _, f := range followers {
+				// followers on the same server may share an inbox
+				if !seen[f.Inbox] {
+					seen[f.Inbox] = true
+					inboxes = append(inboxes, f.Inbox)
+				}
+			}
+			report(p.enqueue(a, inboxes, a.activity(ev)))
+		}
+	}
+}
+
+// POST signed body to the inbox, retried with exponential backoff.
+// Client errors except 429 are not retried.
+func (p *Publisher) deliver(ctx context.Context, d *delivery) error {
+	backoff := p.conf.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		status, err := p.post(ctx, d)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if attempt >= p.conf.MaxAttempts || (status/100 == 4 && status != http.StatusTooManyRequests) {
+			return fmt.Errorf("activitypub %s: delivery to %s failed: %v", d.actor.Name, d.inbox, err)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+func (p *Publisher) post(ctx context.Context, d *delivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, d.inbox, bytes.NewReader(d.body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", ContentType)
+	if err := Sign(req, d.body, d.actor.id+"#main-key", d.actor.key); err != nil {
+		return 0, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
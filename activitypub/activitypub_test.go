@@ -0,0 +1,369 @@
+package activitypub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	KeySize = 1024
+}
+
+// Remote actor with an inbox, which checks signatures of deliveries.
+type remote struct {
+	srv *httptest.Server
+	key *rsa.PrivateKey
+	// key of the local actor which signs deliveries
+	verifyKey *rsa.PublicKey
+	mu        sync.Mutex
+	received  []map[string]interface{}
+	badSig    int
+	// responded status codes in order, then 202
+	statuses []int
+}
+
+func newRemote(t *testing.T) *remote {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &remote{key: key}
+	mux := http.NewServeMux()
+	// claims to be alice with the same key
+	mux.HandleFunc("/users/mallory", func(w http.ResponseWriter, req *http.Request) {
+		pem, _ := encodePublicKey(&r.key.PublicKey)
+		w.Header().Set("Content-Type", ContentType)
+		json.NewEncoder(w).Encode(&Actor{
+			ID:        r.actorID(),
+			Type:      "Person",
+			Inbox:     r.srv.URL + "/users/mallory/inbox",
+			PublicKey: &PublicKey{ID: r.srv.URL + "/users/mallory#main-key", Owner: r.actorID(), PublicKeyPem: pem},
+		})
+	})
+	mux.HandleFunc("/users/alice", func(w http.ResponseWriter, req *http.Request) {
+		pem, _ := encodePublicKey(&r.key.PublicKey)
+		w.Header().Set("Content-Type", ContentType)
+		json.NewEncoder(w).Encode(&Actor{
+			ID:                r.actorID(),
+			Type:              "Person",
+			PreferredUsername: "alice",
+			Inbox:             r.actorID() + "/inbox",
+			PublicKey:         &PublicKey{ID: r.actorID() + "#main-key", Owner: r.actorID(), PublicKeyPem: pem},
+		})
+	})
+	mux.HandleFunc("/users/alice/inbox", func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		body, _ := ioutil.ReadAll(req.Body)
+		if len(r.statuses) > 0 {
+			status := r.statuses[0]
+			r.statuses = r.statuses[1:]
+			w.WriteHeader(status)
+			return
+		}
+		if Verify(req, body, r.verifyKey) != nil {
+			r.badSig++
+		}
+		var act map[string]interface{}
+		json.Unmarshal(body, &act)
+		r.received = append(r.received, act)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	r.srv = httptest.NewServer(mux)
+	t.Cleanup(r.srv.Close)
+	return r
+}
+
+func (r *remote) actorID() string {
+	return r.srv.URL + "/users/alice"
+}
+
+func (r *remote) activities() []map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]map[string]interface{}(nil), r.received...)
+}
+
+// Signed request to inbox of the local actor.
+func (r *remote) post(t *testing.T, p *Publisher, name string, act interface{}) error {
+	body, _ := json.Marshal(act)
+	req := httptest.NewRequest(http.MethodPost, p.conf.BaseURL+"/ap/actors/"+name+"/inbox", bytes.NewReader(body))
+	if err := Sign(req, body, r.actorID()+"#main-key", r.key); err != nil {
+		t.Fatal(err)
+	}
+	return p.HandleInbox(context.Background(), name, req)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newPublisher(t *testing.T) (*Publisher, *timeline.Service, *sql.DB) {
+	dir := t.TempDir()
+	storage, err := timeline.NewStorage("sqlite3", filepath.Join(dir, "timeline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := timeline.NewService(storage)
+	info := timeline.TopicInfo{Title: "pixiv daily", IconURL: "https://img.example.com/icon.png"}
+	if err := tl.NewTopicWithInfo("pixiv.ranking", "/pixiv/ranking/daily", info); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "activitypub.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	p, err := New(db, tl, Config{
+		BaseURL:      "https://dumper.example.com/",
+		PageSize:     2,
+		MaxAttempts:  3,
+		RetryBackoff: 10 * time.Millisecond,
+		Actors:       []ActorConfig{{Name: "daily", Topic: "/pixiv/ranking/daily", Summary: "Daily ranking"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, tl, db
+}
+
+func TestNewConfig(t *testing.T) {
+	a := assert.New(t)
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "activitypub.db"))
+	a.NoError(err)
+	defer db.Close()
+	tl := timeline.NewService(nil)
+	_, err = New(db, tl, Config{BaseURL: "dumper.example.com"})
+	a.Error(err)
+	_, err = New(db, tl, Config{BaseURL: "https://dumper.example.com", Actors: []ActorConfig{{Name: "bad name", Topic: "/a"}}})
+	a.Error(err)
+	_, err = New(db, tl, Config{BaseURL: "https://dumper.example.com", Actors: []ActorConfig{{Name: "a", Topic: "/a"}, {Name: "a", Topic: "/b"}}})
+	a.Error(err)
+
+	// key is kept across restarts
+	conf := Config{BaseURL: "https://dumper.example.com", Actors: []ActorConfig{{Name: "a", Topic: "/a"}}}
+	p1, err := New(db, tl, conf)
+	a.NoError(err)
+	p2, err := New(db, tl, conf)
+	a.NoError(err)
+	a.Equal(p1.actors["a"].pem, p2.actors["a"].pem)
+}
+
+func TestDocuments(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	p, tl, _ := newPublisher(t)
+	a.NoError(tl.Publish("/pixiv/ranking/daily",
+		&timeline.Item{Caption: "first", OriginKey: 1, Thumbnail: "https://img.example.com/1.png", Tags: []string{"cat"}},
+		&timeline.Item{Caption: "second\n<b>", OriginKey: 2},
+		&timeline.Item{Caption: "third", OriginKey: 3}))
+
+	jrd, err := p.WebFinger("acct:daily@dumper.example.com")
+	if a.NoError(err) && a.Len(jrd.Links, 1) {
+		a.Equal("https://dumper.example.com/ap/actors/daily", jrd.Links[0].Href)
+	}
+	_, err = p.WebFinger("acct:daily@other.example.com")
+	a.Equal(ErrUnknownActor, err)
+	_, err = p.WebFinger("acct:none@dumper.example.com")
+	a.Equal(ErrUnknownActor, err)
+
+	doc, err := p.Actor(ctx, "daily")
+	if a.NoError(err) {
+		a.Equal("pixiv daily", doc.Name)
+		a.Equal("Daily ranking", doc.Summary)
+		a.Equal("https://dumper.example.com/ap/actors/daily/inbox", doc.Inbox)
+		a.Equal("image/png", doc.Icon.MediaType)
+		key, err := ParsePublicKey(doc.PublicKey.PublicKeyPem)
+		a.NoError(err)
+		a.Equal(&p.actors["daily"].key.PublicKey, key)
+	}
+	_, err = p.Actor(ctx, "none")
+	a.Equal(ErrUnknownActor, err)
+
+	outbox, err := p.Outbox(ctx, "daily", false, 0)
+	if a.NoError(err) {
+		a.EqualValues(3, outbox.TotalItems)
+		a.Equal("https://dumper.example.com/ap/actors/daily/outbox?page=true", outbox.First)
+	}
+	page, err := p.Outbox(ctx, "daily", true, 0)
+	if a.NoError(err) && a.Len(page.Items, 2) {
+		act := page.Items[0].(*Activity)
+		a.Equal("Create", act.Type)
+		a.Equal("<p>third</p>", act.Object.(*Note).Content)
+		a.Equal("<p>second<br>&lt;b&gt;</p>", page.Items[1].(*Activity).Object.(*Note).Content)
+		a.NotEmpty(page.Next)
+	}
+	items, err := tl.Fetch(ctx, &timeline.Query{Topics: []string{"/pixiv/ranking/daily"}})
+	a.NoError(err)
+	page, err = p.Outbox(ctx, "daily", true, items[2].ID)
+	if a.NoError(err) && a.Len(page.Items, 1) {
+		note := page.Items[0].(*Activity).Object.(*Note)
+		a.Equal([]*Image{{Type: "Image", MediaType: "image/png", URL: "https://img.example.com/1.png"}}, note.Attachment)
+		a.Equal([]*Hashtag{{Type: "Hashtag", Name: "#cat"}}, note.Tag)
+		a.Empty(page.Next)
+	}
+
+	note, err := p.Note(ctx, "daily", items[2].ID)
+	if a.NoError(err) {
+		a.Equal(p.actors["daily"].noteID(items[2].ID), note.ID)
+	}
+	_, err = p.Note(ctx, "daily", items[0].ID+100)
+	a.Equal(ErrNotFound, err)
+}
+
+func TestFollowAndDeliver(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	p, tl, db := newPublisher(t)
+	alice := newRemote(t)
+	alice.verifyKey = &p.actors["daily"].key.PublicKey
+	var errMu sync.Mutex
+	var errs []error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.NoError(p.Start(ctx, func(err error) {
+			errMu.Lock()
+			errs = append(errs, err)
+			errMu.Unlock()
+		}))
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	follow := map[string]interface{}{
+		"id":     alice.actorID() + "/follows/1",
+		"type":   "Follow",
+		"actor":  alice.actorID(),
+		"object": p.actors["daily"].id,
+	}
+	a.NoError(alice.post(t, p, "daily", follow))
+	waitFor(t, func() bool { return len(alice.activities()) == 1 })
+	accept := alice.activities()[0]
+	a.Equal("Accept", accept["type"])
+	a.Equal(alice.actorID()+"/follows/1", accept["object"].(map[string]interface{})["id"])
+	followers, err := p.Followers(ctx, "daily")
+	a.NoError(err)
+	a.Equal([]interface{}{alice.actorID()}, followers.Items)
+
+	// signed by another key
+	other, _ := rsa.GenerateKey(rand.Reader, 1024)
+	body, _ := json.Marshal(follow)
+	req := httptest.NewRequest(http.MethodPost, "https://dumper.example.com/ap/actors/daily/inbox", bytes.NewReader(body))
+	a.NoError(Sign(req, body, alice.actorID()+"#main-key", other))
+	_, ok := p.HandleInbox(ctx, "daily", req).(*SignatureError)
+	a.True(ok)
+	// signed by a key whose actor document claims another ID
+	req = httptest.NewRequest(http.MethodPost, "https://dumper.example.com/ap/actors/daily/inbox", bytes.NewReader(body))
+	a.NoError(Sign(req, body, alice.srv.URL+"/users/mallory#main-key", alice.key))
+	_, ok = p.HandleInbox(ctx, "daily", req).(*SignatureError)
+	a.True(ok)
+	// not signed
+	req = httptest.NewRequest(http.MethodPost, "https://dumper.example.com/ap/actors/daily/inbox", bytes.NewReader(body))
+	_, ok = p.HandleInbox(ctx, "daily", req).(*SignatureError)
+	a.True(ok)
+
+	alice.mu.Lock()
+	alice.statuses = []int{http.StatusServiceUnavailable}
+	alice.mu.Unlock()
+	a.NoError(tl.Publish("/pixiv/ranking/daily", &timeline.Item{Caption: "ranked", OriginKey: 10, Thumbnail: "https://img.example.com/10.jpg"}))
+	waitFor(t, func() bool { return len(alice.activities()) == 2 })
+	create := alice.activities()[1]
+	a.Equal("Create", create["type"])
+	note := create["object"].(map[string]interface{})
+	a.Equal("<p>ranked</p>", note["content"])
+	a.Equal("image/jpeg", note["attachment"].([]interface{})[0].(map[string]interface{})["mediaType"])
+
+	a.NoError(tl.Delete("/pixiv/ranking/daily", 10))
+	waitFor(t, func() bool { return len(alice.activities()) == 3 })
+	del := alice.activities()[2]
+	a.Equal("Delete", del["type"])
+	a.Equal("Tombstone", del["object"].(map[string]interface{})["type"])
+	a.Equal(note["id"], del["object"].(map[string]interface{})["id"])
+
+	a.NoError(alice.post(t, p, "daily", map[string]interface{}{
+		"id":     alice.actorID() + "/follows/1/undo",
+		"type":   "Undo",
+		"actor":  alice.actorID(),
+		"object": follow,
+	}))
+	followers, err = p.Followers(ctx, "daily")
+	a.NoError(err)
+	a.Empty(followers.Items)
+
+	// delivery to a gone follower is not retried
+	a.NoError(addFollower(ctx, db, "daily", &Follower{ID: alice.actorID(), Inbox: alice.actorID() + "/inbox", CreatedAt: time.Now()}))
+	alice.mu.Lock()
+	alice.statuses = []int{http.StatusGone}
+	alice.mu.Unlock()
+	a.NoError(tl.Publish("/pixiv/ranking/daily", &timeline.Item{Caption: "gone", OriginKey: 12}))
+	waitFor(t, func() bool {
+		errMu.Lock()
+		defer errMu.Unlock()
+		return len(errs) == 1
+	})
+	a.Len(alice.activities(), 3)
+	alice.mu.Lock()
+	a.Zero(alice.badSig)
+	alice.mu.Unlock()
+}
+
+func TestDeliverDigest(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	p, tl, db := newPublisher(t)
+	a.NoError(tl.SetPublishPolicies([]timeline.PublishPolicy{{Pattern: "/pixiv/ranking/*", Digest: 20 * time.Millisecond}}))
+	alice := newRemote(t)
+	alice.verifyKey = &p.actors["daily"].key.PublicKey
+	a.NoError(addFollower(ctx, db, "daily", &Follower{ID: alice.actorID(), Inbox: alice.actorID() + "/inbox", CreatedAt: time.Now()}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.NoError(p.Start(ctx, nil))
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	// wait for subscription
+	time.Sleep(30 * time.Millisecond)
+
+	first := &timeline.Item{Caption: "first", OriginKey: 1}
+	last := &timeline.Item{Caption: "last", OriginKey: 2}
+	a.NoError(tl.Publish("/pixiv/ranking/daily", first, last))
+	waitFor(t, func() bool { return len(alice.activities()) == 1 })
+	create := alice.activities()[0]
+	a.Equal("Create", create["type"])
+	note := create["object"].(map[string]interface{})
+	a.Contains(note["content"], "2 items in pixiv daily")
+	a.Equal(fmt.Sprintf("%s/digests/%d-%d", p.actors["daily"].id, first.ID, last.ID), note["id"])
+	a.Equal(note["id"].(string)+"/activity", create["id"])
+	// note of the last item is kept for the item
+	stored, err := p.Note(ctx, "daily", last.ID)
+	a.NoError(err)
+	a.NotEqual(note["id"], stored.ID)
+	a.Equal("<p>last</p>", stored.Content)
+}
@@ -0,0 +1,197 @@
+package activitypub
+
+import (
+	"fmt"
+	"html"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/kanosaki/dumper/timeline"
+)
+
+const (
+	ContentType = "application/activity+json"
+	// Content type of WebFinger responses.
+	JRDContentType = "application/jrd+json"
+	// Addressing to everyone.
+	Public = "https://www.w3.org/ns/activitystreams#Public"
+)
+
+var contextURIs = []string{
+	"https://www.w3.org/ns/activitystreams",
+	"https://w3id.org/security/v1",
+}
+
+type PublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type Image struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType,omitempty"`
+	URL       string `json:"url"`
+}
+
+// Actor document of a topic, or a remote actor fetched on inbox delivery.
+type Actor struct {
+	Context           interface{} `json:"@context,omitempty"`
+	ID                string      `json:"id"`
+	Type              string      `json:"type"`
+	PreferredUsername string      `json:"preferredUsername"`
+	Name              string      `json:"name,omitempty"`
+	Summary           string      `json:"summary,omitempty"`
+	Icon              *Image      `json:"icon,omitempty"`
+	Inbox             string      `json:"inbox"`
+	Outbox            string      `json:"outbox,omitempty"`
+	Followers         string      `json:"followers,omitempty"`
+	PublicKey         *PublicKey  `json:"publicKey,omitempty"`
+	Endpoints         *Endpoints  `json:"endpoints,omitempty"`
+}
+
+type Endpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
+type Hashtag struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// Note of a timeline item, or Tombstone of a deleted one.
+type Note struct {
+	Context      interface{} `json:"@context,omitempty"`
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	AttributedTo string      `json:"attributedTo,omitempty"`
+	Content      string      `json:"content,omitempty"`
+	Published    *time.Time  `json:"published,omitempty"`
+	Updated      *time.Time  `json:"updated,omitempty"`
+	Deleted      *time.Time  `json:"deleted,omitempty"`
+	To           []string    `json:"to,omitempty"`
+	Cc           []string    `json:"cc,omitempty"`
+	Attachment   []*Image    `json:"attachment,omitempty"`
+	Tag          []*Hashtag  `json:"tag,omitempty"`
+}
+
+// Object is a Note for Create, Update and Delete, an Actor ID for Follow,
+// and an Activity for Accept and Undo.
+type Activity struct {
+	Context   interface{} `json:"@context,omitempty"`
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Actor     string      `json:"actor"`
+	Published *time.Time  `json:"published,omitempty"`
+	To        []string    `json:"to,omitempty"`
+	Cc        []string    `json:"cc,omitempty"`
+	Object    interface{} `json:"object"`
+}
+
+type OrderedCollection struct {
+	Context    interface{}   `json:"@context,omitempty"`
+	ID         string        `json:"id"`
+	Type       string        `json:"type"`
+	TotalItems int64         `json:"totalItems"`
+	First      string        `json:"first,omitempty"`
+	PartOf     string        `json:"partOf,omitempty"`
+	Next       string        `json:"next,omitempty"`
+	Items      []interface{} `json:"orderedItems,omitempty"`
+}
+
+// WebFinger response.
+type JRD struct {
+	Subject string    `json:"subject"`
+	Aliases []string  `json:"aliases,omitempty"`
+	Links   []JRDLink `json:"links"`
+}
+
+type JRDLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+// Caption is escaped, and line breaks are kept.
+func noteContent(caption string) string {
+	lines := strings.Split(html.EscapeString(caption), "\n")
+	return "<p>" + strings.Join(lines, "<br>") + "</p>"
+}
+
+// Guessed from the extension of the URL, image/jpeg if unknown.
+func imageType(u string) string {
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		u = u[:i]
+	}
+	if t := mime.TypeByExtension(path.Ext(u)); strings.HasPrefix(t, "image/") {
+		return t
+	}
+	return "image/jpeg"
+}
+
+func (a *actor) noteID(itemID int64) string {
+	return fmt.Sprintf("%s/notes/%d", a.id, itemID)
+}
+
+// Digests are not stored, so they are identified apart from notes of items and can't be dereferenced.
+func (a *actor) digestID(item *timeline.Item) string {
+	return fmt.Sprintf("%s/digests/%d-%d", a.id, item.Digest[0], item.ID)
+}
+
+func (a *actor) note(item *timeline.Item) *Note {
+	published := item.Timestamp
+	id := a.noteID(item.ID)
+	if item.IsDigest() {
+		id = a.digestID(item)
+	}
+	n := &Note{
+		ID:           id,
+		Type:         "Note",
+		AttributedTo: a.id,
+		Content:      noteContent(item.Caption),
+		Published:    &published,
+		To:           []string{Public},
+		Cc:           []string{a.id + "/followers"},
+	}
+	if item.Thumbnail != "" {
+		n.Attachment = []*Image{{Type: "Image", MediaType: imageType(item.Thumbnail), URL: item.Thumbnail}}
+	}
+	for _, tag := range item.Tags {
+		n.Tag = append(n.Tag, &Hashtag{Type: "Hashtag", Name: "#" + tag})
+	}
+	return n
+}
+
+// Activity announcing the event to followers.
+func (a *actor) activity(ev timeline.ItemEvent) *Activity {
+	n := a.note(ev.Item)
+	act := &Activity{
+		Context: contextURIs,
+		Actor:   a.id,
+		To:      n.To,
+		Cc:      n.Cc,
+		Object:  n,
+	}
+	switch ev.Kind {
+	case timeline.ItemUpdated:
+		now := time.Now()
+		n.Updated = &now
+		act.Type = "Update"
+		act.ID = fmt.Sprintf("%s/activity/%d", n.ID, now.UnixNano())
+	case timeline.ItemDeleted:
+		at := time.Now()
+		if ev.Item.Deleted != nil {
+			at = ev.Item.Deleted.At
+		}
+		act.Type = "Delete"
+		act.ID = n.ID + "/delete"
+		act.Object = &Note{ID: n.ID, Type: "Tombstone", Deleted: &at}
+	default:
+		act.Type = "Create"
+		act.ID = n.ID + "/activity"
+		act.Published = n.Published
+	}
+	return act
+}
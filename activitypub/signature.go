@@ -0,0 +1,193 @@
+package activitypub
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// Signed requests whose Date header differs more than this are rejected.
+	MaxClockSkew = 12 * time.Hour
+)
+
+// Rejected HTTP signature of an incoming request.
+type SignatureError struct {
+	Reason string
+}
+
+func (e *SignatureError) Error() string {
+	return "Invalid signature: " + e.Reason
+}
+
+// Sign r by HTTP Signatures (draft-cavage-http-signatures) with rsa-sha256, as Mastodon does.
+// Date is set if missing, and Digest of body is signed for requests with body.
+func Sign(r *http.Request, body []byte, keyID string, key *rsa.PrivateKey) error {
+	if r.Header.Get("Date") == "" {
+		r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		r.Header.Set("Digest", digest(body))
+		headers = append(headers, "digest")
+	}
+	hashed := sha256.Sum256([]byte(signingString(r, headers)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// Key ID in Signature header of r, which is usually the actor ID with a fragment.
+func KeyID(r *http.Request) (string, error) {
+	params, err := parseSignature(r.Header.Get("Signature"))
+	if err != nil {
+		return "", err
+	}
+	return params.keyID, nil
+}
+
+// Check Signature header of r by key. Digest of body is also checked,
+// which should be signed if body is not empty.
+func Verify(r *http.Request, body []byte, key *rsa.PublicKey) error {
+	params, err := parseSignature(r.Header.Get("Signature"))
+	if err != nil {
+		return err
+	}
+	required := []string{"(request-target)", "host", "date"}
+	if len(body) > 0 {
+		required = append(required, "digest")
+	}
+	for _, h := range required {
+		if !containsString(params.headers, h) {
+			return &SignatureError{Reason: h + " is not signed"}
+		}
+	}
+	if len(body) > 0 && r.Header.Get("Digest") != digest(body) {
+		return &SignatureError{Reason: "digest mismatch"}
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return &SignatureError{Reason: "invalid date"}
+	}
+	if skew := time.Since(date); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return &SignatureError{Reason: "date out of range"}
+	}
+	hashed := sha256.Sum256([]byte(signingString(r, params.headers)))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], params.signature); err != nil {
+		return &SignatureError{Reason: "signature mismatch"}
+	}
+	return nil
+}
+
+type signatureParams struct {
+	keyID     string
+	headers   []string
+	signature []byte
+}
+
+// Parse keyId="...",algorithm="...",headers="...",signature="..."
+func parseSignature(header string) (*signatureParams, error) {
+	if header == "" {
+		return nil, &SignatureError{Reason: "not signed"}
+	}
+	params := &signatureParams{headers: []string{"date"}}
+	for _, kv := range strings.Split(header, ",") {
+		eq := strings.Index(kv, "=")
+		if eq < 0 {
+			return nil, &SignatureError{Reason: "malformed header"}
+		}
+		key := strings.TrimSpace(kv[:eq])
+		value := strings.Trim(strings.TrimSpace(kv[eq+1:]), `"`)
+		switch key {
+		case "keyId":
+			params.keyID = value
+		case "algorithm":
+			if value != "rsa-sha256" && value != "hs2019" {
+				return nil, &SignatureError{Reason: "unsupported algorithm " + value}
+			}
+		case "headers":
+			params.headers = strings.Fields(strings.ToLower(value))
+		case "signature":
+			sig, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, &SignatureError{Reason: "malformed signature"}
+			}
+			params.signature = sig
+		}
+	}
+	if params.keyID == "" || params.signature == nil {
+		return nil, &SignatureError{Reason: "keyId and signature are required"}
+	}
+	return params, nil
+}
+
+func signingString(r *http.Request, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines[i] = fmt.Sprintf("(request-target): %s %s", strings.ToLower(r.Method), r.URL.RequestURI())
+		case "host":
+			host := r.Host
+			if host == "" {
+				host = r.URL.Host
+			}
+			lines[i] = "host: " + host
+		default:
+			lines[i] = h + ": " + r.Header.Get(h)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func encodePublicKey(key *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// Parse publicKeyPem of an actor.
+func ParsePublicKey(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("Invalid PEM")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package activitypub
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"time"
+
+	"github.com/kanosaki/dumper/common"
+)
+
+var (
+	// Bits of RSA keys generated for actors.
+	KeySize = 2048
+)
+
+var storeDDLs = []string{
+	`CREATE TABLE IF NOT EXISTS activitypub_key (
+		actor TEXT PRIMARY KEY,
+		private_key TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS activitypub_follower (
+		actor TEXT NOT NULL,
+		follower TEXT NOT NULL,
+		inbox TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY(actor, follower)
+	)`,
+}
+
+// Remote actor following a local actor.
+type Follower struct {
+	ID        string    `json:"id"`
+	Inbox     string    `json:"inbox"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func initStore(ctx context.Context, db *sql.DB) error {
+	for _, ddl := range storeDDLs {
+		if _, err := db.ExecContext(ctx, ddl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Private key of the actor, generated on first use.
+func loadKey(ctx context.Context, db *sql.DB, actor string) (*rsa.PrivateKey, error) {
+	var encoded string
+	err := db.QueryRowContext(ctx, `SELECT private_key FROM activitypub_key WHERE actor = ?`, actor).Scan(&encoded)
+	if err == nil {
+		block, _ := pem.Decode([]byte(encoded))
+		if block == nil {
+			return nil, errors.New("Invalid private key of " + actor)
+		}
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, KeySize)
+	if err != nil {
+		return nil, err
+	}
+	encoded = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	_, err = db.ExecContext(ctx, `INSERT INTO activitypub_key(actor, private_key, created_at) VALUES (?, ?, ?)`,
+		actor, encoded, common.Timestamp(time.Now()))
+	return key, err
+}
+
+func addFollower(ctx context.Context, db *sql.DB, actor string, f *Follower) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO activitypub_follower(actor, follower, inbox, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(actor, follower) DO UPDATE SET inbox = excluded.inbox`,
+		actor, f.ID, f.Inbox, common.Timestamp(f.CreatedAt))
+	return err
+}
+
+func removeFollower(ctx context.Context, db *sql.DB, actor, follower string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM activitypub_follower WHERE actor = ? AND follower = ?`, actor, follower)
+	return err
+}
+
+// Followers of the actor, oldest first.
+func loadFollowers(ctx context.Context, db *sql.DB, actor string) ([]*Follower, error) {
+	rows, err := db.QueryContext(ctx, `SELECT follower, inbox, created_at FROM activitypub_follower
+		WHERE actor = ? ORDER BY created_at, follower`, actor)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []*Follower
+	for rows.Next() {
+		var f Follower
+		var created int64
+		if err := rows.Scan(&f.ID, &f.Inbox, &created); err != nil {
+			return nil, err
+		}
+		f.CreatedAt = common.FromTimestamp(created)
+		ret = append(ret, &f)
+	}
+	return ret, rows.Err()
+}
@@ -1,43 +1,62 @@
 package core
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"os"
 	"strings"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/jasonlvhit/gocron"
+	"github.com/kanosaki/dumper/activitypub"
 	"github.com/kanosaki/dumper/common"
+	"github.com/kanosaki/dumper/esindex"
 	"github.com/kanosaki/dumper/pkg/errors"
 	"github.com/kanosaki/dumper/pkg/eslog"
 	"github.com/kanosaki/dumper/shelf"
 	"github.com/kanosaki/dumper/timeline"
 	"github.com/kanosaki/dumper/web"
+	"github.com/kanosaki/dumper/webhook"
 	elastic "gopkg.in/olivere/elastic.v5"
 )
 
 type Context struct {
-	conf     *common.Config
-	modules  map[string]Module
-	storage  *shelf.Shelf
-	es       *elastic.Client
-	sched    *gocron.Scheduler
-	rootLog  *eslog.Logger
-	log      logrus.FieldLogger
-	db       *sql.DB
-	dbType   common.DBType
-	timeline *timeline.Service
-	web      *web.Server
+	conf      *common.Config
+	modules   map[string]Module
+	storage   *shelf.Shelf
+	es        *elastic.Client
+	sched     *gocron.Scheduler
+	rootLog   *eslog.Logger
+	log       logrus.FieldLogger
+	db        *sql.DB
+	dbType    common.DBType
+	timeline  *timeline.Service
+	retention *timeline.Retention
+	hasher    *timeline.Hasher
+	indexer   *esindex.Indexer
+	webhooks  *webhook.Dispatcher
+	ap        *activitypub.Publisher
+	web       *web.Server
+	// background workers are stopped by Close
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
 }
 
 func NewContext(confpath string) (*Context, error) {
 	conf := common.NewConfig(confpath)
+	ctx, cancel := context.WithCancel(context.Background())
 	c := &Context{
 		conf:    conf,
 		sched:   gocron.NewScheduler(),
 		modules: make(map[string]Module),
+		ctx:     ctx,
+		cancel:  cancel,
 	}
 	if err := c.init(); err != nil {
+		cancel()
 		return nil, err
 	}
 	return c, nil
@@ -88,6 +107,66 @@ func (c *Context) init() error {
 		return err
 	}
 	c.timeline = timeline.NewService(tlStorage)
+	if err := c.timeline.LoadSavedSearches(context.Background()); err != nil {
+		return err
+	}
+	if err := c.timeline.LoadTagAliases(context.Background()); err != nil {
+		return err
+	}
+	c.web.MountTimeline(c.timeline)
+	var retentionConf timeline.RetentionConfig
+	if err := c.conf.Unmarshal("timeline_retention", &retentionConf); err == nil {
+		c.retention, err = timeline.NewRetention(c.timeline, retentionConf)
+		if err != nil {
+			return err
+		}
+		c.web.MountRetention(c.retention)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	var policyConf timeline.PolicyConfig
+	if err := c.conf.Unmarshal("timeline_policies", &policyConf); err == nil {
+		if err := c.timeline.SetPublishPolicies(policyConf.Policies); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	var hasherConf timeline.HasherConfig
+	if err := c.conf.Unmarshal("timeline_phash", &hasherConf); err == nil {
+		c.hasher = timeline.NewHasher(c.timeline, nil, hasherConf)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if c.es != nil {
+		var indexerConf esindex.Config
+		if err := c.conf.Unmarshal("timeline_es", &indexerConf); err == nil {
+			c.indexer = esindex.New(c.es, c.timeline, indexerConf)
+			c.web.MountBackfill(c.indexer)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	var webhookConf webhook.Config
+	if err := c.conf.Unmarshal("webhooks", &webhookConf); err == nil {
+		c.webhooks, err = webhook.New(c.db, c.timeline, webhookConf)
+		if err != nil {
+			return err
+		}
+		c.web.MountWebhooks(c.webhooks)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	var apConf activitypub.Config
+	if err := c.conf.Unmarshal("activitypub", &apConf); err == nil {
+		c.ap, err = activitypub.New(c.db, c.timeline, apConf)
+		if err != nil {
+			return err
+		}
+		c.web.MountActivityPub(c.ap)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
 
@@ -100,6 +179,66 @@ func (c *Context) AddModule(id string, mod Module) error {
 }
 
 func (c *Context) Start() error {
+	go func() {
+		if err := c.web.Start(); err != nil {
+			c.log.Errorf("Web server stopped: %v", err)
+		}
+	}()
+	if c.retention != nil {
+		c.spawn(func() {
+			c.retention.Start(c.ctx, func(stats *timeline.PruneStats) {
+				if stats.Error != "" {
+					c.log.Errorf("Timeline pruning failed: %s", stats.Error)
+				} else if stats.Total > 0 {
+					c.log.Infof("Timeline pruned %d items in %v", stats.Total, stats.Duration)
+				}
+			})
+		})
+	}
+	if c.hasher != nil {
+		c.spawn(func() {
+			err := c.hasher.Start(c.ctx, func(stats *timeline.HashStats, err error) {
+				if err != nil {
+					c.log.Errorf("Thumbnail hashing failed: %v", err)
+				} else if stats.Hashed+stats.Failed > 0 {
+					c.log.Infof("Hashed %d thumbnails, %d failed, %d deferred", stats.Hashed, stats.Failed, stats.Deferred)
+				}
+			})
+			if err != nil {
+				c.log.Errorf("Thumbnail hasher stopped: %v", err)
+			}
+		})
+	}
+	if c.indexer != nil {
+		c.spawn(func() {
+			err := c.indexer.Start(c.ctx, func(err error) {
+				c.log.Errorf("Timeline indexing failed: %v", err)
+			})
+			if err != nil {
+				c.log.Errorf("Timeline indexer stopped: %v", err)
+			}
+		})
+	}
+	if c.webhooks != nil {
+		c.spawn(func() {
+			err := c.webhooks.Start(c.ctx, func(err error) {
+				c.log.Warnf("Webhook delivery failed: %v", err)
+			})
+			if err != nil {
+				c.log.Errorf("Webhook dispatcher stopped: %v", err)
+			}
+		})
+	}
+	if c.ap != nil {
+		c.spawn(func() {
+			err := c.ap.Start(c.ctx, func(err error) {
+				c.log.Warnf("ActivityPub delivery failed: %v", err)
+			})
+			if err != nil {
+				c.log.Errorf("ActivityPub publisher stopped: %v", err)
+			}
+		})
+	}
 	errCh := make(chan error, len(c.modules))
 	for _, m := range c.modules {
 		go func(mod Module) {
@@ -119,11 +258,13 @@ func (c *Context) Start() error {
 	return nil
 }
 
+// Close modules, then stop background workers and wait for them,
+// so items published by modules are flushed to webhooks and the index.
 func (c *Context) Close() error {
 	errCh := make(chan error, len(c.modules))
 	for _, m := range c.modules {
 		go func(mod Module) {
-			errCh <- m.Close()
+			errCh <- mod.Close()
 		}(m)
 	}
 	var errs []error
@@ -133,12 +274,23 @@ func (c *Context) Close() error {
 			errs = append(errs, res)
 		}
 	}
+	c.cancel()
+	c.workers.Wait()
 	if len(errs) != 0 {
 		return errors.Multi(errs...)
 	}
 	return nil
 }
 
+// Run f in background until the context is closed.
+func (c *Context) spawn(f func()) {
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		f()
+	}()
+}
+
 // Common components
 
 func (c *Context) Storage() *shelf.Shelf {
@@ -168,3 +320,7 @@ func (c *Context) DatabaseType() common.DBType {
 func (c *Context) Timeline() *timeline.Service {
 	return c.timeline
 }
+
+func (c *Context) Web() *web.Server {
+	return c.web
+}
@@ -0,0 +1,320 @@
+package esindex
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/kanosaki/dumper/timeline"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+const DocType = "item"
+
+var (
+	DefaultIndex         = "dumper-timeline"
+	DefaultIndexSuffix   = "-2006.01"
+	DefaultBatchSize     = 200
+	DefaultFlushInterval = 5 * time.Second
+	DefaultMaxRetries    = 5
+	DefaultRetryBackoff  = 1 * time.Second
+)
+
+// timeline_es.yaml
+//   index: dumper-timeline
+//   index_suffix: -2006.01     # time format applied to Item.Timestamp
+//   batch_size: 200
+//   flush_interval: 5s
+type Config struct {
+	Index         string        `yaml:"index"`
+	IndexSuffix   string        `yaml:"index_suffix"`
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// Failed bulk requests are retried with exponential backoff.
+	MaxRetries   int           `yaml:"max_retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+}
+
+// Indexed document, ID of the document is Item.ID so that re-indexing is idempotent.
+type Document struct {
+	Caption   string                 `json:"caption"`
+	Thumbnail string                 `json:"thumbnail,omitempty"`
+	Topic     string                 `json:"topic"`
+	Origin    string                 `json:"origin"`
+	OriginKey int64                  `json:"key"`
+	Meta      map[string]interface{} `json:"meta,omitempty"`
+	Tags      []string               `json:"tags,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+func NewDocument(it *timeline.Item) *Document {
+	return &Document{
+		Caption:   it.Caption,
+		Thumbnail: it.Thumbnail,
+		Topic:     it.TopicKey,
+		Origin:    it.Origin,
+		OriginKey: it.OriginKey,
+		Meta:      it.Meta,
+		Tags:      it.Tags,
+		Timestamp: it.Timestamp,
+	}
+}
+
+// Indexer mirrors timeline items into Elasticsearch.
+type Indexer struct {
+	es   *elastic.Client
+	tl   *timeline.Service
+	conf Config
+}
+
+func New(es *elastic.Client, tl *timeline.Service, conf Config) *Indexer {
+	if conf.Index == "" {
+		conf.Index = DefaultIndex
+	}
+	if conf.IndexSuffix == "" {
+		conf.IndexSuffix = DefaultIndexSuffix
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = DefaultBatchSize
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = DefaultFlushInterval
+	}
+	if conf.MaxRetries <= 0 {
+		conf.MaxRetries = DefaultMaxRetries
+	}
+	if conf.RetryBackoff <= 0 {
+		conf.RetryBackoff = DefaultRetryBackoff
+	}
+	return &Indexer{es: es, tl: tl, conf: conf}
+}
+
+func (ix *Indexer) IndexName(t time.Time) string {
+	return ix.conf.Index + t.Format(ix.conf.IndexSuffix)
+}
+
+// Create or update the index template applied to dated indices.
+func (ix *Indexer) PutTemplate(ctx context.Context) error {
+	keyword := map[string]interface{}{"type": "keyword"}
+	_, err := ix.es.IndexPutTemplate(ix.conf.Index).BodyJson(map[string]interface{}{
+		"template": ix.conf.Index + "*",
+		"mappings": map[string]interface{}{
+			DocType: map[string]interface{}{
+				"properties": map[string]interface{}{
+					"caption":   map[string]interface{}{"type": "text"},
+					"thumbnail": map[string]interface{}{"type": "keyword", "index": false},
+					"topic":     keyword,
+					"origin":    keyword,
+					"key":       map[string]interface{}{"type": "long"},
+					"meta":      map[string]interface{}{"type": "object", "dynamic": true},
+					"tags":      keyword,
+					"timestamp": map[string]interface{}{"type": "date"},
+				},
+			},
+		},
+	}).Do(ctx)
+	return err
+}
+
+// Put the index template, then index published items until ctx is done.
+// Updated items are indexed again, and documents of deleted items are removed.
+// Items are flushed by BatchSize or FlushInterval, and items discarded by
+// listener overflow are re-read from storage.
+// Errors which are not recovered by retries are passed to onError if not nil.
+func (ix *Indexer) Start(ctx context.Context, onError func(error)) error {
+	if err := ix.PutTemplate(ctx); err != nil {
+		return err
+	}
+	report := func(err error) {
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+	// glob, to subscribe topics created later
+	lis, err := ix.tl.Listen("/**", timeline.WithRaw(), timeline.WithOverflowPolicy(timeline.DropNewest))
+	if err != nil {
+		return err
+	}
+	defer lis.Close()
+	ticker := time.NewTicker(ix.conf.FlushInterval)
+	defer ticker.Stop()
+	buf := make([]*timeline.Item, 0, ix.conf.BatchSize)
+	var deleted []*timeline.Item
+	flush := func(ctx context.Context) {
+		if len(buf) > 0 {
+			report(ix.Index(ctx, buf...))
+			buf = buf[:0]
+		}
+		// after indexing, an item may be published and deleted in the same batch
+		if len(deleted) > 0 {
+			report(ix.Remove(ctx, deleted...))
+			deleted = nil
+		}
+		if sinceID, missed := lis.Missed(); missed {
+			lis.ClearMissed()
+			// items still in the buffer are indexed twice, which is harmless
+			_, err := ix.Backfill(ctx, &timeline.Query{MinID: int(sinceID), ShowDeleted: true})
+			report(err)
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			// buffered items are indexed within FlushInterval
+			flushCtx, cancel := context.WithTimeout(context.Background(), ix.conf.FlushInterval)
+			flush(flushCtx)
+			cancel()
+			return nil
+		case ev, ok := <-lis.C:
+			if !ok {
+				return lis.Err()
+			}
+			if ev.Kind == timeline.ItemDeleted {
+				deleted = append(deleted, ev.Item)
+			} else {
+				buf = append(buf, ev.Item)
+			}
+			if len(buf)+len(deleted) >= ix.conf.BatchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		}
+	}
+}
+
+// Bulk-index items, failed requests are retried up to MaxRetries.
+// Requests rejected by 4xx other than 429 are not retried.
+func (ix *Indexer) Index(ctx context.Context, items ...*timeline.Item) error {
+	pending := make(map[string]elastic.BulkableRequest, len(items))
+	for _, it := range items {
+		id := strconv.FormatInt(it.ID, 10)
+		pending[id] = elastic.NewBulkIndexRequest().
+			Index(ix.IndexName(it.Timestamp)).
+			Type(DocType).
+			Id(id).
+			Doc(NewDocument(it))
+	}
+	return ix.bulk(ctx, "Indexing", pending, false)
+}
+
+// Bulk-delete documents of items, retried as Index. Missing documents are ignored.
+func (ix *Indexer) Remove(ctx context.Context, items ...*timeline.Item) error {
+	pending := make(map[string]elastic.BulkableRequest, len(items))
+	for _, it := range items {
+		id := strconv.FormatInt(it.ID, 10)
+		pending[id] = elastic.NewBulkDeleteRequest().
+			Index(ix.IndexName(it.Timestamp)).
+			Type(DocType).
+			Id(id)
+	}
+	return ix.bulk(ctx, "Removing", pending, true)
+}
+
+// Send pending requests keyed by document ID until all of them succeed.
+// 404 is regarded as success if missingOK.
+func (ix *Indexer) bulk(ctx context.Context, verb string, pending map[string]elastic.BulkableRequest, missingOK bool) error {
+	backoff := ix.conf.RetryBackoff
+	var lastErr error
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > ix.conf.MaxRetries {
+				return fmt.Errorf("%s %d items failed: %v", verb, len(pending), lastErr)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		bulk := ix.es.Bulk()
+		for _, req := range pending {
+			bulk.Add(req)
+		}
+		res, err := bulk.Do(ctx)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		failed := make(map[string]elastic.BulkableRequest)
+		for _, r := range res.Failed() {
+			if r.Status == 404 && missingOK {
+				continue
+			}
+			if r.Status >= 400 && r.Status < 500 && r.Status != 429 {
+				return fmt.Errorf("%s item %s rejected: %d %v", verb, r.Id, r.Status, errorReason(r))
+			}
+			failed[r.Id] = pending[r.Id]
+			lastErr = fmt.Errorf("%d %v", r.Status, errorReason(r))
+		}
+		pending = failed
+	}
+	return nil
+}
+
+func errorReason(r *elastic.BulkResponseItem) string {
+	if r.Error == nil {
+		return ""
+	}
+	return r.Error.Reason
+}
+
+// Index items matched to q in ascending order of ID from storage, returns number of items.
+// q may be nil for all items, including archived topics.
+// Used to populate the index for items published before the indexer is started.
+// Deleted items are removed from the index if q.ShowDeleted.
+func (ix *Indexer) Backfill(ctx context.Context, q *timeline.Query) (int64, error) {
+	var page timeline.Query
+	if q != nil {
+		page = *q
+	}
+	page.MaxID, page.Offset = 0, 0
+	cursor := page.MinID
+	var n int64
+	for {
+		page.MinID = cursor
+		if page.MinID <= 0 {
+			// MinID is needed for ascending order
+			page.MinID = 1
+		}
+		page.Limit = ix.conf.BatchSize
+		items, err := ix.tl.Fetch(ctx, &page)
+		if err != nil {
+			return n, err
+		}
+		if q != nil && q.MaxID > 0 {
+			// Select returns descending order
+			for len(items) > 0 && items[0].ID > int64(q.MaxID) {
+				items = items[1:]
+			}
+		}
+		if len(items) == 0 {
+			return n, nil
+		}
+		var live, deleted []*timeline.Item
+		for _, it := range items {
+			if it.Deleted != nil {
+				deleted = append(deleted, it)
+			} else {
+				live = append(live, it)
+			}
+		}
+		if len(live) > 0 {
+			if err := ix.Index(ctx, live...); err != nil {
+				return n, err
+			}
+		}
+		if len(deleted) > 0 {
+			if err := ix.Remove(ctx, deleted...); err != nil {
+				return n, err
+			}
+		}
+		n += int64(len(items))
+		cursor = int(items[0].ID) + 1
+		if len(items) < page.Limit {
+			return n, nil
+		}
+	}
+}
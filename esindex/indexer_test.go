@@ -0,0 +1,220 @@
+package esindex
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+// Minimal Elasticsearch, which accepts templates and bulk index and delete requests.
+type fakeES struct {
+	mu        sync.Mutex
+	templates map[string]map[string]interface{}
+	docs      map[string]map[string]interface{} // by index/id
+	requests  int
+	// statuses returned for bulk requests in order, then 200
+	bulkStatus []int
+	// item statuses returned for bulk items in order, then 201
+	itemStatus []int
+}
+
+func newFakeES() *fakeES {
+	return &fakeES{
+		templates: make(map[string]map[string]interface{}),
+		docs:      make(map[string]map[string]interface{}),
+	}
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/_template/"):
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.templates[strings.TrimPrefix(r.URL.Path, "/_template/")] = body
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case r.URL.Path == "/_bulk":
+		f.requests++
+		if len(f.bulkStatus) > 0 {
+			status := f.bulkStatus[0]
+			f.bulkStatus = f.bulkStatus[1:]
+			w.WriteHeader(status)
+			fmt.Fprint(w, `{"error":"unavailable"}`)
+			return
+		}
+		var items []string
+		sc := bufio.NewScanner(r.Body)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			var action map[string]map[string]string
+			json.Unmarshal(sc.Bytes(), &action)
+			if meta, ok := action["delete"]; ok {
+				key := meta["_index"] + "/" + meta["_id"]
+				status := 200
+				if _, ok := f.docs[key]; !ok {
+					status = 404
+				}
+				delete(f.docs, key)
+				items = append(items, fmt.Sprintf(`{"delete":{"_index":%q,"_type":%q,"_id":%q,"status":%d}}`,
+					meta["_index"], meta["_type"], meta["_id"], status))
+				continue
+			}
+			sc.Scan()
+			var doc map[string]interface{}
+			json.Unmarshal(sc.Bytes(), &doc)
+			meta := action["index"]
+			status := 201
+			if len(f.itemStatus) > 0 {
+				status = f.itemStatus[0]
+				f.itemStatus = f.itemStatus[1:]
+			}
+			if status < 300 {
+				f.docs[meta["_index"]+"/"+meta["_id"]] = doc
+			}
+			items = append(items, fmt.Sprintf(`{"index":{"_index":%q,"_type":%q,"_id":%q,"status":%d}}`,
+				meta["_index"], meta["_type"], meta["_id"], status))
+		}
+		fmt.Fprintf(w, `{"took":1,"errors":false,"items":[%s]}`, strings.Join(items, ","))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeES) docCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.docs)
+}
+
+func newTestIndexer(t *testing.T, f *fakeES) (*Indexer, *timeline.Service) {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	es, err := elastic.NewClient(elastic.SetURL(srv.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := timeline.NewStorage("sqlite3", filepath.Join(t.TempDir(), "timeline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := timeline.NewService(storage)
+	ix := New(es, tl, Config{BatchSize: 2, FlushInterval: 10 * time.Millisecond, RetryBackoff: time.Millisecond})
+	return ix, tl
+}
+
+func TestIndex(t *testing.T) {
+	a := assert.New(t)
+	f := newFakeES()
+	ix, _ := newTestIndexer(t, f)
+	ts := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	items := []*timeline.Item{
+		{ID: 1, Caption: "a", TopicKey: "/t", Origin: "o", OriginKey: 10, Timestamp: ts, Tags: []string{"cat"}},
+		{ID: 2, Caption: "b", TopicKey: "/t", Origin: "o", OriginKey: 11, Timestamp: ts.AddDate(0, 1, 0)},
+	}
+	a.NoError(ix.PutTemplate(context.Background()))
+	a.Equal("dumper-timeline*", f.templates["dumper-timeline"]["template"])
+
+	// whole request fails, then one item is throttled
+	f.bulkStatus = []int{http.StatusServiceUnavailable}
+	f.itemStatus = []int{201, 429}
+	a.NoError(ix.Index(context.Background(), items...))
+	a.Equal(3, f.requests)
+	a.Len(f.docs, 2)
+	doc := f.docs["dumper-timeline-2026.10/1"]
+	a.Equal("a", doc["caption"])
+	a.Equal("/t", doc["topic"])
+	a.Equal([]interface{}{"cat"}, doc["tags"])
+	a.Contains(f.docs, "dumper-timeline-2026.11/2")
+
+	// mapping errors are not retried
+	f.requests = 0
+	f.itemStatus = []int{400}
+	a.Error(ix.Index(context.Background(), items[0]))
+	a.Equal(1, f.requests)
+
+	f.requests = 0
+	f.bulkStatus = []int{500, 500, 500, 500, 500, 500}
+	a.Error(ix.Index(context.Background(), items[0]))
+	a.Equal(DefaultMaxRetries+1, f.requests)
+}
+
+func TestRemove(t *testing.T) {
+	a := assert.New(t)
+	f := newFakeES()
+	ix, _ := newTestIndexer(t, f)
+	ts := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	items := []*timeline.Item{
+		{ID: 1, Caption: "a", TopicKey: "/t", Timestamp: ts},
+		{ID: 2, Caption: "b", TopicKey: "/t", Timestamp: ts},
+	}
+	a.NoError(ix.Index(context.Background(), items[0]))
+	// missing document of the second item is ignored
+	a.NoError(ix.Remove(context.Background(), items...))
+	a.Equal(0, f.docCount())
+}
+
+func TestStartAndBackfill(t *testing.T) {
+	a := assert.New(t)
+	f := newFakeES()
+	ix, tl := newTestIndexer(t, f)
+	a.NoError(tl.NewTopic("test", "/es/a"))
+	for i := 0; i < 5; i++ {
+		a.NoError(tl.Publish("/es/a", &timeline.Item{Caption: "old", OriginKey: int64(i)}))
+	}
+	n, err := ix.Backfill(context.Background(), nil)
+	a.NoError(err)
+	a.Equal(int64(5), n)
+	a.Equal(5, f.docCount())
+
+	n, err = ix.Backfill(context.Background(), &timeline.Query{MinID: 2, MaxID: 3})
+	a.NoError(err)
+	a.Equal(int64(2), n)
+
+	// deletion missed by the indexer is applied by backfill
+	a.NoError(tl.Publish("/es/a", &timeline.Item{Caption: "missed", OriginKey: 50, Timestamp: time.Now()}))
+	_, err = ix.Backfill(context.Background(), &timeline.Query{MinID: 6})
+	a.NoError(err)
+	a.Equal(6, f.docCount())
+	a.NoError(tl.Delete("/es/a", 50))
+	n, err = ix.Backfill(context.Background(), &timeline.Query{MinID: 6, ShowDeleted: true})
+	a.NoError(err)
+	a.Equal(int64(1), n)
+	a.Equal(5, f.docCount())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ix.Start(ctx, func(err error) { t.Error(err) })
+	}()
+	// wait for subscription
+	time.Sleep(50 * time.Millisecond)
+	a.NoError(tl.NewTopic("test", "/es/b"))
+	// timestamp is needed to find the index on delete
+	a.NoError(tl.Publish("/es/b", &timeline.Item{Caption: "new", OriginKey: 100, Timestamp: time.Now()}))
+	deadline := time.Now().Add(2 * time.Second)
+	for f.docCount() < 6 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Equal(6, f.docCount())
+
+	a.NoError(tl.Delete("/es/b", 100))
+	for f.docCount() > 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Equal(5, f.docCount())
+	cancel()
+	a.NoError(<-done)
+}
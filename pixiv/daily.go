@@ -53,7 +53,10 @@ func (p *Pixiv) Init(id string, c *core.Context) error {
 		return fmt.Errorf("Pixiv login failed: %v", err)
 	}
 	p.context = c
-	c.Timeline().NewTopic(OriginPixivWork, DailyRankingKey)
+	c.Timeline().NewTopicWithInfo(OriginPixivWork, DailyRankingKey, timeline.TopicInfo{
+		Title:  "pixiv daily ranking",
+		Module: id,
+	})
 	return nil
 }
 
@@ -86,6 +89,7 @@ func (p *Pixiv) updateDaily() error {
 	if err := p.wm.InsertBulk(context.Background(), wItems, now); err != nil {
 		return err
 	}
+	tlItems := make([]*timeline.Item, 0, len(items))
 	for _, item := range items {
 		imageUrl := item.Work.ImageUrls[pixiv.SIZE_480x960]
 		if imageUrl == "" {
@@ -95,15 +99,17 @@ func (p *Pixiv) updateDaily() error {
 			imageUrl = item.Work.ImageUrls[pixiv.SIZE_50x50]
 		}
 
-		err = p.context.Timeline().Publish(DailyRankingKey, &timeline.Item{
+		tlItems = append(tlItems, &timeline.Item{
 			Caption:   item.Work.Title,
 			Thumbnail: imageUrl,
 			OriginKey: int64(item.Work.ID),
 			Timestamp: now,
+			Tags:      item.Work.Tags,
 		})
-		if err != nil {
-			log.Errorf("Failed to publish pixiv daily: %v", err)
-		}
+	}
+	// whole ranking is published or not
+	if err := p.context.Timeline().Publish(DailyRankingKey, tlItems...); err != nil {
+		log.Errorf("Failed to publish pixiv daily: %v", err)
 	}
 	return nil
 }
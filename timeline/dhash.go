@@ -0,0 +1,101 @@
+package timeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math/bits"
+	"strconv"
+)
+
+// 64-bit perceptual hash of a thumbnail, see DHash.
+// Marshaled as 16 hex digits, since JSON numbers lose precision.
+type PHash uint64
+
+func ParsePHash(s string) (PHash, error) {
+	n, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid phash: %s", s)
+	}
+	return PHash(n), nil
+}
+
+// Number of different bits. Resized or re-encoded images are usually within 10.
+func (h PHash) Distance(o PHash) int {
+	return bits.OnesCount64(uint64(h ^ o))
+}
+
+func (h PHash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+func (h PHash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.String())
+}
+
+func (h *PHash) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := ParsePHash(s)
+	if err != nil {
+		return err
+	}
+	*h = parsed
+	return nil
+}
+
+const (
+	dhashWidth  = 9
+	dhashHeight = 8
+)
+
+// Difference hash. The image is shrunk to 9x8 grayscale by area average,
+// and each bit tells whether a cell is brighter than its right neighbor.
+// It is robust to scaling and compression, but not to cropping or flipping.
+func DHash(img image.Image) PHash {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return 0
+	}
+	var sums [dhashHeight][dhashWidth]uint64
+	var counts [dhashHeight][dhashWidth]uint64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		cy := (y - b.Min.Y) * dhashHeight / h
+		for x := b.Min.X; x < b.Max.X; x++ {
+			cx := (x - b.Min.X) * dhashWidth / w
+			r, g, bl, _ := img.At(x, y).RGBA()
+			// ITU-R BT.601 luma, 16bit
+			sums[cy][cx] += (299*uint64(r) + 587*uint64(g) + 114*uint64(bl)) / 1000
+			counts[cy][cx]++
+		}
+	}
+	var gray [dhashHeight][dhashWidth]uint64
+	for y := 0; y < dhashHeight; y++ {
+		for x := 0; x < dhashWidth; x++ {
+			cy, cx := y, x
+			// images smaller than 9x8 leave empty cells, take the nearest filled one
+			for counts[cy][cx] == 0 && cx > 0 {
+				cx--
+			}
+			for counts[cy][cx] == 0 && cy > 0 {
+				cy--
+			}
+			if counts[cy][cx] > 0 {
+				gray[y][x] = sums[cy][cx] / counts[cy][cx]
+			}
+		}
+	}
+	var hash uint64
+	for y := 0; y < dhashHeight; y++ {
+		for x := 0; x < dhashWidth-1; x++ {
+			hash <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return PHash(hash)
+}
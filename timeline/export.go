@@ -0,0 +1,264 @@
+package timeline
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/kanosaki/dumper/common"
+)
+
+var (
+	ExportBatchSize = 500
+	ImportBatchSize = 500
+)
+
+// Line of NDJSON archive. Topic record precedes items of the topic.
+//   {"type":"topic","topic":"/pixiv/ranking/daily","origin":"pixiv/work","info":{...}}
+//   {"type":"item","topic":"/pixiv/ranking/daily","origin":"pixiv/work","key":123,"caption":"...",...}
+type ExportRecord struct {
+	Type      string                 `json:"type"`
+	Topic     string                 `json:"topic"`
+	Origin    string                 `json:"origin"`
+	Info      *TopicInfo             `json:"info,omitempty"`
+	OriginKey int64                  `json:"key,omitempty"`
+	Caption   string                 `json:"caption,omitempty"`
+	Thumbnail string                 `json:"thumbnail,omitempty"`
+	Timestamp time.Time              `json:"timestamp,omitempty"`
+	Meta      map[string]interface{} `json:"meta,omitempty"`
+	Tags      []string               `json:"tags,omitempty"`
+	Deleted   *Tombstone             `json:"deleted,omitempty"`
+}
+
+const (
+	recordTopic = "topic"
+	recordItem  = "item"
+)
+
+// Returned by Service.Import for a malformed record. Records before it are imported.
+type RecordError struct {
+	Line int
+	Err  error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record %d: %v", e.Line, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+type ImportStats struct {
+	Topics   int   `json:"topics"`
+	Inserted int64 `json:"inserted"`
+	Skipped  int64 `json:"skipped"` // already exists
+}
+
+// Write items matched to q as NDJSON in ascending order of ID, returns number of items.
+// Items are read from Storage by ExportBatchSize. Ordering and Offset of q is ignored.
+// Deleted items are written with their tombstones regardless of ShowDeleted of q.
+// Saved searches in q.Topics are expanded, and their items are written under their own topics.
+func (s *Service) Export(ctx context.Context, w io.Writer, q *Query) (int64, error) {
+	enc := json.NewEncoder(w)
+	exportedTopics := make(map[string]bool)
+	page := *q
+	page.MaxID, page.Offset = 0, 0
+	page.ShowDeleted = true
+	cursor := q.MinID
+	var n int64
+	for {
+		page.MinID = cursor
+		if page.MinID <= 0 {
+			// MinID is needed for ascending order
+			page.MinID = 1
+		}
+		page.Limit = ExportBatchSize
+		if q.Limit > 0 && int64(q.Limit)-n < int64(page.Limit) {
+			page.Limit = q.Limit - int(n)
+		}
+		s.topicsMu.RLock()
+		plan := s.planFetch(&page)
+		s.topicsMu.RUnlock()
+		items, err := s.runFetch(ctx, &page, plan)
+		if err != nil {
+			return n, err
+		}
+		// Select returns descending order
+		for i := len(items) - 1; i >= 0; i-- {
+			it := items[i]
+			if q.MaxID > 0 && it.ID > int64(q.MaxID) {
+				return n, nil
+			}
+			if !exportedTopics[it.TopicKey] {
+				exportedTopics[it.TopicKey] = true
+				rec := ExportRecord{Type: recordTopic, Topic: it.TopicKey, Origin: it.Origin}
+				if t, ok := s.Topic(it.TopicKey); ok {
+					info := t.Info()
+					rec.Info = &info
+				}
+				if err := enc.Encode(&rec); err != nil {
+					return n, err
+				}
+			}
+			if err := enc.Encode(&ExportRecord{
+				Type:      recordItem,
+				Topic:     it.TopicKey,
+				Origin:    it.Origin,
+				OriginKey: it.OriginKey,
+				Caption:   it.Caption,
+				Thumbnail: it.Thumbnail,
+				Timestamp: it.Timestamp,
+				Meta:      it.Meta,
+				Tags:      it.Tags,
+				Deleted:   it.Deleted,
+			}); err != nil {
+				return n, err
+			}
+			n++
+			cursor = int(it.ID) + 1
+		}
+		if len(items) < page.Limit || (q.Limit > 0 && n >= int64(q.Limit)) {
+			return n, nil
+		}
+	}
+}
+
+// Read NDJSON written by Export, and insert items which do not exist yet.
+// An item is regarded as existing if topic, origin key and timestamp are same.
+// Topics and origins are created if missing, and listeners are not notified.
+// Deleted items are inserted then marked with their tombstones, which are also applied to existing items.
+// *RecordError is returned for malformed records, and other errors are returned as is.
+func (s *Service) Import(ctx context.Context, r io.Reader) (*ImportStats, error) {
+	stats := &ImportStats{}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var batch []*Item
+	pending := make(map[itemIdentity]bool)
+	// topics whose items are inserted or deleted
+	var changed []string
+	defer func() {
+		s.touchKeys(changed...)
+	}()
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := s.persistent.Insert(ctx, batch...); err != nil {
+			return err
+		}
+		stats.Inserted += int64(len(batch))
+		batch = batch[:0]
+		pending = make(map[itemIdentity]bool)
+		return nil
+	}
+	for line := 1; ; line++ {
+		var rec ExportRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if isDecodeError(err) {
+			return stats, &RecordError{Line: line, Err: err}
+		} else if err != nil {
+			return stats, err
+		}
+		if rec.Topic == "" || rec.Origin == "" {
+			return stats, &RecordError{Line: line, Err: fmt.Errorf("topic and origin are required")}
+		}
+		t, err := s.importTopic(&rec, stats)
+		if err != nil {
+			return stats, err
+		}
+		if rec.Type != recordItem {
+			continue
+		}
+		id := itemIdentity{t.ID, rec.OriginKey, common.Timestamp(rec.Timestamp)}
+		if pending[id] {
+			stats.Skipped++
+			continue
+		}
+		if _, err := s.persistent.FindItem(ctx, t.Key, rec.OriginKey, rec.Timestamp); err == nil {
+			stats.Skipped++
+			if rec.Deleted != nil {
+				changed = appendKey(changed, t.Key)
+				// deleted in the source after the item was copied
+				if err := flush(); err != nil {
+					return stats, err
+				}
+				if _, err := s.persistent.DeleteItem(ctx, t.Key, rec.OriginKey, rec.Deleted); err != nil && err != ErrNotFound {
+					return stats, err
+				}
+			}
+			continue
+		} else if err != ErrNotFound {
+			return stats, err
+		}
+		pending[id] = true
+		it := &Item{
+			Caption:   rec.Caption,
+			Thumbnail: rec.Thumbnail,
+			Timestamp: rec.Timestamp,
+			TopicID:   t.ID,
+			TopicKey:  t.Key,
+			Origin:    t.Origin,
+			OriginKey: rec.OriginKey,
+			Meta:      rec.Meta,
+			Tags:      NormalizeTags(rec.Tags),
+		}
+		batch = append(batch, it)
+		changed = appendKey(changed, t.Key)
+		if rec.Deleted != nil {
+			// flushed first, so that items published later with the same origin key are kept
+			if err := flush(); err != nil {
+				return stats, err
+			}
+			if _, err := s.persistent.DeleteItem(ctx, t.Key, rec.OriginKey, rec.Deleted); err != nil && err != ErrNotFound {
+				return stats, err
+			}
+		} else if len(batch) >= ImportBatchSize {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, flush()
+}
+
+func appendKey(keys []string, key string) []string {
+	if containsString(keys, key) {
+		return keys
+	}
+	return append(keys, key)
+}
+
+type itemIdentity struct {
+	topicID   int
+	originKey int64
+	timestamp int64
+}
+
+// Malformed JSON, rather than failure of reading.
+func isDecodeError(err error) bool {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return true
+	}
+	return err == io.ErrUnexpectedEOF
+}
+
+func (s *Service) importTopic(rec *ExportRecord, stats *ImportStats) (*Topic, error) {
+	if t, ok := s.Topic(rec.Topic); ok {
+		return t, nil
+	}
+	var info TopicInfo
+	if rec.Info != nil {
+		info = *rec.Info
+	}
+	if err := s.NewTopicWithInfo(rec.Origin, rec.Topic, info); err != nil {
+		return nil, err
+	}
+	stats.Topics++
+	t, _ := s.Topic(rec.Topic)
+	return t, nil
+}
@@ -0,0 +1,117 @@
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	src := NewService(newPrivateStorage(t))
+	a.NoError(src.NewTopicWithInfo("export/test", "/export/a", TopicInfo{Title: "Export A"}))
+	a.NoError(src.NewTopic("export/other", "/export/b"))
+	base := time.Unix(1700000000, 0)
+	for i := 0; i < 7; i++ {
+		key := "/export/a"
+		if i%3 == 0 {
+			key = "/export/b"
+		}
+		a.NoError(src.Publish(key, &Item{
+			Caption:   "item",
+			OriginKey: int64(i),
+			Timestamp: base.Add(time.Duration(i) * time.Minute),
+			Meta:      map[string]interface{}{"n": i},
+			Tags:      []string{"export"},
+		}))
+	}
+	// deleted, then published again
+	a.NoError(src.Delete("/export/a", 4, WithReason("export")))
+	a.NoError(src.Publish("/export/a", &Item{Caption: "again", OriginKey: 4, Timestamp: base.Add(10 * time.Minute)}))
+	ExportBatchSize = 2
+	defer func() { ExportBatchSize = 500 }()
+
+	var buf bytes.Buffer
+	n, err := src.Export(ctx, &buf, &Query{Topics: []string{"/export/**"}})
+	a.NoError(err)
+	a.Equal(int64(8), n)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	a.Len(lines, 10) // 2 topics and 8 items
+	a.Contains(lines[0], `"type":"topic"`)
+
+	limited := &bytes.Buffer{}
+	n, err = src.Export(ctx, limited, &Query{Topics: []string{"/export/a"}, Limit: 3})
+	a.NoError(err)
+	a.Equal(int64(3), n)
+
+	dst := NewService(newPrivateStorage(t))
+	a.NoError(dst.NewTopic("export/other", "/export/b"))
+	stats, err := dst.Import(ctx, bytes.NewReader(buf.Bytes()))
+	a.NoError(err)
+	a.Equal(&ImportStats{Topics: 1, Inserted: 8}, stats)
+	tp, ok := dst.Topic("/export/a")
+	if a.True(ok) {
+		a.Equal("Export A", tp.Info().Title)
+	}
+	items, err := dst.Fetch(ctx, &Query{Topics: []string{"/export/a"}})
+	a.NoError(err)
+	a.Equal([]int64{4, 5, 2, 1}, mapOriginKey(items))
+	a.Equal("again", items[0].Caption)
+	a.Equal([]string{"export"}, items[1].Tags)
+	a.Equal(float64(5), items[1].Meta["n"])
+	a.Equal(base.Add(5*time.Minute).Unix(), items[1].Timestamp.Unix())
+	items, err = dst.Fetch(ctx, &Query{Topics: []string{"/export/a"}, ShowDeleted: true})
+	a.NoError(err)
+	a.Equal([]int64{4, 5, 4, 2, 1}, mapOriginKey(items))
+	if a.NotNil(items[2].Deleted) {
+		a.Equal("export", items[2].Deleted.Reason)
+	}
+
+	// idempotent
+	stats, err = dst.Import(ctx, bytes.NewReader(buf.Bytes()))
+	a.NoError(err)
+	a.Equal(&ImportStats{Inserted: 0, Skipped: 8}, stats)
+
+	_, err = dst.Import(ctx, strings.NewReader(`{"type":"item","topic":"/export/a"}`))
+	a.IsType(&RecordError{}, err)
+	_, err = dst.Import(ctx, strings.NewReader(`{"type":"item"`))
+	a.IsType(&RecordError{}, err)
+}
+
+func TestImportTombstoneOfExistingItem(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	laptop := NewService(newPrivateStorage(t))
+	a.NoError(laptop.NewTopic("export/test", "/export/a"))
+	base := time.Unix(1700000000, 0)
+	a.NoError(laptop.Publish("/export/a",
+		&Item{Caption: "kept", OriginKey: 1, Timestamp: base},
+		&Item{Caption: "deleted", OriginKey: 2, Timestamp: base.Add(time.Minute)}))
+	var before bytes.Buffer
+	_, err := laptop.Export(ctx, &before, &Query{})
+	a.NoError(err)
+	server := NewService(newPrivateStorage(t))
+	_, err = server.Import(ctx, &before)
+	a.NoError(err)
+
+	// deleted on the laptop after merged
+	a.NoError(laptop.Delete("/export/a", 2, WithReason("merged")))
+	var after bytes.Buffer
+	_, err = laptop.Export(ctx, &after, &Query{})
+	a.NoError(err)
+	stats, err := server.Import(ctx, &after)
+	a.NoError(err)
+	a.Equal(&ImportStats{Skipped: 2}, stats)
+	items, err := server.Fetch(ctx, &Query{Topics: []string{"/export/a"}, ShowDeleted: true})
+	a.NoError(err)
+	a.Equal([]string{"deleted", "kept"}, captions(items))
+	if a.NotNil(items[0].Deleted) {
+		a.Equal("merged", items[0].Deleted.Reason)
+	}
+	a.Nil(items[1].Deleted)
+}
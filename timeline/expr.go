@@ -0,0 +1,123 @@
+package timeline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Error in expression, Pos is byte offset in the input.
+type SyntaxError struct {
+	Input string
+	Pos   int
+	Msg   string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("col %d: %s\n\t%s\n\t%s^", e.Pos+1, e.Msg, e.Input, strings.Repeat(" ", e.Pos))
+}
+
+type token struct {
+	pos  int
+	text string
+}
+
+// Split expression by whitespaces, but not inside double quotes.
+func lex(s string) ([]token, error) {
+	var tokens []token
+	start := -1
+	inQuote := false
+	quoteStart := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case inQuote && c == '\\':
+			i++
+		case c == '"':
+			if !inQuote {
+				quoteStart = i
+			}
+			inQuote = !inQuote
+			if start < 0 {
+				start = i
+			}
+		case !inQuote && (c == ' ' || c == '\t' || c == '\n' || c == '\r'):
+			if start >= 0 {
+				tokens = append(tokens, token{pos: start, text: s[start:i]})
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if inQuote {
+		return nil, &SyntaxError{Input: s, Pos: quoteStart, Msg: "unterminated quote"}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{pos: start, text: s[start:]})
+	}
+	return tokens, nil
+}
+
+// Remove surrounding double quotes if exists.
+func unquoteValue(v string) (string, error) {
+	if strings.HasPrefix(v, `"`) {
+		return strconv.Unquote(v)
+	}
+	return v, nil
+}
+
+// Split comma separated values, commas inside double quotes are kept.
+// Values are still quoted.
+func splitValues(v string) []string {
+	var ret []string
+	start := 0
+	inQuote := false
+	for i := 0; i < len(v); i++ {
+		switch {
+		case inQuote && v[i] == '\\':
+			i++
+		case v[i] == '"':
+			inQuote = !inQuote
+		case !inQuote && v[i] == ',':
+			ret = append(ret, v[start:i])
+			start = i + 1
+		}
+	}
+	return append(ret, v[start:])
+}
+
+// Quoted value is a string, otherwise number or boolean if possible.
+func parseLiteral(v string) (interface{}, error) {
+	if strings.HasPrefix(v, `"`) {
+		return strconv.Unquote(v)
+	}
+	return parseScalar(v), nil
+}
+
+func quoteValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \t\n\r\",") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// Parse literal as number or boolean if possible,
+// to be compared with JSON values.
+func parseScalar(s string) interface{} {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return s
+}
@@ -0,0 +1,305 @@
+package timeline
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type filterKind int
+
+const (
+	filterCaption filterKind = iota
+	filterOrigin
+	filterMeta
+	filterTag
+)
+
+type filterTerm struct {
+	kind    filterKind
+	negate  bool
+	caption *regexp.Regexp
+	origins []string
+	tags    []string
+	meta    MetaPredicate
+}
+
+// Filter selects items by an expression, terms are combined with AND.
+//   caption:"cat|dog"          caption matches regular expression
+//   origin:twitter.tweet,...   origin is one of values
+//   meta.user:foo,bar          meta field equals one of values
+//   meta.bookmarks:>1000       numeric comparison, >, >=, < and <=
+//   meta.user:*                meta field exists
+//   tag:cat,dog                tagged with any of values, multiple tag terms means AND
+//   -meta.nsfw:true            "-" negates a term
+// Unquoted meta values are compared as number or boolean if possible.
+type Filter struct {
+	terms []filterTerm
+}
+
+func ParseFilter(expr string) (*Filter, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	f := &Filter{}
+	for _, tok := range tokens {
+		term, err := parseFilterTerm(expr, tok)
+		if err != nil {
+			return nil, err
+		}
+		f.terms = append(f.terms, term)
+	}
+	return f, nil
+}
+
+func parseFilterTerm(input string, tok token) (filterTerm, error) {
+	var term filterTerm
+	text, pos := tok.text, tok.pos
+	if strings.HasPrefix(text, "-") {
+		term.negate = true
+		text, pos = text[1:], pos+1
+	}
+	colon := strings.Index(text, ":")
+	if colon <= 0 {
+		return term, &SyntaxError{Input: input, Pos: pos, Msg: "expected key:value"}
+	}
+	key, value := text[:colon], text[colon+1:]
+	valuePos := pos + colon + 1
+	if value == "" {
+		return term, &SyntaxError{Input: input, Pos: valuePos, Msg: fmt.Sprintf("empty value for %s", key)}
+	}
+	switch {
+	case key == "caption":
+		pattern, err := unquoteValue(value)
+		if err != nil {
+			return term, &SyntaxError{Input: input, Pos: valuePos, Msg: "invalid quoted value"}
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return term, &SyntaxError{Input: input, Pos: valuePos, Msg: err.Error()}
+		}
+		term.kind = filterCaption
+		term.caption = re
+	case key == "origin":
+		term.kind = filterOrigin
+		for _, v := range splitValues(value) {
+			origin, err := unquoteValue(v)
+			if err != nil {
+				return term, &SyntaxError{Input: input, Pos: valuePos, Msg: "invalid quoted value"}
+			}
+			term.origins = append(term.origins, origin)
+		}
+	case key == "tag":
+		term.kind = filterTag
+		for _, v := range splitValues(value) {
+			tag, err := unquoteValue(v)
+			if err != nil {
+				return term, &SyntaxError{Input: input, Pos: valuePos, Msg: "invalid quoted value"}
+			}
+			term.tags = append(term.tags, tag)
+		}
+		term.tags = NormalizeTags(term.tags)
+		if len(term.tags) == 0 {
+			return term, &SyntaxError{Input: input, Pos: valuePos, Msg: "empty tag"}
+		}
+	case strings.HasPrefix(key, "meta."):
+		field := strings.TrimPrefix(key, "meta.")
+		if field == "" {
+			return term, &SyntaxError{Input: input, Pos: pos, Msg: "empty meta field"}
+		}
+		pred, err := parseMetaValue(field, value)
+		if err != nil {
+			return term, &SyntaxError{Input: input, Pos: valuePos, Msg: err.Error()}
+		}
+		term.kind = filterMeta
+		term.meta = pred
+	default:
+		return term, &SyntaxError{Input: input, Pos: pos, Msg: fmt.Sprintf("unknown key %q", key)}
+	}
+	return term, nil
+}
+
+var metaCompareFuncs = []struct {
+	prefix string
+	fn     func(string, float64) MetaPredicate
+}{
+	// longer prefix first
+	{">=", MetaGte},
+	{"<=", MetaLte},
+	{">", MetaGt},
+	{"<", MetaLt},
+}
+
+func parseMetaValue(field, value string) (MetaPredicate, error) {
+	if value == "*" {
+		return MetaExists(field), nil
+	}
+	for _, c := range metaCompareFuncs {
+		if strings.HasPrefix(value, c.prefix) {
+			n, err := strconv.ParseFloat(value[len(c.prefix):], 64)
+			if err != nil {
+				return MetaPredicate{}, fmt.Errorf("invalid number %q", value[len(c.prefix):])
+			}
+			return c.fn(field, n), nil
+		}
+	}
+	var values []interface{}
+	for _, v := range splitValues(value) {
+		lit, err := parseLiteral(v)
+		if err != nil {
+			return MetaPredicate{}, fmt.Errorf("invalid quoted value")
+		}
+		values = append(values, lit)
+	}
+	if len(values) == 1 {
+		return MetaEq(field, values[0]), nil
+	}
+	return MetaIn(field, values...), nil
+}
+
+// Filter which matches items matched to both filters, nil is regarded as empty filter.
+func (f *Filter) And(o *Filter) *Filter {
+	if f == nil {
+		return o
+	}
+	if o == nil {
+		return f
+	}
+	return &Filter{terms: append(append([]filterTerm(nil), f.terms...), o.terms...)}
+}
+
+// Evaluate the filter in memory, tag aliases are not resolved.
+func (f *Filter) Match(it *Item) bool {
+	return f.match(it, nil)
+}
+
+func (f *Filter) match(it *Item, aliases tagAliases) bool {
+	for i := range f.terms {
+		if f.terms[i].match(it, aliases) == f.terms[i].negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *filterTerm) match(it *Item, aliases tagAliases) bool {
+	switch t.kind {
+	case filterCaption:
+		return t.caption.MatchString(it.Caption)
+	case filterOrigin:
+		for _, o := range t.origins {
+			if o == it.Origin {
+				return true
+			}
+		}
+		return false
+	case filterTag:
+		return hasAnyTag(it, aliases.resolve(t.tags))
+	default:
+		return t.meta.Match(it.Meta)
+	}
+}
+
+// Serialize to expression, which can be parsed by ParseFilter.
+func (f *Filter) String() string {
+	terms := make([]string, 0, len(f.terms))
+	for i := range f.terms {
+		terms = append(terms, f.terms[i].String())
+	}
+	return strings.Join(terms, " ")
+}
+
+func (t *filterTerm) String() string {
+	var prefix string
+	if t.negate {
+		prefix = "-"
+	}
+	switch t.kind {
+	case filterCaption:
+		return prefix + "caption:" + quoteValue(t.caption.String())
+	case filterOrigin:
+		values := make([]string, len(t.origins))
+		for i, o := range t.origins {
+			values[i] = quoteValue(o)
+		}
+		return prefix + "origin:" + strings.Join(values, ",")
+	case filterTag:
+		values := make([]string, len(t.tags))
+		for i, tag := range t.tags {
+			values[i] = quoteValue(tag)
+		}
+		return prefix + "tag:" + strings.Join(values, ",")
+	default:
+		return prefix + "meta." + t.meta.Field + ":" + formatMetaValue(&t.meta)
+	}
+}
+
+func formatMetaValue(p *MetaPredicate) string {
+	switch p.Op {
+	case MetaOpExists:
+		return "*"
+	case MetaOpGt, MetaOpGte, MetaOpLt, MetaOpLte:
+		f, _ := toFloat(p.Values[0])
+		return metaCompareOps[p.Op] + strconv.FormatFloat(f, 'f', -1, 64)
+	default:
+		values := make([]string, len(p.Values))
+		for i, v := range p.Values {
+			values[i] = formatLiteral(v)
+		}
+		return strings.Join(values, ",")
+	}
+}
+
+func formatLiteral(v interface{}) string {
+	switch lit := v.(type) {
+	case string:
+		_, isString := parseScalar(lit).(string)
+		if !isString || lit == "*" || strings.HasPrefix(lit, "<") || strings.HasPrefix(lit, ">") {
+			// would be parsed as other type
+			return strconv.Quote(lit)
+		}
+		return quoteValue(lit)
+	case bool:
+		return strconv.FormatBool(lit)
+	default:
+		if f, ok := toFloat(lit); ok {
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		return quoteValue(fmt.Sprint(lit))
+	}
+}
+
+// SQL terms, joined with AND by Query.
+func (f *Filter) toTerms() ([]string, []interface{}) {
+	var terms []string
+	var params []interface{}
+	for i := range f.terms {
+		t := &f.terms[i]
+		var term string
+		var ps []interface{}
+		switch t.kind {
+		case filterCaption:
+			term, ps = "timeline.caption REGEXP ?", []interface{}{t.caption.String()}
+		case filterOrigin:
+			placeholders := make([]string, len(t.origins))
+			for i, o := range t.origins {
+				placeholders[i] = "?"
+				ps = append(ps, o)
+			}
+			term = fmt.Sprintf("origin.name IN (%s)", strings.Join(placeholders, ", "))
+		case filterTag:
+			term, ps = tagTerm(t.tags)
+		default:
+			term, ps = t.meta.toTerm()
+		}
+		if t.negate {
+			// missing meta field is NULL, but should be regarded as not matched
+			term = fmt.Sprintf("NOT COALESCE((%s), 0)", term)
+		}
+		terms = append(terms, term)
+		params = append(params, ps...)
+	}
+	return terms, params
+}
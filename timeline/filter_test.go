@@ -0,0 +1,118 @@
+package timeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var filterTestItems = []*Item{
+	{OriginKey: 1, Caption: "cute cat", Origin: "filter/twitter", Meta: map[string]interface{}{"user": "foo", "nsfw": false}},
+	{OriginKey: 2, Caption: "big dog", Origin: "filter/twitter", Meta: map[string]interface{}{"user": "bar", "nsfw": true}},
+	{OriginKey: 3, Caption: "cat and dog", Origin: "filter/pixiv", Meta: map[string]interface{}{"user": "foo", "bookmarks": 1500}},
+	{OriginKey: 4, Caption: "landscape", Origin: "filter/pixiv", Meta: map[string]interface{}{"user": "00123", "bookmarks": 10}},
+	{OriginKey: 5, Caption: "no meta", Origin: "filter/pixiv"},
+}
+
+var filterTestPairs = []struct {
+	expr       string
+	originKeys []int64
+}{
+	{``, []int64{5, 4, 3, 2, 1}},
+	{`caption:cat`, []int64{3, 1}},
+	{`caption:"^(cat|big)"`, []int64{3, 2}},
+	{`origin:filter/twitter`, []int64{2, 1}},
+	{`-origin:filter/twitter`, []int64{5, 4, 3}},
+	{`meta.user:foo`, []int64{3, 1}},
+	{`meta.user:foo,bar`, []int64{3, 2, 1}},
+	{`meta.user:"00123"`, []int64{4}},
+	{`meta.nsfw:true`, []int64{2}},
+	{`-meta.nsfw:true`, []int64{5, 4, 3, 1}},
+	{`meta.bookmarks:>1000`, []int64{3}},
+	{`meta.bookmarks:<=10`, []int64{4}},
+	{`meta.bookmarks:*`, []int64{4, 3}},
+	{`meta.user:foo caption:dog origin:filter/pixiv`, []int64{3}},
+}
+
+func TestFilterMatch(t *testing.T) {
+	a := assert.New(t)
+	for _, pair := range filterTestPairs {
+		f, err := ParseFilter(pair.expr)
+		if !a.NoError(err, pair.expr) {
+			continue
+		}
+		matched := []int64{}
+		for i := len(filterTestItems) - 1; i >= 0; i-- {
+			if f.Match(filterTestItems[i]) {
+				matched = append(matched, filterTestItems[i].OriginKey)
+			}
+		}
+		a.Equal(pair.originKeys, matched, pair.expr)
+		// round trip
+		reparsed, err := ParseFilter(f.String())
+		if a.NoError(err, f.String()) {
+			a.Equal(f.String(), reparsed.String())
+		}
+	}
+}
+
+func TestFilterSelect(t *testing.T) {
+	a := assert.New(t)
+	s := NewService(newPrivateStorage(t))
+	for _, it := range filterTestItems {
+		key := "/filter/" + it.Origin
+		a.NoError(s.NewTopic(it.Origin, key))
+		copied := *it
+		a.NoError(s.Publish(key, &copied))
+	}
+	for _, pair := range filterTestPairs {
+		f, err := ParseFilter(pair.expr)
+		if !a.NoError(err, pair.expr) {
+			continue
+		}
+		items, err := s.Fetch(context.Background(), &Query{Topics: []string{"/filter/**"}, Filter: f})
+		if a.NoError(err, pair.expr) {
+			a.Equal(pair.originKeys, mapOriginKey(items), pair.expr)
+		}
+	}
+}
+
+func TestFilterSyntaxError(t *testing.T) {
+	a := assert.New(t)
+	testPairs := []struct {
+		expr string
+		pos  int
+	}{
+		{`caption`, 0},
+		{`meta.user:foo unknown:1`, 14},
+		{`-meta.:foo`, 1},
+		{`caption:"(unclosed"`, 8},
+		{`meta.user:"foo`, 10},
+		{`meta.bookmarks:>abc`, 15},
+		{`origin:`, 7},
+	}
+	for _, pair := range testPairs {
+		_, err := ParseFilter(pair.expr)
+		if se, ok := err.(*SyntaxError); a.True(ok, pair.expr) {
+			a.Equal(pair.pos, se.Pos, pair.expr)
+		}
+	}
+}
+
+func TestListenWithFilter(t *testing.T) {
+	a := assert.New(t)
+	s := NewService(nil)
+	a.NoError(s.NewTopic("filter/twitter", "/filter/listen"))
+	f, err := ParseFilter("meta.user:foo -caption:dog")
+	a.NoError(err)
+	lis, err := s.Listen("/filter/listen", WithFilter(f))
+	a.NoError(err)
+	for _, it := range filterTestItems {
+		copied := *it
+		copied.Timestamp = time.Now()
+		a.NoError(s.Publish("/filter/listen", &copied))
+	}
+	a.Equal([]string{"cute cat"}, mapItemCaption(eventItems(lis.Fetch(0))))
+}
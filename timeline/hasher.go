@@ -0,0 +1,292 @@
+package timeline
+
+import (
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultHashWorkers = 4
+	DefaultHashTimeout = 30 * time.Second
+	HashBatchSize      = 100
+	HashPollInterval   = 5 * time.Minute
+	MaxThumbnailBytes  = int64(16 << 20)
+
+	// Deferred thumbnails are skipped with exponential backoff, up to DefaultHashMaxBackoff.
+	DefaultHashRetryBackoff = 1 * time.Minute
+	DefaultHashMaxBackoff   = 6 * time.Hour
+)
+
+// timeline_phash.yaml
+//   workers: 4
+//   retry_backoff: 1m
+type HasherConfig struct {
+	Workers      int           `yaml:"workers"`
+	Timeout      time.Duration `yaml:"timeout"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	MaxBackoff   time.Duration `yaml:"max_backoff"`
+}
+
+// Result of a hashing run.
+type HashStats struct {
+	Hashed int `json:"hashed"`
+	// Thumbnails which can't be hashed, such as missing or unsupported formats.
+	// They are not tried again.
+	Failed int `json:"failed"`
+	// Thumbnails which failed by network or server errors, or are waiting for backoff of the failure.
+	// They are tried again by later runs.
+	Deferred int `json:"deferred"`
+}
+
+// Hasher fetches thumbnails of items and stores their perceptual hash, see DHash.
+type Hasher struct {
+	s            *Service
+	client       *http.Client
+	workers      int
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+
+	mu      sync.Mutex
+	run     int
+	retries map[int64]*hashRetry
+}
+
+// Deferred item, which is not fetched until at.
+type hashRetry struct {
+	attempts int
+	at       time.Time
+	// last run which deferred or skipped the item
+	run int
+}
+
+// client is used to fetch thumbnails, http.Client with Timeout if nil.
+func NewHasher(s *Service, client *http.Client, conf HasherConfig) *Hasher {
+	if conf.Workers <= 0 {
+		conf.Workers = DefaultHashWorkers
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = DefaultHashTimeout
+	}
+	if conf.RetryBackoff <= 0 {
+		conf.RetryBackoff = DefaultHashRetryBackoff
+	}
+	if conf.MaxBackoff <= 0 {
+		conf.MaxBackoff = DefaultHashMaxBackoff
+	}
+	if client == nil {
+		client = &http.Client{Timeout: conf.Timeout}
+	}
+	return &Hasher{
+		s:            s,
+		client:       client,
+		workers:      conf.Workers,
+		retryBackoff: conf.RetryBackoff,
+		maxBackoff:   conf.MaxBackoff,
+		retries:      make(map[int64]*hashRetry),
+	}
+}
+
+// Error which is expected to succeed by retry.
+type temporaryError struct {
+	error
+}
+
+// Fetch the image and compute its hash.
+func (h *Hasher) HashURL(ctx context.Context, url string) (PHash, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, temporaryError{err}
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err := fmt.Errorf("Fetching %s: %s", url, res.Status)
+		if res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests {
+			return 0, temporaryError{err}
+		}
+		return 0, err
+	}
+	img, _, err := image.Decode(io.LimitReader(res.Body, MaxThumbnailBytes))
+	if err != nil {
+		return 0, fmt.Errorf("Decoding %s: %v", url, err)
+	}
+	return DHash(img), nil
+}
+
+// Hash all items which are not hashed yet, except deferred items in backoff.
+func (h *Hasher) Run(ctx context.Context) (*HashStats, error) {
+	storage := h.s.persistent
+	stats := &HashStats{}
+	h.mu.Lock()
+	h.run++
+	run := h.run
+	h.mu.Unlock()
+	var cursor int64
+	for {
+		items, err := storage.UnhashedItems(ctx, cursor, HashBatchSize)
+		if err != nil {
+			return stats, err
+		}
+		if len(items) == 0 {
+			h.forgetRetries(run)
+			return stats, nil
+		}
+		cursor = items[len(items)-1].ID
+		if err := h.hashItems(ctx, run, items, stats); err != nil {
+			return stats, err
+		}
+	}
+}
+
+func (h *Hasher) hashItems(ctx context.Context, run int, items []*Item, stats *HashStats) error {
+	now := time.Now()
+	var due []*Item
+	for _, it := range items {
+		if h.waiting(it.ID, run, now) {
+			stats.Deferred++
+		} else {
+			due = append(due, it)
+		}
+	}
+	ch := make(chan *Item)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for i := 0; i < h.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range ch {
+				hash, err := h.HashURL(ctx, it.Thumbnail)
+				if _, ok := err.(temporaryError); ok || ctx.Err() != nil {
+					if ctx.Err() == nil {
+						h.deferItem(it.ID, run)
+					}
+					mu.Lock()
+					stats.Deferred++
+					mu.Unlock()
+					continue
+				}
+				var stored *PHash
+				if err == nil {
+					stored = &hash
+				}
+				err = h.s.persistent.SetItemHash(ctx, it.ID, stored)
+				mu.Lock()
+				switch {
+				case err == ErrNotFound:
+					// deleted while fetching
+				case err != nil:
+					if firstErr == nil {
+						firstErr = err
+					}
+				case stored != nil:
+					stats.Hashed++
+				default:
+					stats.Failed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, it := range due {
+		select {
+		case ch <- it:
+		case <-ctx.Done():
+		}
+	}
+	close(ch)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// Whether the item is deferred and its backoff has not passed.
+func (h *Hasher) waiting(id int64, run int, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.retries[id]
+	if !ok || !now.Before(r.at) {
+		// kept by deferItem if it fails again
+		return false
+	}
+	r.run = run
+	return true
+}
+
+func (h *Hasher) deferItem(id int64, run int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.retries[id]
+	if !ok {
+		r = &hashRetry{}
+		h.retries[id] = r
+	}
+	r.attempts++
+	r.at = time.Now().Add(h.backoff(r.attempts))
+	r.run = run
+}
+
+// Drop deferred items which are hashed or deleted, they were not seen by the completed run.
+func (h *Hasher) forgetRetries(run int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, r := range h.retries {
+		if r.run != run {
+			delete(h.retries, id)
+		}
+	}
+}
+
+func (h *Hasher) backoff(attempts int) time.Duration {
+	b := h.retryBackoff
+	for i := 1; i < attempts && b < h.maxBackoff; i++ {
+		b *= 2
+	}
+	if b > h.maxBackoff {
+		b = h.maxBackoff
+	}
+	return b
+}
+
+// Hash items on publish, and pending items every HashPollInterval, until ctx is done.
+// onRun is called with result of each run if not nil.
+func (h *Hasher) Start(ctx context.Context, onRun func(*HashStats, error)) error {
+	lis, err := h.s.Listen("/**", WithRaw())
+	if err != nil {
+		return err
+	}
+	defer lis.Close()
+	for {
+		stats, err := h.Run(ctx)
+		if onRun != nil && ctx.Err() == nil {
+			onRun(stats, err)
+		}
+		timer := time.NewTimer(HashPollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-lis.C:
+			timer.Stop()
+			// items are loaded from storage, drain the notifications
+			for len(lis.C) > 0 {
+				<-lis.C
+			}
+		case <-timer.C:
+		}
+	}
+}
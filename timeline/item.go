@@ -14,8 +14,83 @@ type Item struct {
 	Timestamp time.Time `json:"timestamp"`
 	TopicID   int `json:"timelineID"`
 	TopicKey  string `json:"-"`
+	Origin    string `json:"origin,omitempty"`
 	OriginKey int64 `json:"key"` // ID for each timeline
 	Meta      map[string]interface{} `json:"meta"`
+	Tags      []string `json:"tags,omitempty"` // normalized by NormalizeTag, aliases are resolved on store
+	PHash     *PHash `json:"phash,omitempty"` // hash of thumbnail, filled by Hasher
+	// IDs of near-duplicates collapsed into this item, see Query.Collapse.
+	Duplicates []int64 `json:"duplicates,omitempty"`
+	// IDs of consecutive items from the same author folded into this item, see MergeQuery.BurstField.
+	Folded    []int64 `json:"folded,omitempty"`
+	// IDs of items summarized by this item, which is delivered to listeners by PublishPolicy.Digest.
+	// Digest is not stored, and its ID is the one of the last summarized item as a position of the stream,
+	// which does not identify the digest. See IsDigest.
+	Digest    []int64 `json:"digest,omitempty"`
+	State     *ItemState `json:"state,omitempty"` // filled if Query.User is given
+	Deleted   *Tombstone `json:"deleted,omitempty"` // set if deleted by Service.Delete
+}
+
+// Record of a deleted item, which is kept in Storage and excluded from queries unless Query.ShowDeleted.
+type Tombstone struct {
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Digest of PublishPolicy.Digest, which should be identified apart from stored items.
+func (i *Item) IsDigest() bool {
+	return len(i.Digest) > 0
+}
+
+// Timestamp to be stored, items without Timestamp are regarded as created at now.
+func insertedTimestamp(it *Item, now time.Time) time.Time {
+	if it.Timestamp.IsZero() {
+		return now
+	}
+	return it.Timestamp
+}
+
+type ItemEventKind int
+
+const (
+	ItemAdded ItemEventKind = iota
+	ItemUpdated
+	ItemDeleted
+)
+
+var itemEventKindNames = map[ItemEventKind]string{
+	ItemAdded:   "added",
+	ItemUpdated: "updated",
+	ItemDeleted: "deleted",
+}
+
+func (k ItemEventKind) String() string {
+	return itemEventKindNames[k]
+}
+
+func (k ItemEventKind) MarshalJSON() ([]byte, error) {
+	return json.Marshal(k.String())
+}
+
+func (k *ItemEventKind) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	for kind, n := range itemEventKindNames {
+		if n == name {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown item event: %s", name)
+}
+
+// Delivered to listeners via Listener.C.
+type ItemEvent struct {
+	Kind ItemEventKind `json:"kind"`
+	// Content after the change, Item.Deleted is set for ItemDeleted.
+	Item *Item `json:"item"`
 }
 
 func (i *Item) EncodeMeta() ([]byte, error) {
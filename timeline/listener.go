@@ -1,28 +1,136 @@
 package timeline
 
-import "sync"
+import (
+	"errors"
+	"sync"
+	"time"
+)
 
+var (
+	DefaultBlockTimeout = 1 * time.Second
+	TopicEventBuffer    = 16
+	ErrOverflow         = errors.New("Listener buffer overflowed")
+)
+
+// Behavior of Listener.Push when buffer is full.
+type OverflowPolicy int
+
+const (
+	// Discard pushed item.
+	DropNewest OverflowPolicy = iota
+	// Discard head of buffer to make room for pushed item.
+	DropOldest
+	// Wait for consumer until timeout, then discard pushed item.
+	Block
+	// Close the listener, consumer should re-sync from storage.
+	Disconnect
+)
+
+// Items are delivered to C as ItemEvent, and changes of matched topics to TopicC.
+// Topic events are dropped if TopicC is full.
 type Listener struct {
-	Key        string
-	C          chan *Item
-	closed     bool
-	overflowed uint32
-	fetchMu    sync.Mutex
-	pushMu     sync.Mutex
+	Key          string
+	Pattern      TopicPattern
+	C            chan ItemEvent
+	TopicC       chan TopicEvent
+	filter       *Filter
+	raw          bool
+	policy       OverflowPolicy
+	blockTimeout time.Duration
+	closed       bool
+	err          error
+	overflowed   uint64
+	missed       bool
+	missedSince  int64
+	s            *Service
+	topics       []*Topic
+	topicsMu     sync.Mutex
+	fetchMu      sync.Mutex
+	pushMu       sync.Mutex
 }
 
-func (l *Listener) Push(i *Item) {
+func (l *Listener) Push(ev ItemEvent) {
 	l.pushMu.Lock()
-	defer l.pushMu.Unlock()
-	if len(l.C) == cap(l.C) {
-		l.overflowed = (l.overflowed + 1) % 0xFFFFFFFF
+	if l.closed {
+		l.pushMu.Unlock()
 		return
 	}
-	l.C <- i
+	select {
+	case l.C <- ev:
+		l.pushMu.Unlock()
+		return
+	default:
+	}
+	switch l.policy {
+	case DropOldest:
+		// Consumer may take items concurrently, retry until pushed.
+		for {
+			select {
+			case dropped := <-l.C:
+				l.markMissed(dropped)
+			default:
+			}
+			select {
+			case l.C <- ev:
+				l.pushMu.Unlock()
+				return
+			default:
+			}
+		}
+	case Block:
+		timer := time.NewTimer(l.blockTimeout)
+		defer timer.Stop()
+		select {
+		case l.C <- ev:
+		case <-timer.C:
+			l.markMissed(ev)
+		}
+		l.pushMu.Unlock()
+	case Disconnect:
+		l.markMissed(ev)
+		l.closeLocked(ErrOverflow)
+		l.pushMu.Unlock()
+		l.detach()
+	default:
+		l.markMissed(ev)
+		l.pushMu.Unlock()
+	}
+}
+
+// pushMu should be held
+func (l *Listener) markMissed(ev ItemEvent) {
+	l.overflowed++
+	if !l.missed || ev.Item.ID < l.missedSince {
+		l.missedSince = ev.Item.ID
+	}
+	l.missed = true
+}
+
+// Number of events discarded by overflow.
+func (l *Listener) Overflowed() uint64 {
+	l.pushMu.Lock()
+	defer l.pushMu.Unlock()
+	return l.overflowed
+}
+
+// Reports whether events are discarded since last ClearMissed,
+// and ID of the oldest item of discarded events.
+// Consumer can re-sync with Query{MinID: sinceID, ShowDeleted: true} from storage.
+func (l *Listener) Missed() (sinceID int64, missed bool) {
+	l.pushMu.Lock()
+	defer l.pushMu.Unlock()
+	return l.missedSince, l.missed
+}
+
+func (l *Listener) ClearMissed() {
+	l.pushMu.Lock()
+	defer l.pushMu.Unlock()
+	l.missed = false
+	l.missedSince = 0
 }
 
 // Return head of buffer channel as slice.
-func (l *Listener) Fetch(limit int) []*Item {
+func (l *Listener) Fetch(limit int) []ItemEvent {
 	l.fetchMu.Lock()
 	defer l.fetchMu.Unlock()
 	chLen := len(l.C)
@@ -34,13 +142,94 @@ func (l *Listener) Fetch(limit int) []*Item {
 	if limit == 0 && chLen != 0 {
 		limit = chLen
 	}
-	ret := make([]*Item, 0, limit)
+	ret := make([]ItemEvent, 0, limit)
 	for i := 0; i < limit; i++ {
-		ret = append(ret, <-l.C)
+		ev, ok := <-l.C
+		if !ok {
+			break
+		}
+		ret = append(ret, ev)
 	}
 	return ret
 }
 
+// Closed listener is detached from all topics, and C is closed.
+// Buffered events can still be received.
 func (l *Listener) Close() {
+	l.pushMu.Lock()
+	closing := !l.closed
+	l.closeLocked(nil)
+	l.pushMu.Unlock()
+	if closing {
+		l.detach()
+	}
+}
+
+func (l *Listener) Closed() bool {
+	l.pushMu.Lock()
+	defer l.pushMu.Unlock()
+	return l.closed
+}
+
+// Reason of close, ErrOverflow if disconnected by Disconnect policy.
+func (l *Listener) Err() error {
+	l.pushMu.Lock()
+	defer l.pushMu.Unlock()
+	return l.err
+}
+
+// pushMu should be held
+func (l *Listener) closeLocked(err error) {
+	if l.closed {
+		return
+	}
 	l.closed = true
+	l.err = err
+	close(l.C)
+	close(l.TopicC)
+}
+
+func (l *Listener) pushTopicEvent(ev TopicEvent) {
+	l.pushMu.Lock()
+	defer l.pushMu.Unlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.TopicC <- ev:
+	default:
+	}
+}
+
+func (l *Listener) attach(t *Topic) {
+	l.topicsMu.Lock()
+	l.topics = append(l.topics, t)
+	l.topicsMu.Unlock()
+	t.addListener(l)
+}
+
+func (l *Listener) detachTopic(t *Topic) {
+	l.topicsMu.Lock()
+	topics := make([]*Topic, 0, len(l.topics))
+	for _, lt := range l.topics {
+		if lt != t {
+			topics = append(topics, lt)
+		}
+	}
+	l.topics = topics
+	l.topicsMu.Unlock()
+	t.removeListener(l)
+}
+
+func (l *Listener) detach() {
+	if l.s != nil {
+		l.s.removeListener(l)
+	}
+	l.topicsMu.Lock()
+	topics := l.topics
+	l.topics = nil
+	l.topicsMu.Unlock()
+	for _, t := range topics {
+		t.removeListener(l)
+	}
 }
@@ -0,0 +1,121 @@
+package timeline
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Service without storage, to not share sequence with storage tests.
+func newOverflowService(t *testing.T, key string) *Service {
+	s := NewService(nil)
+	s.ListenerBuffer = 2
+	if err := s.NewTopic("", key); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func publishN(t *testing.T, s *Service, key string, n int) []*Item {
+	items := make([]*Item, 0, n)
+	for i := 0; i < n; i++ {
+		it := simpleItem(fmt.Sprint(i))
+		it.ID = int64(i + 1)
+		if err := s.Publish(key, it); err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, it)
+	}
+	return items
+}
+
+func TestListenerDropNewest(t *testing.T) {
+	a := assert.New(t)
+	s := newOverflowService(t, "/overflow/newest")
+	lis, err := s.Listen("/overflow/newest")
+	a.NoError(err)
+	items := publishN(t, s, "/overflow/newest", 4)
+	a.Equal([]string{"0", "1"}, mapItemCaption(eventItems(lis.Fetch(0))))
+	a.Equal(uint64(2), lis.Overflowed())
+	since, missed := lis.Missed()
+	a.True(missed)
+	a.Equal(items[2].ID, since)
+	lis.ClearMissed()
+	_, missed = lis.Missed()
+	a.False(missed)
+}
+
+func TestListenerDropOldest(t *testing.T) {
+	a := assert.New(t)
+	s := newOverflowService(t, "/overflow/oldest")
+	lis, err := s.Listen("/overflow/oldest", WithOverflowPolicy(DropOldest))
+	a.NoError(err)
+	items := publishN(t, s, "/overflow/oldest", 4)
+	a.Equal([]string{"2", "3"}, mapItemCaption(eventItems(lis.Fetch(0))))
+	a.Equal(uint64(2), lis.Overflowed())
+	since, missed := lis.Missed()
+	a.True(missed)
+	a.Equal(items[0].ID, since)
+}
+
+func TestListenerBlock(t *testing.T) {
+	a := assert.New(t)
+	s := newOverflowService(t, "/overflow/block")
+	lis, err := s.Listen("/overflow/block", WithOverflowPolicy(Block), WithBlockTimeout(10*time.Millisecond))
+	a.NoError(err)
+	publishN(t, s, "/overflow/block", 3)
+	a.Equal(uint64(1), lis.Overflowed())
+	a.Equal([]string{"0", "1"}, mapItemCaption(eventItems(lis.Fetch(0))))
+
+	// consumer catches up while publisher is blocked
+	blocking, err := s.Listen("/overflow/block", WithOverflowPolicy(Block), WithBlockTimeout(time.Minute))
+	a.NoError(err)
+	lis.Close()
+	done := make(chan struct{})
+	go func() {
+		publishN(t, s, "/overflow/block", 3)
+		close(done)
+	}()
+	var received []*Item
+	for len(received) < 3 {
+		received = append(received, (<-blocking.C).Item)
+	}
+	<-done
+	a.Equal([]string{"0", "1", "2"}, mapItemCaption(received))
+	a.Equal(uint64(0), blocking.Overflowed())
+}
+
+func TestListenerDisconnect(t *testing.T) {
+	a := assert.New(t)
+	s := newOverflowService(t, "/overflow/disconnect")
+	lis, err := s.Listen("/overflow/disconnect", WithOverflowPolicy(Disconnect))
+	a.NoError(err)
+	publishN(t, s, "/overflow/disconnect", 3)
+	a.True(lis.Closed())
+	a.Equal(ErrOverflow, lis.Err())
+	a.Empty(s.Topics("/overflow/disconnect")[0].listeners)
+	// buffered items are still readable
+	a.Equal([]string{"0", "1"}, mapItemCaption(eventItems(lis.Fetch(0))))
+	_, ok := <-lis.C
+	a.False(ok)
+}
+
+func TestListenerClose(t *testing.T) {
+	a := assert.New(t)
+	s := newOverflowService(t, "/close/a")
+	a.NoError(s.NewTopic("", "/close/b"))
+	lis, err := s.Listen("/close/**")
+	a.NoError(err)
+	a.Len(s.Topics("/close/a")[0].listeners, 1)
+	a.Len(s.Topics("/close/b")[0].listeners, 1)
+	lis.Close()
+	a.Empty(s.Topics("/close/a")[0].listeners)
+	a.Empty(s.Topics("/close/b")[0].listeners)
+	a.Nil(lis.Err())
+	// publish after close is ignored
+	publishN(t, s, "/close/a", 1)
+	lis.Close()
+	a.Empty(lis.Fetch(0))
+}
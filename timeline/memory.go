@@ -0,0 +1,1013 @@
+package timeline
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kanosaki/dumper/common"
+)
+
+// Storage on process memory, with the same semantics as SQLiteStorage.
+// Each instance has its own contents, which are lost on exit. Used by tests and ephemeral runs.
+type MemoryStorage struct {
+	mu          sync.RWMutex
+	origins     map[string]int
+	originNames map[int]string
+	topics      map[string]*memTopic
+	topicsByID  map[int]*memTopic
+	lastTopicID int
+	items       []*memItem // in ascending order of ID
+	lastItemID  int64
+	tags        map[string]*memTag
+	tagsByID    map[int64]*memTag
+	lastTagID   int64
+	markers     map[string]map[int]int64      // user -> topic ID -> last read ID
+	states      map[string]map[int64]*memFlag // user -> item ID -> flags
+	searches    map[int]string                // topic ID -> query expression
+}
+
+type memTopic struct {
+	id        int
+	key       string
+	originID  int
+	info      TopicInfo
+	createdAt int64 // milliseconds, as stored by SQLiteStorage
+}
+
+type memItem struct {
+	id        int64
+	topicID   int
+	caption   string
+	thumbnail string
+	originKey int64
+	timestamp int64  // milliseconds
+	metaBytes []byte // copied out on Select
+	meta      map[string]interface{}
+	phash     *PHash
+	hashed    bool    // attempted to hash
+	tags      []int64 // canonical tag IDs
+	deleted   *Tombstone
+}
+
+type memTag struct {
+	id      int64
+	name    string
+	aliasOf int64 // 0 if canonical
+}
+
+type memFlag struct {
+	starred bool
+	hidden  bool
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		origins:     make(map[string]int),
+		originNames: make(map[int]string),
+		topics:      make(map[string]*memTopic),
+		topicsByID:  make(map[int]*memTopic),
+		tags:        make(map[string]*memTag),
+		tagsByID:    make(map[int64]*memTag),
+		markers:     make(map[string]map[int]int64),
+		states:      make(map[string]map[int64]*memFlag),
+		searches:    make(map[int]string),
+	}
+}
+
+// Always nil, MemoryStorage has no database.
+func (s *MemoryStorage) DB() *sql.DB {
+	return nil
+}
+
+func (s *MemoryStorage) OriginID(ctx context.Context, originName string, createIfMissing bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id, ok := s.origins[originName]; ok {
+		return id, nil
+	}
+	if !createIfMissing {
+		return 0, ErrNotFound
+	}
+	id := len(s.origins) + 1
+	s.origins[originName] = id
+	s.originNames[id] = originName
+	return id, nil
+}
+
+func (s *MemoryStorage) TopicID(ctx context.Context, key string, originID int, createIfMissing bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.topics[key]; ok {
+		return t.id, nil
+	}
+	if !createIfMissing {
+		return 0, ErrNotFound
+	}
+	if _, ok := s.originNames[originID]; !ok {
+		return 0, fmt.Errorf("Unknown origin ID: %d", originID)
+	}
+	s.lastTopicID++
+	t := &memTopic{id: s.lastTopicID, key: key, originID: originID, createdAt: common.Timestamp(time.Now())}
+	s.topics[key] = t
+	s.topicsByID[t.id] = t
+	return t.id, nil
+}
+
+func (s *MemoryStorage) TopicInfo(ctx context.Context, key string) (TopicInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.topics[key]
+	if !ok {
+		return TopicInfo{}, ErrNotFound
+	}
+	info := t.info
+	info.CreatedAt = time.Time{}
+	if t.createdAt > 0 {
+		info.CreatedAt = common.FromTimestamp(t.createdAt)
+	}
+	return info, nil
+}
+
+func (s *MemoryStorage) UpdateTopicInfo(ctx context.Context, key string, info TopicInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.topics[key]
+	if !ok {
+		return ErrNotFound
+	}
+	t.info = info
+	t.createdAt = 0
+	if !info.CreatedAt.IsZero() {
+		t.createdAt = common.Timestamp(info.CreatedAt)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) RenameTopic(ctx context.Context, oldKey, newKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.topics[oldKey]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok := s.topics[newKey]; ok {
+		return ErrTopicExists
+	}
+	delete(s.topics, oldKey)
+	t.key = newKey
+	s.topics[newKey] = t
+	return nil
+}
+
+func (s *MemoryStorage) DeleteTopic(ctx context.Context, key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.topics[key]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	deleted := s.deleteItems(func(it *memItem) bool {
+		return it.topicID == t.id
+	}, -1)
+	for _, markers := range s.markers {
+		delete(markers, t.id)
+	}
+	delete(s.searches, t.id)
+	delete(s.topics, key)
+	delete(s.topicsByID, t.id)
+	return deleted, nil
+}
+
+func (s *MemoryStorage) Insert(ctx context.Context, item ...*Item) (int64, error) {
+	if len(item) == 0 {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// validated before modification, as a transaction
+	stored := make([]*memItem, len(item))
+	timestamps := make([]time.Time, len(item))
+	now := time.Now()
+	for i, it := range item {
+		if _, ok := s.topicsByID[it.TopicID]; !ok {
+			return 0, &InsertError{Index: i, Item: it, Err: fmt.Errorf("Unknown topic ID: %d", it.TopicID)}
+		}
+		metaBytes, err := json.Marshal(it.Meta)
+		if err != nil {
+			return 0, &InsertError{Index: i, Item: it, Err: err}
+		}
+		timestamps[i] = insertedTimestamp(it, now)
+		stored[i] = &memItem{
+			topicID:   it.TopicID,
+			caption:   it.Caption,
+			thumbnail: it.Thumbnail,
+			originKey: it.OriginKey,
+			timestamp: common.Timestamp(timestamps[i]),
+			metaBytes: metaBytes,
+		}
+		json.Unmarshal(metaBytes, &stored[i].meta)
+	}
+	for i, it := range item {
+		s.lastItemID++
+		stored[i].id = s.lastItemID
+		s.items = append(s.items, stored[i])
+		it.ID = stored[i].id
+		it.Timestamp = timestamps[i]
+		if len(it.Tags) > 0 {
+			ids, names := s.resolveTags(it.Tags)
+			stored[i].tags = ids
+			it.Tags = names
+		}
+	}
+	return s.lastItemID, nil
+}
+
+func (s *MemoryStorage) item(id int64) *memItem {
+	i := sort.Search(len(s.items), func(i int) bool {
+		return s.items[i].id >= id
+	})
+	if i < len(s.items) && s.items[i].id == id {
+		return s.items[i]
+	}
+	return nil
+}
+
+func (s *MemoryStorage) FindItem(ctx context.Context, topicKey string, originKey int64, timestamp time.Time) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.topics[topicKey]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	ts := common.Timestamp(timestamp)
+	for _, it := range s.items {
+		if it.topicID == t.id && it.originKey == originKey && it.timestamp == ts {
+			return it.id, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+func (s *MemoryStorage) Select(ctx context.Context, q *Query) ([]*Item, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m := s.matcher(q)
+	if m == nil {
+		return nil, nil
+	}
+	var matched []*memItem
+	for _, it := range s.items {
+		if m.match(it) {
+			matched = append(matched, it)
+		}
+	}
+	byTimestamp, ascend := q.orderBy()
+	if byTimestamp {
+		// ties are kept in ascending order of ID, as SQLite does
+		sort.SliceStable(matched, func(i, j int) bool {
+			if ascend {
+				return matched[i].timestamp < matched[j].timestamp
+			}
+			return matched[i].timestamp > matched[j].timestamp
+		})
+	} else if !ascend {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
+		}
+	}
+	if q.Offset > 0 {
+		if q.Offset >= len(matched) {
+			return nil, nil
+		}
+		matched = matched[q.Offset:]
+	}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+	ret := make([]*Item, len(matched))
+	for i, it := range matched {
+		// flipped to descending order
+		if ascend {
+			ret[len(matched)-i-1] = s.toItem(it, q.User)
+		} else {
+			ret[i] = s.toItem(it, q.User)
+		}
+	}
+	return ret, nil
+}
+
+func (s *MemoryStorage) toItem(it *memItem, user string) *Item {
+	t := s.topicsByID[it.topicID]
+	ret := &Item{
+		ID:        it.id,
+		Caption:   it.caption,
+		Thumbnail: it.thumbnail,
+		Timestamp: common.FromTimestamp(it.timestamp),
+		TopicID:   it.topicID,
+		OriginKey: it.originKey,
+		TopicKey:  t.key,
+		Origin:    s.originNames[t.originID],
+		Tags:      s.tagNames(it.tags),
+	}
+	json.Unmarshal(it.metaBytes, &ret.Meta)
+	if it.phash != nil {
+		h := *it.phash
+		ret.PHash = &h
+	}
+	if it.deleted != nil {
+		tombstone := *it.deleted
+		ret.Deleted = &tombstone
+	}
+	if user != "" {
+		ret.State = &ItemState{Read: it.id <= s.markers[user][it.topicID]}
+		if f, ok := s.states[user][it.id]; ok {
+			ret.State.Starred, ret.State.Hidden = f.starred, f.hidden
+		}
+	}
+	return ret
+}
+
+func (s *MemoryStorage) CountByTopic(ctx context.Context, q *Query) (map[string]int64, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make(map[string]int64)
+	m := s.matcher(q)
+	if m == nil {
+		return ret, nil
+	}
+	for _, it := range s.items {
+		if m.match(it) {
+			ret[s.topicsByID[it.topicID].key]++
+		}
+	}
+	return ret, nil
+}
+
+func (s *MemoryStorage) DeleteItems(ctx context.Context, q *Query, keep []*Query, limit int) (int64, error) {
+	if err := q.Validate(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.matcher(q.withDeleted())
+	if m == nil {
+		return 0, nil
+	}
+	var keepers []*memMatcher
+	for _, k := range keep {
+		if err := k.Validate(); err != nil {
+			return 0, err
+		}
+		k = k.withDeleted()
+		if terms, _ := k.conditionTerms(); len(terms) == 0 {
+			// matches all items
+			return 0, nil
+		}
+		if km := s.matcher(k); km != nil {
+			keepers = append(keepers, km)
+		}
+	}
+	return s.deleteItems(func(it *memItem) bool {
+		if !m.match(it) {
+			return false
+		}
+		for _, km := range keepers {
+			if km.match(it) {
+				return false
+			}
+		}
+		return true
+	}, limit), nil
+}
+
+// Delete at most limit items matched to f oldest first, or all if limit is negative.
+// States of deleted items are also deleted.
+func (s *MemoryStorage) deleteItems(f func(*memItem) bool, limit int) int64 {
+	var deleted int64
+	kept := s.items[:0]
+	for _, it := range s.items {
+		if (limit < 0 || deleted < int64(limit)) && f(it) {
+			deleted++
+			for _, states := range s.states {
+				delete(states, it.id)
+			}
+			continue
+		}
+		kept = append(kept, it)
+	}
+	for i := len(kept); i < len(s.items); i++ {
+		s.items[i] = nil
+	}
+	s.items = kept
+	return deleted
+}
+
+func (s *MemoryStorage) MarkRead(ctx context.Context, user, topicKey string, upToID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.topics[topicKey]
+	if !ok {
+		return ErrNotFound
+	}
+	if upToID <= 0 {
+		for _, it := range s.items {
+			if it.topicID == t.id {
+				upToID = it.id
+			}
+		}
+	}
+	markers, ok := s.markers[user]
+	if !ok {
+		markers = make(map[int]int64)
+		s.markers[user] = markers
+	}
+	if last, ok := markers[t.id]; !ok || upToID > last {
+		markers[t.id] = upToID
+	}
+	return nil
+}
+
+func (s *MemoryStorage) ReadMarkers(ctx context.Context, user string) (map[string]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make(map[string]int64)
+	for _, t := range s.topics {
+		if id, ok := s.markers[user][t.id]; ok {
+			ret[t.key] = id
+		}
+	}
+	return ret, nil
+}
+
+func (s *MemoryStorage) SetItemFlag(ctx context.Context, user string, itemID int64, flag ItemFlag, value bool) error {
+	if _, ok := itemFlagColumns[flag]; !ok {
+		panic("Unknown ItemFlag")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.item(itemID) == nil {
+		return ErrNotFound
+	}
+	states, ok := s.states[user]
+	if !ok {
+		states = make(map[int64]*memFlag)
+		s.states[user] = states
+	}
+	f, ok := states[itemID]
+	if !ok {
+		f = &memFlag{}
+		states[itemID] = f
+	}
+	if flag == FlagStarred {
+		f.starred = value
+	} else {
+		f.hidden = value
+	}
+	return nil
+}
+
+// Resolve tag names to canonical tag IDs and names, missing tags are created.
+func (s *MemoryStorage) resolveTags(tags []string) ([]int64, []string) {
+	tags = NormalizeTags(tags)
+	ids := make([]int64, 0, len(tags))
+	names := make([]string, 0, len(tags))
+	for _, name := range tags {
+		t := s.canonicalTag(s.tag(name))
+		if !containsInt64(ids, t.id) {
+			ids = append(ids, t.id)
+			names = append(names, t.name)
+		}
+	}
+	return ids, names
+}
+
+// Tag of the normalized name, created if missing.
+func (s *MemoryStorage) tag(name string) *memTag {
+	t, ok := s.tags[name]
+	if !ok {
+		s.lastTagID++
+		t = &memTag{id: s.lastTagID, name: name}
+		s.tags[name] = t
+		s.tagsByID[t.id] = t
+	}
+	return t
+}
+
+func (s *MemoryStorage) canonicalTag(t *memTag) *memTag {
+	if t.aliasOf != 0 {
+		return s.tagsByID[t.aliasOf]
+	}
+	return t
+}
+
+// Canonical IDs of existing tags, as tagTerm of SQL.
+func (s *MemoryStorage) canonicalIDs(names []string) []int64 {
+	var ret []int64
+	for _, name := range names {
+		if t, ok := s.tags[name]; ok {
+			ret = append(ret, s.canonicalTag(t).id)
+		}
+	}
+	return ret
+}
+
+// Names of tags in sorted order, nil if no tags.
+func (s *MemoryStorage) tagNames(ids []int64) []string {
+	if len(ids) == 0 {
+		return nil
+	}
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = s.tagsByID[id].name
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *MemoryStorage) AddTags(ctx context.Context, itemID int64, tags []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it := s.item(itemID)
+	if it == nil {
+		return nil, ErrNotFound
+	}
+	ids, _ := s.resolveTags(tags)
+	for _, id := range ids {
+		if !containsInt64(it.tags, id) {
+			it.tags = append(it.tags, id)
+		}
+	}
+	return s.tagNames(it.tags), nil
+}
+
+func (s *MemoryStorage) RemoveTags(ctx context.Context, itemID int64, tags []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it := s.item(itemID)
+	if it == nil {
+		return nil, nil
+	}
+	removed := s.canonicalIDs(NormalizeTags(tags))
+	kept := it.tags[:0]
+	for _, id := range it.tags {
+		if !containsInt64(removed, id) {
+			kept = append(kept, id)
+		}
+	}
+	it.tags = kept
+	return s.tagNames(it.tags), nil
+}
+
+func (s *MemoryStorage) SetTagAlias(ctx context.Context, alias, canonical string) error {
+	alias = NormalizeTag(alias)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if canonical == "" {
+		if t, ok := s.tags[alias]; ok {
+			t.aliasOf = 0
+		}
+		return nil
+	}
+	aliasTag := s.tag(alias)
+	target := s.canonicalTag(s.tag(NormalizeTag(canonical)))
+	if target.id == aliasTag.id {
+		return ErrTagAliasCycle
+	}
+	// aliases of alias are moved to canonical
+	for _, t := range s.tags {
+		if t.id == aliasTag.id || t.aliasOf == aliasTag.id {
+			t.aliasOf = target.id
+		}
+	}
+	for _, it := range s.items {
+		if !containsInt64(it.tags, aliasTag.id) {
+			continue
+		}
+		kept := it.tags[:0]
+		for _, id := range it.tags {
+			if id != aliasTag.id && id != target.id {
+				kept = append(kept, id)
+			}
+		}
+		it.tags = append(kept, target.id)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) TagAliases(ctx context.Context) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make(map[string]string)
+	for name, t := range s.tags {
+		if t.aliasOf != 0 {
+			ret[name] = s.tagsByID[t.aliasOf].name
+		}
+	}
+	return ret, nil
+}
+
+func (s *MemoryStorage) TagCounts(ctx context.Context, q *Query, limit int) ([]TagCount, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m := s.matcher(q)
+	if m == nil {
+		return nil, nil
+	}
+	counts := make(map[int64]int64)
+	for _, it := range s.items {
+		if m.match(it) {
+			for _, id := range it.tags {
+				counts[id]++
+			}
+		}
+	}
+	var ret []TagCount
+	for id, n := range counts {
+		ret = append(ret, TagCount{Tag: s.tagsByID[id].name, Count: n})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Tag < ret[j].Tag
+	})
+	if limit > 0 && len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret, nil
+}
+
+func (s *MemoryStorage) CountByBucket(ctx context.Context, sq *StatsQuery) ([]BucketCount, error) {
+	if err := sq.Validate(); err != nil {
+		return nil, err
+	}
+	q := sq.Query
+	if q == nil {
+		q = &Query{}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m := s.matcher(q)
+	if m == nil {
+		return nil, nil
+	}
+	size, _ := sq.Interval.millis()
+	shift := sq.bucketShift()
+	type key struct {
+		bucket int64
+		group  string
+	}
+	counts := make(map[key]int64)
+	for _, it := range s.items {
+		if !m.match(it) {
+			continue
+		}
+		var group string
+		switch sq.GroupBy {
+		case "":
+		case GroupByTopic:
+			group = s.topicsByID[it.topicID].key
+		case GroupByOrigin:
+			group = s.originNames[s.topicsByID[it.topicID].originID]
+		default:
+			v, ok := lookupMeta(it.meta, sq.metaField())
+			if !ok {
+				continue
+			}
+			group = metaText(v)
+		}
+		counts[key{(it.timestamp + shift) / size, group}]++
+	}
+	var ret []BucketCount
+	for k, n := range counts {
+		ret = append(ret, BucketCount{Bucket: k.bucket, Group: k.group, Count: n})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Bucket != ret[j].Bucket {
+			return ret[i].Bucket < ret[j].Bucket
+		}
+		return ret[i].Group < ret[j].Group
+	})
+	return ret, nil
+}
+
+// Text of meta value, as CAST(json_extract(...) AS TEXT) in SQLite.
+func metaText(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case bool:
+		if x {
+			return "1"
+		}
+		return "0"
+	case float64:
+		if x == float64(int64(x)) {
+			return strconv.FormatInt(int64(x), 10)
+		}
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		b, _ := json.Marshal(x)
+		return string(b)
+	}
+}
+
+func (s *MemoryStorage) SavedSearches(ctx context.Context) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make(map[string]string)
+	for _, t := range s.topics {
+		if expr, ok := s.searches[t.id]; ok {
+			ret[t.key] = expr
+		}
+	}
+	return ret, nil
+}
+
+func (s *MemoryStorage) SaveSearch(ctx context.Context, topicKey, expr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.topics[topicKey]
+	if !ok {
+		return ErrNotFound
+	}
+	s.searches[t.id] = expr
+	return nil
+}
+
+func (s *MemoryStorage) SetItemHash(ctx context.Context, itemID int64, hash *PHash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it := s.item(itemID)
+	if it == nil {
+		return ErrNotFound
+	}
+	it.phash, it.hashed = nil, true
+	if hash != nil {
+		h := *hash
+		it.phash = &h
+	}
+	return nil
+}
+
+func (s *MemoryStorage) UnhashedItems(ctx context.Context, afterID int64, limit int) ([]*Item, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ret []*Item
+	for _, it := range s.items {
+		if limit >= 0 && len(ret) >= limit {
+			break
+		}
+		if !it.hashed && it.id > afterID && it.thumbnail != "" {
+			ret = append(ret, &Item{ID: it.id, Thumbnail: it.thumbnail})
+		}
+	}
+	return ret, nil
+}
+
+func (s *MemoryStorage) UpdateItem(ctx context.Context, item *Item) ([]*Item, error) {
+	metaBytes, err := json.Marshal(item.Meta)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.topicsByID[item.TopicID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	targets := s.originItems(t.id, item.OriginKey, false)
+	if len(targets) == 0 {
+		return nil, ErrNotFound
+	}
+	ret := make([]*Item, len(targets))
+	for i, it := range targets {
+		if it.thumbnail != item.Thumbnail {
+			it.phash, it.hashed = nil, false
+		}
+		it.caption = item.Caption
+		it.thumbnail = item.Thumbnail
+		it.metaBytes = metaBytes
+		it.meta = nil
+		json.Unmarshal(metaBytes, &it.meta)
+		it.tags, _ = s.resolveTags(item.Tags)
+		ret[i] = s.toItem(it, "")
+	}
+	return ret, nil
+}
+
+func (s *MemoryStorage) DeleteItem(ctx context.Context, topicKey string, originKey int64, tombstone *Tombstone) ([]*Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.topics[topicKey]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	targets := s.originItems(t.id, originKey, tombstone == nil)
+	if len(targets) == 0 {
+		return nil, ErrNotFound
+	}
+	ret := make([]*Item, len(targets))
+	for i, it := range targets {
+		if tombstone != nil {
+			// in precision of SQLiteStorage
+			it.deleted = &Tombstone{At: common.FromTimestamp(common.Timestamp(tombstone.At)), Reason: tombstone.Reason}
+		}
+		ret[i] = s.toItem(it, "")
+	}
+	if tombstone == nil {
+		s.deleteItems(func(it *memItem) bool {
+			return it.topicID == t.id && it.originKey == originKey
+		}, -1)
+	}
+	return ret, nil
+}
+
+// Items of the topic which have the origin key, in descending order of ID.
+func (s *MemoryStorage) originItems(topicID int, originKey int64, includeDeleted bool) []*memItem {
+	var ret []*memItem
+	for i := len(s.items) - 1; i >= 0; i-- {
+		it := s.items[i]
+		if it.topicID == topicID && it.originKey == originKey && (includeDeleted || it.deleted == nil) {
+			ret = append(ret, it)
+		}
+	}
+	return ret
+}
+
+// Query evaluated on memItem, consistent with conditionTerms.
+type memMatcher struct {
+	s           *MemoryStorage
+	q           *Query
+	topics      map[int]bool // nil for all topics
+	tags        [][]int64    // canonical IDs of each of Query.Tags
+	anyTags     []int64
+	excludeTags []int64
+	filterTags  map[int][]int64 // by index of filter terms
+	after       int64
+	before      int64
+}
+
+// Build matcher of q, nil if no topic is matched. Should be called with s.mu locked.
+func (s *MemoryStorage) matcher(q *Query) *memMatcher {
+	m := &memMatcher{s: s, q: q, filterTags: make(map[int][]int64)}
+	if len(q.Topics) > 0 {
+		keys := make([]string, 0, len(s.topics))
+		for k := range s.topics {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		resolved, ok := resolveTopics(q.Topics, keys)
+		if !ok {
+			return nil
+		}
+		m.topics = make(map[int]bool)
+		for _, k := range resolved {
+			if t, ok := s.topics[k]; ok {
+				m.topics[t.id] = true
+			}
+		}
+	}
+	for _, t := range NormalizeTags(q.Tags) {
+		m.tags = append(m.tags, s.canonicalIDs([]string{t}))
+	}
+	m.anyTags = s.canonicalIDs(NormalizeTags(q.AnyTags))
+	m.excludeTags = s.canonicalIDs(NormalizeTags(q.ExcludeTags))
+	if q.Filter != nil {
+		for i := range q.Filter.terms {
+			if t := &q.Filter.terms[i]; t.kind == filterTag {
+				m.filterTags[i] = s.canonicalIDs(t.tags)
+			}
+		}
+	}
+	if !q.After.IsZero() {
+		m.after = q.After.UnixNano() / int64(time.Millisecond)
+	}
+	if !q.Before.IsZero() {
+		m.before = q.Before.UnixNano() / int64(time.Millisecond)
+	}
+	return m
+}
+
+func (m *memMatcher) match(it *memItem) bool {
+	q, s := m.q, m.s
+	if m.topics != nil && !m.topics[it.topicID] {
+		return false
+	}
+	if len(q.Origins) > 0 && !containsString(q.Origins, s.originNames[s.topicsByID[it.topicID].originID]) {
+		return false
+	}
+	for i := range q.Meta {
+		if !q.Meta[i].Match(it.meta) {
+			return false
+		}
+	}
+	if q.Filter != nil {
+		for i := range q.Filter.terms {
+			if m.matchTerm(i, it) == q.Filter.terms[i].negate {
+				return false
+			}
+		}
+	}
+	for _, ids := range m.tags {
+		if !hasAnyInt64(it.tags, ids) {
+			return false
+		}
+	}
+	if len(q.AnyTags) > 0 && !hasAnyInt64(it.tags, m.anyTags) {
+		return false
+	}
+	if hasAnyInt64(it.tags, m.excludeTags) {
+		return false
+	}
+	if (!q.After.IsZero() && it.timestamp < m.after) || (!q.Before.IsZero() && it.timestamp > m.before) {
+		return false
+	}
+	if (q.MinID > 0 && it.id < int64(q.MinID)) || (q.MaxID > 0 && it.id > int64(q.MaxID)) {
+		return false
+	}
+	if q.Starred && !m.starred(it.id) {
+		return false
+	}
+	if q.Unread && it.id <= s.markers[q.User][it.topicID] {
+		return false
+	}
+	if q.readUpTo > 0 && it.id <= q.readUpTo {
+		return false
+	}
+	if q.SimilarTo != nil && (it.phash == nil || it.phash.Distance(*q.SimilarTo) > q.MaxDistance) {
+		return false
+	}
+	if q.User != "" && !q.ShowHidden {
+		if f, ok := s.states[q.User][it.id]; ok && f.hidden {
+			return false
+		}
+	}
+	if !q.ShowDeleted && it.deleted != nil {
+		return false
+	}
+	return true
+}
+
+func (m *memMatcher) matchTerm(i int, it *memItem) bool {
+	t := &m.q.Filter.terms[i]
+	switch t.kind {
+	case filterCaption:
+		return t.caption.MatchString(it.caption)
+	case filterOrigin:
+		return containsString(t.origins, m.s.originNames[m.s.topicsByID[it.topicID].originID])
+	case filterTag:
+		return hasAnyInt64(it.tags, m.filterTags[i])
+	default:
+		return t.meta.Match(it.meta)
+	}
+}
+
+// Starred by Query.User, or by anyone if User is empty.
+func (m *memMatcher) starred(id int64) bool {
+	if m.q.User != "" {
+		f, ok := m.s.states[m.q.User][id]
+		return ok && f.starred
+	}
+	for _, states := range m.s.states {
+		if f, ok := states[id]; ok && f.starred {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt64(ns []int64, n int64) bool {
+	for _, v := range ns {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyInt64(ns []int64, want []int64) bool {
+	for _, n := range want {
+		if containsInt64(ns, n) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,315 @@
+package timeline
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	// Page size of merged feed when Query.Limit is not given.
+	DefaultMergeLimit = 50
+	ErrInvalidCursor  = errors.New("Invalid cursor")
+	ErrMergeOffset    = errors.New("Offset is not supported in merged feed, use Cursor")
+)
+
+// Merged feed of several topics. Topics take turns by smooth weighted round-robin
+// instead of being ordered by time, so that a chatty topic doesn't drown out the others.
+// Items of each topic are in descending order of ID.
+type MergeQuery struct {
+	// Topics, filters and per-user state of items, all active topics except saved searches if Topics is empty.
+	// Limit is the page size, and Offset is not supported.
+	Query *Query
+	// The first matched weight is applied, other topics have weight 1.
+	// A topic of weight 3 appears 3 times as often as a topic of weight 1, equal weights make round-robin.
+	Weights []TopicWeight
+	// MergedPage.Next of the previous page, empty for the first page.
+	Cursor string
+	// Fold consecutive items of a topic which have the same value of Meta field, such as "user".
+	// Up to MaxBurst items of a run are kept, and the rest are folded into the last kept one.
+	BurstField string
+	MaxBurst   int // 1 if not given
+}
+
+type TopicWeight struct {
+	Pattern TopicPattern
+	Weight  int
+}
+
+type MergedPage struct {
+	Items []*Item `json:"items"`
+	// Cursor of the next page, empty at the end.
+	// Pages are stable, items published after the first page are not included.
+	Next string `json:"next,omitempty"`
+}
+
+func (mq *MergeQuery) Validate() error {
+	for _, w := range mq.Weights {
+		if w.Weight <= 0 {
+			return fmt.Errorf("Weight must be positive: %s", w.Pattern)
+		}
+	}
+	if mq.MaxBurst < 0 {
+		return fmt.Errorf("Negative MaxBurst: %d", mq.MaxBurst)
+	}
+	if mq.Query == nil {
+		return nil
+	}
+	if mq.Query.Offset > 0 {
+		return ErrMergeOffset
+	}
+	return mq.Query.Validate()
+}
+
+func (mq *MergeQuery) weightOf(key string) int {
+	for _, w := range mq.Weights {
+		if w.Pattern.Match(key) {
+			return w.Weight
+		}
+	}
+	return 1
+}
+
+func (mq *MergeQuery) maxBurst() int {
+	if mq.MaxBurst == 0 {
+		return 1
+	}
+	return mq.MaxBurst
+}
+
+// Position in the merged feed, serialized into MergedPage.Next.
+type mergeCursor struct {
+	// Items newer than Snapshot are excluded to keep pages stable.
+	Snapshot int64                  `json:"s"`
+	Sources  map[string]*mergeState `json:"t,omitempty"`
+}
+
+// Position of a topic. Topics not in the cursor start from the Snapshot.
+type mergeState struct {
+	Last   int64  `json:"l,omitempty"` // ID of the last consumed item
+	Credit int    `json:"c,omitempty"` // current weight of round-robin
+	Run    string `json:"r,omitempty"` // burst key of the last item, and length of its run
+	RunLen int    `json:"n,omitempty"`
+	Done   bool   `json:"d,omitempty"`
+}
+
+func decodeCursor(s string) (*mergeCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c mergeCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Snapshot <= 0 {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+func (c *mergeCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+type mergeSource struct {
+	key    string
+	weight int
+	state  *mergeState
+	buf    []*Item
+	more   bool  // Storage may have items after buf
+	kept   *Item // the last kept item of the run in this page
+}
+
+// Fetch merged feed page by page, see MergeQuery.
+func (s *Service) FetchMerged(ctx context.Context, mq *MergeQuery) (*MergedPage, error) {
+	if err := mq.Validate(); err != nil {
+		return nil, err
+	}
+	base := &Query{}
+	if mq.Query != nil {
+		copied := *mq.Query
+		base = &copied
+	}
+	if base.Limit <= 0 {
+		base.Limit = DefaultMergeLimit
+	}
+	collapse := base.Collapse
+	base.Collapse = false
+	cursor := &mergeCursor{}
+	if mq.Cursor != "" {
+		var err error
+		if cursor, err = decodeCursor(mq.Cursor); err != nil {
+			return nil, err
+		}
+	} else {
+		newest, err := s.persistent.Select(ctx, &Query{Limit: 1})
+		if err != nil {
+			return nil, err
+		}
+		if len(newest) == 0 {
+			return &MergedPage{Items: []*Item{}}, nil
+		}
+		cursor.Snapshot = newest[0].ID
+		if base.MaxID > 0 && int64(base.MaxID) < cursor.Snapshot {
+			cursor.Snapshot = int64(base.MaxID)
+		}
+	}
+	var sources []*mergeSource
+	for _, key := range s.mergeKeys(base) {
+		st, ok := cursor.Sources[key]
+		if !ok {
+			st = &mergeState{}
+		}
+		sources = append(sources, &mergeSource{key: key, weight: mq.weightOf(key), state: st, more: !st.Done})
+	}
+
+	items := []*Item{}
+	for len(items) < base.Limit {
+		var best *mergeSource
+		total := 0
+		for _, src := range sources {
+			if src.state.Done {
+				continue
+			}
+			src.state.Credit += src.weight
+			total += src.weight
+			if best == nil || src.state.Credit > best.state.Credit {
+				best = src
+			}
+		}
+		if best == nil {
+			break
+		}
+		best.state.Credit -= total
+		it, err := s.nextMerged(ctx, best, base, cursor.Snapshot, mq)
+		if err != nil {
+			return nil, err
+		}
+		if it == nil {
+			// give back the turn of the exhausted topic
+			for _, src := range sources {
+				if !src.state.Done {
+					src.state.Credit -= src.weight
+				}
+			}
+			best.state.Credit, best.state.Done = 0, true
+			continue
+		}
+		items = append(items, it)
+	}
+
+	page := &MergedPage{Items: items}
+	if collapse {
+		page.Items = collapseDuplicates(items, base.CollapseDistance)
+	}
+	next := &mergeCursor{Snapshot: cursor.Snapshot, Sources: make(map[string]*mergeState)}
+	var remaining bool
+	for _, src := range sources {
+		if len(src.buf) == 0 && !src.more {
+			src.state.Done = true
+		}
+		remaining = remaining || !src.state.Done
+		next.Sources[src.key] = src.state
+	}
+	if remaining {
+		page.Next = next.encode()
+	}
+	return page, nil
+}
+
+// Keys of topics merged by FetchMerged, in sorted order.
+func (s *Service) mergeKeys(q *Query) []string {
+	s.topicsMu.RLock()
+	defer s.topicsMu.RUnlock()
+	var ret []string
+	if len(q.Topics) == 0 {
+		for _, k := range s.topicKeys {
+			if t := s.topics[k]; !t.Archived && t.search == nil {
+				ret = append(ret, k)
+			}
+		}
+		return ret
+	}
+	keys, _ := resolveTopics(q.Topics, s.topicKeys)
+	for _, k := range s.topicKeys {
+		if containsString(keys, k) {
+			ret = append(ret, k)
+		}
+	}
+	return ret
+}
+
+// Next item of the topic which is not folded, nil if the topic has no more items.
+func (s *Service) nextMerged(ctx context.Context, src *mergeSource, base *Query, snapshot int64, mq *MergeQuery) (*Item, error) {
+	for {
+		if len(src.buf) == 0 {
+			if !src.more {
+				return nil, nil
+			}
+			if err := s.fillMerged(ctx, src, base, snapshot); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		it := src.buf[0]
+		src.buf = src.buf[1:]
+		src.state.Last = it.ID
+		if mq.BurstField == "" {
+			return it, nil
+		}
+		key := burstKey(it, mq.BurstField)
+		if key == "" || key != src.state.Run {
+			src.state.Run, src.state.RunLen = key, 1
+			src.kept = it
+			return it, nil
+		}
+		src.state.RunLen++
+		if src.state.RunLen <= mq.maxBurst() {
+			src.kept = it
+			return it, nil
+		}
+		// the kept item may be in the previous page
+		if src.kept != nil {
+			src.kept.Folded = append(src.kept.Folded, it.ID)
+		}
+	}
+}
+
+func (s *Service) fillMerged(ctx context.Context, src *mergeSource, base *Query, snapshot int64) error {
+	maxID := snapshot
+	if src.state.Last > 0 {
+		maxID = src.state.Last - 1
+	}
+	if maxID <= 0 || (base.MinID > 0 && maxID < int64(base.MinID)) {
+		src.more = false
+		return nil
+	}
+	q := *base
+	q.Topics = []string{src.key}
+	// MaxID also makes the order descending by ID
+	q.MaxID = int(maxID)
+	// one more item tells whether the topic has items after this chunk
+	q.Limit = base.Limit + 1
+	s.topicsMu.RLock()
+	plan := s.planFetch(&q)
+	s.topicsMu.RUnlock()
+	items, err := s.runFetch(ctx, &q, plan)
+	if err != nil {
+		return err
+	}
+	src.more = len(items) > base.Limit
+	if src.more {
+		items = items[:base.Limit]
+	}
+	src.buf = items
+	return nil
+}
+
+func burstKey(it *Item, field string) string {
+	v, ok := lookupMeta(it.Meta, field)
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,90 @@
+package timeline
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchMerged(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("pixiv.ranking", "/m/pixiv"))
+	a.NoError(s.NewTopic("twitter.tweet", "/m/twitter"))
+	for i := 1; i <= 3; i++ {
+		a.NoError(s.Publish("/m/pixiv", &Item{Caption: fmt.Sprintf("p%d", i), OriginKey: int64(i)}))
+	}
+	for i := 1; i <= 10; i++ {
+		a.NoError(s.Publish("/m/twitter", &Item{Caption: fmt.Sprintf("t%d", i), OriginKey: int64(100 + i)}))
+	}
+
+	// round-robin, and ties are given to the first topic in order of keys
+	q := &Query{Topics: []string{"/m/**"}, Limit: 4}
+	page, err := s.FetchMerged(ctx, &MergeQuery{Query: q})
+	a.NoError(err)
+	a.Equal([]string{"p3", "t10", "p2", "t9"}, captions(page.Items))
+	a.NotEmpty(page.Next)
+
+	// items published after the first page are not included
+	a.NoError(s.Publish("/m/pixiv", &Item{Caption: "p4", OriginKey: 4}))
+	page, err = s.FetchMerged(ctx, &MergeQuery{Query: q, Cursor: page.Next})
+	a.NoError(err)
+	a.Equal([]string{"p1", "t8", "t7", "t6"}, captions(page.Items))
+	var rest []string
+	for page.Next != "" {
+		page, err = s.FetchMerged(ctx, &MergeQuery{Query: q, Cursor: page.Next})
+		a.NoError(err)
+		rest = append(rest, captions(page.Items)...)
+	}
+	a.Equal([]string{"t5", "t4", "t3", "t2", "t1"}, rest)
+
+	// weighted
+	page, err = s.FetchMerged(ctx, &MergeQuery{
+		Query:   q,
+		Weights: []TopicWeight{{Pattern: ParsePattern("/m/twitter"), Weight: 3}},
+	})
+	a.NoError(err)
+	a.Equal([]string{"t10", "p4", "t9", "t8"}, captions(page.Items))
+
+	_, err = s.FetchMerged(ctx, &MergeQuery{Query: q, Cursor: "broken"})
+	a.Equal(ErrInvalidCursor, err)
+	_, err = s.FetchMerged(ctx, &MergeQuery{Query: &Query{Offset: 10}})
+	a.Equal(ErrMergeOffset, err)
+	_, err = s.FetchMerged(ctx, &MergeQuery{Weights: []TopicWeight{{Pattern: ParsePattern("/m/**")}}})
+	a.Error(err)
+}
+
+func TestFetchMergedBurst(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("twitter.tweet", "/m/list"))
+	for i, user := range []string{"a", "a", "a", "b", "a", "a"} {
+		a.NoError(s.Publish("/m/list", &Item{
+			Caption:   fmt.Sprintf("%s%d", user, i),
+			OriginKey: int64(i),
+			Meta:      map[string]interface{}{"user": user},
+		}))
+	}
+	mq := &MergeQuery{Query: &Query{Topics: []string{"/m/list"}, Limit: 2}, BurstField: "user"}
+	page, err := s.FetchMerged(ctx, mq)
+	a.NoError(err)
+	a.Equal([]string{"a5", "b3"}, captions(page.Items))
+	a.Equal([]int64{page.Items[0].ID - 1}, page.Items[0].Folded)
+
+	mq.Cursor = page.Next
+	page, err = s.FetchMerged(ctx, mq)
+	a.NoError(err)
+	a.Equal([]string{"a2"}, captions(page.Items))
+	a.Len(page.Items[0].Folded, 2)
+	a.Empty(page.Next)
+
+	mq.Cursor, mq.MaxBurst = "", 2
+	mq.Query.Limit = 10
+	page, err = s.FetchMerged(ctx, mq)
+	a.NoError(err)
+	a.Equal([]string{"a5", "a4", "b3", "a2", "a1"}, captions(page.Items))
+}
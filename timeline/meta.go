@@ -0,0 +1,229 @@
+package timeline
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type MetaOp int
+
+const (
+	MetaOpEq MetaOp = iota
+	MetaOpIn
+	MetaOpExists
+	MetaOpGt
+	MetaOpGte
+	MetaOpLt
+	MetaOpLte
+)
+
+var identPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Predicate on a field of Item.Meta.
+// Field is a dot separated path, "user" matches meta["user"],
+// "user.name" matches meta["user"]["name"].
+type MetaPredicate struct {
+	Field  string
+	Op     MetaOp
+	Values []interface{}
+}
+
+func MetaEq(field string, v interface{}) MetaPredicate {
+	return MetaPredicate{Field: field, Op: MetaOpEq, Values: []interface{}{v}}
+}
+
+func MetaIn(field string, vs ...interface{}) MetaPredicate {
+	return MetaPredicate{Field: field, Op: MetaOpIn, Values: vs}
+}
+
+func MetaExists(field string) MetaPredicate {
+	return MetaPredicate{Field: field, Op: MetaOpExists}
+}
+
+func MetaGt(field string, v float64) MetaPredicate {
+	return MetaPredicate{Field: field, Op: MetaOpGt, Values: []interface{}{v}}
+}
+
+func MetaGte(field string, v float64) MetaPredicate {
+	return MetaPredicate{Field: field, Op: MetaOpGte, Values: []interface{}{v}}
+}
+
+func MetaLt(field string, v float64) MetaPredicate {
+	return MetaPredicate{Field: field, Op: MetaOpLt, Values: []interface{}{v}}
+}
+
+func MetaLte(field string, v float64) MetaPredicate {
+	return MetaPredicate{Field: field, Op: MetaOpLte, Values: []interface{}{v}}
+}
+
+// JSON path for json_extract, such as `$.user.name`
+func (p *MetaPredicate) jsonPath() string {
+	segs := strings.Split(p.Field, ".")
+	for i, s := range segs {
+		if !identPattern.MatchString(s) {
+			segs[i] = fmt.Sprintf("%q", s)
+		}
+	}
+	return "$." + strings.Join(segs, ".")
+}
+
+func (p *MetaPredicate) Validate() error {
+	if len(p.Field) == 0 {
+		return fmt.Errorf("Empty meta field")
+	}
+	switch p.Op {
+	case MetaOpEq, MetaOpGt, MetaOpGte, MetaOpLt, MetaOpLte:
+		if len(p.Values) != 1 {
+			return fmt.Errorf("Meta %s: operator requires exactly one value", p.Field)
+		}
+	case MetaOpIn:
+		if len(p.Values) == 0 {
+			return fmt.Errorf("Meta %s: IN requires at least one value", p.Field)
+		}
+	case MetaOpExists:
+	default:
+		return fmt.Errorf("Meta %s: unknown operator %d", p.Field, p.Op)
+	}
+	return nil
+}
+
+var metaCompareOps = map[MetaOp]string{
+	MetaOpGt:  ">",
+	MetaOpGte: ">=",
+	MetaOpLt:  "<",
+	MetaOpLte: "<=",
+}
+
+// Build SQL term, predicate should be validated.
+func (p *MetaPredicate) toTerm() (string, []interface{}) {
+	path := p.jsonPath()
+	extract := "json_extract(timeline.meta, ?)"
+	switch p.Op {
+	case MetaOpEq:
+		return extract + " = ?", []interface{}{path, p.Values[0]}
+	case MetaOpIn:
+		placeholders := make([]string, len(p.Values))
+		params := []interface{}{path}
+		for i, v := range p.Values {
+			placeholders[i] = "?"
+			params = append(params, v)
+		}
+		return fmt.Sprintf("%s IN (%s)", extract, strings.Join(placeholders, ", ")), params
+	case MetaOpExists:
+		return "json_type(timeline.meta, ?) IS NOT NULL", []interface{}{path}
+	default:
+		return fmt.Sprintf("CAST(%s AS REAL) %s ?", extract, metaCompareOps[p.Op]), []interface{}{path, p.Values[0]}
+	}
+}
+
+// Evaluate predicate in memory, consistent with SQL version.
+func (p *MetaPredicate) Match(meta map[string]interface{}) bool {
+	v, ok := lookupMeta(meta, p.Field)
+	if !ok {
+		return false
+	}
+	switch p.Op {
+	case MetaOpExists:
+		return true
+	case MetaOpEq:
+		return scalarEqual(v, p.Values[0])
+	case MetaOpIn:
+		for _, pv := range p.Values {
+			if scalarEqual(v, pv) {
+				return true
+			}
+		}
+		return false
+	default:
+		// JSON null is NULL in SQL, which is not comparable
+		f, ok := castReal(v)
+		if !ok {
+			return false
+		}
+		c, _ := toFloat(p.Values[0])
+		switch p.Op {
+		case MetaOpGt:
+			return f > c
+		case MetaOpGte:
+			return f >= c
+		case MetaOpLt:
+			return f < c
+		default:
+			return f <= c
+		}
+	}
+}
+
+func lookupMeta(meta map[string]interface{}, field string) (interface{}, bool) {
+	var cur interface{} = meta
+	for _, seg := range strings.Split(field, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		cur, ok = m[seg]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case bool:
+		// JSON boolean is extracted as 1 or 0 in SQLite
+		if n {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// Leading number of a string, which is converted by CAST in SQLite.
+var leadingReal = regexp.MustCompile(`^\s*[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?`)
+
+// Value as CAST(... AS REAL) in SQL, false for JSON null.
+// Strings are converted by leading number, and other non numeric values are regarded as 0.
+func castReal(v interface{}) (float64, bool) {
+	if v == nil {
+		return 0, false
+	}
+	if str, ok := v.(string); ok {
+		f, _ := strconv.ParseFloat(strings.TrimSpace(leadingReal.FindString(str)), 64)
+		return f, true
+	}
+	f, _ := toFloat(v)
+	return f, true
+}
+
+func scalarEqual(a, b interface{}) bool {
+	fa, aNum := toFloat(a)
+	fb, bNum := toFloat(b)
+	if aNum || bNum {
+		return aNum && bNum && fa == fb
+	}
+	sa, aStr := a.(string)
+	sb, bStr := b.(string)
+	return aStr && bStr && sa == sb
+}
@@ -0,0 +1,135 @@
+package timeline
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Schema changes for databases created by older versions.
+// Each migration should be idempotent.
+var sqliteMigrations = []func(ctx context.Context, db *sql.DB) error{
+	fixTimelineForeignKey,
+	addTopicInfoColumns,
+	addItemHashColumns,
+	addItemDeletedColumns,
+}
+
+func migrateSQLite(ctx context.Context, db *sql.DB) error {
+	for _, m := range sqliteMigrations {
+		if err := m(ctx, db); err != nil {
+			return fmt.Errorf("Migration failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func sqliteColumns(ctx context.Context, db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		ret[name] = true
+	}
+	return ret, rows.Err()
+}
+
+// Add columns in order, if missing. columns are pairs of name and definition.
+func addSQLiteColumns(ctx context.Context, db *sql.DB, table string, columns [][2]string) error {
+	existing, err := sqliteColumns(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	for _, c := range columns {
+		if existing[c[0]] {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, c[0], c[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeline.topic_id referred timeline(id) instead of topic(id),
+// which rejects deleting items. SQLite cannot alter constraints, so the table is rebuilt.
+func fixTimelineForeignKey(ctx context.Context, db *sql.DB) error {
+	var ddl string
+	row := db.QueryRowContext(ctx, `SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'timeline'`)
+	if err := row.Scan(&ddl); err != nil {
+		return err
+	}
+	if !strings.Contains(ddl, "REFERENCES timeline(id)") {
+		return nil
+	}
+	// foreign_keys pragma is per connection, and no-op inside transaction.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON`)
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		fmt.Sprintf(sqliteTimelineDDL, "timeline_migrating"),
+		`INSERT INTO timeline_migrating(id, topic_id, caption, thumbnail, origin_key, timestamp, meta)
+			SELECT id, topic_id, caption, thumbnail, origin_key, timestamp, meta FROM timeline`,
+		`DROP TABLE timeline`,
+		`ALTER TABLE timeline_migrating RENAME TO timeline`,
+	}
+	// indexes are dropped with the old table
+	statements = append(statements, sqliteTimelineIndexDDLs...)
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func addTopicInfoColumns(ctx context.Context, db *sql.DB) error {
+	return addSQLiteColumns(ctx, db, "topic", [][2]string{
+		{"title", "TEXT NOT NULL DEFAULT ''"},
+		{"description", "TEXT NOT NULL DEFAULT ''"},
+		{"icon_url", "TEXT NOT NULL DEFAULT ''"},
+		{"created_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"module", "TEXT NOT NULL DEFAULT ''"},
+		{"archived", "INTEGER NOT NULL DEFAULT 0"},
+	})
+}
+
+func addItemHashColumns(ctx context.Context, db *sql.DB) error {
+	err := addSQLiteColumns(ctx, db, "timeline", [][2]string{
+		{"phash", "INTEGER"},
+		{"phash_at", "INTEGER"},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS timeline_phash_pending ON timeline(id) WHERE phash_at IS NULL`)
+	return err
+}
+
+func addItemDeletedColumns(ctx context.Context, db *sql.DB) error {
+	return addSQLiteColumns(ctx, db, "timeline", [][2]string{
+		{"deleted_at", "INTEGER"},
+		{"deleted_reason", "TEXT NOT NULL DEFAULT ''"},
+	})
+}
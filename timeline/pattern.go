@@ -0,0 +1,148 @@
+package timeline
+
+import (
+	"path"
+	"strings"
+)
+
+// TopicPattern selects topics by key.
+//
+// Each entry is a key or a glob, separated by whitespace or comma,
+// and entries with "!" prefix excludes matched topics.
+//   /pixiv/ranking/** !/pixiv/ranking/*_r18
+// Glob is matched for each path segment, "*" matches within a segment,
+// and "**" matches any number of segments.
+// Entry without wildcard matches the topic exactly, as in Query.Topics,
+// so subtree of a topic is selected by "/key/**".
+type TopicPattern struct {
+	Include []string
+	Exclude []string
+}
+
+func ParsePattern(s string) TopicPattern {
+	var p TopicPattern
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	for _, f := range fields {
+		if strings.HasPrefix(f, "!") {
+			p.Exclude = append(p.Exclude, f[1:])
+		} else {
+			p.Include = append(p.Include, f)
+		}
+	}
+	return p
+}
+
+// Match all topics if Include is empty.
+func (p TopicPattern) Match(key string) bool {
+	included := len(p.Include) == 0
+	for _, inc := range p.Include {
+		if matchEntry(inc, key) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, exc := range p.Exclude {
+		if matchEntry(exc, key) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p TopicPattern) IsGlob() bool {
+	for _, e := range p.Include {
+		if isGlob(e) {
+			return true
+		}
+	}
+	for _, e := range p.Exclude {
+		if isGlob(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p TopicPattern) String() string {
+	entries := make([]string, 0, len(p.Include)+len(p.Exclude))
+	entries = append(entries, p.Include...)
+	for _, e := range p.Exclude {
+		entries = append(entries, "!"+e)
+	}
+	return strings.Join(entries, " ")
+}
+
+func isGlob(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+func matchEntry(entry, key string) bool {
+	if isGlob(entry) {
+		return matchGlob(entry, key)
+	}
+	return entry == key
+}
+
+func matchGlob(pattern, key string) bool {
+	return matchSegments(
+		strings.Split(strings.Trim(pattern, "/"), "/"),
+		strings.Split(strings.Trim(key, "/"), "/"),
+	)
+}
+
+func matchSegments(ps, ks []string) bool {
+	for len(ps) > 0 {
+		if ps[0] == "**" {
+			for i := 0; i <= len(ks); i++ {
+				if matchSegments(ps[1:], ks[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(ks) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(ps[0], ks[0]); !ok {
+			return false
+		}
+		ps, ks = ps[1:], ks[1:]
+	}
+	return len(ks) == 0
+}
+
+// Resolve Query.Topics to concrete keys.
+// Returns false if patterns are given but no topic is matched.
+func resolveTopics(entries []string, keys []string) ([]string, bool) {
+	hasPattern := false
+	for _, e := range entries {
+		if isGlob(e) || strings.HasPrefix(e, "!") {
+			hasPattern = true
+			break
+		}
+	}
+	if !hasPattern {
+		return entries, true
+	}
+	// entries are already split, keys may contain separators of ParsePattern
+	var p TopicPattern
+	for _, e := range entries {
+		if strings.HasPrefix(e, "!") {
+			p.Exclude = append(p.Exclude, e[1:])
+		} else {
+			p.Include = append(p.Include, e)
+		}
+	}
+	var ret []string
+	for _, key := range keys {
+		if p.Match(key) {
+			ret = append(ret, key)
+		}
+	}
+	return ret, len(ret) > 0
+}
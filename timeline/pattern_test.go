@@ -0,0 +1,68 @@
+package timeline
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicPatternMatch(t *testing.T) {
+	a := assert.New(t)
+	testPairs := []struct {
+		pattern string
+		key     string
+		matched bool
+	}{
+		// plain key
+		{"/twitter/list", "/twitter/list", true},
+		{"/twitter/list", "/twitter/listening", false},
+		{"/twitter/list", "/twitter/list/foo", false},
+		{"", "/anything", true},
+		// glob
+		{"/twitter/list/*", "/twitter/listening", false},
+		{"/twitter/list/*", "/twitter/list/foo", true},
+		{"/twitter/list/*", "/twitter/list/foo/bar", false},
+		{"/twitter/list/*/*", "/twitter/list/foo/bar", true},
+		{"/twitter/list/**", "/twitter/list/foo/bar", true},
+		{"/twitter/list/**", "/twitter/list", true},
+		{"/twitter/list/**", "/twitter/listening/foo", false},
+		{"/**/daily", "/pixiv/ranking/daily", true},
+		{"/**/daily", "/pixiv/ranking/daily_r18", false},
+		{"/pixiv/ranking/daily*", "/pixiv/ranking/daily_r18", true},
+		// multiple and exclude
+		{"/pixiv/ranking/** !/pixiv/ranking/*_r18", "/pixiv/ranking/daily", true},
+		{"/pixiv/ranking/** !/pixiv/ranking/*_r18", "/pixiv/ranking/daily_r18", false},
+		{"/pixiv/**,/tumblr/**", "/tumblr/dashboard", true},
+		{"!/pixiv/**", "/tumblr/dashboard", true},
+		{"!/pixiv/**", "/pixiv/ranking/daily", false},
+		{"!/pixiv", "/pixiv/ranking/daily", true},
+	}
+	for _, pair := range testPairs {
+		a.Equal(pair.matched, ParsePattern(pair.pattern).Match(pair.key), "%q %q", pair.pattern, pair.key)
+	}
+	a.Equal("/pixiv/** !/pixiv/*_r18", ParsePattern("/pixiv/**, !/pixiv/*_r18").String())
+}
+
+func TestResolveTopics(t *testing.T) {
+	a := assert.New(t)
+	keys := []string{"/pixiv/ranking/daily", "/pixiv/ranking/daily_r18", "/twitter/list/a/b", "/twitter/listening"}
+	resolved, ok := resolveTopics([]string{"/pixiv/ranking/daily"}, keys)
+	a.True(ok)
+	a.Equal([]string{"/pixiv/ranking/daily"}, resolved)
+	resolved, ok = resolveTopics([]string{"/pixiv/ranking/*", "!/pixiv/ranking/*_r18", "/twitter/listening"}, keys)
+	a.True(ok)
+	a.Equal([]string{"/pixiv/ranking/daily", "/twitter/listening"}, resolved)
+	resolved, ok = resolveTopics([]string{"/twitter/list/**"}, keys)
+	a.True(ok)
+	a.Equal([]string{"/twitter/list/a/b"}, resolved)
+	_, ok = resolveTopics([]string{"/tumblr/**"}, keys)
+	a.False(ok)
+	// keys containing separators of ParsePattern
+	keys = []string{"/feed/My Blog", "/feed/a,b", "/feed/other"}
+	resolved, ok = resolveTopics([]string{"/feed/My Blog", "/feed/*,*"}, keys)
+	a.True(ok)
+	a.Equal([]string{"/feed/My Blog", "/feed/a,b"}, resolved)
+	resolved, ok = resolveTopics([]string{"/feed/*", "!/feed/My Blog"}, keys)
+	a.True(ok)
+	a.Equal([]string{"/feed/a,b", "/feed/other"}, resolved)
+}
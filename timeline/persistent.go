@@ -1,34 +1,173 @@
 package timeline
 
 import (
+	"container/list"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/kanosaki/dumper/common"
+	"github.com/mattn/go-sqlite3"
 )
 
 var (
 	defaultSelectBufferCap = 32
 	ErrNotFound            = errors.New("Not found")
+	ErrTopicExists         = errors.New("Topic already exists")
 )
 
+// SQLite driver with REGEXP function, used by caption filter, and foreign keys enabled.
+const sqliteDriver = "sqlite3_timeline"
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			// foreign_keys is per connection, enabled for all connections in the pool
+			if _, err := conn.Exec(`PRAGMA foreign_keys = ON`, nil); err != nil {
+				return err
+			}
+			if err := conn.RegisterFunc("hamming", sqliteHamming, true); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("regexp", sqliteRegexp, true)
+		},
+	})
+}
+
+var (
+	// Number of compiled patterns of REGEXP kept, least recently used ones are evicted.
+	RegexpCacheSize = 128
+	regexpCache     = &regexpLRU{entries: make(map[string]*list.Element), order: list.New()}
+)
+
+// Patterns come from clients, so the cache is bounded.
+type regexpLRU struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element // value of element is *regexp.Regexp
+	order   *list.List               // front is most recently used
+}
+
+func (c *regexpLRU) get(pattern string) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[pattern]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[pattern] = c.order.PushFront(re)
+	for c.order.Len() > RegexpCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*regexp.Regexp).String())
+	}
+	return re, nil
+}
+
+// X REGEXP Y is evaluated as regexp(Y, X)
+func sqliteRegexp(pattern, s string) (bool, error) {
+	re, err := regexpCache.get(pattern)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(s), nil
+}
+
+// Returned by Storage.Insert when an item can't be stored, no items of the call are stored.
+type InsertError struct {
+	Index int // in arguments of Insert
+	Item  *Item
+	Err   error
+}
+
+func (e *InsertError) Error() string {
+	return fmt.Sprintf("Inserting item #%d %v failed: %v", e.Index, e.Item, e.Err)
+}
+
+func (e *InsertError) Unwrap() error {
+	return e.Err
+}
+
+// Number of different bits, used by similarity query.
+func sqliteHamming(a, b int64) int {
+	return PHash(a).Distance(PHash(b))
+}
+
 type Storage interface {
+	// Store items in a transaction, and set ID and canonical Tags of items.
+	// Items with zero Timestamp are stored with the current time, which is also set to the items.
+	// Returns ID of the last item. On failure, *InsertError is returned and items are not modified.
 	Insert(ctx context.Context, item ... *Item) (int64, error)
 	Select(ctx context.Context, q *Query) ([]*Item, error)
+	// Count items matched to q for each topic key. Ordering and Limit of q is ignored.
+	CountByTopic(ctx context.Context, q *Query) (map[string]int64, error)
 	OriginID(ctx context.Context, originName string, createIfMissing bool) (int, error)
 	TopicID(ctx context.Context, key string, originID int, createIfMissing bool) (int, error)
+	// Metadata of the topic, ErrNotFound if missing.
+	TopicInfo(ctx context.Context, key string) (TopicInfo, error)
+	UpdateTopicInfo(ctx context.Context, key string, info TopicInfo) error
+	// Change key of the topic, items are kept. ErrTopicExists if newKey is used.
+	RenameTopic(ctx context.Context, oldKey, newKey string) error
+	// Delete the topic and its items, returns number of deleted items.
+	DeleteTopic(ctx context.Context, key string) (int64, error)
+	// Delete at most limit items matched to q, oldest first. Ordering and Limit of q is ignored.
+	// Items matched to any of keep are not deleted, ShowDeleted of q and keep is regarded as true.
+	// Returns number of deleted items.
+	DeleteItems(ctx context.Context, q *Query, keep []*Query, limit int) (int64, error)
+	// Mark items of the topic up to upToID as read by user, or all items if upToID is 0.
+	// Read marker never goes back.
+	MarkRead(ctx context.Context, user, topicKey string, upToID int64) error
+	// Last read item ID for each topic key.
+	ReadMarkers(ctx context.Context, user string) (map[string]int64, error)
+	// ErrNotFound if the item is missing.
+	SetItemFlag(ctx context.Context, user string, itemID int64, flag ItemFlag, value bool) error
+	// Attach tags to the item, returns all tags of the item. ErrNotFound if the item is missing.
+	AddTags(ctx context.Context, itemID int64, tags []string) ([]string, error)
+	// Detach tags from the item, returns remaining tags of the item.
+	RemoveTags(ctx context.Context, itemID int64, tags []string) ([]string, error)
+	// Make alias to be regarded as canonical tag, or remove alias if canonical is empty.
+	SetTagAlias(ctx context.Context, alias, canonical string) error
+	// Canonical tag name for each alias.
+	TagAliases(ctx context.Context) (map[string]string, error)
+	// ID of the item identified by topic, origin key and timestamp. ErrNotFound if missing.
+	FindItem(ctx context.Context, topicKey string, originKey int64, timestamp time.Time) (int64, error)
+	// Count items matched to StatsQuery.Query for each bucket and group, buckets without items are omitted.
+	CountByBucket(ctx context.Context, sq *StatsQuery) ([]BucketCount, error)
+	// Tags of items matched to q, in descending order of count.
+	TagCounts(ctx context.Context, q *Query, limit int) ([]TagCount, error)
+	// Query expression for each key of saved search topics.
+	SavedSearches(ctx context.Context) (map[string]string, error)
+	// Store query expression of the topic, which should exist. Replaces existing one.
+	SaveSearch(ctx context.Context, topicKey, expr string) error
+	// Store perceptual hash of the item, nil hash records a failed attempt. ErrNotFound if missing.
+	SetItemHash(ctx context.Context, itemID int64, hash *PHash) error
+	// Items after afterID which have thumbnail and are not attempted to hash, in ascending order of ID.
+	// Only ID and Thumbnail are filled.
+	UnhashedItems(ctx context.Context, afterID int64, limit int) ([]*Item, error)
+	// Replace caption, thumbnail, meta and tags of items identified by TopicID and OriginKey of item,
+	// except deleted ones. Returns updated items. ErrNotFound if missing.
+	UpdateItem(ctx context.Context, item *Item) ([]*Item, error)
+	// Mark items identified by the topic and origin key as deleted, or remove them if tombstone is nil.
+	// Returns deleted items with Deleted. ErrNotFound if missing, or already marked if tombstone is given.
+	DeleteItem(ctx context.Context, topicKey string, originKey int64, tombstone *Tombstone) ([]*Item, error)
+	// Underlying database, nil if the storage has no database.
 	DB() *sql.DB
 }
 
 func NewStorage(dbType, param string) (Storage, error) {
 	switch dbType {
 	case "sqlite3":
-		s, err := sql.Open("sqlite3", param)
+		s, err := sql.Open(sqliteDriver, param)
 		if err != nil {
 			return nil, err
 		}
@@ -36,11 +175,7 @@ func NewStorage(dbType, param string) (Storage, error) {
 	case "mysql":
 		return nil, nil
 	case "memory":
-		s, err := sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
-		if err != nil {
-			return nil, err
-		}
-		return NewSQLiteStorage(s)
+		return NewMemoryStorage(), nil
 	default:
 		return nil, fmt.Errorf("Unsupoorted dbType: %v", dbType)
 	}
@@ -48,8 +183,9 @@ func NewStorage(dbType, param string) (Storage, error) {
 
 // Column structure is shared between sql dialects.
 type SQLiteStorage struct {
-	db        *sql.DB
-	origins   map[string]int
+	db         *sql.DB
+	insertStmt *sql.Stmt // bound to transactions by Tx.Stmt
+	origins    map[string]int
 	originsMu sync.Mutex
 	topics    map[string]topicMeta
 	topicsMu  sync.Mutex
@@ -105,6 +241,31 @@ func scanTopics(db *sql.DB) (map[string]topicMeta, error) {
 	return ret, nil
 }
 
+// Table name is formatted, to be rebuilt by migration.
+const sqliteTimelineDDL = `
+	CREATE TABLE IF NOT EXISTS %s (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		topic_id INTEGER NOT NULL,
+		caption TEXT NOT NULL,
+		thumbnail TEXT NOT NULL,
+		origin_key INTEGER NOT NULL,
+		timestamp INTEGER NOT NULL,
+		meta BLOB,
+		phash INTEGER,
+		phash_at INTEGER,
+		deleted_at INTEGER,
+		deleted_reason TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(topic_id) REFERENCES topic(id)
+	)`
+
+// Also created again when the table is rebuilt by migration.
+var sqliteTimelineIndexDDLs = []string{
+	`CREATE INDEX IF NOT EXISTS timeline_topic_id ON timeline(topic_id, id)`,
+	`CREATE INDEX IF NOT EXISTS timeline_origin_key ON timeline(topic_id, origin_key)`,
+	// time range of stats and retention in topics
+	`CREATE INDEX IF NOT EXISTS timeline_topic_timestamp ON timeline(topic_id, timestamp)`,
+}
+
 var sqliteInitDDLs = []string{
 	`PRAGMA foreign_keys = ON`,
 	`
@@ -117,18 +278,60 @@ var sqliteInitDDLs = []string{
 		id INTEGER PRIMARY KEY,
 		key TEXT NOT NULL UNIQUE,
 		origin_id INTEGER NOT NULL,
+		title TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		icon_url TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL DEFAULT 0,
+		module TEXT NOT NULL DEFAULT '',
+		archived INTEGER NOT NULL DEFAULT 0,
 		FOREIGN KEY(origin_id) REFERENCES origin(id)
 	)`,
+	fmt.Sprintf(sqliteTimelineDDL, "timeline"),
+	sqliteTimelineIndexDDLs[0],
+	sqliteTimelineIndexDDLs[1],
+	sqliteTimelineIndexDDLs[2],
 	`
-	CREATE TABLE IF NOT EXISTS timeline (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
+	CREATE TABLE IF NOT EXISTS read_marker(
+		user TEXT NOT NULL,
 		topic_id INTEGER NOT NULL,
-		caption TEXT NOT NULL,
-		thumbnail TEXT NOT NULL,
-		origin_key INTEGER NOT NULL,
-		timestamp INTEGER NOT NULL,
-		meta BLOB,
-		FOREIGN KEY(topic_id) REFERENCES timeline(id)
+		last_read_id INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY(user, topic_id),
+		FOREIGN KEY(topic_id) REFERENCES topic(id) ON DELETE CASCADE
+	)`,
+	`
+	CREATE TABLE IF NOT EXISTS item_state(
+		user TEXT NOT NULL,
+		item_id INTEGER NOT NULL,
+		starred INTEGER NOT NULL DEFAULT 0,
+		hidden INTEGER NOT NULL DEFAULT 0,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY(user, item_id),
+		FOREIGN KEY(item_id) REFERENCES timeline(id) ON DELETE CASCADE
+	)`,
+	`CREATE INDEX IF NOT EXISTS item_state_item_id ON item_state(item_id)`,
+	`
+	CREATE TABLE IF NOT EXISTS tag(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		alias_of INTEGER,
+		FOREIGN KEY(alias_of) REFERENCES tag(id)
+	)`,
+	`
+	CREATE TABLE IF NOT EXISTS item_tag(
+		item_id INTEGER NOT NULL,
+		tag_id INTEGER NOT NULL,
+		PRIMARY KEY(item_id, tag_id),
+		FOREIGN KEY(item_id) REFERENCES timeline(id) ON DELETE CASCADE,
+		FOREIGN KEY(tag_id) REFERENCES tag(id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS item_tag_tag_id ON item_tag(tag_id, item_id)`,
+	`
+	CREATE TABLE IF NOT EXISTS saved_search(
+		topic_id INTEGER PRIMARY KEY,
+		query TEXT NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY(topic_id) REFERENCES topic(id) ON DELETE CASCADE
 	)`,
 }
 
@@ -138,9 +341,9 @@ func NewSQLiteStorage(s *sql.DB) (*SQLiteStorage, error) {
 		if err != nil {
 			return nil, err
 		}
-		if err != nil {
-			return nil, err
-		}
+	}
+	if err := migrateSQLite(context.Background(), s); err != nil {
+		return nil, err
 	}
 	originMap, err := scanOrigins(s)
 	if err != nil {
@@ -150,10 +353,15 @@ func NewSQLiteStorage(s *sql.DB) (*SQLiteStorage, error) {
 	if err != nil {
 		return nil, err
 	}
+	insertStmt, err := s.Prepare(`INSERT INTO timeline(topic_id, caption, thumbnail, origin_key, timestamp, meta) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
 	return &SQLiteStorage{
-		db:      s,
-		origins: originMap,
-		topics:  topicMap,
+		db:         s,
+		insertStmt: insertStmt,
+		origins:    originMap,
+		topics:     topicMap,
 	}, nil
 }
 
@@ -192,7 +400,8 @@ func (s *SQLiteStorage) TopicID(ctx context.Context, key string, originID int, c
 		if !createIfMissing {
 			return 0, ErrNotFound
 		}
-		_, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO topic(key, origin_id) VALUES (?, ?)`, key, originID)
+		_, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO topic(key, origin_id, created_at) VALUES (?, ?, ?)`,
+			key, originID, common.Timestamp(time.Now()))
 		if err != nil {
 			return 0, err
 		}
@@ -209,33 +418,199 @@ func (s *SQLiteStorage) TopicID(ctx context.Context, key string, originID int, c
 	return tMeta.ID, nil
 }
 
+func (s *SQLiteStorage) TopicInfo(ctx context.Context, key string) (TopicInfo, error) {
+	var info TopicInfo
+	var createdAt int64
+	row := s.db.QueryRowContext(ctx, `SELECT title, description, icon_url, created_at, module, archived FROM topic WHERE key = ?`, key)
+	err := row.Scan(&info.Title, &info.Description, &info.IconURL, &createdAt, &info.Module, &info.Archived)
+	if err == sql.ErrNoRows {
+		return info, ErrNotFound
+	}
+	if err != nil {
+		return info, err
+	}
+	if createdAt > 0 {
+		info.CreatedAt = common.FromTimestamp(createdAt)
+	}
+	return info, nil
+}
+
+func (s *SQLiteStorage) UpdateTopicInfo(ctx context.Context, key string, info TopicInfo) error {
+	var createdAt int64
+	if !info.CreatedAt.IsZero() {
+		createdAt = common.Timestamp(info.CreatedAt)
+	}
+	r, err := s.db.ExecContext(ctx, `UPDATE topic SET title = ?, description = ?, icon_url = ?, created_at = ?, module = ?, archived = ? WHERE key = ?`,
+		info.Title, info.Description, info.IconURL, createdAt, info.Module, info.Archived, key)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) RenameTopic(ctx context.Context, oldKey, newKey string) error {
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	tMeta, ok := s.topics[oldKey]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok := s.topics[newKey]; ok {
+		return ErrTopicExists
+	}
+	if _, err := s.db.ExecContext(ctx, `UPDATE topic SET key = ? WHERE id = ?`, newKey, tMeta.ID); err != nil {
+		return err
+	}
+	delete(s.topics, oldKey)
+	s.topics[newKey] = tMeta
+	return nil
+}
+
+func (s *SQLiteStorage) DeleteTopic(ctx context.Context, key string) (int64, error) {
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	tMeta, ok := s.topics[key]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	r, err := tx.ExecContext(ctx, `DELETE FROM timeline WHERE topic_id = ?`, tMeta.ID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	deleted, err := r.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM topic WHERE id = ?`, tMeta.ID); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	delete(s.topics, key)
+	return deleted, nil
+}
+
+// Replace topic patterns in q with matched keys, nil if no topic is matched.
+func (s *SQLiteStorage) resolveTopics(q *Query) *Query {
+	if len(q.Topics) == 0 {
+		return q
+	}
+	s.topicsMu.Lock()
+	keys := make([]string, 0, len(s.topics))
+	for k := range s.topics {
+		keys = append(keys, k)
+	}
+	s.topicsMu.Unlock()
+	sort.Strings(keys)
+	topics, ok := resolveTopics(q.Topics, keys)
+	if !ok {
+		return nil
+	}
+	resolved := *q
+	resolved.Topics = topics
+	return &resolved
+}
+
 func (s *SQLiteStorage) Insert(ctx context.Context, item ... *Item) (int64, error) {
-	stmt, err := s.db.PrepareContext(ctx, `INSERT INTO timeline(topic_id, caption, thumbnail, origin_key, timestamp, meta) VALUES (?, ?, ?, ?, ?, ?)`)
+	if len(item) == 0 {
+		return 0, nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, err
 	}
-	var r sql.Result
-	for _, it := range item {
+	stmt := tx.StmtContext(ctx, s.insertStmt)
+	// applied to items after commit
+	ids := make([]int64, len(item))
+	tags := make([][]string, len(item))
+	timestamps := make([]time.Time, len(item))
+	now := time.Now()
+	fail := func(i int, err error) (int64, error) {
+		tx.Rollback()
+		return 0, &InsertError{Index: i, Item: item[i], Err: err}
+	}
+	for i, it := range item {
 		metaBytes, err := json.Marshal(it.Meta)
-		timestamp := it.Timestamp.UnixNano() / int64(time.Millisecond)
-		r, err = stmt.ExecContext(ctx, it.TopicID, it.Caption, it.Thumbnail, it.OriginKey, timestamp, metaBytes)
 		if err != nil {
-			return 0, err
+			return fail(i, err)
 		}
-		if lid, err := r.LastInsertId(); err == nil {
-			it.ID = lid
+		timestamps[i] = insertedTimestamp(it, now)
+		r, err := stmt.ExecContext(ctx, it.TopicID, it.Caption, it.Thumbnail, it.OriginKey, common.Timestamp(timestamps[i]), metaBytes)
+		if err != nil {
+			return fail(i, err)
 		}
+		if ids[i], err = r.LastInsertId(); err != nil {
+			return fail(i, err)
+		}
+		tags[i] = it.Tags
+		if len(it.Tags) > 0 {
+			if tags[i], err = s.insertTags(ctx, tx, ids[i], it.Tags); err != nil {
+				return fail(i, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	for i, it := range item {
+		it.ID = ids[i]
+		it.Tags = tags[i]
+		it.Timestamp = timestamps[i]
 	}
-	return r.LastInsertId()
+	return ids[len(ids)-1], nil
+}
+
+func (s *SQLiteStorage) FindItem(ctx context.Context, topicKey string, originKey int64, timestamp time.Time) (int64, error) {
+	s.topicsMu.Lock()
+	tMeta, ok := s.topics[topicKey]
+	s.topicsMu.Unlock()
+	if !ok {
+		return 0, ErrNotFound
+	}
+	var id int64
+	row := s.db.QueryRowContext(ctx, `SELECT id FROM timeline WHERE topic_id = ? AND origin_key = ? AND timestamp = ? LIMIT 1`,
+		tMeta.ID, originKey, common.Timestamp(timestamp))
+	if err := row.Scan(&id); err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	return id, nil
 }
 
 func (s *SQLiteStorage) Select(ctx context.Context, q *Query) ([]*Item, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	q = s.resolveTopics(q)
+	if q == nil {
+		return nil, nil
+	}
 	where, params, ascend := q.ToWhereClause()
+	var stateColumns, stateJoins string
+	if q.User != "" {
+		stateColumns = `, COALESCE(item_state.starred, 0), COALESCE(item_state.hidden, 0), timeline.id <= COALESCE(read_marker.last_read_id, 0)`
+		stateJoins = `LEFT JOIN item_state on item_state.item_id = timeline.id AND item_state.user = ?
+		LEFT JOIN read_marker on read_marker.topic_id = timeline.topic_id AND read_marker.user = ? `
+		params = append([]interface{}{q.User, q.User}, params...)
+	}
 	query := `SELECT
 		timeline.id, timeline.topic_id, timeline.caption, timeline.thumbnail, timeline.origin_key, timeline.timestamp, timeline.meta,
-		topic.key
-		FROM timeline JOIN topic on timeline.topic_id = topic.id ` + where
-	rows, err := s.db.Query(query, params...)
+		timeline.phash, timeline.deleted_at, timeline.deleted_reason, topic.key, origin.name` + stateColumns + `
+		FROM timeline JOIN topic on timeline.topic_id = topic.id
+		JOIN origin on topic.origin_id = origin.id ` + stateJoins + where
+	rows, err := s.db.QueryContext(ctx, query, params...)
 	if err != nil {
 		return nil, err
 	}
@@ -247,10 +622,18 @@ func (s *SQLiteStorage) Select(ctx context.Context, q *Query) ([]*Item, error) {
 	for rows.Next() {
 		var id, originKey, timestamp int64
 		var topicID int
-		var caption, thumbnail, topicName string
+		var caption, thumbnail, topicName, originName string
 		var metaBytes []byte
 		var meta map[string]interface{}
-		if err := rows.Scan(&id, &topicID, &caption, &thumbnail, &originKey, &timestamp, &metaBytes, &topicName); err != nil {
+		var phash, deletedAt sql.NullInt64
+		var deletedReason string
+		dest := []interface{}{&id, &topicID, &caption, &thumbnail, &originKey, &timestamp, &metaBytes, &phash, &deletedAt, &deletedReason, &topicName, &originName}
+		var state *ItemState
+		if q.User != "" {
+			state = &ItemState{}
+			dest = append(dest, &state.Starred, &state.Hidden, &state.Read)
+		}
+		if err := rows.Scan(dest...); err != nil {
 			return nil, err
 		}
 		if len(metaBytes) > 0 {
@@ -260,6 +643,15 @@ func (s *SQLiteStorage) Select(ctx context.Context, q *Query) ([]*Item, error) {
 			}
 		}
 		json.Unmarshal(metaBytes, &meta)
+		var hash *PHash
+		if phash.Valid {
+			h := PHash(phash.Int64)
+			hash = &h
+		}
+		var tombstone *Tombstone
+		if deletedAt.Valid {
+			tombstone = &Tombstone{At: common.FromTimestamp(deletedAt.Int64), Reason: deletedReason}
+		}
 		ret = append(ret, &Item{
 			ID:        id,
 			Caption:   caption,
@@ -268,12 +660,21 @@ func (s *SQLiteStorage) Select(ctx context.Context, q *Query) ([]*Item, error) {
 			TopicID:   topicID,
 			OriginKey: originKey,
 			TopicKey:  topicName,
+			Origin:    originName,
 			Meta:      meta,
+			PHash:     hash,
+			State:     state,
+			Deleted:   tombstone,
 		})
 	}
 	if rows.Err() != nil {
 		return nil, rows.Err()
 	}
+	// release the connection before loading tags
+	rows.Close()
+	if err := s.loadTags(ctx, ret); err != nil {
+		return nil, err
+	}
 	if ascend {
 		// flip array
 		flipped := make([]*Item, len(ret))
@@ -284,3 +685,112 @@ func (s *SQLiteStorage) Select(ctx context.Context, q *Query) ([]*Item, error) {
 	}
 	return ret, nil
 }
+
+func (s *SQLiteStorage) CountByTopic(ctx context.Context, q *Query) (map[string]int64, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	q = s.resolveTopics(q)
+	if q == nil {
+		return map[string]int64{}, nil
+	}
+	if q.Unread {
+		return s.countUnread(ctx, q)
+	}
+	return s.countByTopic(ctx, q)
+}
+
+// Unread items are counted for each topic by comparing IDs with its read marker,
+// so the range of timeline_topic_id is scanned instead of all items of the topic.
+func (s *SQLiteStorage) countUnread(ctx context.Context, q *Query) (map[string]int64, error) {
+	markers, err := s.ReadMarkers(ctx, q.User)
+	if err != nil {
+		return nil, err
+	}
+	keys := q.Topics
+	if len(keys) == 0 {
+		s.topicsMu.Lock()
+		for k := range s.topics {
+			keys = append(keys, k)
+		}
+		s.topicsMu.Unlock()
+	}
+	ret := make(map[string]int64)
+	for _, key := range keys {
+		tq := *q
+		tq.Topics = []string{key}
+		tq.Unread = false
+		// all items are unread without marker
+		tq.readUpTo = markers[key]
+		counts, err := s.countByTopic(ctx, &tq)
+		if err != nil {
+			return nil, err
+		}
+		for k, n := range counts {
+			ret[k] += n
+		}
+	}
+	return ret, nil
+}
+
+func (s *SQLiteStorage) countByTopic(ctx context.Context, q *Query) (map[string]int64, error) {
+	where, params := q.ToCondition()
+	query := `SELECT topic.key, COUNT(*)
+		FROM timeline JOIN topic on timeline.topic_id = topic.id
+		JOIN origin on topic.origin_id = origin.id ` + where + ` GROUP BY topic.key`
+	rows, err := s.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make(map[string]int64)
+	for rows.Next() {
+		var key string
+		var count int64
+		if err := rows.Scan(&key, &count); err != nil {
+			return nil, err
+		}
+		ret[key] = count
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return ret, nil
+}
+
+func (s *SQLiteStorage) DeleteItems(ctx context.Context, q *Query, keep []*Query, limit int) (int64, error) {
+	if err := q.Validate(); err != nil {
+		return 0, err
+	}
+	q = s.resolveTopics(q.withDeleted())
+	if q == nil {
+		return 0, nil
+	}
+	where, params := q.ToCondition()
+	for _, k := range keep {
+		if err := k.Validate(); err != nil {
+			return 0, err
+		}
+		terms, ps := k.withDeleted().conditionTerms()
+		if len(terms) == 0 {
+			// matches all items
+			return 0, nil
+		}
+		cond := fmt.Sprintf("NOT COALESCE((%s), 0)", strings.Join(terms, " AND "))
+		if where == "" {
+			where = "WHERE " + cond
+		} else {
+			where += " AND " + cond
+		}
+		params = append(params, ps...)
+	}
+	// Deleted in a single statement, so write lock is held only for limit rows.
+	query := `DELETE FROM timeline WHERE id IN (
+		SELECT timeline.id FROM timeline JOIN topic on timeline.topic_id = topic.id
+		JOIN origin on topic.origin_id = origin.id ` + where + ` ORDER BY timeline.id ASC LIMIT ?)`
+	r, err := s.db.ExecContext(ctx, query, append(params, limit)...)
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
@@ -2,6 +2,8 @@ package timeline
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"testing"
 	"time"
@@ -31,6 +33,21 @@ func printTimelines(db Storage) error {
 	return nil
 }
 
+// Storage on private in-memory database, not shared with other tests.
+func newPrivateStorage(t *testing.T) Storage {
+	db, err := sql.Open(sqliteDriver, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each connection has its own database
+	db.SetMaxOpenConns(1)
+	s, err := NewSQLiteStorage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
 func mapOriginKey(items []*Item) []int64 {
 	ret := make([]int64, 0, len(items))
 	for _, item := range items {
@@ -41,11 +58,7 @@ func mapOriginKey(items []*Item) []int64 {
 
 func TestSQLiteStorage(t *testing.T) {
 	a := assert.New(t)
-	db, err := NewStorage("memory", "")
-	if err != nil {
-		t.Error(err)
-		return
-	}
+	db := newPrivateStorage(t)
 	now := time.Now()
 	ctx := context.Background()
 	origin1, err := db.OriginID(ctx, "twitter/timeline/status", true)
@@ -120,3 +133,275 @@ func TestSQLiteStorage(t *testing.T) {
 		a.Equal(pair.originKeys, mapOriginKey(ps), pp.Sprint(pair.query))
 	}
 }
+
+func TestSQLiteStorageMetaQuery(t *testing.T) {
+	a := assert.New(t)
+	db := newPrivateStorage(t)
+	ctx := context.Background()
+	now := time.Now()
+	twitterOrigin, err := db.OriginID(ctx, "meta/twitter", true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	pixivOrigin, err := db.OriginID(ctx, "meta/pixiv", true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	twitterTopic, err := db.TopicID(ctx, "/meta/twitter", twitterOrigin, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	pixivTopic, err := db.TopicID(ctx, "/meta/pixiv", pixivOrigin, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	items := []*Item{
+		{TopicID: twitterTopic, OriginKey: 101, Caption: "A", Timestamp: now, Meta: map[string]interface{}{"user": "foo"}},
+		{TopicID: twitterTopic, OriginKey: 102, Caption: "B", Timestamp: now, Meta: map[string]interface{}{"user": "bar"}},
+		{TopicID: twitterTopic, OriginKey: 103, Caption: "C", Timestamp: now},
+		{TopicID: pixivTopic, OriginKey: 201, Caption: "D", Timestamp: now, Meta: map[string]interface{}{"user": "foo", "bookmarks": 1500}},
+		{TopicID: pixivTopic, OriginKey: 202, Caption: "E", Timestamp: now, Meta: map[string]interface{}{"user": "baz", "bookmarks": 300}},
+		{TopicID: pixivTopic, OriginKey: 203, Caption: "F", Timestamp: now, Meta: map[string]interface{}{"stats": map[string]interface{}{"views": 10}}},
+	}
+	if _, err := db.Insert(ctx, items...); err != nil {
+		t.Error(err)
+		return
+	}
+	topics := []string{"/meta/twitter", "/meta/pixiv"}
+	testPairs := []struct {
+		originKeys []int64
+		query      *Query
+	}{
+		{[]int64{201, 101}, &Query{Topics: topics, Meta: []MetaPredicate{MetaEq("user", "foo")}}},
+		{[]int64{202, 201, 102}, &Query{Topics: topics, Meta: []MetaPredicate{MetaIn("user", "bar", "baz", "foo")}, Limit: 3}},
+		{[]int64{202, 201, 102, 101}, &Query{Topics: topics, Meta: []MetaPredicate{MetaExists("user")}}},
+		{[]int64{201}, &Query{Topics: topics, Meta: []MetaPredicate{MetaGt("bookmarks", 1000)}}},
+		{[]int64{202}, &Query{Topics: topics, Meta: []MetaPredicate{MetaExists("bookmarks"), MetaLte("bookmarks", 1000)}}},
+		{[]int64{203}, &Query{Topics: topics, Meta: []MetaPredicate{MetaEq("stats.views", 10)}}},
+		{[]int64{103, 102, 101}, &Query{Origins: []string{"meta/twitter"}}},
+		{[]int64{201}, &Query{Origins: []string{"meta/pixiv"}, Meta: []MetaPredicate{MetaEq("user", "foo")}}},
+	}
+	for _, pair := range testPairs {
+		ps, err := db.Select(ctx, pair.query)
+		if err != nil {
+			t.Error(err, pp.Sprint(pair.query))
+			return
+		}
+		a.Equal(pair.originKeys, mapOriginKey(ps), pp.Sprint(pair.query))
+	}
+	ps, err := db.Select(ctx, &Query{Origins: []string{"meta/pixiv"}, Limit: 1})
+	if a.NoError(err) && a.Len(ps, 1) {
+		a.Equal("meta/pixiv", ps[0].Origin)
+		a.Equal("/meta/pixiv", ps[0].TopicKey)
+	}
+	_, err = db.Select(ctx, &Query{Meta: []MetaPredicate{{Field: "user", Op: MetaOpEq}}})
+	a.Error(err)
+}
+
+// In-memory evaluation of MetaPredicate should agree with SQL, for values which SQLite converts implicitly.
+func TestMetaPredicateMatchesSQL(t *testing.T) {
+	metas := map[int64]interface{}{
+		1:  "123",
+		2:  "12abc",
+		3:  nil, // JSON null
+		4:  5,
+		5:  true,
+		6:  "abc",
+		7:  map[string]interface{}{"x": 1},
+		8:  " 7",
+		9:  "1e3",
+		10: []interface{}{1},
+	}
+	testPairs := []struct {
+		originKeys []int64
+		pred       MetaPredicate
+	}{
+		{[]int64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, MetaExists("n")},
+		{[]int64{}, MetaEq("n", 123)},
+		{[]int64{1}, MetaEq("n", "123")},
+		{[]int64{4}, MetaEq("n", 5)},
+		{[]int64{5}, MetaEq("n", 1)},
+		{[]int64{5}, MetaEq("n", true)},
+		{[]int64{}, MetaEq("n", nil)},
+		{[]int64{4, 1}, MetaIn("n", "123", 5)},
+		{[]int64{9, 1}, MetaGt("n", 100)},
+		{[]int64{9, 2, 1}, MetaGte("n", 12)},
+		{[]int64{10, 7, 6}, MetaLt("n", 1)},
+		{[]int64{10, 8, 7, 6, 5, 4}, MetaLte("n", 7)},
+	}
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		a := assert.New(t)
+		ctx := context.Background()
+		origin, err := s.OriginID(ctx, "meta/consistency", true)
+		a.NoError(err)
+		topic, err := s.TopicID(ctx, "/meta/consistency", origin, true)
+		a.NoError(err)
+		items := []*Item{{TopicID: topic, OriginKey: 0, Timestamp: conformanceBase}}
+		for key := int64(1); key <= int64(len(metas)); key++ {
+			items = append(items, &Item{TopicID: topic, OriginKey: key, Timestamp: conformanceBase,
+				Meta: map[string]interface{}{"n": metas[key]}})
+		}
+		_, err = s.Insert(ctx, items...)
+		a.NoError(err)
+		for _, pair := range testPairs {
+			selected, err := s.Select(ctx, &Query{Topics: []string{"/meta/consistency"}, Meta: []MetaPredicate{pair.pred}})
+			if a.NoError(err) {
+				a.Equal(pair.originKeys, mapOriginKey(selected), "%+v", pair.pred)
+			}
+			matched := []int64{}
+			for i := len(items) - 1; i >= 0; i-- {
+				// as decoded from JSON
+				var meta map[string]interface{}
+				b, _ := json.Marshal(items[i].Meta)
+				json.Unmarshal(b, &meta)
+				if pair.pred.Match(meta) {
+					matched = append(matched, items[i].OriginKey)
+				}
+			}
+			a.Equal(pair.originKeys, matched, "Match %+v", pair.pred)
+		}
+	})
+}
+
+func TestSQLiteStorageTopicPattern(t *testing.T) {
+	a := assert.New(t)
+	db := newPrivateStorage(t)
+	ctx := context.Background()
+	origin, err := db.OriginID(ctx, "pattern/test", true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i, key := range []string{"/pattern/ranking/daily", "/pattern/ranking/daily_r18", "/pattern/list/a"} {
+		topicID, err := db.TopicID(ctx, key, origin, true)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := db.Insert(ctx, &Item{TopicID: topicID, OriginKey: int64(i + 1), Timestamp: time.Now()}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	testPairs := []struct {
+		originKeys []int64
+		query      *Query
+	}{
+		{[]int64{3, 2, 1}, &Query{Topics: []string{"/pattern/**"}}},
+		{[]int64{1}, &Query{Topics: []string{"/pattern/ranking/*", "!/pattern/ranking/*_r18"}}},
+		{[]int64{3, 1}, &Query{Topics: []string{"/pattern/list/a", "/pattern/ranking/daily"}}},
+		{[]int64{}, &Query{Topics: []string{"/pattern/nothing/**"}}},
+	}
+	for _, pair := range testPairs {
+		ps, err := db.Select(ctx, pair.query)
+		if err != nil {
+			t.Error(err, pp.Sprint(pair.query))
+			return
+		}
+		a.Equal(pair.originKeys, mapOriginKey(ps), pp.Sprint(pair.query))
+	}
+}
+
+func TestSQLiteStorageInsertAtomic(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	storage := newPrivateStorage(t)
+	s := NewService(storage)
+	a.NoError(s.NewTopic("test", "/atomic"))
+	lis, err := s.Listen("/atomic")
+	a.NoError(err)
+	defer lis.Close()
+
+	good := &Item{Caption: "good", OriginKey: 1, Tags: []string{"#Cat"}}
+	bad := &Item{Caption: "bad", OriginKey: 2, Meta: map[string]interface{}{"ch": make(chan int)}}
+	err = s.Publish("/atomic", good, bad)
+	insertErr, ok := err.(*InsertError)
+	if a.True(ok, "%v", err) {
+		a.Equal(1, insertErr.Index)
+		a.Equal(bad, insertErr.Item)
+		a.Contains(insertErr.Error(), "bad")
+	}
+	a.Equal(int64(0), good.ID)
+	a.Equal([]string{"cat"}, good.Tags)
+	a.Len(lis.C, 0)
+	counts, err := s.Count(ctx, &Query{Topics: []string{"/atomic"}})
+	a.NoError(err)
+	a.Equal(int64(0), counts["/atomic"])
+
+	second := &Item{Caption: "second", OriginKey: 2}
+	a.NoError(s.Publish("/atomic", good, second))
+	a.NotZero(good.ID)
+	a.Equal(good.ID+1, second.ID)
+	a.Len(lis.C, 2)
+	last, err := storage.Insert(ctx)
+	a.NoError(err)
+	a.Equal(int64(0), last)
+}
+
+func benchmarkInsert(b *testing.B, n, batch int) {
+	db, err := sql.Open(sqliteDriver, b.TempDir()+"/bench.db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	storage, err := NewSQLiteStorage(db)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	oid, err := storage.OriginID(ctx, "bench", true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tid, err := storage.TopicID(ctx, "/bench", oid, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	items := make([]*Item, n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range items {
+			items[j] = &Item{
+				Caption:   "bench",
+				TopicID:   tid,
+				OriginKey: int64(j),
+				Timestamp: time.Now(),
+				Meta:      map[string]interface{}{"rank": j},
+			}
+		}
+		for j := 0; j < n; j += batch {
+			if _, err := storage.Insert(ctx, items[j:j+batch]...); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// 2000 items in a call, and 2000 calls of an item.
+//   go test -tags sqlite_json -run '^$' -bench Insert ./timeline/
+func BenchmarkInsertBatch(b *testing.B) {
+	benchmarkInsert(b, 2000, 2000)
+}
+
+func BenchmarkInsertOneByOne(b *testing.B) {
+	benchmarkInsert(b, 2000, 1)
+}
+
+func TestRegexpCacheBounded(t *testing.T) {
+	a := assert.New(t)
+	for i := 0; i < RegexpCacheSize*2; i++ {
+		ok, err := sqliteRegexp(fmt.Sprintf("^item %d$", i), fmt.Sprintf("item %d", i))
+		a.NoError(err)
+		a.True(ok)
+	}
+	regexpCache.mu.Lock()
+	a.Len(regexpCache.entries, RegexpCacheSize)
+	a.Equal(RegexpCacheSize, regexpCache.order.Len())
+	regexpCache.mu.Unlock()
+	_, err := sqliteRegexp("(", "x")
+	a.Error(err)
+}
@@ -0,0 +1,376 @@
+package timeline
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultRatePer  = 1 * time.Minute
+	DefaultMaxQueue = 10000
+	// Number of items whose captions are listed in Caption of a digest item.
+	DigestCaptionItems = 5
+)
+
+// Shapes the live stream of topics matched to Pattern, see TopicPattern.
+// Storage receives every published item regardless of policies,
+// and listeners created WithRaw receive them without shaping.
+type PublishPolicy struct {
+	Pattern string `yaml:"pattern" json:"pattern"`
+	// Deliver at most Rate items per Per, excess items are queued and delivered later.
+	Rate int           `yaml:"rate" json:"rate,omitempty"`
+	Per  time.Duration `yaml:"per" json:"per,omitempty"`
+	// Items queued over MaxQueue are dropped from the live stream, oldest first.
+	MaxQueue int `yaml:"max_queue" json:"maxQueue,omitempty"`
+	// Collect items for Digest, then deliver a single item which summarizes them, see Item.Digest.
+	// Filters of listeners and saved searches are applied to the collected items.
+	// Exclusive with Rate.
+	Digest time.Duration `yaml:"digest" json:"digest,omitempty"`
+}
+
+// timeline_policies.yaml
+//   policies:
+//     - pattern: /twitter/list/**
+//       rate: 30
+//       per: 1m
+//     - pattern: /pixiv/ranking/*
+//       digest: 1h
+type PolicyConfig struct {
+	Policies []PublishPolicy `yaml:"policies"`
+}
+
+func (p *PublishPolicy) validate() error {
+	if p.Pattern == "" {
+		return fmt.Errorf("pattern is required for publish policy")
+	}
+	if p.Rate < 0 || p.Per < 0 || p.MaxQueue < 0 || p.Digest < 0 {
+		return fmt.Errorf("Invalid publish policy of %s: negative value", p.Pattern)
+	}
+	if (p.Rate > 0) == (p.Digest > 0) {
+		return fmt.Errorf("Invalid publish policy of %s: either rate or digest is required", p.Pattern)
+	}
+	return nil
+}
+
+// Listeners which receive an event.
+type stream int
+
+const (
+	streamAll stream = iota
+	// Listeners created WithRaw, for items shaped by a policy.
+	streamRaw
+	// Other listeners, for items delivered by a policy.
+	streamShaped
+)
+
+func (st stream) accepts(l *Listener) bool {
+	switch st {
+	case streamRaw:
+		return l.raw
+	case streamShaped:
+		return !l.raw
+	default:
+		return true
+	}
+}
+
+// Replace publish policies. Each topic is shaped by the first matched policy.
+// Items queued by previous policies are delivered immediately.
+func (s *Service) SetPublishPolicies(policies []PublishPolicy) error {
+	compiled := make([]*publishPolicy, len(policies))
+	for i := range policies {
+		p := policies[i]
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if p.Per == 0 {
+			p.Per = DefaultRatePer
+		}
+		if p.MaxQueue == 0 {
+			p.MaxQueue = DefaultMaxQueue
+		}
+		compiled[i] = &publishPolicy{PublishPolicy: p, pattern: ParsePattern(p.Pattern)}
+	}
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	s.policiesMu.Lock()
+	defer s.policiesMu.Unlock()
+	for t := range s.shapers {
+		s.releaseShaperLocked(t, true)
+	}
+	s.policies = compiled
+	return nil
+}
+
+// Configured publish policies, in order of matching.
+func (s *Service) PublishPolicies() []PublishPolicy {
+	s.policiesMu.Lock()
+	defer s.policiesMu.Unlock()
+	ret := make([]PublishPolicy, len(s.policies))
+	for i, p := range s.policies {
+		ret[i] = p.PublishPolicy
+	}
+	return ret
+}
+
+type publishPolicy struct {
+	PublishPolicy
+	pattern TopicPattern
+}
+
+// Queue of a topic shaped by a policy. Items are delivered with mu locked,
+// so that queued and immediate items are delivered in order.
+type shaper struct {
+	*publishPolicy
+	s       *Service
+	t       *Topic
+	mu      sync.Mutex
+	queue   []*Item
+	dropped uint64
+	// rate limit by token bucket of Rate tokens
+	tokens  float64
+	filled  time.Time
+	timer   *time.Timer
+	stopped bool
+}
+
+// Shaper of the topic, nil if no policy is matched.
+// Should be called with topicsMu locked.
+func (s *Service) shaperOf(t *Topic) *shaper {
+	s.policiesMu.Lock()
+	defer s.policiesMu.Unlock()
+	if len(s.policies) == 0 || t.search != nil {
+		return nil
+	}
+	if sh, ok := s.shapers[t]; ok {
+		return sh
+	}
+	var sh *shaper
+	for _, p := range s.policies {
+		if p.pattern.Match(t.Key) {
+			sh = &shaper{publishPolicy: p, s: s, t: t, tokens: float64(p.Rate), filled: time.Now()}
+			break
+		}
+	}
+	// unmatched topics are also cached
+	s.shapers[t] = sh
+	return sh
+}
+
+// Deliver queued items if flush, and forget the shaper so that the policy is matched again.
+// Should be called with topicsMu write locked.
+func (s *Service) releaseShaper(t *Topic, flush bool) {
+	s.policiesMu.Lock()
+	defer s.policiesMu.Unlock()
+	s.releaseShaperLocked(t, flush)
+}
+
+func (s *Service) releaseShaperLocked(t *Topic, flush bool) {
+	sh := s.shapers[t]
+	delete(s.shapers, t)
+	if sh == nil {
+		return
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.stopped = true
+	if sh.timer != nil {
+		sh.timer.Stop()
+	}
+	if !flush || len(sh.queue) == 0 {
+		return
+	}
+	if sh.Digest > 0 {
+		sh.deliverDigest(sh.queue)
+	} else {
+		for _, it := range sh.queue {
+			sh.deliver(it)
+		}
+	}
+	sh.queue = nil
+}
+
+// Number of items waiting in queues of policies, and dropped by MaxQueue, by topic key.
+func (s *Service) PolicyStatus() map[string]PolicyStatus {
+	s.topicsMu.RLock()
+	defer s.topicsMu.RUnlock()
+	s.policiesMu.Lock()
+	defer s.policiesMu.Unlock()
+	ret := make(map[string]PolicyStatus)
+	for t, sh := range s.shapers {
+		if sh == nil {
+			continue
+		}
+		sh.mu.Lock()
+		ret[t.Key] = PolicyStatus{Pattern: sh.Pattern, Queued: len(sh.queue), Dropped: sh.dropped}
+		sh.mu.Unlock()
+	}
+	return ret
+}
+
+type PolicyStatus struct {
+	Pattern string `json:"pattern"`
+	Queued  int    `json:"queued"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// Take the event into the shaped stream. Added items are delivered now or queued,
+// and changes of queued items are applied to the queue.
+// Returns false if the event should be delivered as is.
+// Should be called with topicsMu locked.
+func (sh *shaper) offer(ev ItemEvent) bool {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.stopped {
+		return false
+	}
+	if ev.Kind != ItemAdded {
+		for i, it := range sh.queue {
+			if it.ID != ev.Item.ID {
+				continue
+			}
+			if ev.Kind == ItemDeleted {
+				// not seen by listeners yet
+				sh.queue = append(sh.queue[:i], sh.queue[i+1:]...)
+			} else {
+				sh.queue[i] = ev.Item
+			}
+			return true
+		}
+		return false
+	}
+	if sh.Digest > 0 {
+		sh.queue = append(sh.queue, ev.Item)
+		if sh.timer == nil {
+			sh.timer = time.AfterFunc(sh.Digest, sh.flushDigest)
+		}
+		return true
+	}
+	sh.refill(time.Now())
+	if len(sh.queue) == 0 && sh.tokens >= 1 {
+		sh.tokens--
+		sh.deliver(ev.Item)
+		return true
+	}
+	sh.queue = append(sh.queue, ev.Item)
+	if len(sh.queue) > sh.MaxQueue {
+		sh.queue = sh.queue[1:]
+		sh.dropped++
+	}
+	sh.schedule()
+	return true
+}
+
+// Should be called with mu locked.
+func (sh *shaper) refill(now time.Time) {
+	sh.tokens += float64(sh.Rate) * float64(now.Sub(sh.filled)) / float64(sh.Per)
+	if sh.tokens > float64(sh.Rate) {
+		sh.tokens = float64(sh.Rate)
+	}
+	sh.filled = now
+}
+
+// Wake when the next token is filled. Should be called with mu locked.
+func (sh *shaper) schedule() {
+	if sh.timer != nil {
+		return
+	}
+	wait := time.Duration((1 - sh.tokens) * float64(sh.Per) / float64(sh.Rate))
+	sh.timer = time.AfterFunc(wait, sh.flushRate)
+}
+
+func (sh *shaper) flushRate() {
+	sh.s.topicsMu.RLock()
+	defer sh.s.topicsMu.RUnlock()
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.timer = nil
+	if sh.stopped {
+		return
+	}
+	sh.refill(time.Now())
+	for len(sh.queue) > 0 && sh.tokens >= 1 {
+		sh.tokens--
+		sh.deliver(sh.queue[0])
+		sh.queue = sh.queue[1:]
+	}
+	if len(sh.queue) > 0 {
+		sh.schedule()
+	}
+}
+
+func (sh *shaper) flushDigest() {
+	sh.s.topicsMu.RLock()
+	defer sh.s.topicsMu.RUnlock()
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.timer = nil
+	if sh.stopped || len(sh.queue) == 0 {
+		return
+	}
+	sh.deliverDigest(sh.queue)
+	sh.queue = nil
+}
+
+// Should be called with topicsMu and mu locked.
+func (sh *shaper) deliver(it *Item) {
+	sh.s.deliverItem(sh.t, ItemEvent{Kind: ItemAdded, Item: it}, streamShaped)
+}
+
+// Deliver digests of items to listeners of the topic and matched saved searches.
+// Filters are applied to the summarized items, as the digest item has no meta or tags.
+// Should be called with topicsMu and mu locked.
+func (sh *shaper) deliverDigest(items []*Item) {
+	published := make(map[*Listener]struct{})
+	sh.t.publishDigest(items, sh.digest, published)
+	aliases := sh.s.tagAliases()
+	for _, k := range sh.s.topicKeys {
+		t := sh.s.topics[k]
+		if t.search == nil || t.Archived {
+			continue
+		}
+		if matched := matchedItems(items, func(it *Item) bool { return t.search.match(it, aliases) }); len(matched) > 0 {
+			t.publishDigest(matched, sh.digest, published)
+		}
+	}
+}
+
+// Summary of items, whose ID is the newest one so that it can be used as a cursor.
+// Items are in published order.
+func (sh *shaper) digest(items []*Item) *Item {
+	last := items[len(items)-1]
+	title := sh.t.Info().Title
+	if title == "" {
+		title = sh.t.Key
+	}
+	lines := []string{fmt.Sprintf("%d items in %s", len(items), title)}
+	d := &Item{
+		ID:        last.ID,
+		Timestamp: last.Timestamp,
+		TopicID:   last.TopicID,
+		TopicKey:  last.TopicKey,
+		Origin:    last.Origin,
+		Meta:      map[string]interface{}{},
+		Digest:    make([]int64, len(items)),
+	}
+	for i, it := range items {
+		d.Digest[i] = it.ID
+		if d.Thumbnail == "" {
+			d.Thumbnail = it.Thumbnail
+		}
+		if i < DigestCaptionItems {
+			caption := it.Caption
+			if nl := strings.IndexByte(caption, '\n'); nl >= 0 {
+				caption = caption[:nl]
+			}
+			lines = append(lines, "- "+caption)
+		}
+	}
+	if len(items) > DigestCaptionItems {
+		lines = append(lines, fmt.Sprintf("and %d more", len(items)-DigestCaptionItems))
+	}
+	d.Caption = strings.Join(lines, "\n")
+	return d
+}
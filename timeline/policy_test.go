@@ -0,0 +1,164 @@
+package timeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func waitCaptions(t *testing.T, lis *Listener, n int) []string {
+	var ret []string
+	deadline := time.Now().Add(3 * time.Second)
+	for len(ret) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout, received %v", ret)
+		}
+		ret = append(ret, receiveCaptions(lis)...)
+		time.Sleep(5 * time.Millisecond)
+	}
+	return ret
+}
+
+func TestPublishPolicyValidation(t *testing.T) {
+	a := assert.New(t)
+	s := NewService(nil)
+	a.Error(s.SetPublishPolicies([]PublishPolicy{{Rate: 1}}))
+	a.Error(s.SetPublishPolicies([]PublishPolicy{{Pattern: "/a"}}))
+	a.Error(s.SetPublishPolicies([]PublishPolicy{{Pattern: "/a", Rate: 1, Digest: time.Second}}))
+	a.NoError(s.SetPublishPolicies([]PublishPolicy{{Pattern: "/a", Rate: 1}}))
+	a.Equal([]PublishPolicy{{Pattern: "/a", Rate: 1, Per: DefaultRatePer, MaxQueue: DefaultMaxQueue}}, s.PublishPolicies())
+}
+
+func TestRateLimitPolicy(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("twitter.tweet", "/policy/list"))
+	a.NoError(s.NewTopic("twitter.tweet", "/policy/other"))
+	a.NoError(s.SetPublishPolicies([]PublishPolicy{{Pattern: "/policy/list", Rate: 2, Per: time.Second, MaxQueue: 3}}))
+	lis, err := s.Listen("/policy/**")
+	a.NoError(err)
+	defer lis.Close()
+	raw, err := s.Listen("/policy/**", WithRaw())
+	a.NoError(err)
+	defer raw.Close()
+
+	a.NoError(s.Publish("/policy/list",
+		&Item{Caption: "1", OriginKey: 1}, &Item{Caption: "2", OriginKey: 2}, &Item{Caption: "3", OriginKey: 3},
+		&Item{Caption: "4", OriginKey: 4}, &Item{Caption: "5", OriginKey: 5}, &Item{Caption: "6", OriginKey: 6}))
+	a.NoError(s.Publish("/policy/other", &Item{Caption: "other", OriginKey: 7}))
+	// burst of Rate items, then the queue is delivered by rate
+	a.Equal([]string{"1", "2", "other"}, receiveCaptions(lis))
+	a.Equal([]string{"1", "2", "3", "4", "5", "6", "other"}, receiveCaptions(raw))
+	status := s.PolicyStatus()["/policy/list"]
+	a.Equal(3, status.Queued)
+	a.EqualValues(1, status.Dropped)
+
+	// changes of queued items are applied before delivery
+	a.NoError(s.Update(&Item{TopicKey: "/policy/list", OriginKey: 5, Caption: "5 edited"}))
+	a.NoError(s.Delete("/policy/list", 6))
+	a.Empty(receiveCaptions(lis))
+	a.Equal([]string{"5 edited", "6"}, receiveCaptions(raw))
+	a.Equal([]string{"4", "5 edited"}, waitCaptions(t, lis, 2))
+
+	// storage receives every item
+	items, err := s.Fetch(ctx, &Query{Topics: []string{"/policy/list"}})
+	a.NoError(err)
+	a.Len(items, 5)
+}
+
+func TestDigestPolicy(t *testing.T) {
+	a := assert.New(t)
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopicWithInfo("pixiv.ranking", "/policy/ranking", TopicInfo{Title: "Ranking"}))
+	a.NoError(s.SetPublishPolicies([]PublishPolicy{{Pattern: "/policy/*", Digest: 50 * time.Millisecond}}))
+	lis, err := s.Listen("/policy/ranking")
+	a.NoError(err)
+	defer lis.Close()
+
+	var published []*Item
+	for i := 1; i <= DigestCaptionItems+1; i++ {
+		it := &Item{Caption: "rank " + string(rune('0'+i)) + "\nby artist", OriginKey: int64(i)}
+		if i == 2 {
+			it.Thumbnail = "http://img.local/2.jpg"
+		}
+		published = append(published, it)
+	}
+	a.NoError(s.Publish("/policy/ranking", published...))
+	a.Empty(lis.Fetch(0))
+	captions := waitCaptions(t, lis, 1)
+	a.Equal([]string{"6 items in Ranking\n- rank 1\n- rank 2\n- rank 3\n- rank 4\n- rank 5\nand 1 more"}, captions)
+
+	a.NoError(s.Publish("/policy/ranking", &Item{Caption: "late", OriginKey: 10}))
+	// delivered on policy change
+	a.NoError(s.SetPublishPolicies(nil))
+	events := lis.Fetch(0)
+	if a.Len(events, 1) {
+		d := events[0].Item
+		a.Equal("1 items in Ranking\n- late", d.Caption)
+		a.Len(d.Digest, 1)
+		a.Equal(d.Digest[0], d.ID)
+	}
+	a.NoError(s.Publish("/policy/ranking", &Item{Caption: "direct", OriginKey: 11}))
+	a.Equal([]string{"direct"}, receiveCaptions(lis))
+}
+
+func TestDigestItem(t *testing.T) {
+	a := assert.New(t)
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("pixiv.ranking", "/policy/digest"))
+	a.NoError(s.SetPublishPolicies([]PublishPolicy{{Pattern: "/policy/digest", Digest: time.Hour}}))
+	a.NoError(s.Publish("/policy/digest",
+		&Item{Caption: "a", OriginKey: 1},
+		&Item{Caption: "b", OriginKey: 2, Thumbnail: "http://img.local/b.jpg"}))
+	t.Cleanup(func() { s.SetPublishPolicies(nil) })
+	topic, _ := s.Topic("/policy/digest")
+	sh := s.shaperOf(topic)
+	sh.mu.Lock()
+	d := sh.digest(sh.queue)
+	ids := []int64{sh.queue[0].ID, sh.queue[1].ID}
+	sh.mu.Unlock()
+	a.Equal("2 items in /policy/digest\n- a\n- b", d.Caption)
+	a.Equal("http://img.local/b.jpg", d.Thumbnail)
+	a.Equal(ids, d.Digest)
+	a.Equal(ids[1], d.ID)
+	a.Equal("/policy/digest", d.TopicKey)
+}
+
+func TestDigestPolicyFilters(t *testing.T) {
+	a := assert.New(t)
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("pixiv.ranking", "/policy/filtered"))
+	_, err := s.NewSavedSearch("policy-cats", "topic:/policy/** tag:cat", TopicInfo{})
+	a.NoError(err)
+	a.NoError(s.SetPublishPolicies([]PublishPolicy{{Pattern: "/policy/filtered", Digest: time.Hour}}))
+	all, err := s.Listen("/policy/filtered")
+	a.NoError(err)
+	defer all.Close()
+	f, err := ParseFilter("meta.user:alice")
+	a.NoError(err)
+	alice, err := s.Listen("/policy/filtered", WithFilter(f))
+	a.NoError(err)
+	defer alice.Close()
+	f, err = ParseFilter("meta.user:carol")
+	a.NoError(err)
+	carol, err := s.Listen("/policy/filtered", WithFilter(f))
+	a.NoError(err)
+	defer carol.Close()
+	cats, err := s.Listen("/saved/policy-cats")
+	a.NoError(err)
+	defer cats.Close()
+
+	a.NoError(s.Publish("/policy/filtered",
+		&Item{Caption: "a", OriginKey: 1, Meta: map[string]interface{}{"user": "alice"}, Tags: []string{"cat"}},
+		&Item{Caption: "b", OriginKey: 2, Meta: map[string]interface{}{"user": "bob"}},
+		&Item{Caption: "c", OriginKey: 3, Meta: map[string]interface{}{"user": "alice"}}))
+	// delivered on policy change
+	a.NoError(s.SetPublishPolicies(nil))
+	a.Equal([]string{"3 items in /policy/filtered\n- a\n- b\n- c"}, receiveCaptions(all))
+	a.Equal([]string{"2 items in /policy/filtered\n- a\n- c"}, receiveCaptions(alice))
+	a.Empty(receiveCaptions(carol))
+	a.Equal([]string{"1 items in /policy/filtered\n- a"}, receiveCaptions(cats))
+}
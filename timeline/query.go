@@ -1,23 +1,90 @@
 package timeline
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"strings"
 	"time"
 )
 
 type Query struct {
-	Topics []string
-	MaxID  int
-	MinID  int
-	Limit  int
-	Before time.Time
-	After  time.Time
+	Topics  []string
+	Origins []string // origin names, such as "twitter.tweet"
+	Meta    []MetaPredicate
+	Filter  *Filter
+	// Items should have all of Tags, any of AnyTags, and none of ExcludeTags.
+	Tags        []string
+	AnyTags     []string
+	ExcludeTags []string
+	MaxID       int
+	MinID       int
+	Limit       int
+	Offset      int
+	Before      time.Time
+	After       time.Time
+	// Per-user state, see ItemState. Hidden items of User are excluded unless ShowHidden.
+	User       string
+	Starred    bool // starred by User, or by anyone if User is empty
+	Unread     bool // newer than read marker of User
+	ShowHidden bool
+	// Include items deleted by Service.Delete, which have Item.Deleted.
+	ShowDeleted bool
+	// Items whose PHash is within MaxDistance of SimilarTo.
+	SimilarTo   *PHash
+	MaxDistance int
+	// Collapse near-duplicates within CollapseDistance in Service.Fetch, newest one is kept.
+	// Fewer than Limit items may be returned.
+	Collapse         bool
+	CollapseDistance int
+	// Items newer than read marker of a saved search, instead of Unread.
+	readUpTo int64
 }
 
+var ErrNoUser = errors.New("User is required")
+
+func (q *Query) Validate() error {
+	if q.Unread && q.User == "" {
+		return ErrNoUser
+	}
+	for i := range q.Meta {
+		if err := q.Meta[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Build WHERE clause for SQLite
 func (q *Query) ToWhereClause() (string, []interface{}, bool) {
-	ascend := false
-	orderClause := " ORDER BY timeline.id DESC"
+	where, params := q.ToCondition()
+	orderClause, ascend := q.order()
+	where += orderClause
+	if q.Offset > 0 {
+		var limit int64 = math.MaxInt64 // OFFSET requires LIMIT
+		if q.Limit > 0 {
+			limit = int64(q.Limit)
+		}
+		return where + " LIMIT ? OFFSET ?", append(params, limit, q.Offset), ascend
+	}
+	if q.Limit > 0 {
+		return where + " LIMIT ?", append(params, q.Limit), ascend
+	}
+	return where, params, ascend
+}
+
+// Build WHERE clause without ordering and limit, for aggregations.
+// Returns empty string if no condition is given.
+func (q *Query) ToCondition() (string, []interface{}) {
+	terms, params := q.conditionTerms()
+	if len(terms) == 0 {
+		return "", params
+	}
+	return "WHERE " + strings.Join(terms, " AND "), params
+}
+
+// Terms of WHERE clause, joined with AND.
+func (q *Query) conditionTerms() ([]string, []interface{}) {
 	terms := []string{}
 	params := []interface{}{}
 	if len(q.Topics) > 0 {
@@ -30,38 +97,122 @@ func (q *Query) ToWhereClause() (string, []interface{}, bool) {
 			fmt.Sprintf("(%s)", strings.Join(topicTerms, " OR ")),
 		)
 	}
-	if q.After.Nanosecond() > 0 {
-		ascend = true
-		orderClause = " ORDER BY timeline.timestamp ASC"
+	if len(q.Origins) > 0 {
+		placeholders := make([]string, len(q.Origins))
+		for i, origin := range q.Origins {
+			placeholders[i] = "?"
+			params = append(params, origin)
+		}
+		terms = append(terms,
+			fmt.Sprintf("origin.name IN (%s)", strings.Join(placeholders, ", ")),
+		)
+	}
+	for i := range q.Meta {
+		term, ps := q.Meta[i].toTerm()
+		terms = append(terms, term)
+		params = append(params, ps...)
+	}
+	if q.Filter != nil {
+		fTerms, ps := q.Filter.toTerms()
+		terms = append(terms, fTerms...)
+		params = append(params, ps...)
+	}
+	for _, t := range NormalizeTags(q.Tags) {
+		term, ps := tagTerm([]string{t})
+		terms = append(terms, term)
+		params = append(params, ps...)
+	}
+	if anyTags := NormalizeTags(q.AnyTags); len(anyTags) > 0 {
+		term, ps := tagTerm(anyTags)
+		terms = append(terms, term)
+		params = append(params, ps...)
+	}
+	if excludeTags := NormalizeTags(q.ExcludeTags); len(excludeTags) > 0 {
+		term, ps := tagTerm(excludeTags)
+		terms = append(terms, "NOT "+term)
+		params = append(params, ps...)
+	}
+	if !q.After.IsZero() {
 		afterMillisec := q.After.UnixNano() / int64(time.Millisecond)
 		params = append(params, afterMillisec)
 		terms = append(terms, "timeline.timestamp >= ?")
 	}
-	if q.Before.Nanosecond() > 0 {
-		ascend = false
-		orderClause = " ORDER BY timeline.timestamp DESC"
+	if !q.Before.IsZero() {
 		beforeMillisec := q.Before.UnixNano() / int64(time.Millisecond)
 		params = append(params, beforeMillisec)
 		terms = append(terms, "timeline.timestamp <= ?")
 	}
 	if q.MinID > 0 {
-		ascend = true
-		orderClause = " ORDER BY timeline.id ASC"
 		params = append(params, q.MinID)
 		terms = append(terms, "timeline.id >= ?")
 	}
 	if q.MaxID > 0 {
-		orderClause = " ORDER BY timeline.id DESC"
-		ascend = false
 		params = append(params, q.MaxID)
 		terms = append(terms, "timeline.id <= ?")
 	}
-	where := strings.Join(terms, " AND ") + orderClause
-	if len(terms) > 0 {
-		where = "WHERE " + where
+	if q.Starred {
+		if q.User != "" {
+			params = append(params, q.User)
+			terms = append(terms, "EXISTS (SELECT 1 FROM item_state WHERE item_state.item_id = timeline.id AND item_state.starred = 1 AND item_state.user = ?)")
+		} else {
+			terms = append(terms, "EXISTS (SELECT 1 FROM item_state WHERE item_state.item_id = timeline.id AND item_state.starred = 1)")
+		}
 	}
-	if q.Limit > 0 {
-		return where + " LIMIT ?", append(params, q.Limit), ascend
+	if q.Unread {
+		params = append(params, q.User)
+		terms = append(terms, "timeline.id > COALESCE((SELECT read_marker.last_read_id FROM read_marker WHERE read_marker.topic_id = timeline.topic_id AND read_marker.user = ?), 0)")
+	}
+	if q.readUpTo > 0 {
+		params = append(params, q.readUpTo)
+		terms = append(terms, "timeline.id > ?")
+	}
+	if q.SimilarTo != nil {
+		params = append(params, int64(*q.SimilarTo), q.MaxDistance)
+		terms = append(terms, "timeline.phash IS NOT NULL AND hamming(timeline.phash, ?) <= ?")
+	}
+	if q.User != "" && !q.ShowHidden {
+		params = append(params, q.User)
+		terms = append(terms, "NOT EXISTS (SELECT 1 FROM item_state WHERE item_state.item_id = timeline.id AND item_state.hidden = 1 AND item_state.user = ?)")
+	}
+	if !q.ShowDeleted {
+		terms = append(terms, "timeline.deleted_at IS NULL")
+	}
+	return terms, params
+}
+
+// Copy of q which also matches deleted items.
+func (q *Query) withDeleted() *Query {
+	ret := *q
+	ret.ShowDeleted = true
+	return &ret
+}
+
+// ORDER BY clause, and whether rows are fetched in ascending order.
+// Results are always returned in descending order, ascending fetch is flipped by Storage.
+func (q *Query) order() (string, bool) {
+	byTimestamp, ascend := q.orderBy()
+	column, direction := "timeline.id", "DESC"
+	if byTimestamp {
+		column = "timeline.timestamp"
+	}
+	if ascend {
+		direction = "ASC"
+	}
+	return " ORDER BY " + column + " " + direction, ascend
+}
+
+// Whether items are ordered by timestamp instead of ID, and fetched in ascending order.
+func (q *Query) orderBy() (bool, bool) {
+	switch {
+	case q.MaxID > 0:
+		return false, false
+	case q.MinID > 0:
+		return false, true
+	case !q.Before.IsZero():
+		return true, false
+	case !q.After.IsZero():
+		return true, true
+	default:
+		return false, false
 	}
-	return where, params, ascend
 }
@@ -0,0 +1,323 @@
+package timeline
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kanosaki/dumper/common"
+)
+
+// ParseQuery builds Query from a compact expression, terms are combined with AND.
+//   topic:/twitter/**,/pixiv/**     topics, see TopicPattern. -topic: excludes topics
+//   after:2026-10-01                date, RFC3339 or milliseconds from epoch. before: as well
+//   tag:cat -tag:nsfw tag:cat,dog   all of, none of and any of tags
+//   "exact phrase" cat              caption contains the phrase or the word
+//   limit:50 offset:100 min_id:1 max_id:100
+//   user:foo is:starred is:unread show:hidden show:deleted collapse:8
+// Terms of Filter, such as meta.user:foo and caption:"^cat", are also accepted.
+// Errors are *SyntaxError, which tells the position in the expression.
+func ParseQuery(expr string) (*Query, error) {
+	return ParseQueryFor(expr, "")
+}
+
+// Parse the expression, user is applied to is:starred and is:unread if user: is not given.
+func ParseQueryFor(expr, user string) (*Query, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{input: expr, q: &Query{}, seen: make(map[string]bool)}
+	for _, tok := range tokens {
+		if err := p.term(tok); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.filter.terms) > 0 {
+		p.q.Filter = &p.filter
+	}
+	if p.q.User == "" && (p.q.Starred || p.q.Unread) {
+		p.q.User = user
+	}
+	if err := p.q.Validate(); err != nil {
+		if err == ErrNoUser {
+			return nil, &SyntaxError{Input: expr, Pos: p.unreadPos, Msg: "is:unread requires user:"}
+		}
+		return nil, &SyntaxError{Input: expr, Msg: err.Error()}
+	}
+	return p.q, nil
+}
+
+type queryParser struct {
+	input     string
+	q         *Query
+	filter    Filter
+	seen      map[string]bool // keys which can appear once
+	unreadPos int
+}
+
+func (p *queryParser) errorf(pos int, format string, args ...interface{}) error {
+	return &SyntaxError{Input: p.input, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *queryParser) term(tok token) error {
+	text, pos := tok.text, tok.pos
+	negate := strings.HasPrefix(text, "-")
+	if negate {
+		text, pos = text[1:], pos+1
+	}
+	if text == "" {
+		return p.errorf(tok.pos, "expected term after -")
+	}
+	if strings.HasPrefix(text, `"`) || !strings.Contains(text, ":") {
+		phrase, err := unquoteValue(text)
+		if err != nil {
+			return p.errorf(pos, "invalid quoted value")
+		}
+		p.filter.terms = append(p.filter.terms, filterTerm{
+			kind:    filterCaption,
+			negate:  negate,
+			caption: regexp.MustCompile(regexp.QuoteMeta(phrase)),
+		})
+		return nil
+	}
+	colon := strings.Index(text, ":")
+	key, value := text[:colon], text[colon+1:]
+	valuePos := pos + colon + 1
+	switch key {
+	case "caption", "origin", "tag":
+		return p.filterTerm(tok)
+	case "topic":
+		if value == "" {
+			return p.errorf(valuePos, "empty value for topic")
+		}
+		for _, v := range splitValues(value) {
+			topic, err := unquoteValue(v)
+			if err != nil || topic == "" {
+				return p.errorf(valuePos, "invalid topic")
+			}
+			if negate {
+				topic = "!" + topic
+			}
+			p.q.Topics = append(p.q.Topics, topic)
+		}
+		return nil
+	}
+	if strings.HasPrefix(key, "meta.") {
+		return p.filterTerm(tok)
+	}
+	if negate {
+		return p.errorf(tok.pos, "%s can't be negated", key)
+	}
+	if value == "" {
+		return p.errorf(valuePos, "empty value for %s", key)
+	}
+	if key != "is" && key != "show" {
+		if p.seen[key] {
+			return p.errorf(pos, "duplicate %s", key)
+		}
+		p.seen[key] = true
+	}
+	var err error
+	switch key {
+	case "after", "before":
+		var t time.Time
+		if t, err = parseQueryTime(value); err != nil {
+			return p.errorf(valuePos, "invalid time %q, expected 2006-01-02 or RFC3339", value)
+		}
+		if key == "after" {
+			p.q.After = t
+		} else {
+			p.q.Before = t
+		}
+	case "limit":
+		p.q.Limit, err = parseQueryInt(value)
+	case "offset":
+		p.q.Offset, err = parseQueryInt(value)
+	case "min_id":
+		p.q.MinID, err = parseQueryInt(value)
+	case "max_id":
+		p.q.MaxID, err = parseQueryInt(value)
+	case "user":
+		p.q.User, err = unquoteValue(value)
+	case "is":
+		switch value {
+		case "starred":
+			p.q.Starred = true
+		case "unread":
+			p.q.Unread = true
+			p.unreadPos = tok.pos
+		default:
+			return p.errorf(valuePos, "unknown is:%s, expected starred or unread", value)
+		}
+	case "show":
+		switch value {
+		case "hidden":
+			p.q.ShowHidden = true
+		case "deleted":
+			p.q.ShowDeleted = true
+		default:
+			return p.errorf(valuePos, "unknown show:%s, expected hidden or deleted", value)
+		}
+	case "collapse":
+		p.q.Collapse = true
+		if value == "true" {
+			p.q.CollapseDistance = DefaultSimilarDistance
+		} else {
+			p.q.CollapseDistance, err = parseQueryInt(value)
+		}
+	default:
+		return p.errorf(pos, "unknown key %q", key)
+	}
+	if err != nil {
+		return p.errorf(valuePos, "invalid %s %q", key, value)
+	}
+	return nil
+}
+
+// Terms shared with Filter are stored into fields of Query if possible.
+func (p *queryParser) filterTerm(tok token) error {
+	term, err := parseFilterTerm(p.input, tok)
+	if err != nil {
+		return err
+	}
+	q := p.q
+	switch {
+	case term.kind == filterTag && term.negate:
+		q.ExcludeTags = append(q.ExcludeTags, term.tags...)
+	case term.kind == filterTag && len(term.tags) == 1:
+		q.Tags = append(q.Tags, term.tags[0])
+	case term.kind == filterTag && len(q.AnyTags) == 0:
+		q.AnyTags = term.tags
+	case term.kind == filterOrigin && !term.negate && len(q.Origins) == 0:
+		q.Origins = term.origins
+	case term.kind == filterMeta && !term.negate:
+		q.Meta = append(q.Meta, term.meta)
+	default:
+		p.filter.terms = append(p.filter.terms, term)
+	}
+	return nil
+}
+
+func parseQueryInt(v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err == nil && n < 0 {
+		return 0, fmt.Errorf("negative")
+	}
+	return n, err
+}
+
+func parseQueryTime(v string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return common.FromTimestamp(ms), nil
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func formatQueryTime(t time.Time) string {
+	if t.Location() == time.UTC && t.Equal(t.Truncate(24*time.Hour)) {
+		return t.Format("2006-01-02")
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// Serialize to expression, which is parsed by ParseQuery into an equivalent Query.
+// SimilarTo and MaxDistance are not serialized.
+func (q *Query) String() string {
+	var terms []string
+	var topics, excluded []string
+	for _, t := range q.Topics {
+		if strings.HasPrefix(t, "!") {
+			excluded = append(excluded, quoteValue(t[1:]))
+		} else {
+			topics = append(topics, quoteValue(t))
+		}
+	}
+	if len(topics) > 0 {
+		terms = append(terms, "topic:"+strings.Join(topics, ","))
+	}
+	if len(excluded) > 0 {
+		terms = append(terms, "-topic:"+strings.Join(excluded, ","))
+	}
+	if len(q.Origins) > 0 {
+		terms = append(terms, (&filterTerm{kind: filterOrigin, origins: q.Origins}).String())
+	}
+	for _, tag := range NormalizeTags(q.Tags) {
+		terms = append(terms, "tag:"+quoteValue(tag))
+	}
+	if anyTags := NormalizeTags(q.AnyTags); len(anyTags) > 0 {
+		terms = append(terms, (&filterTerm{kind: filterTag, tags: anyTags}).String())
+	}
+	if excludeTags := NormalizeTags(q.ExcludeTags); len(excludeTags) > 0 {
+		terms = append(terms, (&filterTerm{kind: filterTag, negate: true, tags: excludeTags}).String())
+	}
+	for i := range q.Meta {
+		terms = append(terms, (&filterTerm{kind: filterMeta, meta: q.Meta[i]}).String())
+	}
+	if q.Filter != nil {
+		for i := range q.Filter.terms {
+			terms = append(terms, q.Filter.terms[i].queryString())
+		}
+	}
+	if !q.After.IsZero() {
+		terms = append(terms, "after:"+formatQueryTime(q.After))
+	}
+	if !q.Before.IsZero() {
+		terms = append(terms, "before:"+formatQueryTime(q.Before))
+	}
+	ints := []struct {
+		key   string
+		value int
+	}{
+		{"min_id", q.MinID}, {"max_id", q.MaxID}, {"limit", q.Limit}, {"offset", q.Offset},
+	}
+	for _, n := range ints {
+		if n.value > 0 {
+			terms = append(terms, n.key+":"+strconv.Itoa(n.value))
+		}
+	}
+	if q.User != "" {
+		terms = append(terms, "user:"+quoteValue(q.User))
+	}
+	if q.Starred {
+		terms = append(terms, "is:starred")
+	}
+	if q.Unread {
+		terms = append(terms, "is:unread")
+	}
+	if q.ShowHidden {
+		terms = append(terms, "show:hidden")
+	}
+	if q.ShowDeleted {
+		terms = append(terms, "show:deleted")
+	}
+	if q.Collapse {
+		terms = append(terms, "collapse:"+strconv.Itoa(q.CollapseDistance))
+	}
+	return strings.Join(terms, " ")
+}
+
+// Literal caption pattern is written as a phrase.
+func (t *filterTerm) queryString() string {
+	if t.kind != filterCaption {
+		return t.String()
+	}
+	phrase, complete := t.caption.LiteralPrefix()
+	if !complete || phrase == "" {
+		return t.String()
+	}
+	if !strings.ContainsAny(phrase, ":-") {
+		phrase = quoteValue(phrase)
+	} else {
+		phrase = strconv.Quote(phrase)
+	}
+	if t.negate {
+		return "-" + phrase
+	}
+	return phrase
+}
@@ -0,0 +1,103 @@
+package timeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQuery(t *testing.T) {
+	a := assert.New(t)
+	q, err := ParseQuery(`topic:/twitter/** after:2026-10-01 tag:cat -tag:nsfw meta.user:foo "exact phrase" limit:50`)
+	a.NoError(err)
+	a.Equal([]string{"/twitter/**"}, q.Topics)
+	a.Equal(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), q.After)
+	a.Equal([]string{"cat"}, q.Tags)
+	a.Equal([]string{"nsfw"}, q.ExcludeTags)
+	a.Equal([]MetaPredicate{MetaEq("user", "foo")}, q.Meta)
+	a.Equal(50, q.Limit)
+	a.Equal(`"exact phrase"`, q.Filter.String()[len(`caption:`):])
+	a.Equal(`topic:/twitter/** tag:cat -tag:nsfw meta.user:foo "exact phrase" after:2026-10-01 limit:50`, q.String())
+
+	// matched as Filter
+	a.True(q.Filter.Match(&Item{Caption: "an exact phrase."}))
+	a.False(q.Filter.Match(&Item{Caption: "phrase exact"}))
+
+	q, err = ParseQueryFor(`is:unread -topic:/twitter/private tag:a,b origin:pixiv.ranking -meta.nsfw:true collapse:true`, "alice")
+	a.NoError(err)
+	a.Equal("alice", q.User)
+	a.Equal([]string{"!/twitter/private"}, q.Topics)
+	a.Equal([]string{"a", "b"}, q.AnyTags)
+	a.Equal([]string{"pixiv.ranking"}, q.Origins)
+	a.Equal(DefaultSimilarDistance, q.CollapseDistance)
+	a.Equal("-meta.nsfw:true", q.Filter.String())
+}
+
+func TestQueryRoundTrip(t *testing.T) {
+	a := assert.New(t)
+	exprs := []string{
+		``,
+		`topic:/twitter/**,/pixiv/** -topic:/twitter/private`,
+		`tag:cat tag:dog tag:a,b -tag:nsfw,gore`,
+		`origin:twitter.tweet -origin:pixiv.ranking origin:a,b`,
+		`meta.user:"00123" meta.bookmarks:>=1000 meta.shelf:* -meta.nsfw:true`,
+		`cat "a:b" "-minus" -dog caption:"^(cat|dog)"`,
+		`after:2026-10-01 before:2026-10-02T12:30:00+09:00`,
+		`after:1790000000123 min_id:10 max_id:20 limit:5 offset:3`,
+		`user:"john doe" is:starred is:unread show:hidden show:deleted collapse:4`,
+	}
+	for _, expr := range exprs {
+		q, err := ParseQuery(expr)
+		if !a.NoError(err, expr) {
+			continue
+		}
+		s := q.String()
+		reparsed, err := ParseQuery(s)
+		if !a.NoError(err, s) {
+			continue
+		}
+		a.Equal(s, reparsed.String(), expr)
+		a.True(q.After.Equal(reparsed.After), expr)
+		a.True(q.Before.Equal(reparsed.Before), expr)
+		a.Equal(q.Topics, reparsed.Topics, expr)
+		a.Equal(q.Meta, reparsed.Meta, expr)
+		a.Equal(q.Limit, reparsed.Limit, expr)
+	}
+	q := &Query{Topics: []string{"/a b"}, Origins: []string{"x"}, Limit: 10, Collapse: true}
+	reparsed, err := ParseQuery(q.String())
+	a.NoError(err)
+	a.Equal(q, reparsed)
+}
+
+func TestParseQueryError(t *testing.T) {
+	a := assert.New(t)
+	cases := []struct {
+		expr string
+		pos  int
+		msg  string
+	}{
+		{`tag:cat limit:x`, 14, `invalid limit "x"`},
+		{`tag:cat  foo:bar`, 9, `unknown key "foo"`},
+		{`limit:1 limit:2`, 8, `duplicate limit`},
+		{`after:yesterday`, 6, `invalid time "yesterday", expected 2006-01-02 or RFC3339`},
+		{`-limit:5`, 0, `limit can't be negated`},
+		{`topic:/a "unterminated`, 9, `unterminated quote`},
+		{`is:read`, 3, `unknown is:read, expected starred or unread`},
+		{`tag:cat is:unread`, 8, `is:unread requires user:`},
+		{`meta.n:>x`, 7, `invalid number "x"`},
+		{`caption:"("`, 8, "error parsing regexp: missing closing ): `(`"},
+		{`-`, 0, `expected term after -`},
+	}
+	for _, c := range cases {
+		_, err := ParseQuery(c.expr)
+		se, ok := err.(*SyntaxError)
+		if !a.True(ok, "%s: %v", c.expr, err) {
+			continue
+		}
+		a.Equal(c.pos, se.Pos, c.expr)
+		a.Equal(c.msg, se.Msg, c.expr)
+	}
+	_, err := ParseQuery(`tag:cat limit:x`)
+	a.Equal("col 15: invalid limit \"x\"\n\ttag:cat limit:x\n\t              ^", err.Error())
+}
@@ -0,0 +1,273 @@
+package timeline
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Meta field set by modules when media of the item is archived into shelf,
+// its value is the blob key.
+const MetaShelf = "shelf"
+
+var (
+	DefaultPruneBatchSize = 500
+	DefaultPruneInterval  = 1 * time.Hour
+	// Pause between batches, to let other writers take the database lock.
+	DefaultPruneBatchPause = 50 * time.Millisecond
+	PruneStatsHistory      = 24
+)
+
+// Retention rule for topics matched to Pattern, see TopicPattern.
+// Zero MaxAge and MaxCount means unlimited.
+// Kept items are also counted for MaxCount.
+type RetentionRule struct {
+	Pattern  string        `yaml:"pattern" json:"pattern"`
+	MaxAge   time.Duration `yaml:"max_age" json:"maxAge"`
+	MaxCount int           `yaml:"max_count" json:"maxCount"`
+	// Keep items whose media is archived into shelf, see MetaShelf.
+	KeepArchived bool `yaml:"keep_archived" json:"keepArchived"`
+	// Keep items starred by any user.
+	KeepStarred bool `yaml:"keep_starred" json:"keepStarred"`
+	// Keep items matched to the filter expression, see Filter.
+	Keep string `yaml:"keep" json:"keep,omitempty"`
+}
+
+// timeline_retention.yaml
+//   interval: 1h
+//   rules:
+//     - pattern: /twitter/**
+//       max_age: 720h
+//       keep_archived: true
+//     - pattern: /pixiv/ranking/daily
+//       max_count: 5000
+type RetentionConfig struct {
+	Interval   time.Duration   `yaml:"interval"`
+	BatchSize  int             `yaml:"batch_size"`
+	BatchPause time.Duration   `yaml:"batch_pause"`
+	Rules      []RetentionRule `yaml:"rules"`
+}
+
+// Result of a pruning run.
+type PruneStats struct {
+	Started  time.Time        `json:"started"`
+	Duration time.Duration    `json:"duration"`
+	Batches  int              `json:"batches"`
+	Total    int64            `json:"total"`
+	Pruned   map[string]int64 `json:"pruned"` // by topic key
+	Error    string           `json:"error,omitempty"`
+}
+
+func (r *RetentionRule) keepQueries() ([]*Query, error) {
+	var keep []*Query
+	if r.KeepArchived {
+		keep = append(keep, &Query{Meta: []MetaPredicate{MetaExists(MetaShelf)}})
+	}
+	if r.KeepStarred {
+		keep = append(keep, &Query{Starred: true})
+	}
+	if r.Keep != "" {
+		f, err := ParseFilter(r.Keep)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid keep of %s: %v", r.Pattern, err)
+		}
+		keep = append(keep, &Query{Filter: f})
+	}
+	return keep, nil
+}
+
+// Retention deletes old items by rules periodically.
+type Retention struct {
+	s       *Service
+	conf    RetentionConfig
+	rules   []retentionRule
+	stats   []*PruneStats
+	statsMu sync.Mutex
+	runMu   sync.Mutex
+}
+
+type retentionRule struct {
+	RetentionRule
+	keep []*Query
+}
+
+func NewRetention(s *Service, conf RetentionConfig) (*Retention, error) {
+	if conf.Interval <= 0 {
+		conf.Interval = DefaultPruneInterval
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = DefaultPruneBatchSize
+	}
+	if conf.BatchPause <= 0 {
+		conf.BatchPause = DefaultPruneBatchPause
+	}
+	r := &Retention{s: s, conf: conf}
+	for _, rule := range conf.Rules {
+		keep, err := rule.keepQueries()
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, retentionRule{
+			RetentionRule: rule,
+			keep:          keep,
+		})
+	}
+	return r, nil
+}
+
+func (r *Retention) Rules() []RetentionRule {
+	return r.conf.Rules
+}
+
+// Run pruning every Interval until ctx is done, onRun is called with result if not nil.
+func (r *Retention) Start(ctx context.Context, onRun func(*PruneStats)) {
+	tick := time.NewTicker(r.conf.Interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			stats := r.Run(ctx)
+			if onRun != nil {
+				onRun(stats)
+			}
+		}
+	}
+}
+
+// Prune items by all rules once. Topics matched to multiple rules are pruned by each rule.
+func (r *Retention) Run(ctx context.Context) *PruneStats {
+	r.runMu.Lock()
+	defer r.runMu.Unlock()
+	stats := &PruneStats{
+		Started: time.Now(),
+		Pruned:  make(map[string]int64),
+	}
+	for i := range r.rules {
+		if err := r.prune(ctx, &r.rules[i], stats); err != nil {
+			stats.Error = err.Error()
+			break
+		}
+	}
+	stats.Duration = time.Since(stats.Started)
+	r.statsMu.Lock()
+	r.stats = append(r.stats, stats)
+	if len(r.stats) > PruneStatsHistory {
+		r.stats = r.stats[len(r.stats)-PruneStatsHistory:]
+	}
+	r.statsMu.Unlock()
+	return stats
+}
+
+// Stats of recent runs, oldest first.
+func (r *Retention) Stats() []*PruneStats {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	return append([]*PruneStats(nil), r.stats...)
+}
+
+func (r *Retention) prune(ctx context.Context, rule *retentionRule, stats *PruneStats) error {
+	storage := r.s.persistent
+	if storage == nil || (rule.MaxAge <= 0 && rule.MaxCount <= 0) {
+		return nil
+	}
+	// archived topics are also pruned
+	var keys []string
+	for _, t := range r.s.Topics(rule.Pattern) {
+		keys = append(keys, t.Key)
+	}
+	for _, t := range r.s.ArchivedTopics(rule.Pattern) {
+		keys = append(keys, t.Key)
+	}
+	for _, key := range keys {
+		var queries []*Query
+		if rule.MaxAge > 0 {
+			queries = append(queries, &Query{Topics: []string{key}, Before: stats.Started.Add(-rule.MaxAge)})
+		}
+		if rule.MaxCount > 0 {
+			// newest item to be pruned
+			items, err := storage.Select(ctx, &Query{Topics: []string{key}, Limit: 1, Offset: rule.MaxCount})
+			if err != nil {
+				return err
+			}
+			if len(items) > 0 {
+				queries = append(queries, &Query{Topics: []string{key}, MaxID: int(items[0].ID)})
+			}
+		}
+		for _, q := range queries {
+			for {
+				n, err := storage.DeleteItems(ctx, q, rule.keep, r.conf.BatchSize)
+				if err != nil {
+					return err
+				}
+				stats.Batches++
+				stats.Total += n
+				if n > 0 {
+					stats.Pruned[key] += n
+					r.s.touchKeys(key)
+				}
+				if n < int64(r.conf.BatchSize) {
+					break
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(r.conf.BatchPause):
+				}
+			}
+		}
+		if stats.Pruned[key] > 0 {
+			if err := r.evictHistory(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Remove pruned items of the topic from history of topics and saved searches,
+// so that they are not replayed by WithHistory.
+func (r *Retention) evictHistory(ctx context.Context, key string) error {
+	candidates := make(map[*Topic][]*Item)
+	minID, maxID := int64(math.MaxInt64), int64(0)
+	r.s.topicsMu.RLock()
+	for _, t := range r.s.topics {
+		t.historyMu.Lock()
+		for e := t.history.Front(); e != nil; e = e.Next() {
+			// digest items are kept as updateHistory does
+			if it := e.Value.(*Item); it.TopicKey == key && !it.IsDigest() {
+				candidates[t] = append(candidates[t], it)
+				if it.ID < minID {
+					minID = it.ID
+				}
+				if it.ID > maxID {
+					maxID = it.ID
+				}
+			}
+		}
+		t.historyMu.Unlock()
+	}
+	r.s.topicsMu.RUnlock()
+	if len(candidates) == 0 {
+		return nil
+	}
+	items, err := r.s.persistent.Select(ctx, &Query{Topics: []string{key}, MinID: int(minID), MaxID: int(maxID), ShowDeleted: true})
+	if err != nil {
+		return err
+	}
+	exists := make(map[int64]bool, len(items))
+	for _, it := range items {
+		exists[it.ID] = true
+	}
+	for t, its := range candidates {
+		for _, it := range its {
+			if !exists[it.ID] {
+				t.updateHistory(it, true)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package timeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetention(t *testing.T) {
+	a := assert.New(t)
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("retention/test", "/retention/age"))
+	a.NoError(s.NewTopic("retention/test", "/retention/count"))
+	a.NoError(s.NewTopic("retention/test", "/other"))
+	_, err := s.NewSavedSearch("retention", "topic:/retention/count", TopicInfo{})
+	a.NoError(err)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		ts := now.Add(-time.Duration(10-i) * 24 * time.Hour)
+		age := &Item{Caption: "age", OriginKey: int64(i), Timestamp: ts}
+		if i == 0 {
+			age.Meta = map[string]interface{}{MetaShelf: "blob"}
+		}
+		a.NoError(s.Publish("/retention/age", age))
+		a.NoError(s.Publish("/retention/count", &Item{Caption: "count", OriginKey: int64(i), Timestamp: ts}))
+		a.NoError(s.Publish("/other", &Item{Caption: "other", OriginKey: int64(i), Timestamp: ts}))
+	}
+	r, err := NewRetention(s, RetentionConfig{
+		BatchSize:  2,
+		BatchPause: time.Millisecond,
+		Rules: []RetentionRule{
+			{Pattern: "/retention/age", MaxAge: 5*24*time.Hour + time.Hour, KeepArchived: true},
+			{Pattern: "/retention/count", MaxCount: 3, Keep: "meta.pinned:*"},
+		},
+	})
+	a.NoError(err)
+	stats := r.Run(context.Background())
+	a.Empty(stats.Error)
+	// items older than 5 days except archived one
+	a.Equal(int64(4), stats.Pruned["/retention/age"])
+	a.Equal(int64(7), stats.Pruned["/retention/count"])
+	a.Equal(int64(11), stats.Total)
+	counts, err := s.Count(context.Background(), &Query{})
+	a.NoError(err)
+	a.Equal(map[string]int64{"/retention/age": 6, "/retention/count": 3, "/other": 10}, counts)
+
+	ageItems, err := s.Fetch(context.Background(), &Query{Topics: []string{"/retention/age"}, MaxID: 1 << 30, Limit: 1, Offset: 5})
+	a.NoError(err)
+	a.Equal([]int64{0}, mapOriginKey(ageItems))
+
+	// pruned items are not replayed
+	for _, key := range []string{"/retention/count", "/saved/retention"} {
+		lis, err := s.Listen(key, WithHistory(10))
+		a.NoError(err)
+		a.Equal([]int64{7, 8, 9}, mapOriginKey(eventItems(lis.Fetch(0))), key)
+		lis.Close()
+	}
+
+	// nothing to prune in second run
+	stats = r.Run(context.Background())
+	a.Equal(int64(0), stats.Total)
+	a.Len(r.Stats(), 2)
+
+	_, err = NewRetention(s, RetentionConfig{Rules: []RetentionRule{{Pattern: "/", MaxCount: 1, Keep: "unknown:1"}}})
+	a.Error(err)
+}
+
+func TestRetentionZeroTimestamp(t *testing.T) {
+	a := assert.New(t)
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("retention/test", "/retention/now"))
+	published := &Item{Caption: "published", OriginKey: 1}
+	a.NoError(s.Publish("/retention/now", published))
+	a.False(published.Timestamp.IsZero())
+	// inserted without Publish, as Import does
+	inserted := &Item{Caption: "inserted", OriginKey: 2, TopicID: published.TopicID}
+	_, err := s.persistent.Insert(context.Background(), inserted)
+	a.NoError(err)
+	a.False(inserted.Timestamp.IsZero())
+
+	r, err := NewRetention(s, RetentionConfig{Rules: []RetentionRule{{Pattern: "/retention/**", MaxAge: time.Hour}}})
+	a.NoError(err)
+	stats := r.Run(context.Background())
+	a.Empty(stats.Error)
+	a.Equal(int64(0), stats.Total)
+	items, err := s.Fetch(context.Background(), &Query{Topics: []string{"/retention/now"}})
+	a.NoError(err)
+	a.Equal([]int64{2, 1}, mapOriginKey(items))
+}
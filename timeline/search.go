@@ -0,0 +1,507 @@
+package timeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kanosaki/dumper/common"
+)
+
+// Saved search is a virtual topic keyed SavedSearchPrefix + name, whose items are
+// items of other topics matched to its query. It can be listed, listened, fetched and
+// marked as read as ordinary topics, but can't be published to.
+const (
+	SavedSearchOrigin = "saved"
+	SavedSearchPrefix = "/saved/"
+)
+
+var ErrSearchName = errors.New("Invalid saved search name")
+
+func SavedSearchKey(name string) string {
+	return SavedSearchPrefix + name
+}
+
+func (s *SQLiteStorage) SavedSearches(ctx context.Context) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT topic.key, saved_search.query
+		FROM saved_search JOIN topic on saved_search.topic_id = topic.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make(map[string]string)
+	for rows.Next() {
+		var key, expr string
+		if err := rows.Scan(&key, &expr); err != nil {
+			return nil, err
+		}
+		ret[key] = expr
+	}
+	return ret, rows.Err()
+}
+
+func (s *SQLiteStorage) SaveSearch(ctx context.Context, topicKey, expr string) error {
+	s.topicsMu.Lock()
+	tMeta, ok := s.topics[topicKey]
+	s.topicsMu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO saved_search(topic_id, query, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(topic_id) DO UPDATE SET query = excluded.query, updated_at = excluded.updated_at`,
+		tMeta.ID, expr, common.Timestamp(time.Now()))
+	return err
+}
+
+// Parse query of a saved search. Per-user state and paging are given on fetch.
+func parseSavedSearch(expr string) (*Query, error) {
+	q, err := ParseQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+	var rejected []string
+	if q.User != "" || q.Starred || q.Unread || q.ShowHidden {
+		rejected = append(rejected, "user state")
+	}
+	if q.Limit > 0 || q.Offset > 0 || q.MinID > 0 || q.MaxID > 0 {
+		rejected = append(rejected, "paging")
+	}
+	if q.Collapse {
+		rejected = append(rejected, "collapse")
+	}
+	if len(rejected) > 0 {
+		return nil, &SyntaxError{Input: expr, Msg: fmt.Sprintf("saved search can't have %s", strings.Join(rejected, " and "))}
+	}
+	return q, nil
+}
+
+func validSearchName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "/") && !strings.HasSuffix(name, "/") &&
+		!strings.ContainsAny(name, " \t\r\n*?!,\"")
+}
+
+// Create a saved search of the query expression, see ParseQuery.
+func (s *Service) NewSavedSearch(name, expr string, info TopicInfo) (*Topic, error) {
+	if !validSearchName(name) {
+		return nil, ErrSearchName
+	}
+	q, err := parseSavedSearch(expr)
+	if err != nil {
+		return nil, err
+	}
+	key := SavedSearchKey(name)
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	if _, ok := s.topics[key]; ok {
+		return nil, ErrTopicExists
+	}
+	if s.persistent != nil {
+		ctx := context.Background()
+		originID, err := s.persistent.OriginID(ctx, SavedSearchOrigin, true)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.persistent.TopicID(ctx, key, originID, true); err != nil {
+			return nil, err
+		}
+		if err := s.persistent.SaveSearch(ctx, key, expr); err != nil {
+			return nil, err
+		}
+	}
+	return s.newTopicLocked(SavedSearchOrigin, key, info, q, expr)
+}
+
+// Replace query of the saved search. Read markers are kept, since the topic is not changed.
+func (s *Service) UpdateSavedSearch(key, expr string) error {
+	q, err := parseSavedSearch(expr)
+	if err != nil {
+		return err
+	}
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	t, ok := s.topics[key]
+	if !ok || t.search == nil {
+		return ErrNoTopic
+	}
+	if s.persistent != nil {
+		if err := s.persistent.SaveSearch(context.Background(), key, expr); err != nil {
+			return err
+		}
+	}
+	t.infoMu.Lock()
+	t.search, t.searchExpr = q, expr
+	t.infoMu.Unlock()
+	s.notifyTopic(t, TopicUpdated, "")
+	return nil
+}
+
+// Register saved searches in storage, should be called once after NewService.
+func (s *Service) LoadSavedSearches(ctx context.Context) error {
+	if s.persistent == nil {
+		return nil
+	}
+	searches, err := s.persistent.SavedSearches(ctx)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(searches))
+	for k := range searches {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	for _, key := range keys {
+		if _, ok := s.topics[key]; ok {
+			continue
+		}
+		q, err := parseSavedSearch(searches[key])
+		if err != nil {
+			return fmt.Errorf("Saved search %s: %v", key, err)
+		}
+		if _, err := s.newTopicLocked(SavedSearchOrigin, key, TopicInfo{}, q, searches[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query expression of the saved search, empty for ordinary topics.
+func (t *Topic) SavedSearch() string {
+	t.infoMu.RLock()
+	defer t.infoMu.RUnlock()
+	return t.searchExpr
+}
+
+// Deliver the event to listeners of saved searches matched to its item.
+// Should be called with topicsMu locked.
+func (s *Service) publishSearches(ev ItemEvent, published map[*Listener]struct{}, st stream) {
+	aliases := s.tagAliases()
+	for _, k := range s.topicKeys {
+		t := s.topics[k]
+		if t.search != nil && !t.Archived && t.search.match(ev.Item, aliases) {
+			t.publish(ev, published, st)
+		}
+	}
+}
+
+// Evaluate q in memory, consistent with SQL version except that
+// tag aliases and per-user state are not evaluated.
+func (q *Query) Match(it *Item) bool {
+	return q.match(it, nil)
+}
+
+// Tag aliases are resolved by aliases.
+func (q *Query) match(it *Item, aliases tagAliases) bool {
+	if len(q.Topics) > 0 && !matchTopicEntries(q.Topics, it.TopicKey) {
+		return false
+	}
+	if len(q.Origins) > 0 && !containsString(q.Origins, it.Origin) {
+		return false
+	}
+	for i := range q.Meta {
+		if !q.Meta[i].Match(it.Meta) {
+			return false
+		}
+	}
+	if q.Filter != nil && !q.Filter.match(it, aliases) {
+		return false
+	}
+	for _, t := range aliases.resolve(NormalizeTags(q.Tags)) {
+		if !hasAnyTag(it, []string{t}) {
+			return false
+		}
+	}
+	if anyTags := aliases.resolve(NormalizeTags(q.AnyTags)); len(anyTags) > 0 && !hasAnyTag(it, anyTags) {
+		return false
+	}
+	if hasAnyTag(it, aliases.resolve(NormalizeTags(q.ExcludeTags))) {
+		return false
+	}
+	if (!q.After.IsZero() && it.Timestamp.Before(q.After)) || (!q.Before.IsZero() && it.Timestamp.After(q.Before)) {
+		return false
+	}
+	return (q.MinID <= 0 || it.ID >= int64(q.MinID)) && (q.MaxID <= 0 || it.ID <= int64(q.MaxID))
+}
+
+func matchTopicEntries(entries []string, key string) bool {
+	keys, ok := resolveTopics(entries, []string{key})
+	return ok && containsString(keys, key)
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Query matched to both of the saved search q and o. Topics of o are replaced by q.
+func (q *Query) and(o *Query) *Query {
+	ret := *o
+	ret.Topics = q.Topics
+	ret.Origins = q.Origins
+	ret.Filter = q.Filter.And(o.Filter)
+	var terms []filterTerm
+	if len(o.Origins) > 0 {
+		if len(q.Origins) == 0 {
+			ret.Origins = o.Origins
+		} else {
+			terms = append(terms, filterTerm{kind: filterOrigin, origins: o.Origins})
+		}
+	}
+	ret.AnyTags = q.AnyTags
+	if anyTags := NormalizeTags(o.AnyTags); len(anyTags) > 0 {
+		if len(q.AnyTags) == 0 {
+			ret.AnyTags = anyTags
+		} else {
+			terms = append(terms, filterTerm{kind: filterTag, tags: anyTags})
+		}
+	}
+	if len(terms) > 0 {
+		ret.Filter = ret.Filter.And(&Filter{terms: terms})
+	}
+	ret.Meta = append(append([]MetaPredicate(nil), q.Meta...), o.Meta...)
+	ret.Tags = append(append([]string(nil), q.Tags...), o.Tags...)
+	ret.ExcludeTags = append(append([]string(nil), q.ExcludeTags...), o.ExcludeTags...)
+	if q.After.After(o.After) {
+		ret.After = q.After
+	}
+	if !q.Before.IsZero() && (o.Before.IsZero() || q.Before.Before(o.Before)) {
+		ret.Before = q.Before
+	}
+	return &ret
+}
+
+// Sub-queries of a fetch, saved searches in Query.Topics are expanded.
+type fetchPlan struct {
+	rest     *Query // ordinary topics, nil if all topics are saved searches
+	searches []searchQuery
+}
+
+type searchQuery struct {
+	key string
+	q   *Query
+}
+
+// Should be called with topicsMu locked.
+func (s *Service) planFetch(q *Query) fetchPlan {
+	if len(q.Topics) == 0 {
+		return fetchPlan{rest: q}
+	}
+	keys, _ := resolveTopics(q.Topics, s.topicKeys)
+	var plan fetchPlan
+	var rest []string
+	for _, k := range keys {
+		if t, ok := s.topics[k]; ok && t.search != nil {
+			plan.searches = append(plan.searches, searchQuery{key: k, q: t.search.and(q)})
+		} else {
+			rest = append(rest, k)
+		}
+	}
+	if len(plan.searches) == 0 {
+		return fetchPlan{rest: q}
+	}
+	if len(rest) > 0 {
+		r := *q
+		r.Topics = rest
+		plan.rest = &r
+	}
+	return plan
+}
+
+// Read markers of saved searches are compared with item IDs, instead of markers of item topics.
+func (s *Service) searchMarkers(ctx context.Context, q *Query, plan fetchPlan) (map[string]int64, error) {
+	if len(plan.searches) == 0 || q.User == "" {
+		return nil, nil
+	}
+	return s.persistent.ReadMarkers(ctx, q.User)
+}
+
+func (sq *searchQuery) withMarker(markers map[string]int64) *Query {
+	if !sq.q.Unread {
+		return sq.q
+	}
+	q := *sq.q
+	q.Unread = false
+	// all items are unread without marker
+	q.readUpTo = markers[sq.key]
+	return &q
+}
+
+// Queries to be run for the plan, key is empty for ordinary topics.
+func (plan fetchPlan) subQueries(markers map[string]int64) []searchQuery {
+	var subs []searchQuery
+	if plan.rest != nil {
+		subs = append(subs, searchQuery{q: plan.rest})
+	}
+	for _, sq := range plan.searches {
+		subs = append(subs, searchQuery{key: sq.key, q: sq.withMarker(markers)})
+	}
+	return subs
+}
+
+func (s *Service) runFetch(ctx context.Context, q *Query, plan fetchPlan) ([]*Item, error) {
+	if len(plan.searches) == 0 {
+		return s.persistent.Select(ctx, plan.rest)
+	}
+	markers, err := s.searchMarkers(ctx, q, plan)
+	if err != nil {
+		return nil, err
+	}
+	subs := plan.subQueries(markers)
+	var merged []*Item
+	seen := make(map[int64]bool)
+	for _, sub := range subs {
+		if len(subs) > 1 && sub.q.Limit > 0 {
+			// paged after merge
+			copied := *sub.q
+			copied.Limit, copied.Offset = sub.q.Limit+sub.q.Offset, 0
+			sub.q = &copied
+		}
+		items, err := s.persistent.Select(ctx, sub.q)
+		if err != nil {
+			return nil, err
+		}
+		for _, it := range items {
+			if sub.key != "" && it.State != nil {
+				it.State.Read = it.ID <= markers[sub.key]
+			}
+			if !seen[it.ID] {
+				seen[it.ID] = true
+				merged = append(merged, it)
+			}
+		}
+	}
+	if len(subs) == 1 {
+		return merged, nil
+	}
+	byTimestamp, ascend := q.orderBy()
+	sort.SliceStable(merged, func(i, j int) bool {
+		if byTimestamp && !merged[i].Timestamp.Equal(merged[j].Timestamp) {
+			return merged[i].Timestamp.After(merged[j].Timestamp)
+		}
+		return merged[i].ID > merged[j].ID
+	})
+	if ascend {
+		reverseItems(merged)
+	}
+	if q.Offset > 0 {
+		if q.Offset >= len(merged) {
+			return nil, nil
+		}
+		merged = merged[q.Offset:]
+	}
+	if q.Limit > 0 && len(merged) > q.Limit {
+		merged = merged[:q.Limit]
+	}
+	if ascend {
+		reverseItems(merged)
+	}
+	return merged, nil
+}
+
+func (s *Service) runCount(ctx context.Context, q *Query, plan fetchPlan) (map[string]int64, error) {
+	if len(plan.searches) == 0 {
+		return s.persistent.CountByTopic(ctx, plan.rest)
+	}
+	ret := make(map[string]int64)
+	if plan.rest != nil {
+		counts, err := s.persistent.CountByTopic(ctx, plan.rest)
+		if err != nil {
+			return nil, err
+		}
+		for k, n := range counts {
+			ret[k] = n
+		}
+	}
+	markers, err := s.searchMarkers(ctx, q, plan)
+	if err != nil {
+		return nil, err
+	}
+	for _, sq := range plan.searches {
+		counts, err := s.persistent.CountByTopic(ctx, sq.withMarker(markers))
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range counts {
+			ret[sq.key] += n
+		}
+	}
+	return ret, nil
+}
+
+// Tag counts are summed over sub-queries, so an item matched by several of them is counted for each.
+func (s *Service) runTagCounts(ctx context.Context, q *Query, plan fetchPlan, limit int) ([]TagCount, error) {
+	if len(plan.searches) == 0 {
+		return s.persistent.TagCounts(ctx, plan.rest, limit)
+	}
+	markers, err := s.searchMarkers(ctx, q, plan)
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]int64)
+	for _, sub := range plan.subQueries(markers) {
+		counts, err := s.persistent.TagCounts(ctx, sub.q, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, tc := range counts {
+			sums[tc.Tag] += tc.Count
+		}
+	}
+	ret := make([]TagCount, 0, len(sums))
+	for tag, n := range sums {
+		ret = append(ret, TagCount{Tag: tag, Count: n})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Tag < ret[j].Tag
+	})
+	if limit > 0 && len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret, nil
+}
+
+// Items of saved searches are grouped under their keys when grouped by topic, as runCount does.
+func (s *Service) runCountByBucket(ctx context.Context, sq *StatsQuery, plan fetchPlan) ([]BucketCount, error) {
+	if len(plan.searches) == 0 {
+		resolved := *sq
+		resolved.Query = plan.rest
+		return s.persistent.CountByBucket(ctx, &resolved)
+	}
+	markers, err := s.searchMarkers(ctx, sq.Query, plan)
+	if err != nil {
+		return nil, err
+	}
+	var ret []BucketCount
+	for _, sub := range plan.subQueries(markers) {
+		resolved := *sq
+		resolved.Query = sub.q
+		counts, err := s.persistent.CountByBucket(ctx, &resolved)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range counts {
+			if sub.key != "" && sq.GroupBy == GroupByTopic {
+				c.Group = sub.key
+			}
+			ret = append(ret, c)
+		}
+	}
+	return ret, nil
+}
+
+func reverseItems(items []*Item) {
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+}
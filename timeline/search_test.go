@@ -0,0 +1,195 @@
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func receiveCaptions(lis *Listener) []string {
+	var ret []string
+	for _, ev := range lis.Fetch(0) {
+		ret = append(ret, ev.Item.Caption)
+	}
+	return ret
+}
+
+func TestSavedSearch(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	storage := newPrivateStorage(t)
+	s := NewService(storage)
+	a.NoError(s.NewTopic("twitter.tweet", "/search/twitter/a"))
+	a.NoError(s.NewTopic("pixiv.ranking", "/search/pixiv"))
+	a.NoError(s.Publish("/search/twitter/a",
+		&Item{Caption: "cat 1", OriginKey: 1, Tags: []string{"cat"}},
+		&Item{Caption: "dog 1", OriginKey: 2, Tags: []string{"dog"}}))
+	a.NoError(s.Publish("/search/pixiv", &Item{Caption: "cat 2", OriginKey: 3, Tags: []string{"cat"}}))
+
+	cats, err := s.NewSavedSearch("cats", "topic:/search/** tag:cat", TopicInfo{Title: "Cats"})
+	a.NoError(err)
+	a.Equal("/saved/cats", cats.Key)
+	_, err = s.NewSavedSearch("cats", "tag:cat", TopicInfo{})
+	a.Equal(ErrTopicExists, err)
+	_, err = s.NewSavedSearch("bad name", "tag:cat", TopicInfo{})
+	a.Equal(ErrSearchName, err)
+	_, err = s.NewSavedSearch("paged", "tag:cat limit:10", TopicInfo{})
+	a.IsType(&SyntaxError{}, err)
+	a.Equal(ErrSavedSearch, s.Publish("/saved/cats", &Item{OriginKey: 4}))
+
+	// listed and fetched as a topic
+	a.Equal([]*Topic{cats}, s.Topics("/saved/**"))
+	items, err := s.Fetch(ctx, &Query{Topics: []string{"/saved/cats"}})
+	a.NoError(err)
+	a.Equal([]string{"cat 2", "cat 1"}, captions(items))
+	items, err = s.Fetch(ctx, &Query{Topics: []string{"/saved/cats", "/search/twitter/a"}, Limit: 2})
+	a.NoError(err)
+	a.Equal([]string{"cat 2", "dog 1"}, captions(items))
+	counts, err := s.Count(ctx, &Query{Topics: []string{"/saved/**"}})
+	a.NoError(err)
+	a.Equal(map[string]int64{"/saved/cats": 2}, counts)
+
+	// listened with history
+	lis, err := s.Listen("/saved/cats", WithHistory(10))
+	a.NoError(err)
+	defer lis.Close()
+	all, err := s.Listen("/**")
+	a.NoError(err)
+	defer all.Close()
+	a.Equal([]string{"cat 1", "cat 2"}, receiveCaptions(lis))
+	a.NoError(s.Publish("/search/twitter/a",
+		&Item{Caption: "cat 3", OriginKey: 5, Tags: []string{"cat"}},
+		&Item{Caption: "dog 2", OriginKey: 6, Tags: []string{"dog"}}))
+	a.Equal([]string{"cat 3"}, receiveCaptions(lis))
+	// delivered once
+	a.Equal([]string{"cat 3", "dog 2"}, receiveCaptions(all))
+
+	// read state of the saved search
+	a.NoError(s.MarkRead(ctx, "alice", "/saved/cats", 0))
+	a.NoError(s.Publish("/search/pixiv", &Item{Caption: "cat 4", OriginKey: 7, Tags: []string{"cat"}}))
+	unread, err := s.UnreadCounts(ctx, "alice", "/saved/**")
+	a.NoError(err)
+	a.Equal(map[string]int64{"/saved/cats": 1}, unread)
+	items, err = s.Fetch(ctx, &Query{Topics: []string{"/saved/cats"}, User: "alice", Unread: true})
+	a.NoError(err)
+	a.Equal([]string{"cat 4"}, captions(items))
+	items, err = s.Fetch(ctx, &Query{Topics: []string{"/saved/cats"}, User: "alice", Limit: 2})
+	a.NoError(err)
+	a.False(items[0].State.Read)
+	a.True(items[1].State.Read)
+
+	// editing keeps read state, dog 2 is published after marked as read
+	a.NoError(s.UpdateSavedSearch("/saved/cats", "topic:/search/** tag:cat,dog"))
+	a.Equal("topic:/search/** tag:cat,dog", cats.SavedSearch())
+	unread, err = s.UnreadCounts(ctx, "alice", "/saved/**")
+	a.NoError(err)
+	a.Equal(map[string]int64{"/saved/cats": 2}, unread)
+	items, err = s.Fetch(ctx, &Query{Topics: []string{"/saved/cats"}})
+	a.NoError(err)
+	a.Len(items, 6)
+	a.Equal(ErrNoTopic, s.UpdateSavedSearch("/search/pixiv", "tag:cat"))
+
+	// loaded after restart
+	restarted := NewService(storage)
+	a.NoError(restarted.LoadSavedSearches(ctx))
+	loaded, ok := restarted.Topic("/saved/cats")
+	a.True(ok)
+	a.Equal("topic:/search/** tag:cat,dog", loaded.SavedSearch())
+	a.Equal("Cats", loaded.Title)
+
+	_, err = s.DeleteTopic("/saved/cats")
+	a.NoError(err)
+	var n int
+	a.NoError(storage.DB().QueryRow(`SELECT COUNT(*) FROM saved_search`).Scan(&n))
+	a.Equal(0, n)
+}
+
+// Entry points other than Fetch and Count expand saved searches too.
+func TestSavedSearchEntryPoints(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("test", "/search/a"))
+	cat1 := &Item{Caption: "cat 1", OriginKey: 1, Tags: []string{"cat"}}
+	dog := &Item{Caption: "dog 1", OriginKey: 2, Tags: []string{"dog"}}
+	cat2 := &Item{Caption: "cat 2", OriginKey: 3, Tags: []string{"cat", "kitten"}}
+	a.NoError(s.Publish("/search/a", cat1, dog, cat2))
+	_, err := s.NewSavedSearch("cats", "topic:/search/** tag:cat", TopicInfo{})
+	a.NoError(err)
+	saved := []string{"/saved/cats"}
+
+	// resync of streams and webhooks
+	items, err := s.FetchSince(ctx, "/saved/cats", 0, 10, nil)
+	a.NoError(err)
+	a.Equal([]string{"cat 1", "cat 2"}, captions(items))
+	items, err = s.FetchSince(ctx, "/saved/cats", cat1.ID, 10, nil)
+	a.NoError(err)
+	a.Equal([]string{"cat 2"}, captions(items))
+
+	var buf bytes.Buffer
+	n, err := s.Export(ctx, &buf, &Query{Topics: saved})
+	a.NoError(err)
+	a.Equal(int64(2), n)
+	a.NotContains(buf.String(), "dog 1")
+
+	for it, h := range map[*Item]PHash{cat1: 0, dog: 0x1, cat2: 0x3} {
+		h := h
+		a.NoError(s.persistent.SetItemHash(ctx, it.ID, &h))
+	}
+	similar, err := s.SimilarItems(ctx, cat1.ID, DefaultSimilarDistance, &Query{Topics: saved})
+	a.NoError(err)
+	a.Equal([]int64{cat2.ID}, itemIDs(similar))
+
+	tags, err := s.TagCounts(ctx, &Query{Topics: saved}, 0)
+	a.NoError(err)
+	a.Equal([]TagCount{{Tag: "cat", Count: 2}, {Tag: "kitten", Count: 1}}, tags)
+	tags, err = s.TagCounts(ctx, &Query{Topics: saved}, 1)
+	a.NoError(err)
+	a.Equal([]TagCount{{Tag: "cat", Count: 2}}, tags)
+
+	stats, err := s.Stats(ctx, &StatsQuery{Query: &Query{Topics: []string{"/search/a", "/saved/cats"}}, Interval: StatsDay, GroupBy: GroupByTopic})
+	a.NoError(err)
+	totals := make(map[string]int64)
+	for _, g := range stats.Groups {
+		totals[g.Key] = g.Total
+	}
+	a.Equal(map[string]int64{"/search/a": 3, "/saved/cats": 2}, totals)
+	stats, err = s.Stats(ctx, &StatsQuery{Query: &Query{Topics: saved}, Interval: StatsDay})
+	a.NoError(err)
+	a.Equal(int64(2), stats.Groups[0].Total)
+}
+
+func TestQueryMatch(t *testing.T) {
+	a := assert.New(t)
+	it := &Item{TopicKey: "/twitter/a", Origin: "twitter.tweet", Caption: "cute cat", Tags: []string{"cat"},
+		Meta: map[string]interface{}{"user": "foo"}}
+	for expr, expected := range map[string]bool{
+		``:                      true,
+		`topic:/twitter/**`:     true,
+		`topic:/twitter`:        false,
+		`-topic:/twitter/a`:     false,
+		`tag:cat meta.user:foo`: true,
+		`tag:cat,dog -tag:nsfw`: true,
+		`tag:dog`:               false,
+		`origin:pixiv.ranking`:  false,
+		`"cute"`:                true,
+		`-cute`:                 false,
+		`after:2026-10-01`:      false,
+		`meta.user:bar`:         false,
+	} {
+		q, err := ParseQuery(expr)
+		if a.NoError(err) {
+			a.Equal(expected, q.Match(it), expr)
+		}
+	}
+}
+
+func captions(items []*Item) []string {
+	ret := make([]string, 0, len(items))
+	for _, it := range items {
+		ret = append(ret, it.Caption)
+	}
+	return ret
+}
@@ -4,16 +4,21 @@ import (
 	"container/list"
 	"context"
 	"errors"
+	"math"
 	"sort"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	DefaultListenerBuffer = 200
-	ListenerCleanupThresh = 4
 	DefaultHistorySize    = 100
-	ErrNoTopic            = errors.New("No matched topic")
+	// Upper bound of WithHistory, which also sizes buffer of the listener.
+	MaxHistory       = 1000
+	ErrNoTopic       = errors.New("No matched topic")
+	ErrTopicArchived = errors.New("Topic is archived")
+	ErrSavedSearch   = errors.New("Topic is a saved search")
 )
 
 type Service struct {
@@ -22,7 +27,17 @@ type Service struct {
 	topics         map[string]*Topic
 	topicKeys      []string // list of topics, sorted
 	topicsMu       sync.RWMutex
+	listeners      map[*Listener]struct{}
+	listenersMu    sync.Mutex
 	persistent     Storage
+	// Publish policies and shapers of topics, nil for topics without policy.
+	policies   []*publishPolicy
+	shapers    map[*Topic]*shaper
+	policiesMu sync.Mutex
+	aliases    tagAliases
+	aliasesMu  sync.Mutex
+	// Unix time in nanoseconds of the last change of topics, saved searches or tag aliases, accessed atomically.
+	modified int64
 }
 
 func NewService(storage Storage) *Service {
@@ -30,51 +45,359 @@ func NewService(storage Storage) *Service {
 		ListenerBuffer: DefaultListenerBuffer,
 		HistorySize:    DefaultHistorySize,
 		topics:         make(map[string]*Topic),
+		listeners:      make(map[*Listener]struct{}),
 		persistent:     storage,
+		shapers:        make(map[*Topic]*shaper),
+		modified:       time.Now().UnixNano(),
 	}
 }
 
 func (s *Service) NewTopic(origin, key string) error {
+	return s.NewTopicWithInfo(origin, key, TopicInfo{})
+}
+
+// Create topic with metadata. If the topic already exists in storage,
+// stored metadata is kept and only empty fields are filled by info.
+func (s *Service) NewTopicWithInfo(origin, key string, info TopicInfo) error {
 	s.topicsMu.Lock()
 	defer s.topicsMu.Unlock()
 	if _, ok := s.topics[key]; ok {
 		return nil
 	}
+	_, err := s.newTopicLocked(origin, key, info, nil, "")
+	return err
+}
+
+// Register a topic, search is given for saved search.
+// Should be called with topicsMu write locked.
+func (s *Service) newTopicLocked(origin, key string, info TopicInfo, search *Query, searchExpr string) (*Topic, error) {
 	var topicID int
 	if s.persistent != nil {
 		ctx := context.Background()
 		originID, err := s.persistent.OriginID(ctx, origin, true)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		topicID, err = s.persistent.TopicID(ctx, key, originID, true)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		stored, err := s.persistent.TopicInfo(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		merged := mergeTopicInfo(stored, info)
+		if merged != stored {
+			if err := s.persistent.UpdateTopicInfo(ctx, key, merged); err != nil {
+				return nil, err
+			}
+		}
+		info = merged
+	} else if info.CreatedAt.IsZero() {
+		info.CreatedAt = time.Now()
 	}
 	s.topicKeys = append(s.topicKeys, key)
 	sort.Strings(s.topicKeys)
 	t := &Topic{
-		Key:     key,
-		s:       s,
-		history: list.New(),
-		ID:      topicID,
+		Key:        key,
+		Origin:     origin,
+		TopicInfo:  info,
+		search:     search,
+		searchExpr: searchExpr,
+		s:          s,
+		history:    list.New(),
+		ID:         topicID,
+		modified:   time.Now().UnixNano(),
 	}
 	s.topics[key] = t
-	// TODO: Consider updating listeners topic
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	if !info.Archived {
+		for l := range s.listeners {
+			if l.Pattern.Match(key) {
+				l.attach(t)
+			}
+		}
+	}
+	s.notifyTopicLocked(t, TopicCreated, "")
+	return t, nil
+}
+
+func mergeTopicInfo(stored, info TopicInfo) TopicInfo {
+	if stored.Title == "" {
+		stored.Title = info.Title
+	}
+	if stored.Description == "" {
+		stored.Description = info.Description
+	}
+	if stored.IconURL == "" {
+		stored.IconURL = info.IconURL
+	}
+	if stored.Module == "" {
+		stored.Module = info.Module
+	}
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = info.CreatedAt
+	}
+	return stored
+}
+
+// Get a topic by key, including archived one.
+func (s *Service) Topic(key string) (*Topic, bool) {
+	s.topicsMu.RLock()
+	defer s.topicsMu.RUnlock()
+	t, ok := s.topics[key]
+	return t, ok
+}
+
+// Replace title, description, icon URL and module of the topic.
+// CreatedAt and Archived are kept.
+func (s *Service) UpdateTopic(key string, info TopicInfo) error {
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	t, ok := s.topics[key]
+	if !ok {
+		return ErrNoTopic
+	}
+	current := t.Info()
+	info.CreatedAt = current.CreatedAt
+	info.Archived = current.Archived
+	if err := s.storeTopicInfo(key, info); err != nil {
+		return err
+	}
+	t.setInfo(info)
+	s.notifyTopic(t, TopicUpdated, "")
+	return nil
+}
+
+// Archived topic rejects Publish, and is hidden from Topics and Listen.
+// Listeners are detached on archive, and matched ones are attached again on unarchive.
+func (s *Service) ArchiveTopic(key string, archived bool) error {
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	t, ok := s.topics[key]
+	if !ok {
+		return ErrNoTopic
+	}
+	info := t.Info()
+	if info.Archived == archived {
+		return nil
+	}
+	info.Archived = archived
+	if err := s.storeTopicInfo(key, info); err != nil {
+		return err
+	}
+	t.setInfo(info)
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	if archived {
+		t.listenersMu.Lock()
+		listeners := t.listeners
+		t.listenersMu.Unlock()
+		for _, l := range listeners {
+			l.detachTopic(t)
+		}
+		s.notifyTopicLocked(t, TopicArchived, "")
+	} else {
+		for l := range s.listeners {
+			if l.Pattern.Match(key) {
+				l.attach(t)
+			}
+		}
+		s.notifyTopicLocked(t, TopicUnarchived, "")
+	}
 	return nil
 }
 
+// Change key of the topic, stored items are moved to the new key.
+// Listeners are re-attached according to the new key.
+func (s *Service) RenameTopic(oldKey, newKey string) error {
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	t, ok := s.topics[oldKey]
+	if !ok {
+		return ErrNoTopic
+	}
+	if _, ok := s.topics[newKey]; ok {
+		return ErrTopicExists
+	}
+	if s.persistent != nil {
+		if err := s.persistent.RenameTopic(context.Background(), oldKey, newKey); err != nil {
+			return err
+		}
+	}
+	// queued items have the old key, and the policy is matched to the new key later
+	s.releaseShaper(t, true)
+	t.setKey(newKey)
+	delete(s.topics, oldKey)
+	s.topics[newKey] = t
+	s.removeTopicKey(oldKey)
+	s.topicKeys = append(s.topicKeys, newKey)
+	sort.Strings(s.topicKeys)
+	// items in history may be delivered to listeners, so replaced by copies
+	t.historyMu.Lock()
+	for e := t.history.Front(); e != nil; e = e.Next() {
+		copied := *e.Value.(*Item)
+		copied.TopicKey = newKey
+		e.Value = &copied
+	}
+	t.historyMu.Unlock()
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	if !t.Info().Archived {
+		for l := range s.listeners {
+			matched, attached := l.Pattern.Match(newKey), t.hasListener(l)
+			if matched && !attached {
+				l.attach(t)
+			} else if !matched && attached {
+				l.detachTopic(t)
+			}
+		}
+	}
+	s.notifyTopicLocked(t, TopicRenamed, oldKey)
+	return nil
+}
+
+// Delete the topic and its items, returns number of deleted items.
+func (s *Service) DeleteTopic(key string) (int64, error) {
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	t, ok := s.topics[key]
+	if !ok {
+		return 0, ErrNoTopic
+	}
+	var deleted int64
+	if s.persistent != nil {
+		var err error
+		deleted, err = s.persistent.DeleteTopic(context.Background(), key)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		deleted = int64(t.history.Len())
+	}
+	s.releaseShaper(t, false)
+	delete(s.topics, key)
+	s.removeTopicKey(key)
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	t.listenersMu.Lock()
+	listeners := t.listeners
+	t.listenersMu.Unlock()
+	for _, l := range listeners {
+		l.detachTopic(t)
+	}
+	s.notifyTopicLocked(t, TopicDeleted, "")
+	return deleted, nil
+}
+
+// Should be called with topicsMu write locked.
+func (s *Service) removeTopicKey(key string) {
+	i := sort.SearchStrings(s.topicKeys, key)
+	if i < len(s.topicKeys) && s.topicKeys[i] == key {
+		s.topicKeys = append(s.topicKeys[:i], s.topicKeys[i+1:]...)
+	}
+}
+
+func (s *Service) storeTopicInfo(key string, info TopicInfo) error {
+	if s.persistent == nil {
+		return nil
+	}
+	return s.persistent.UpdateTopicInfo(context.Background(), key, info)
+}
+
+func (s *Service) notifyTopic(t *Topic, kind TopicEventKind, oldKey string) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.notifyTopicLocked(t, kind, oldKey)
+}
+
+// Notify listeners matched to the topic, or its old key if renamed.
+// Should be called with listenersMu locked.
+func (s *Service) notifyTopicLocked(t *Topic, kind TopicEventKind, oldKey string) {
+	advanceClock(&s.modified)
+	ev := t.event(kind, oldKey)
+	for l := range s.listeners {
+		if l.Pattern.Match(ev.Key) || (oldKey != "" && l.Pattern.Match(oldKey)) {
+			l.pushTopicEvent(ev)
+		}
+	}
+}
+
+// Time of the last change which may affect items of topics, used as a validator of cached pages.
+// Changes of their items, topics themselves, saved searches and tag aliases are regarded.
+func (s *Service) LastModified(topics []*Topic) time.Time {
+	last := atomic.LoadInt64(&s.modified)
+	for _, t := range topics {
+		if m := atomic.LoadInt64(&t.modified); m > last {
+			last = m
+		}
+	}
+	return time.Unix(0, last)
+}
+
+// Record a change of items in the topic, which may also change items of saved searches.
+// Should be called with topicsMu locked.
+func (s *Service) touchItems(t *Topic) {
+	advanceClock(&t.modified)
+	for _, k := range s.topicKeys {
+		if st := s.topics[k]; st.search != nil {
+			advanceClock(&st.modified)
+		}
+	}
+}
+
+// touchItems for topics changed without notifyItem, such as by Import and Retention.
+func (s *Service) touchKeys(keys ...string) {
+	s.topicsMu.RLock()
+	defer s.topicsMu.RUnlock()
+	for _, k := range keys {
+		if t, ok := s.topics[k]; ok {
+			s.touchItems(t)
+		}
+	}
+}
+
+// Store the current time to clock, which is advanced at least by 1 so that every change is distinguished.
+func advanceClock(clock *int64) {
+	now := time.Now().UnixNano()
+	for {
+		cur := atomic.LoadInt64(clock)
+		next := now
+		if next <= cur {
+			next = cur + 1
+		}
+		if atomic.CompareAndSwapInt64(clock, cur, next) {
+			return
+		}
+	}
+}
+
+// Store items in a single transaction, then deliver them to listeners.
+// Items are published all or nothing, see InsertError.
 func (s *Service) Publish(topic string, item ... *Item) error {
 	s.topicsMu.RLock()
 	defer s.topicsMu.RUnlock()
 	ctx := context.Background()
+	now := time.Now()
 	for _, it := range item {
 		t, ok := s.topics[topic]
 		if !ok {
 			return ErrNoTopic
 		}
+		if t.Archived {
+			return ErrTopicArchived
+		}
+		if t.search != nil {
+			return ErrSavedSearch
+		}
 		it.TopicID = t.ID
+		it.TopicKey = t.Key
+		it.Origin = t.Origin
+		if len(it.Tags) > 0 {
+			it.Tags = NormalizeTags(it.Tags)
+		}
+		it.Timestamp = insertedTimestamp(it, now)
 	}
 	if s.persistent != nil {
 		if _, err := s.persistent.Insert(ctx, item...); err != nil {
@@ -82,55 +405,282 @@ func (s *Service) Publish(topic string, item ... *Item) error {
 		}
 	}
 	for _, it := range item {
-		published := make(map[*Listener]struct{})
-		for i := 0; i < len(s.topicKeys); i++ {
-			// reverse loop --> seek longest match topic
-			k := s.topicKeys[len(s.topicKeys)-i-1]
-			if topic == k {
-				s.topics[k].publish(it, published)
-			}
-		}
+		s.notifyItem(s.topics[topic], ItemEvent{Kind: ItemAdded, Item: it})
 	}
 	return nil
 }
 
-func (s *Service) Topics(prefix string) (ret []*Topic) {
+// List topics matched to the pattern, see TopicPattern.
+// Archived topics are excluded.
+func (s *Service) Topics(pattern string) []*Topic {
+	return s.listTopics(pattern, false)
+}
+
+// List archived topics matched to the pattern.
+func (s *Service) ArchivedTopics(pattern string) []*Topic {
+	return s.listTopics(pattern, true)
+}
+
+func (s *Service) listTopics(pattern string, archived bool) (ret []*Topic) {
+	p := ParsePattern(pattern)
 	s.topicsMu.RLock()
 	defer s.topicsMu.RUnlock()
 	for _, k := range s.topicKeys {
-		if strings.HasPrefix(k, prefix) {
-			ret = append(ret, s.topics[k])
+		if t := s.topics[k]; t.Archived == archived && p.Match(k) {
+			ret = append(ret, t)
 		}
 	}
 	return
 }
 
+// Fetch items matched to q. Saved searches in q.Topics are expanded to their queries.
 func (s *Service) Fetch(ctx context.Context, q *Query) ([]*Item, error) {
-	return s.persistent.Select(ctx, q)
+	s.topicsMu.RLock()
+	plan := s.planFetch(q)
+	s.topicsMu.RUnlock()
+	items, err := s.runFetch(ctx, q, plan)
+	if err != nil || !q.Collapse {
+		return items, err
+	}
+	return collapseDuplicates(items, q.CollapseDistance), nil
 }
 
-func (s *Service) Listen(key string) (*Listener, error) {
-	lis := &Listener{
-		Key: key,
-		C:   make(chan *Item, s.ListenerBuffer),
+// Fetch items published after afterID to topics matched to pattern, in ascending order.
+// Used to resume a listener from a known position. filter may be nil.
+// Items of saved searches matched to pattern are included, as in Fetch.
+func (s *Service) FetchSince(ctx context.Context, pattern string, afterID int64, limit int, filter *Filter) ([]*Item, error) {
+	var keys []string
+	for _, t := range s.Topics(pattern) {
+		keys = append(keys, t.Key)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	q := &Query{
+		Topics: keys,
+		MinID:  int(afterID + 1),
+		Limit:  limit,
+		Filter: filter,
 	}
 	s.topicsMu.RLock()
-	found := false
-	defer s.topicsMu.RUnlock()
+	plan := s.planFetch(q)
+	s.topicsMu.RUnlock()
+	items, err := s.runFetch(ctx, q, plan)
+	if err != nil {
+		return nil, err
+	}
+	// Select returns descending order
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	return items, nil
+}
+
+// Get single item by its ID.
+func (s *Service) Get(ctx context.Context, id int64) (*Item, error) {
+	items, err := s.persistent.Select(ctx, &Query{
+		MinID: int(id),
+		MaxID: int(id),
+		Limit: 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrNotFound
+	}
+	return items[0], nil
+}
+
+// Count items for each topic, items of saved searches are counted under their keys.
+func (s *Service) Count(ctx context.Context, q *Query) (map[string]int64, error) {
+	s.topicsMu.RLock()
+	plan := s.planFetch(q)
+	s.topicsMu.RUnlock()
+	return s.runCount(ctx, q, plan)
+}
+
+type listenOptions struct {
+	raw          bool
+	history      int
+	filter       *Filter
+	policy       OverflowPolicy
+	blockTimeout time.Duration
+}
+
+type ListenOption func(*listenOptions)
+
+// Replay latest n items of matched topics before live items.
+// Items older than in-memory history are loaded from Storage. n is capped by MaxHistory.
+func WithHistory(n int) ListenOption {
+	return func(o *listenOptions) {
+		if n > MaxHistory {
+			n = MaxHistory
+		}
+		o.history = n
+	}
+}
+
+// Deliver only items matched to the filter, including replayed history.
+// Updated items are delivered if the new content is matched.
+func WithFilter(f *Filter) ListenOption {
+	return func(o *listenOptions) {
+		o.filter = f
+	}
+}
+
+// Receive every published item, instead of the stream shaped by PublishPolicy.
+// Used by consumers which mirror storage, such as indexers.
+func WithRaw() ListenOption {
+	return func(o *listenOptions) {
+		o.raw = true
+	}
+}
+
+// Behavior on buffer overflow, DropNewest by default.
+func WithOverflowPolicy(p OverflowPolicy) ListenOption {
+	return func(o *listenOptions) {
+		o.policy = p
+	}
+}
+
+// Timeout for Block policy, DefaultBlockTimeout by default.
+func WithBlockTimeout(d time.Duration) ListenOption {
+	return func(o *listenOptions) {
+		o.blockTimeout = d
+	}
+}
+
+// Subscribe topics matched to key, which is a TopicPattern.
+// Topics created later are also subscribed if matched, and changes of
+// matched topics are notified via Listener.TopicC.
+func (s *Service) Listen(key string, opts ...ListenOption) (*Listener, error) {
+	o := listenOptions{
+		blockTimeout: DefaultBlockTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	lis := &Listener{
+		Key:          key,
+		Pattern:      ParsePattern(key),
+		C:            make(chan ItemEvent, s.ListenerBuffer+o.history),
+		TopicC:       make(chan TopicEvent, TopicEventBuffer),
+		filter:       o.filter,
+		raw:          o.raw,
+		policy:       o.policy,
+		blockTimeout: o.blockTimeout,
+		s:            s,
+	}
+	if o.history > 0 {
+		// Publish holds read lock while storing and delivering items,
+		// so write lock gives consistent view of history and live items.
+		s.topicsMu.Lock()
+		defer s.topicsMu.Unlock()
+	} else {
+		s.topicsMu.RLock()
+		defer s.topicsMu.RUnlock()
+	}
+	var matched []*Topic
 	for i := 0; i < len(s.topicKeys); i++ {
 		// reverse loop --> seek longest match topic
 		k := s.topicKeys[len(s.topicKeys)-i-1]
-		if strings.HasPrefix(k, key) {
-			s.topics[k].addListener(lis)
-			found = true
+		if lis.Pattern.Match(k) && !s.topics[k].Archived {
+			matched = append(matched, s.topics[k])
 		}
 	}
-	if !found {
+	// Plain key should match existing topic, glob may match topics created later.
+	if len(matched) == 0 && !lis.Pattern.IsGlob() {
 		return nil, ErrNoTopic
 	}
+	if o.history > 0 {
+		items, err := s.replay(matched, o.history, o.filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, it := range items {
+			lis.C <- ItemEvent{Kind: ItemAdded, Item: it}
+		}
+	}
+	s.listenersMu.Lock()
+	s.listeners[lis] = struct{}{}
+	s.listenersMu.Unlock()
+	for _, t := range matched {
+		lis.attach(t)
+	}
 	return lis, nil
 }
 
+func (s *Service) removeListener(l *Listener) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	delete(s.listeners, l)
+}
+
+// Collect latest n items of topics in ascending order.
+// Should be called with topicsMu locked.
+func (s *Service) replay(topics []*Topic, n int, filter *Filter) ([]*Item, error) {
+	var merged []*Item
+	aliases := s.tagAliases()
+	// History is complete only for items newer than bound.
+	// Older items are dropped from truncated history, or published before restart.
+	var bound int64
+	minID := int64(math.MaxInt64)
+	for _, t := range topics {
+		for e := t.history.Front(); e != nil; e = e.Next() {
+			it := e.Value.(*Item)
+			if it.ID < minID {
+				minID = it.ID
+			}
+			if filter == nil || filter.match(it, aliases) {
+				merged = append(merged, it)
+			}
+		}
+		if t.history.Len() > 0 && t.history.Len() >= s.HistorySize {
+			if oldest := t.history.Front().Value.(*Item).ID; oldest > bound {
+				bound = oldest
+			}
+		}
+	}
+	if minID != math.MaxInt64 && minID > bound {
+		bound = minID
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].ID > merged[j].ID
+	})
+	ret := make([]*Item, 0, n)
+	for _, it := range merged {
+		if len(ret) == n || it.ID < bound {
+			break
+		}
+		// same item in a topic and saved searches
+		if len(ret) > 0 && ret[len(ret)-1].ID == it.ID {
+			continue
+		}
+		ret = append(ret, it)
+	}
+	// ID of oldest collected item, no older items exist if it is 1
+	hasOlder := len(ret) == 0 || ret[len(ret)-1].ID > 1
+	if len(ret) < n && hasOlder && s.persistent != nil {
+		q := &Query{Limit: n - len(ret), Filter: filter}
+		for _, t := range topics {
+			q.Topics = append(q.Topics, t.Key)
+		}
+		if len(ret) > 0 {
+			q.MaxID = int(ret[len(ret)-1].ID - 1)
+		}
+		older, err := s.runFetch(context.Background(), q, s.planFetch(q))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, older...)
+	}
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	return ret, nil
+}
+
 func (s *Service) PrintStatus() {
 	for i := 0; i < len(s.topicKeys); i++ {
 		// reverse loop --> seek longest match topic
@@ -1,6 +1,8 @@
 package timeline
 
 import (
+	"bytes"
+	"context"
 	"testing"
 	"github.com/stretchr/testify/assert"
 )
@@ -21,6 +23,14 @@ func mapItemCaption(ts []*Item) []string {
 	return ret
 }
 
+func eventItems(evs []ItemEvent) []*Item {
+	ret := make([]*Item, 0, len(evs))
+	for _, ev := range evs {
+		ret = append(ret, ev.Item)
+	}
+	return ret
+}
+
 func simpleItem(caption string) *Item {
 	return &Item{
 		Caption: caption,
@@ -33,39 +43,153 @@ func TestListTopic(t *testing.T) {
 	s := NewService(storage)
 	s.NewTopic("", "/foo/bar/baz/piyo")
 	s.NewTopic("", "/foo/bar/baz")
-	a.Equal(mapTopicKeys(s.Topics("/foo")), []string{"/foo/bar/baz", "/foo/bar/baz/piyo"})
+	a.Equal(mapTopicKeys(s.Topics("/foo/**")), []string{"/foo/bar/baz", "/foo/bar/baz/piyo"})
 	// modification
 	s.NewTopic("", "/foo")
-	a.Equal(mapTopicKeys(s.Topics("/")), []string{"/foo", "/foo/bar/baz", "/foo/bar/baz/piyo"})
+	a.Equal(mapTopicKeys(s.Topics("/**")), []string{"/foo", "/foo/bar/baz", "/foo/bar/baz/piyo"})
 	// duplicated name will not override
 	s.NewTopic("", "/foo")
-	a.Equal(mapTopicKeys(s.Topics("/")), []string{"/foo", "/foo/bar/baz", "/foo/bar/baz/piyo"})
+	a.Equal(mapTopicKeys(s.Topics("/**")), []string{"/foo", "/foo/bar/baz", "/foo/bar/baz/piyo"})
 	s.NewTopic("", "/hoge")
-	a.Equal(mapTopicKeys(s.Topics("/foo")), []string{"/foo", "/foo/bar/baz", "/foo/bar/baz/piyo"})
-	a.Equal(mapTopicKeys(s.Topics("/")), []string{"/foo", "/foo/bar/baz", "/foo/bar/baz/piyo", "/hoge"})
+	a.Equal(mapTopicKeys(s.Topics("/foo/**")), []string{"/foo", "/foo/bar/baz", "/foo/bar/baz/piyo"})
+	a.Equal(mapTopicKeys(s.Topics("/**")), []string{"/foo", "/foo/bar/baz", "/foo/bar/baz/piyo", "/hoge"})
 
-	root, _ := s.Listen("/")
-	hoge, _ := s.Listen("/hog")
-	foo, _ := s.Listen("/fo")
-	foobarbaz, _ := s.Listen("/foo/bar/baz")
-	foobarbazp, _ := s.Listen("/foo/bar/baz/p")
+	root, _ := s.Listen("/**")
+	hoge, _ := s.Listen("/hog*")
+	foo, _ := s.Listen("/fo*/**")
+	foobarbaz, _ := s.Listen("/foo/bar/baz/**")
+	foobarbazp, _ := s.Listen("/foo/bar/baz/p*")
 
 	s.Publish("/foo/bar/baz", simpleItem("X"))
 	s.Publish("/foo/bar/baz", simpleItem("Y"))
 	s.Publish("/foo/bar/baz", simpleItem("Z"))
-	a.Equal([]string{"X", "Y", "Z"}, mapItemCaption(root.Fetch(0)))
-	a.Equal([]string{"X", "Y", "Z"}, mapItemCaption(foo.Fetch(0)))
-	a.Equal([]string{"X", "Y", "Z"}, mapItemCaption(foobarbaz.Fetch(0)))
-	a.Equal([]string{}, mapItemCaption(hoge.Fetch(0)))
-	a.Equal([]string{}, mapItemCaption(foobarbaz.Fetch(0)))
-	a.Equal([]string{}, mapItemCaption(foobarbazp.Fetch(0)))
+	a.Equal([]string{"X", "Y", "Z"}, mapItemCaption(eventItems(root.Fetch(0))))
+	a.Equal([]string{"X", "Y", "Z"}, mapItemCaption(eventItems(foo.Fetch(0))))
+	a.Equal([]string{"X", "Y", "Z"}, mapItemCaption(eventItems(foobarbaz.Fetch(0))))
+	a.Equal([]string{}, mapItemCaption(eventItems(hoge.Fetch(0))))
+	a.Equal([]string{}, mapItemCaption(eventItems(foobarbaz.Fetch(0))))
+	a.Equal([]string{}, mapItemCaption(eventItems(foobarbazp.Fetch(0))))
 
 	s.Publish("/foo/bar/baz/piyo", simpleItem("X"))
 	s.Publish("/foo/bar/baz", simpleItem("Y"))
 	s.Publish("/foo", simpleItem("Z"))
-	a.Equal([]string{"X", "Y", "Z"}, mapItemCaption(root.Fetch(0)))
-	a.Equal([]string{}, mapItemCaption(hoge.Fetch(0)))
-	a.Equal([]string{"X", "Y", "Z"}, mapItemCaption(foo.Fetch(0)))
-	a.Equal([]string{"X", "Y"}, mapItemCaption(foobarbaz.Fetch(0)))
-	a.Equal([]string{"X"}, mapItemCaption(foobarbazp.Fetch(0)))
+	a.Equal([]string{"X", "Y", "Z"}, mapItemCaption(eventItems(root.Fetch(0))))
+	a.Equal([]string{}, mapItemCaption(eventItems(hoge.Fetch(0))))
+	a.Equal([]string{"X", "Y", "Z"}, mapItemCaption(eventItems(foo.Fetch(0))))
+	a.Equal([]string{"X", "Y"}, mapItemCaption(eventItems(foobarbaz.Fetch(0))))
+	a.Equal([]string{"X"}, mapItemCaption(eventItems(foobarbazp.Fetch(0))))
+}
+
+func TestListenWithHistory(t *testing.T) {
+	a := assert.New(t)
+	storage, _ := NewStorage("memory", "")
+	s := NewService(storage)
+	s.HistorySize = 2
+	a.NoError(s.NewTopic("", "/history/a"))
+	a.NoError(s.NewTopic("", "/history/b"))
+	a.NoError(s.Publish("/history/a", simpleItem("A1")))
+	a.NoError(s.Publish("/history/b", simpleItem("B1")))
+	a.NoError(s.Publish("/history/a", simpleItem("A2"), simpleItem("A3")))
+	a.NoError(s.Publish("/history/b", simpleItem("B2")))
+
+	// Served from history
+	recent, err := s.Listen("/history/**", WithHistory(3))
+	a.NoError(err)
+	a.Equal([]string{"A2", "A3", "B2"}, mapItemCaption(eventItems(recent.Fetch(0))))
+
+	// Older items than history are loaded from storage
+	all, err := s.Listen("/history/**", WithHistory(10))
+	a.NoError(err)
+	a.Equal([]string{"A1", "B1", "A2", "A3", "B2"}, mapItemCaption(eventItems(all.Fetch(0))))
+
+	// Buffer is not sized by unbounded history
+	huge, err := s.Listen("/history/**", WithHistory(1<<40))
+	a.NoError(err)
+	a.Equal(s.ListenerBuffer+MaxHistory, cap(huge.C))
+	a.Len(huge.Fetch(0), 5)
+
+	// Service restarted, history is empty
+	restarted := NewService(storage)
+	a.NoError(restarted.NewTopic("", "/history/a"))
+	a.NoError(restarted.NewTopic("", "/history/b"))
+	a.NoError(restarted.Publish("/history/b", simpleItem("B3")))
+	lis, err := restarted.Listen("/history/**", WithHistory(3))
+	a.NoError(err)
+	a.Equal([]string{"A3", "B2", "B3"}, mapItemCaption(eventItems(lis.Fetch(0))))
+
+	// Then switches to live items
+	a.NoError(restarted.Publish("/history/a", simpleItem("A4")))
+	a.Equal([]string{"A4"}, mapItemCaption(eventItems(lis.Fetch(0))))
+}
+
+func TestListenPattern(t *testing.T) {
+	a := assert.New(t)
+	s := NewService(nil)
+	a.NoError(s.NewTopic("", "/twitter/list/foo/cats"))
+	a.NoError(s.NewTopic("", "/twitter/listening"))
+
+	lists, err := s.Listen("/twitter/list/** !/twitter/list/*/nsfw")
+	a.NoError(err)
+	future, err := s.Listen("/tumblr/**")
+	a.NoError(err)
+	_, err = s.Listen("/tumblr")
+	a.Equal(ErrNoTopic, err)
+
+	// topics created later are attached
+	a.NoError(s.NewTopic("", "/twitter/list/foo/dogs"))
+	a.NoError(s.NewTopic("", "/twitter/list/foo/nsfw"))
+	a.NoError(s.NewTopic("", "/tumblr/dashboard"))
+
+	s.Publish("/twitter/list/foo/cats", simpleItem("cat"))
+	s.Publish("/twitter/listening", simpleItem("listening"))
+	s.Publish("/twitter/list/foo/dogs", simpleItem("dog"))
+	s.Publish("/twitter/list/foo/nsfw", simpleItem("nsfw"))
+	s.Publish("/tumblr/dashboard", simpleItem("tumblr"))
+	a.Equal([]string{"cat", "dog"}, mapItemCaption(eventItems(lists.Fetch(0))))
+	a.Equal([]string{"tumblr"}, mapItemCaption(eventItems(future.Fetch(0))))
+
+	// closed listener is not attached anymore
+	future.Close()
+	a.NoError(s.NewTopic("", "/tumblr/likes"))
+	a.Empty(s.Topics("/tumblr/likes")[0].listeners)
+	a.Equal([]string{"/tumblr/dashboard", "/tumblr/likes"}, mapTopicKeys(s.Topics("/tumblr/*")))
+}
+
+func TestLastModified(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("test", "/modified/a"))
+	a.NoError(s.NewTopic("test", "/modified/b"))
+	_, err := s.NewSavedSearch("modified", "topic:/modified/b", TopicInfo{})
+	a.NoError(err)
+	topicA, _ := s.Topic("/modified/a")
+	saved, _ := s.Topic("/saved/modified")
+	changed := func(topic *Topic, f func()) bool {
+		before := s.LastModified([]*Topic{topic})
+		f()
+		return s.LastModified([]*Topic{topic}).After(before)
+	}
+
+	a.True(changed(topicA, func() { a.NoError(s.Publish("/modified/a", &Item{OriginKey: 1})) }))
+	a.True(changed(topicA, func() { a.NoError(s.Update(&Item{TopicKey: "/modified/a", OriginKey: 1, Caption: "edited"})) }))
+	a.True(changed(topicA, func() { a.NoError(s.Delete("/modified/a", 1)) }))
+	a.False(changed(topicA, func() { a.NoError(s.Publish("/modified/b", &Item{OriginKey: 2})) }))
+	a.True(changed(saved, func() { a.NoError(s.Publish("/modified/b", &Item{OriginKey: 3})) }))
+	a.True(changed(topicA, func() { a.NoError(s.SetTagAlias(ctx, "kitty", "cat")) }))
+
+	// changed without events
+	var buf bytes.Buffer
+	_, err = s.Export(ctx, &buf, &Query{Topics: []string{"/modified/b"}})
+	a.NoError(err)
+	dst := NewService(newPrivateStorage(t))
+	a.NoError(dst.NewTopic("test", "/modified/b"))
+	imported, _ := dst.Topic("/modified/b")
+	before := dst.LastModified([]*Topic{imported})
+	_, err = dst.Import(ctx, &buf)
+	a.NoError(err)
+	a.True(dst.LastModified([]*Topic{imported}).After(before))
+	r, err := NewRetention(s, RetentionConfig{Rules: []RetentionRule{{Pattern: "/modified/b", MaxCount: 1}}})
+	a.NoError(err)
+	a.True(changed(saved, func() { a.Empty(r.Run(ctx).Error) }))
 }
@@ -0,0 +1,116 @@
+package timeline
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/kanosaki/dumper/common"
+)
+
+var (
+	// Distance regarded as near-duplicate when not specified, see PHash.Distance.
+	DefaultSimilarDistance = 8
+)
+
+func (s *SQLiteStorage) SetItemHash(ctx context.Context, itemID int64, hash *PHash) error {
+	var value sql.NullInt64
+	if hash != nil {
+		value = sql.NullInt64{Int64: int64(*hash), Valid: true}
+	}
+	r, err := s.db.ExecContext(ctx, `UPDATE timeline SET phash = ?, phash_at = ? WHERE id = ?`,
+		value, common.Timestamp(time.Now()), itemID)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *SQLiteStorage) UnhashedItems(ctx context.Context, afterID int64, limit int) ([]*Item, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, thumbnail FROM timeline
+		WHERE phash_at IS NULL AND id > ? AND thumbnail != '' ORDER BY id LIMIT ?`, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []*Item
+	for rows.Next() {
+		it := &Item{}
+		if err := rows.Scan(&it.ID, &it.Thumbnail); err != nil {
+			return nil, err
+		}
+		ret = append(ret, it)
+	}
+	return ret, rows.Err()
+}
+
+// Items matched to q whose hash is within maxDistance from the item, nearest first.
+// The item itself is excluded, and no items are returned if the item is not hashed yet.
+// Limit and Offset of q are applied in order of distance. Saved searches in q.Topics are expanded.
+func (s *Service) SimilarItems(ctx context.Context, itemID int64, maxDistance int, q *Query) ([]*Item, error) {
+	it, err := s.Get(ctx, itemID)
+	if err != nil {
+		return nil, err
+	}
+	if it.PHash == nil {
+		return nil, nil
+	}
+	similar := *q
+	similar.SimilarTo = it.PHash
+	similar.MaxDistance = maxDistance
+	// paged after sorting by distance, items are bounded by maxDistance
+	similar.Limit, similar.Offset = 0, 0
+	s.topicsMu.RLock()
+	plan := s.planFetch(&similar)
+	s.topicsMu.RUnlock()
+	items, err := s.runFetch(ctx, &similar, plan)
+	if err != nil {
+		return nil, err
+	}
+	ret := items[:0]
+	for _, other := range items {
+		if other.ID != itemID {
+			ret = append(ret, other)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].PHash.Distance(*it.PHash) < ret[j].PHash.Distance(*it.PHash)
+	})
+	if q.Offset >= len(ret) {
+		return nil, nil
+	}
+	ret = ret[q.Offset:]
+	if q.Limit > 0 && len(ret) > q.Limit {
+		ret = ret[:q.Limit]
+	}
+	return ret, nil
+}
+
+// Fold items into the first item within distance, whose Duplicates holds IDs of folded items.
+// Items without hash are kept.
+func collapseDuplicates(items []*Item, distance int) []*Item {
+	var kept, hashed []*Item
+	for _, it := range items {
+		if it.PHash == nil {
+			kept = append(kept, it)
+			continue
+		}
+		var folded bool
+		for _, k := range hashed {
+			if k.PHash.Distance(*it.PHash) <= distance {
+				k.Duplicates = append(k.Duplicates, it.ID)
+				folded = true
+				break
+			}
+		}
+		if !folded {
+			kept = append(kept, it)
+			hashed = append(hashed, it)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,185 @@
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Diagonal gradient, inverted if invert.
+func gradient(w, h int, invert bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x*255/w + y*255/h) / 2)
+			if invert {
+				v = 255 - v
+			}
+			img.SetGray(x, y, color.Gray{Y: v})
+		}
+	}
+	return img
+}
+
+// Vertical stripes, which has no relation to gradient.
+func stripes(w, h int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x*9/w)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	return img
+}
+
+func TestDHash(t *testing.T) {
+	a := assert.New(t)
+	small := DHash(gradient(90, 80, false))
+	large := DHash(gradient(450, 400, false))
+	a.True(small.Distance(large) <= 2, "%v %v", small, large)
+	a.True(small.Distance(DHash(gradient(90, 80, true))) > 40)
+	a.True(small.Distance(DHash(stripes(90, 80))) > 20)
+	// smaller than hash size
+	DHash(gradient(3, 2, false))
+	a.Equal(PHash(0), DHash(image.NewGray(image.Rect(0, 0, 0, 0))))
+
+	b, err := json.Marshal(small)
+	a.NoError(err)
+	var parsed PHash
+	a.NoError(json.Unmarshal(b, &parsed))
+	a.Equal(small, parsed)
+	a.Equal(0, PHash(0xff).Distance(0xff))
+	a.Equal(8, PHash(0xff).Distance(0))
+}
+
+func TestHasher(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	images := map[string]image.Image{
+		"/small.png": gradient(90, 80, false),
+		"/large.png": gradient(450, 400, false),
+		"/other.png": stripes(90, 80),
+	}
+	unavailable := true
+	flakyRequests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/flaky.png" {
+			flakyRequests++
+		}
+		if r.URL.Path == "/flaky.png" && unavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/flaky.png" {
+			r.URL.Path = "/small.png"
+		}
+		img, ok := images[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var buf bytes.Buffer
+		png.Encode(&buf, img)
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("test", "/hash/pixiv"))
+	a.NoError(s.NewTopic("test", "/hash/twitter"))
+	pixiv := &Item{Caption: "pixiv", OriginKey: 1, Thumbnail: srv.URL + "/small.png"}
+	other := &Item{Caption: "other", OriginKey: 2, Thumbnail: srv.URL + "/other.png"}
+	missing := &Item{Caption: "missing", OriginKey: 3, Thumbnail: srv.URL + "/missing.png"}
+	noThumbnail := &Item{Caption: "no thumbnail", OriginKey: 4}
+	a.NoError(s.Publish("/hash/pixiv", pixiv, other, missing, noThumbnail))
+	tweet := &Item{Caption: "tweet", OriginKey: 5, Thumbnail: srv.URL + "/large.png"}
+	flaky := &Item{Caption: "flaky", OriginKey: 6, Thumbnail: srv.URL + "/flaky.png"}
+	a.NoError(s.Publish("/hash/twitter", tweet, flaky))
+
+	h := NewHasher(s, srv.Client(), HasherConfig{Workers: 2})
+	stats, err := h.Run(ctx)
+	a.NoError(err)
+	a.Equal(&HashStats{Hashed: 3, Failed: 1, Deferred: 1}, stats)
+	unavailable = false
+	// not fetched until backoff has passed
+	stats, err = h.Run(ctx)
+	a.NoError(err)
+	a.Equal(&HashStats{Deferred: 1}, stats)
+	a.Equal(1, flakyRequests)
+	a.Equal(2*DefaultHashRetryBackoff, h.backoff(2))
+	a.Equal(DefaultHashMaxBackoff, h.backoff(100))
+	h.retries[flaky.ID].at = time.Now()
+	stats, err = h.Run(ctx)
+	a.NoError(err)
+	a.Equal(&HashStats{Hashed: 1}, stats)
+	a.Equal(2, flakyRequests)
+	a.Empty(h.retries)
+	stats, err = h.Run(ctx)
+	a.NoError(err)
+	a.Equal(&HashStats{}, stats)
+
+	similar, err := s.SimilarItems(ctx, pixiv.ID, DefaultSimilarDistance, &Query{})
+	a.NoError(err)
+	// nearest first
+	a.Equal([]int64{flaky.ID, tweet.ID}, itemIDs(similar))
+	similar, err = s.SimilarItems(ctx, pixiv.ID, DefaultSimilarDistance, &Query{Topics: []string{"/hash/pixiv"}})
+	a.NoError(err)
+	a.Empty(similar)
+	similar, err = s.SimilarItems(ctx, noThumbnail.ID, DefaultSimilarDistance, &Query{})
+	a.NoError(err)
+	a.Empty(similar)
+
+	items, err := s.Fetch(ctx, &Query{Topics: []string{"/hash/**"}, Collapse: true, CollapseDistance: DefaultSimilarDistance})
+	a.NoError(err)
+	// newest is kept
+	a.Equal([]int64{flaky.ID, noThumbnail.ID, missing.ID, other.ID}, itemIDs(items))
+	a.ElementsMatch([]int64{tweet.ID, pixiv.ID}, items[0].Duplicates)
+	a.NotNil(items[0].PHash)
+	a.Nil(items[1].PHash)
+}
+
+func itemIDs(items []*Item) []int64 {
+	ret := make([]int64, 0, len(items))
+	for _, it := range items {
+		ret = append(ret, it.ID)
+	}
+	return ret
+}
+
+func TestSimilarItemsLimit(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("test", "/similar/a"))
+	near := &Item{Caption: "near", OriginKey: 1, Thumbnail: "http://img.local/1.png"}
+	target := &Item{Caption: "target", OriginKey: 2, Thumbnail: "http://img.local/2.png"}
+	far := &Item{Caption: "far", OriginKey: 3, Thumbnail: "http://img.local/3.png"}
+	middle := &Item{Caption: "middle", OriginKey: 4, Thumbnail: "http://img.local/4.png"}
+	a.NoError(s.Publish("/similar/a", near, target, far, middle))
+	for it, h := range map[*Item]PHash{near: 0x1, target: 0, far: 0x7, middle: 0x3} {
+		h := h
+		a.NoError(s.persistent.SetItemHash(ctx, it.ID, &h))
+	}
+
+	// nearest items even if older ones
+	similar, err := s.SimilarItems(ctx, target.ID, DefaultSimilarDistance, &Query{Limit: 2})
+	a.NoError(err)
+	a.Equal([]int64{near.ID, middle.ID}, itemIDs(similar))
+	similar, err = s.SimilarItems(ctx, target.ID, DefaultSimilarDistance, &Query{Limit: 1, Offset: 2})
+	a.NoError(err)
+	a.Equal([]int64{far.ID}, itemIDs(similar))
+	similar, err = s.SimilarItems(ctx, target.ID, DefaultSimilarDistance, &Query{Offset: 3})
+	a.NoError(err)
+	a.Empty(similar)
+}
@@ -0,0 +1,141 @@
+package timeline
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/kanosaki/dumper/common"
+)
+
+// Per-user state of an item.
+type ItemState struct {
+	Starred bool `json:"starred"`
+	Hidden  bool `json:"hidden"`
+	Read    bool `json:"read"` // not newer than read marker of the topic
+}
+
+type ItemFlag int
+
+const (
+	FlagStarred ItemFlag = iota
+	FlagHidden
+)
+
+var itemFlagColumns = map[ItemFlag]string{
+	FlagStarred: "starred",
+	FlagHidden:  "hidden",
+}
+
+func (s *SQLiteStorage) MarkRead(ctx context.Context, user, topicKey string, upToID int64) error {
+	s.topicsMu.Lock()
+	tMeta, ok := s.topics[topicKey]
+	s.topicsMu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	now := common.Timestamp(time.Now())
+	// Single row is updated regardless of number of items.
+	var err error
+	if upToID > 0 {
+		_, err = s.db.ExecContext(ctx, `INSERT INTO read_marker(user, topic_id, last_read_id, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(user, topic_id) DO UPDATE SET
+				last_read_id = MAX(last_read_id, excluded.last_read_id), updated_at = excluded.updated_at`,
+			user, tMeta.ID, upToID, now)
+	} else {
+		_, err = s.db.ExecContext(ctx, `INSERT INTO read_marker(user, topic_id, last_read_id, updated_at)
+			SELECT ?, ?, COALESCE(MAX(id), 0), ? FROM timeline WHERE topic_id = ?
+			ON CONFLICT(user, topic_id) DO UPDATE SET
+				last_read_id = MAX(last_read_id, excluded.last_read_id), updated_at = excluded.updated_at`,
+			user, tMeta.ID, now, tMeta.ID)
+	}
+	return err
+}
+
+func (s *SQLiteStorage) ReadMarkers(ctx context.Context, user string) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT topic.key, read_marker.last_read_id
+		FROM read_marker JOIN topic on read_marker.topic_id = topic.id WHERE read_marker.user = ?`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make(map[string]int64)
+	for rows.Next() {
+		var key string
+		var id int64
+		if err := rows.Scan(&key, &id); err != nil {
+			return nil, err
+		}
+		ret[key] = id
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return ret, nil
+}
+
+func (s *SQLiteStorage) SetItemFlag(ctx context.Context, user string, itemID int64, flag ItemFlag, value bool) error {
+	column, ok := itemFlagColumns[flag]
+	if !ok {
+		panic("Unknown ItemFlag")
+	}
+	var exists int
+	row := s.db.QueryRowContext(ctx, `SELECT 1 FROM timeline WHERE id = ?`, itemID)
+	if err := row.Scan(&exists); err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO item_state(user, item_id, `+column+`, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(user, item_id) DO UPDATE SET `+column+` = excluded.`+column+`, updated_at = excluded.updated_at`,
+		user, itemID, value, common.Timestamp(time.Now()))
+	return err
+}
+
+// Mark items of topics matched to pattern as read, see Storage.MarkRead.
+func (s *Service) MarkRead(ctx context.Context, user, pattern string, upToID int64) error {
+	for _, t := range s.Topics(pattern) {
+		upTo := upToID
+		if upTo == 0 && t.SavedSearch() != "" {
+			// items are in other topics
+			items, err := s.Fetch(ctx, &Query{Topics: []string{t.Key}, Limit: 1})
+			if err != nil {
+				return err
+			}
+			if len(items) == 0 {
+				continue
+			}
+			upTo = items[0].ID
+		}
+		if err := s.persistent.MarkRead(ctx, user, t.Key, upTo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Number of unread items for each topic matched to pattern, hidden items are not counted.
+// Topics without unread items are omitted.
+func (s *Service) UnreadCounts(ctx context.Context, user, pattern string) (map[string]int64, error) {
+	var keys []string
+	for _, t := range s.Topics(pattern) {
+		keys = append(keys, t.Key)
+	}
+	if len(keys) == 0 {
+		return map[string]int64{}, nil
+	}
+	return s.Count(ctx, &Query{Topics: keys, User: user, Unread: true})
+}
+
+func (s *Service) ReadMarkers(ctx context.Context, user string) (map[string]int64, error) {
+	return s.persistent.ReadMarkers(ctx, user)
+}
+
+func (s *Service) Star(ctx context.Context, user string, itemID int64, starred bool) error {
+	return s.persistent.SetItemFlag(ctx, user, itemID, FlagStarred, starred)
+}
+
+// Hidden items are excluded from Fetch with Query.User, unless Query.ShowHidden.
+func (s *Service) Hide(ctx context.Context, user string, itemID int64, hidden bool) error {
+	return s.persistent.SetItemFlag(ctx, user, itemID, FlagHidden, hidden)
+}
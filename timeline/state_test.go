@@ -0,0 +1,111 @@
+package timeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadState(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("state/test", "/state/a"))
+	a.NoError(s.NewTopic("state/test", "/state/b"))
+	var items []*Item
+	for i := 0; i < 5; i++ {
+		it := &Item{Caption: "a", OriginKey: int64(i), Timestamp: time.Now()}
+		a.NoError(s.Publish("/state/a", it))
+		items = append(items, it)
+	}
+	a.NoError(s.Publish("/state/b", &Item{Caption: "b", OriginKey: 10}))
+
+	counts, err := s.UnreadCounts(ctx, "alice", "/state/**")
+	a.NoError(err)
+	a.Equal(map[string]int64{"/state/a": 5, "/state/b": 1}, counts)
+
+	a.NoError(s.MarkRead(ctx, "alice", "/state/a", items[2].ID))
+	// read marker never goes back
+	a.NoError(s.MarkRead(ctx, "alice", "/state/a", items[0].ID))
+	a.NoError(s.MarkRead(ctx, "alice", "/state/b", 0))
+	counts, err = s.UnreadCounts(ctx, "alice", "/state/**")
+	a.NoError(err)
+	a.Equal(map[string]int64{"/state/a": 2}, counts)
+	markers, err := s.ReadMarkers(ctx, "alice")
+	a.NoError(err)
+	a.Equal(items[2].ID, markers["/state/a"])
+	// other user is not affected
+	counts, err = s.UnreadCounts(ctx, "bob", "/state/a")
+	a.NoError(err)
+	a.Equal(map[string]int64{"/state/a": 5}, counts)
+	// counted for each topic with its own marker, including glob and all topics
+	counts, err = s.Count(ctx, &Query{Topics: []string{"/state/*"}, User: "alice", Unread: true})
+	a.NoError(err)
+	a.Equal(map[string]int64{"/state/a": 2}, counts)
+	counts, err = s.Count(ctx, &Query{User: "alice", Unread: true})
+	a.NoError(err)
+	a.Equal(map[string]int64{"/state/a": 2}, counts)
+
+	unread, err := s.Fetch(ctx, &Query{Topics: []string{"/state/a"}, User: "alice", Unread: true})
+	a.NoError(err)
+	a.Equal([]int64{4, 3}, mapOriginKey(unread))
+	all, err := s.Fetch(ctx, &Query{Topics: []string{"/state/a"}, User: "alice"})
+	a.NoError(err)
+	if a.Len(all, 5) {
+		a.False(all[0].State.Read)
+		a.True(all[2].State.Read)
+	}
+
+	_, err = s.Fetch(ctx, &Query{Unread: true})
+	a.Equal(ErrNoUser, err)
+}
+
+func TestItemFlags(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("state/test", "/state/flags"))
+	var items []*Item
+	for i := 0; i < 3; i++ {
+		it := &Item{Caption: "flag", OriginKey: int64(i)}
+		a.NoError(s.Publish("/state/flags", it))
+		items = append(items, it)
+	}
+	a.NoError(s.Star(ctx, "alice", items[0].ID, true))
+	a.NoError(s.Star(ctx, "alice", items[1].ID, true))
+	a.NoError(s.Star(ctx, "alice", items[1].ID, false))
+	a.NoError(s.Hide(ctx, "alice", items[2].ID, true))
+	a.Equal(ErrNotFound, s.Star(ctx, "alice", 99999, true))
+
+	starred, err := s.Fetch(ctx, &Query{User: "alice", Starred: true})
+	a.NoError(err)
+	a.Equal([]int64{0}, mapOriginKey(starred))
+	a.True(starred[0].State.Starred)
+	starred, err = s.Fetch(ctx, &Query{User: "bob", Starred: true})
+	a.NoError(err)
+	a.Empty(starred)
+
+	visible, err := s.Fetch(ctx, &Query{User: "alice"})
+	a.NoError(err)
+	a.Equal([]int64{1, 0}, mapOriginKey(visible))
+	withHidden, err := s.Fetch(ctx, &Query{User: "alice", ShowHidden: true})
+	a.NoError(err)
+	a.Equal([]int64{2, 1, 0}, mapOriginKey(withHidden))
+	counts, err := s.UnreadCounts(ctx, "alice", "/state/flags")
+	a.NoError(err)
+	a.Equal(int64(2), counts["/state/flags"])
+
+	// starred items are kept by retention, state is deleted with items
+	r, err := NewRetention(s, RetentionConfig{Rules: []RetentionRule{{Pattern: "/state/flags", MaxCount: 1, KeepStarred: true}}})
+	a.NoError(err)
+	stats := r.Run(ctx)
+	a.Empty(stats.Error)
+	a.Equal(int64(1), stats.Total)
+	remains, err := s.Fetch(ctx, &Query{User: "alice", ShowHidden: true})
+	a.NoError(err)
+	a.Equal([]int64{2, 0}, mapOriginKey(remains))
+	_, err = s.DeleteTopic("/state/flags")
+	a.NoError(err)
+}
@@ -0,0 +1,273 @@
+package timeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kanosaki/dumper/common"
+)
+
+type StatsInterval string
+
+const (
+	StatsHour StatsInterval = "hour"
+	StatsDay  StatsInterval = "day"
+	StatsWeek StatsInterval = "week"
+)
+
+// Groups of StatsQuery.GroupBy, or "meta.<field>" to group by a field of Item.Meta.
+const (
+	GroupByTopic  = "topic"
+	GroupByOrigin = "origin"
+)
+
+var (
+	// Number of buckets when StatsQuery has no After.
+	DefaultStatsBuckets = 30
+	MaxStatsBuckets     = 2000
+	ErrTooManyBuckets   = errors.New("Too many buckets, narrow the time range")
+	ErrStatsRange       = errors.New("After is later than Before")
+)
+
+func (i StatsInterval) millis() (int64, error) {
+	switch i {
+	case StatsHour:
+		return int64(time.Hour / time.Millisecond), nil
+	case StatsDay:
+		return int64(24 * time.Hour / time.Millisecond), nil
+	case StatsWeek:
+		return int64(7 * 24 * time.Hour / time.Millisecond), nil
+	default:
+		return 0, fmt.Errorf("Unknown interval: %s", i)
+	}
+}
+
+// Item counts of Query in time buckets.
+// Query.After and Query.Before give the range, Before defaults to now.
+type StatsQuery struct {
+	Query    *Query
+	Interval StatsInterval
+	// Empty for total, GroupByTopic, GroupByOrigin or "meta.<field>".
+	// Items without the meta field are not counted.
+	GroupBy string
+	// Offset of bucket boundaries from UTC, such as 9h for midnight in JST. Weeks start on Monday.
+	UTCOffset time.Duration
+	// Top groups by total count, 0 for all.
+	Limit int
+}
+
+func (sq *StatsQuery) metaField() string {
+	return strings.TrimPrefix(sq.GroupBy, "meta.")
+}
+
+func (sq *StatsQuery) Validate() error {
+	if _, err := sq.Interval.millis(); err != nil {
+		return err
+	}
+	switch {
+	case sq.GroupBy == "", sq.GroupBy == GroupByTopic, sq.GroupBy == GroupByOrigin:
+	case strings.HasPrefix(sq.GroupBy, "meta.") && sq.metaField() != "":
+	default:
+		return fmt.Errorf("Unknown group: %s", sq.GroupBy)
+	}
+	if sq.Query == nil {
+		return nil
+	}
+	return sq.Query.Validate()
+}
+
+// Milliseconds added to timestamps before dividing into buckets.
+// Epoch is Thursday, shifted by 3 days for weeks to start on Monday.
+func (sq *StatsQuery) bucketShift() int64 {
+	shift := int64(sq.UTCOffset / time.Millisecond)
+	if sq.Interval == StatsWeek {
+		shift += 3 * int64(24*time.Hour/time.Millisecond)
+	}
+	return shift
+}
+
+// Index of the bucket which contains t, counted from unix epoch.
+func (sq *StatsQuery) bucketOf(t time.Time) int64 {
+	size, _ := sq.Interval.millis()
+	return (common.Timestamp(t) + sq.bucketShift()) / size
+}
+
+func (sq *StatsQuery) bucketStart(bucket int64) time.Time {
+	size, _ := sq.Interval.millis()
+	t := common.FromTimestamp(bucket*size - sq.bucketShift())
+	if sq.UTCOffset == 0 {
+		return t.UTC()
+	}
+	return t.In(time.FixedZone("", int(sq.UTCOffset/time.Second)))
+}
+
+// Count of a bucket and a group, returned by Storage.
+type BucketCount struct {
+	Bucket int64 // see StatsQuery.bucketOf
+	Group  string
+	Count  int64
+}
+
+type Stats struct {
+	Interval StatsInterval `json:"interval"`
+	GroupBy  string        `json:"groupBy"`
+	// Start of each bucket, in ascending order.
+	Buckets []time.Time `json:"buckets"`
+	// In descending order of total.
+	Groups []*StatsGroup `json:"groups"`
+}
+
+type StatsGroup struct {
+	Key    string  `json:"key"`
+	Total  int64   `json:"total"`
+	Counts []int64 `json:"counts"` // for each bucket
+}
+
+func (s *SQLiteStorage) CountByBucket(ctx context.Context, sq *StatsQuery) ([]BucketCount, error) {
+	if err := sq.Validate(); err != nil {
+		return nil, err
+	}
+	q := s.resolveTopics(sq.Query)
+	if q == nil {
+		return nil, nil
+	}
+	size, _ := sq.Interval.millis()
+	var group string
+	var groupParams []interface{}
+	switch sq.GroupBy {
+	case "":
+		group = "''"
+	case GroupByTopic:
+		group = "topic.key"
+	case GroupByOrigin:
+		group = "origin.name"
+	default:
+		field := sq.metaField()
+		filtered := *q
+		filtered.Meta = append(append([]MetaPredicate(nil), q.Meta...), MetaExists(field))
+		q = &filtered
+		group = "CAST(json_extract(timeline.meta, ?) AS TEXT)"
+		groupParams = []interface{}{(&MetaPredicate{Field: field}).jsonPath()}
+	}
+	where, params := q.ToCondition()
+	query := `SELECT (timeline.timestamp + ?) / ? AS bucket, ` + group + ` AS grp, COUNT(*)
+		FROM timeline JOIN topic on timeline.topic_id = topic.id
+		JOIN origin on topic.origin_id = origin.id ` + where + ` GROUP BY bucket, grp`
+	params = append(append([]interface{}{sq.bucketShift(), size}, groupParams...), params...)
+	rows, err := s.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []BucketCount
+	for rows.Next() {
+		var bc BucketCount
+		if err := rows.Scan(&bc.Bucket, &bc.Group, &bc.Count); err != nil {
+			return nil, err
+		}
+		ret = append(ret, bc)
+	}
+	return ret, rows.Err()
+}
+
+// Count items in buckets of time. Buckets and groups without items are filled with 0,
+// topics matched to Query.Topics are listed even if they have no items when grouped by topic.
+// Saved searches in Query.Topics are expanded, and grouped under their keys as in Service.Count.
+func (s *Service) Stats(ctx context.Context, sq *StatsQuery) (*Stats, error) {
+	if err := sq.Validate(); err != nil {
+		return nil, err
+	}
+	size, _ := sq.Interval.millis()
+	q := &Query{}
+	if sq.Query != nil {
+		copied := *sq.Query
+		q = &copied
+	}
+	if q.Before.IsZero() {
+		q.Before = time.Now()
+	}
+	if q.After.IsZero() {
+		q.After = q.Before.Add(-time.Duration(int64(DefaultStatsBuckets-1)*size) * time.Millisecond)
+	}
+	first, last := sq.bucketOf(q.After), sq.bucketOf(q.Before)
+	if last < first {
+		return nil, ErrStatsRange
+	}
+	if last-first+1 > int64(MaxStatsBuckets) {
+		return nil, ErrTooManyBuckets
+	}
+	resolved := *sq
+	resolved.Query = q
+	s.topicsMu.RLock()
+	plan := s.planFetch(q)
+	s.topicsMu.RUnlock()
+	counts, err := s.runCountByBucket(ctx, &resolved, plan)
+	if err != nil {
+		return nil, err
+	}
+	ret := &Stats{Interval: sq.Interval, GroupBy: sq.GroupBy, Groups: []*StatsGroup{}}
+	for b := first; b <= last; b++ {
+		ret.Buckets = append(ret.Buckets, sq.bucketStart(b))
+	}
+	groups := make(map[string]*StatsGroup)
+	group := func(key string) *StatsGroup {
+		g, ok := groups[key]
+		if !ok {
+			g = &StatsGroup{Key: key, Counts: make([]int64, len(ret.Buckets))}
+			groups[key] = g
+			ret.Groups = append(ret.Groups, g)
+		}
+		return g
+	}
+	if sq.GroupBy == "" {
+		group("")
+	}
+	if sq.GroupBy == GroupByTopic {
+		for _, key := range s.silentCandidates(q) {
+			group(key)
+		}
+	}
+	for _, c := range counts {
+		if c.Bucket < first || c.Bucket > last {
+			continue
+		}
+		g := group(c.Group)
+		g.Counts[c.Bucket-first] += c.Count
+		g.Total += c.Count
+	}
+	sort.SliceStable(ret.Groups, func(i, j int) bool {
+		if ret.Groups[i].Total != ret.Groups[j].Total {
+			return ret.Groups[i].Total > ret.Groups[j].Total
+		}
+		return ret.Groups[i].Key < ret.Groups[j].Key
+	})
+	if sq.Limit > 0 && len(ret.Groups) > sq.Limit {
+		ret.Groups = ret.Groups[:sq.Limit]
+	}
+	return ret, nil
+}
+
+// Existing topics matched to q, all active topics if q has no topics.
+func (s *Service) silentCandidates(q *Query) []string {
+	if len(q.Topics) == 0 {
+		var ret []string
+		for _, t := range s.Topics("") {
+			ret = append(ret, t.Key)
+		}
+		return ret
+	}
+	s.topicsMu.RLock()
+	defer s.topicsMu.RUnlock()
+	keys, _ := resolveTopics(q.Topics, s.topicKeys)
+	var ret []string
+	for _, k := range keys {
+		if _, ok := s.topics[k]; ok {
+			ret = append(ret, k)
+		}
+	}
+	return ret
+}
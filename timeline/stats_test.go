@@ -0,0 +1,73 @@
+package timeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("twitter.tweet", "/stats/twitter/a"))
+	a.NoError(s.NewTopic("twitter.tweet", "/stats/twitter/b"))
+	a.NoError(s.NewTopic("pixiv.ranking", "/stats/pixiv"))
+	a.NoError(s.NewTopic("pixiv.ranking", "/stats/silent"))
+	day := time.Date(2026, 10, 5, 0, 0, 0, 0, time.UTC) // Monday
+	at := func(d, h int) time.Time { return day.Add(time.Duration(d*24+h) * time.Hour) }
+	a.NoError(s.Publish("/stats/twitter/a",
+		&Item{OriginKey: 1, Timestamp: at(0, 1), Meta: map[string]interface{}{"user": "foo"}},
+		&Item{OriginKey: 2, Timestamp: at(0, 23), Meta: map[string]interface{}{"user": "foo"}},
+		&Item{OriginKey: 3, Timestamp: at(2, 5), Meta: map[string]interface{}{"user": "bar"}}))
+	a.NoError(s.Publish("/stats/twitter/b",
+		&Item{OriginKey: 4, Timestamp: at(1, 12), Meta: map[string]interface{}{"user": "foo"}}))
+	a.NoError(s.Publish("/stats/pixiv",
+		&Item{OriginKey: 5, Timestamp: at(7, 0)},
+		&Item{OriginKey: 6, Timestamp: at(-1, 0)}))
+
+	q := &Query{Topics: []string{"/stats/**"}, After: at(0, 0), Before: at(2, 23)}
+	stats, err := s.Stats(ctx, &StatsQuery{Query: q, Interval: StatsDay, GroupBy: GroupByTopic})
+	a.NoError(err)
+	a.Equal([]time.Time{at(0, 0), at(1, 0), at(2, 0)}, stats.Buckets)
+	a.Equal([]*StatsGroup{
+		{Key: "/stats/twitter/a", Total: 3, Counts: []int64{2, 0, 1}},
+		{Key: "/stats/twitter/b", Total: 1, Counts: []int64{0, 1, 0}},
+		{Key: "/stats/pixiv", Total: 0, Counts: []int64{0, 0, 0}},
+		{Key: "/stats/silent", Total: 0, Counts: []int64{0, 0, 0}},
+	}, stats.Groups)
+
+	stats, err = s.Stats(ctx, &StatsQuery{Query: q, Interval: StatsDay, GroupBy: "meta.user", Limit: 1})
+	a.NoError(err)
+	a.Equal([]*StatsGroup{{Key: "foo", Total: 3, Counts: []int64{2, 1, 0}}}, stats.Groups)
+
+	// 23:00 UTC belongs to next day in JST
+	jst := &StatsQuery{Query: q, Interval: StatsDay, GroupBy: GroupByOrigin, UTCOffset: 9 * time.Hour}
+	stats, err = s.Stats(ctx, jst)
+	a.NoError(err)
+	a.True(at(-1, 15).Equal(stats.Buckets[0]))
+	a.Equal("+09:00", stats.Buckets[0].Format("Z07:00"))
+	a.Equal([]*StatsGroup{{Key: "twitter.tweet", Total: 4, Counts: []int64{1, 2, 1, 0}}}, stats.Groups)
+
+	wide := &Query{Topics: []string{"/stats/**"}, After: at(-1, 0), Before: at(7, 0)}
+	stats, err = s.Stats(ctx, &StatsQuery{Query: wide, Interval: StatsWeek})
+	a.NoError(err)
+	a.Equal([]time.Time{at(-7, 0), at(0, 0), at(7, 0)}, stats.Buckets)
+	a.Equal([]*StatsGroup{{Key: "", Total: 6, Counts: []int64{1, 4, 1}}}, stats.Groups)
+
+	stats, err = s.Stats(ctx, &StatsQuery{Query: &Query{Topics: []string{"/stats/pixiv"}, Before: at(7, 1)}, Interval: StatsHour})
+	a.NoError(err)
+	a.Len(stats.Buckets, DefaultStatsBuckets)
+	a.Equal(int64(1), stats.Groups[0].Total)
+
+	_, err = s.Stats(ctx, &StatsQuery{Query: wide, Interval: "month"})
+	a.Error(err)
+	_, err = s.Stats(ctx, &StatsQuery{Query: wide, Interval: StatsDay, GroupBy: "meta."})
+	a.Error(err)
+	_, err = s.Stats(ctx, &StatsQuery{Query: &Query{After: at(0, 0), Before: at(-1, 0)}, Interval: StatsDay})
+	a.Equal(ErrStatsRange, err)
+	_, err = s.Stats(ctx, &StatsQuery{Query: &Query{After: at(-365, 0), Before: at(0, 0)}, Interval: StatsHour})
+	a.Equal(ErrTooManyBuckets, err)
+}
@@ -0,0 +1,614 @@
+package timeline
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Implementations of Storage checked by the conformance tests, new backends should be added here.
+var storageImpls = []struct {
+	name string
+	new  func(t *testing.T) Storage
+}{
+	{"sqlite", newPrivateStorage},
+	{"memory", func(t *testing.T) Storage { return NewMemoryStorage() }},
+}
+
+func forEachStorage(t *testing.T, f func(t *testing.T, s Storage)) {
+	for _, impl := range storageImpls {
+		impl := impl
+		t.Run(impl.name, func(t *testing.T) {
+			f(t, impl.new(t))
+		})
+	}
+}
+
+var conformanceBase = time.Date(2026, 10, 1, 0, 30, 0, 0, time.UTC)
+
+// Items of the fixture by caption, published an hour apart in this order.
+type conformanceFixture map[string]*Item
+
+func (f conformanceFixture) id(caption string) int64 {
+	return f[caption].ID
+}
+
+func newConformanceFixture(t *testing.T, s Storage) conformanceFixture {
+	ctx := context.Background()
+	twitter, err := s.OriginID(ctx, "twitter.tweet", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pixiv, err := s.OriginID(ctx, "pixiv.ranking", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics := make(map[string]int)
+	for key, origin := range map[string]int{"/c/twitter/a": twitter, "/c/twitter/b": twitter, "/c/pixiv": pixiv} {
+		if topics[key], err = s.TopicID(ctx, key, origin, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items := []*Item{
+		{TopicKey: "/c/twitter/a", Caption: "cat photo", Thumbnail: "http://c/1.jpg",
+			Meta: map[string]interface{}{"user": "alice", "fav": 10}, Tags: []string{"cat"}},
+		{TopicKey: "/c/twitter/a", Caption: "dog photo", Thumbnail: "http://c/2.jpg",
+			Meta: map[string]interface{}{"user": "bob", "fav": 3}, Tags: []string{"Dog"}},
+		{TopicKey: "/c/twitter/b", Caption: "cat and dog", Thumbnail: "http://c/3.jpg",
+			Meta: map[string]interface{}{"user": "alice", "fav": 7, "nested": map[string]interface{}{"lang": "ja"}}, Tags: []string{"cat", "#dog"}},
+		{TopicKey: "/c/pixiv", Caption: "ranking 1", Thumbnail: "http://c/4.jpg",
+			Meta: map[string]interface{}{"rank": 1, "r18": false}, Tags: []string{"illust"}},
+		{TopicKey: "/c/pixiv", Caption: "ranking 2", Thumbnail: "http://c/5.jpg",
+			Meta: map[string]interface{}{"rank": 2, "r18": true}, Tags: []string{"illust", "cat"}},
+		{TopicKey: "/c/twitter/b", Caption: "hello"},
+	}
+	ret := make(conformanceFixture)
+	for i, it := range items {
+		it.TopicID = topics[it.TopicKey]
+		it.OriginKey = int64(i + 1)
+		it.Timestamp = conformanceBase.Add(time.Duration(i+1) * time.Hour)
+		ret[it.Caption] = it
+	}
+	if _, err := s.Insert(ctx, items...); err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func selectCaptions(t *testing.T, s Storage, q *Query) []string {
+	items, err := s.Select(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return captions(items)
+}
+
+func mustFilter(expr string) *Filter {
+	f, err := ParseFilter(expr)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func TestStorageSelect(t *testing.T) {
+	at := func(hour int) time.Time {
+		return conformanceBase.Add(time.Duration(hour) * time.Hour)
+	}
+	cases := []struct {
+		name     string
+		query    func(f conformanceFixture) *Query
+		captions []string
+	}{
+		{"all", func(f conformanceFixture) *Query { return &Query{} },
+			[]string{"hello", "ranking 2", "ranking 1", "cat and dog", "dog photo", "cat photo"}},
+		{"limit", func(f conformanceFixture) *Query { return &Query{Limit: 2} },
+			[]string{"hello", "ranking 2"}},
+		{"offset", func(f conformanceFixture) *Query { return &Query{Limit: 2, Offset: 1} },
+			[]string{"ranking 2", "ranking 1"}},
+		{"offset over", func(f conformanceFixture) *Query { return &Query{Offset: 10} },
+			[]string{}},
+		{"topic glob", func(f conformanceFixture) *Query { return &Query{Topics: []string{"/c/twitter/**"}} },
+			[]string{"hello", "cat and dog", "dog photo", "cat photo"}},
+		{"topic exclusion", func(f conformanceFixture) *Query { return &Query{Topics: []string{"/c/**", "!/c/pixiv"}} },
+			[]string{"hello", "cat and dog", "dog photo", "cat photo"}},
+		{"topic keys", func(f conformanceFixture) *Query { return &Query{Topics: []string{"/c/twitter/a", "/c/pixiv"}} },
+			[]string{"ranking 2", "ranking 1", "dog photo", "cat photo"}},
+		{"missing topic", func(f conformanceFixture) *Query { return &Query{Topics: []string{"/c/none"}} },
+			[]string{}},
+		{"unmatched glob", func(f conformanceFixture) *Query { return &Query{Topics: []string{"/none/**"}} },
+			[]string{}},
+		{"origin", func(f conformanceFixture) *Query { return &Query{Origins: []string{"pixiv.ranking"}} },
+			[]string{"ranking 2", "ranking 1"}},
+		{"min id", func(f conformanceFixture) *Query { return &Query{MinID: int(f.id("cat and dog"))} },
+			[]string{"hello", "ranking 2", "ranking 1", "cat and dog"}},
+		{"min id ascending fetch", func(f conformanceFixture) *Query { return &Query{MinID: int(f.id("cat and dog")), Limit: 2} },
+			[]string{"ranking 1", "cat and dog"}},
+		{"max id", func(f conformanceFixture) *Query { return &Query{MaxID: int(f.id("cat and dog")), Limit: 2} },
+			[]string{"cat and dog", "dog photo"}},
+		{"after", func(f conformanceFixture) *Query { return &Query{After: at(3)} },
+			[]string{"hello", "ranking 2", "ranking 1", "cat and dog"}},
+		{"after ascending fetch", func(f conformanceFixture) *Query { return &Query{After: at(3), Limit: 2} },
+			[]string{"ranking 1", "cat and dog"}},
+		{"before", func(f conformanceFixture) *Query { return &Query{Before: at(2)} },
+			[]string{"dog photo", "cat photo"}},
+		{"time range", func(f conformanceFixture) *Query { return &Query{After: at(2), Before: at(4), Limit: 2} },
+			[]string{"ranking 1", "cat and dog"}},
+		{"meta eq", func(f conformanceFixture) *Query { return &Query{Meta: []MetaPredicate{MetaEq("user", "alice")}} },
+			[]string{"cat and dog", "cat photo"}},
+		{"meta in", func(f conformanceFixture) *Query {
+			return &Query{Meta: []MetaPredicate{MetaIn("user", "bob", "carol")}}
+		},
+			[]string{"dog photo"}},
+		{"meta numeric", func(f conformanceFixture) *Query { return &Query{Meta: []MetaPredicate{MetaGt("fav", 5)}} },
+			[]string{"cat and dog", "cat photo"}},
+		{"meta missing numeric", func(f conformanceFixture) *Query { return &Query{Meta: []MetaPredicate{MetaLte("rank", 1)}} },
+			[]string{"ranking 1"}},
+		{"meta bool", func(f conformanceFixture) *Query { return &Query{Meta: []MetaPredicate{MetaEq("r18", true)}} },
+			[]string{"ranking 2"}},
+		{"meta nested", func(f conformanceFixture) *Query { return &Query{Meta: []MetaPredicate{MetaExists("nested.lang")}} },
+			[]string{"cat and dog"}},
+		{"tag", func(f conformanceFixture) *Query { return &Query{Tags: []string{"#Cat"}} },
+			[]string{"ranking 2", "cat and dog", "cat photo"}},
+		{"all of tags", func(f conformanceFixture) *Query { return &Query{Tags: []string{"cat", "dog"}} },
+			[]string{"cat and dog"}},
+		{"any of tags", func(f conformanceFixture) *Query { return &Query{AnyTags: []string{"dog", "illust"}} },
+			[]string{"ranking 2", "ranking 1", "cat and dog", "dog photo"}},
+		{"exclude tags", func(f conformanceFixture) *Query { return &Query{ExcludeTags: []string{"cat"}} },
+			[]string{"hello", "ranking 1", "dog photo"}},
+		{"unknown tag", func(f conformanceFixture) *Query { return &Query{Tags: []string{"unknown"}} },
+			[]string{}},
+		{"filter caption", func(f conformanceFixture) *Query { return &Query{Filter: mustFilter("caption:^cat")} },
+			[]string{"cat and dog", "cat photo"}},
+		{"filter negated caption", func(f conformanceFixture) *Query { return &Query{Filter: mustFilter("-caption:photo")} },
+			[]string{"hello", "ranking 2", "ranking 1", "cat and dog"}},
+		{"filter negated missing meta", func(f conformanceFixture) *Query { return &Query{Filter: mustFilter("-meta.user:alice")} },
+			[]string{"hello", "ranking 2", "ranking 1", "dog photo"}},
+		{"filter terms", func(f conformanceFixture) *Query {
+			return &Query{Filter: mustFilter("meta.user:alice -tag:dog origin:twitter.tweet")}
+		},
+			[]string{"cat photo"}},
+		{"compound", func(f conformanceFixture) *Query {
+			return &Query{Topics: []string{"/c/twitter/**"}, Tags: []string{"cat"}, Before: at(5), Limit: 1}
+		}, []string{"cat and dog"}},
+	}
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		f := newConformanceFixture(t, s)
+		for _, c := range cases {
+			assert.Equal(t, c.captions, selectCaptions(t, s, c.query(f)), c.name)
+		}
+
+		// stored fields
+		items, err := s.Select(context.Background(), &Query{MinID: int(f.id("cat and dog")), MaxID: int(f.id("cat and dog"))})
+		assert.NoError(t, err)
+		if assert.Len(t, items, 1) {
+			it := items[0]
+			assert.Equal(t, "/c/twitter/b", it.TopicKey)
+			assert.Equal(t, "twitter.tweet", it.Origin)
+			assert.Equal(t, int64(3), it.OriginKey)
+			assert.Equal(t, "http://c/3.jpg", it.Thumbnail)
+			assert.True(t, conformanceBase.Add(3*time.Hour).Equal(it.Timestamp))
+			assert.Equal(t, []string{"cat", "dog"}, it.Tags)
+			assert.Equal(t, map[string]interface{}{"user": "alice", "fav": float64(7), "nested": map[string]interface{}{"lang": "ja"}}, it.Meta)
+			assert.Nil(t, it.State)
+		}
+		// canonical tags are set on insert
+		assert.Equal(t, []string{"cat", "dog"}, f["cat and dog"].Tags)
+		assert.Equal(t, []string{"dog"}, f["dog photo"].Tags)
+
+		_, err = s.Select(context.Background(), &Query{Unread: true})
+		assert.Equal(t, ErrNoUser, err)
+	})
+}
+
+func TestStorageInsert(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		a := assert.New(t)
+		ctx := context.Background()
+		f := newConformanceFixture(t, s)
+		topicID, err := s.TopicID(ctx, "/c/pixiv", 0, false)
+		a.NoError(err)
+		valid := &Item{TopicID: topicID, Caption: "valid", Timestamp: time.Now()}
+		invalid := &Item{TopicID: 9999, Caption: "invalid", Timestamp: time.Now()}
+		_, err = s.Insert(ctx, valid, invalid)
+		var insertErr *InsertError
+		if a.True(errors.As(err, &insertErr)) {
+			a.Equal(1, insertErr.Index)
+		}
+		a.Zero(valid.ID)
+		a.Len(selectCaptions(t, s, &Query{}), 6)
+
+		last, err := s.Insert(ctx, valid)
+		a.NoError(err)
+		a.Equal(valid.ID, last)
+		a.True(valid.ID > f.id("hello"))
+
+		id, err := s.FindItem(ctx, "/c/pixiv", 4, conformanceBase.Add(4*time.Hour))
+		a.NoError(err)
+		a.Equal(f.id("ranking 1"), id)
+		_, err = s.FindItem(ctx, "/c/pixiv", 4, conformanceBase)
+		a.Equal(ErrNotFound, err)
+		_, err = s.FindItem(ctx, "/c/none", 4, conformanceBase)
+		a.Equal(ErrNotFound, err)
+	})
+}
+
+func TestStorageTopics(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		a := assert.New(t)
+		ctx := context.Background()
+		f := newConformanceFixture(t, s)
+		_, err := s.OriginID(ctx, "none", false)
+		a.Equal(ErrNotFound, err)
+		_, err = s.TopicID(ctx, "/c/none", 0, false)
+		a.Equal(ErrNotFound, err)
+		id1, err := s.OriginID(ctx, "twitter.tweet", false)
+		a.NoError(err)
+		id2, err := s.OriginID(ctx, "twitter.tweet", true)
+		a.NoError(err)
+		a.Equal(id1, id2)
+
+		info, err := s.TopicInfo(ctx, "/c/pixiv")
+		a.NoError(err)
+		a.False(info.CreatedAt.IsZero())
+		info.Title, info.Archived = "Pixiv", true
+		a.NoError(s.UpdateTopicInfo(ctx, "/c/pixiv", info))
+		updated, err := s.TopicInfo(ctx, "/c/pixiv")
+		a.NoError(err)
+		a.Equal("Pixiv", updated.Title)
+		a.True(updated.Archived)
+		a.True(info.CreatedAt.Truncate(time.Millisecond).Equal(updated.CreatedAt))
+		a.Equal(ErrNotFound, s.UpdateTopicInfo(ctx, "/c/none", info))
+		_, err = s.TopicInfo(ctx, "/c/none")
+		a.Equal(ErrNotFound, err)
+
+		a.Equal(ErrTopicExists, s.RenameTopic(ctx, "/c/pixiv", "/c/twitter/a"))
+		a.Equal(ErrNotFound, s.RenameTopic(ctx, "/c/none", "/c/other"))
+		a.NoError(s.RenameTopic(ctx, "/c/pixiv", "/c/illust"))
+		a.Equal([]string{"ranking 2", "ranking 1"}, selectCaptions(t, s, &Query{Topics: []string{"/c/illust"}}))
+		a.Empty(selectCaptions(t, s, &Query{Topics: []string{"/c/pixiv"}}))
+		info, err = s.TopicInfo(ctx, "/c/illust")
+		a.NoError(err)
+		a.Equal("Pixiv", info.Title)
+
+		a.NoError(s.MarkRead(ctx, "alice", "/c/twitter/b", 0))
+		a.NoError(s.SetItemFlag(ctx, "alice", f.id("hello"), FlagStarred, true))
+		a.NoError(s.SaveSearch(ctx, "/c/twitter/b", "tag:cat"))
+		n, err := s.DeleteTopic(ctx, "/c/twitter/b")
+		a.NoError(err)
+		a.Equal(int64(2), n)
+		_, err = s.DeleteTopic(ctx, "/c/twitter/b")
+		a.Equal(ErrNotFound, err)
+		a.Len(selectCaptions(t, s, &Query{}), 4)
+		markers, err := s.ReadMarkers(ctx, "alice")
+		a.NoError(err)
+		a.Empty(markers)
+		searches, err := s.SavedSearches(ctx)
+		a.NoError(err)
+		a.Empty(searches)
+		a.Empty(selectCaptions(t, s, &Query{Starred: true}))
+	})
+}
+
+func TestStorageState(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		a := assert.New(t)
+		ctx := context.Background()
+		f := newConformanceFixture(t, s)
+		twitter := []string{"/c/twitter/**"}
+		a.NoError(s.SetItemFlag(ctx, "alice", f.id("cat photo"), FlagStarred, true))
+		a.NoError(s.SetItemFlag(ctx, "alice", f.id("dog photo"), FlagHidden, true))
+		a.NoError(s.SetItemFlag(ctx, "bob", f.id("hello"), FlagStarred, true))
+		a.Equal(ErrNotFound, s.SetItemFlag(ctx, "alice", 9999, FlagStarred, true))
+
+		a.Equal([]string{"hello", "cat and dog", "cat photo"}, selectCaptions(t, s, &Query{Topics: twitter, User: "alice"}))
+		a.Equal([]string{"hello", "cat and dog", "dog photo", "cat photo"}, selectCaptions(t, s, &Query{Topics: twitter, User: "alice", ShowHidden: true}))
+		a.Equal([]string{"cat photo"}, selectCaptions(t, s, &Query{User: "alice", Starred: true}))
+		a.Equal([]string{"hello", "cat photo"}, selectCaptions(t, s, &Query{Starred: true}))
+		// hidden by others
+		a.Len(selectCaptions(t, s, &Query{Topics: twitter, User: "bob"}), 4)
+
+		a.NoError(s.MarkRead(ctx, "alice", "/c/twitter/a", 0))
+		a.NoError(s.MarkRead(ctx, "alice", "/c/twitter/b", f.id("cat and dog")))
+		// never goes back
+		a.NoError(s.MarkRead(ctx, "alice", "/c/twitter/a", f.id("cat photo")))
+		a.Equal(ErrNotFound, s.MarkRead(ctx, "alice", "/c/none", 0))
+		markers, err := s.ReadMarkers(ctx, "alice")
+		a.NoError(err)
+		a.Equal(map[string]int64{"/c/twitter/a": f.id("dog photo"), "/c/twitter/b": f.id("cat and dog")}, markers)
+		markers, err = s.ReadMarkers(ctx, "bob")
+		a.NoError(err)
+		a.Empty(markers)
+
+		a.Equal([]string{"hello"}, selectCaptions(t, s, &Query{Topics: twitter, User: "alice", Unread: true}))
+		a.Equal([]string{"hello", "ranking 2", "ranking 1"}, selectCaptions(t, s, &Query{User: "alice", Unread: true}))
+		items, err := s.Select(ctx, &Query{Topics: twitter, User: "alice", ShowHidden: true})
+		a.NoError(err)
+		states := make(map[string]ItemState)
+		for _, it := range items {
+			states[it.Caption] = *it.State
+		}
+		a.Equal(map[string]ItemState{
+			"hello":       {},
+			"cat and dog": {Read: true},
+			"dog photo":   {Hidden: true, Read: true},
+			"cat photo":   {Starred: true, Read: true},
+		}, states)
+
+		a.NoError(s.SetItemFlag(ctx, "alice", f.id("dog photo"), FlagHidden, false))
+		a.Len(selectCaptions(t, s, &Query{Topics: twitter, User: "alice"}), 4)
+	})
+}
+
+func TestStorageCounts(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		a := assert.New(t)
+		ctx := context.Background()
+		newConformanceFixture(t, s)
+		counts, err := s.CountByTopic(ctx, &Query{Tags: []string{"cat"}, Limit: 1})
+		a.NoError(err)
+		a.Equal(map[string]int64{"/c/twitter/a": 1, "/c/twitter/b": 1, "/c/pixiv": 1}, counts)
+		counts, err = s.CountByTopic(ctx, &Query{Topics: []string{"/none/**"}})
+		a.NoError(err)
+		a.Empty(counts)
+
+		tags, err := s.TagCounts(ctx, &Query{}, 0)
+		a.NoError(err)
+		a.Equal([]TagCount{{"cat", 3}, {"dog", 2}, {"illust", 2}}, tags)
+		tags, err = s.TagCounts(ctx, &Query{Topics: []string{"/c/twitter/**"}}, 1)
+		a.NoError(err)
+		a.Equal([]TagCount{{"cat", 2}}, tags)
+
+		sortBuckets := func(bcs []BucketCount) []BucketCount {
+			sort.Slice(bcs, func(i, j int) bool {
+				if bcs[i].Bucket != bcs[j].Bucket {
+					return bcs[i].Bucket < bcs[j].Bucket
+				}
+				return bcs[i].Group < bcs[j].Group
+			})
+			return bcs
+		}
+		day := (&StatsQuery{Interval: StatsDay}).bucketOf(conformanceBase)
+		buckets, err := s.CountByBucket(ctx, &StatsQuery{Query: &Query{}, Interval: StatsDay, GroupBy: GroupByOrigin})
+		a.NoError(err)
+		a.Equal([]BucketCount{{day, "pixiv.ranking", 2}, {day, "twitter.tweet", 4}}, sortBuckets(buckets))
+		buckets, err = s.CountByBucket(ctx, &StatsQuery{Query: &Query{Topics: []string{"/c/twitter/**"}}, Interval: StatsDay, GroupBy: "meta.user"})
+		a.NoError(err)
+		a.Equal([]BucketCount{{day, "alice", 2}, {day, "bob", 1}}, sortBuckets(buckets))
+		buckets, err = s.CountByBucket(ctx, &StatsQuery{Query: &Query{Origins: []string{"pixiv.ranking"}}, Interval: StatsHour, GroupBy: "meta.rank"})
+		a.NoError(err)
+		hour := (&StatsQuery{Interval: StatsHour}).bucketOf(conformanceBase)
+		a.Equal([]BucketCount{{hour + 4, "1", 1}, {hour + 5, "2", 1}}, sortBuckets(buckets))
+		buckets, err = s.CountByBucket(ctx, &StatsQuery{Query: &Query{}, Interval: StatsHour, UTCOffset: 30 * time.Minute})
+		a.NoError(err)
+		a.Len(buckets, 6)
+		a.Equal(hour+2, sortBuckets(buckets)[0].Bucket)
+	})
+}
+
+func TestStorageTags(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		a := assert.New(t)
+		ctx := context.Background()
+		f := newConformanceFixture(t, s)
+		tags, err := s.AddTags(ctx, f.id("hello"), []string{"Greeting", "#cat", "cat"})
+		a.NoError(err)
+		a.Equal([]string{"cat", "greeting"}, tags)
+		tags, err = s.RemoveTags(ctx, f.id("hello"), []string{"CAT", "unknown"})
+		a.NoError(err)
+		a.Equal([]string{"greeting"}, tags)
+		_, err = s.AddTags(ctx, 9999, []string{"cat"})
+		a.Equal(ErrNotFound, err)
+
+		// alias is resolved on query and on store
+		a.NoError(s.SetTagAlias(ctx, "kitty", "cat"))
+		a.Equal([]string{"ranking 2", "cat and dog", "cat photo"}, selectCaptions(t, s, &Query{Tags: []string{"kitty"}}))
+		tags, err = s.AddTags(ctx, f.id("hello"), []string{"Kitty"})
+		a.NoError(err)
+		a.Equal([]string{"cat", "greeting"}, tags)
+		tags, err = s.RemoveTags(ctx, f.id("hello"), []string{"kitty"})
+		a.NoError(err)
+		a.Equal([]string{"greeting"}, tags)
+
+		// existing tags are moved to canonical
+		a.NoError(s.SetTagAlias(ctx, "dog", "cat"))
+		a.Equal([]string{"ranking 2", "cat and dog", "dog photo", "cat photo"}, selectCaptions(t, s, &Query{Filter: mustFilter("tag:dog")}))
+		items, err := s.Select(ctx, &Query{Topics: []string{"/c/twitter/a"}})
+		a.NoError(err)
+		a.Equal([]string{"cat"}, items[0].Tags)
+		counts, err := s.TagCounts(ctx, &Query{}, 0)
+		a.NoError(err)
+		a.Equal([]TagCount{{"cat", 4}, {"illust", 2}, {"greeting", 1}}, counts)
+		a.Equal(ErrTagAliasCycle, s.SetTagAlias(ctx, "cat", "kitty"))
+		aliases, err := s.TagAliases(ctx)
+		a.NoError(err)
+		a.Equal(map[string]string{"kitty": "cat", "dog": "cat"}, aliases)
+
+		// removed alias is a separate tag
+		a.NoError(s.SetTagAlias(ctx, "kitty", ""))
+		a.Empty(selectCaptions(t, s, &Query{Tags: []string{"kitty"}}))
+		aliases, err = s.TagAliases(ctx)
+		a.NoError(err)
+		a.Equal(map[string]string{"dog": "cat"}, aliases)
+	})
+}
+
+func TestStorageDeleteItems(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		a := assert.New(t)
+		ctx := context.Background()
+		f := newConformanceFixture(t, s)
+		a.NoError(s.SetItemFlag(ctx, "alice", f.id("cat photo"), FlagStarred, true))
+		twitter := &Query{Topics: []string{"/c/twitter/**"}}
+
+		n, err := s.DeleteItems(ctx, twitter, []*Query{{}}, 10)
+		a.NoError(err)
+		a.Zero(n)
+		// oldest first
+		n, err = s.DeleteItems(ctx, twitter, []*Query{{Starred: true}}, 1)
+		a.NoError(err)
+		a.Equal(int64(1), n)
+		a.Equal([]string{"hello", "cat and dog", "cat photo"}, selectCaptions(t, s, twitter))
+		n, err = s.DeleteItems(ctx, twitter, []*Query{{Starred: true}, {Filter: mustFilter("meta.user:alice")}}, 10)
+		a.NoError(err)
+		a.Equal(int64(1), n)
+		a.Equal([]string{"cat and dog", "cat photo"}, selectCaptions(t, s, twitter))
+		n, err = s.DeleteItems(ctx, &Query{Topics: []string{"/none/**"}}, nil, 10)
+		a.NoError(err)
+		a.Zero(n)
+		n, err = s.DeleteItems(ctx, &Query{Before: conformanceBase.Add(4 * time.Hour)}, nil, 10)
+		a.NoError(err)
+		a.Equal(int64(3), n)
+		a.Equal([]string{"ranking 2"}, selectCaptions(t, s, &Query{}))
+		// state of deleted items
+		a.Empty(selectCaptions(t, s, &Query{Starred: true}))
+	})
+}
+
+func TestStorageHash(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		a := assert.New(t)
+		ctx := context.Background()
+		f := newConformanceFixture(t, s)
+		unhashed := func(after int64, limit int) []int64 {
+			items, err := s.UnhashedItems(ctx, after, limit)
+			a.NoError(err)
+			var ids []int64
+			for _, it := range items {
+				a.NotEmpty(it.Thumbnail)
+				ids = append(ids, it.ID)
+			}
+			return ids
+		}
+		// items without thumbnail are skipped
+		a.Equal([]int64{f.id("cat photo"), f.id("dog photo"), f.id("cat and dog"), f.id("ranking 1"), f.id("ranking 2")}, unhashed(0, 10))
+		a.Equal([]int64{f.id("cat and dog")}, unhashed(f.id("dog photo"), 1))
+
+		h1, h2 := PHash(0xff), PHash(0xf0)
+		a.NoError(s.SetItemHash(ctx, f.id("cat photo"), &h1))
+		a.NoError(s.SetItemHash(ctx, f.id("dog photo"), &h2))
+		a.NoError(s.SetItemHash(ctx, f.id("cat and dog"), nil))
+		a.Equal(ErrNotFound, s.SetItemHash(ctx, 9999, &h1))
+		a.Equal([]int64{f.id("ranking 1"), f.id("ranking 2")}, unhashed(0, 10))
+
+		items, err := s.Select(ctx, &Query{SimilarTo: &h1, MaxDistance: 4})
+		a.NoError(err)
+		a.Equal([]string{"dog photo", "cat photo"}, captions(items))
+		a.Equal(h2, *items[0].PHash)
+		a.Equal([]string{"cat photo"}, selectCaptions(t, s, &Query{SimilarTo: &h1, MaxDistance: 3}))
+	})
+}
+
+func TestStorageSavedSearch(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		a := assert.New(t)
+		ctx := context.Background()
+		newConformanceFixture(t, s)
+		a.NoError(s.SaveSearch(ctx, "/c/pixiv", "tag:cat"))
+		a.NoError(s.SaveSearch(ctx, "/c/pixiv", "tag:dog"))
+		a.Equal(ErrNotFound, s.SaveSearch(ctx, "/c/none", "tag:dog"))
+		a.NoError(s.RenameTopic(ctx, "/c/pixiv", "/saved/dogs"))
+		searches, err := s.SavedSearches(ctx)
+		a.NoError(err)
+		a.Equal(map[string]string{"/saved/dogs": "tag:dog"}, searches)
+	})
+}
+
+func TestStorageUpdateItem(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		a := assert.New(t)
+		ctx := context.Background()
+		f := newConformanceFixture(t, s)
+		h := PHash(0xff)
+		a.NoError(s.SetItemHash(ctx, f.id("cat photo"), &h))
+		a.NoError(s.SetItemHash(ctx, f.id("dog photo"), &h))
+
+		cat := f["cat photo"]
+		updated, err := s.UpdateItem(ctx, &Item{TopicID: cat.TopicID, OriginKey: cat.OriginKey,
+			Caption: "cat video", Thumbnail: cat.Thumbnail, Meta: map[string]interface{}{"user": "carol"}, Tags: []string{"Cat", "video"}})
+		a.NoError(err)
+		if a.Len(updated, 1) {
+			it := updated[0]
+			a.Equal(cat.ID, it.ID)
+			a.Equal("cat video", it.Caption)
+			a.Equal("/c/twitter/a", it.TopicKey)
+			a.True(cat.Timestamp.Equal(it.Timestamp))
+			a.Equal([]string{"cat", "video"}, it.Tags)
+			// thumbnail is not changed
+			a.NotNil(it.PHash)
+		}
+		a.Equal([]string{"cat video"}, selectCaptions(t, s, &Query{Filter: mustFilter("meta.user:carol")}))
+		a.Equal([]string{"cat video"}, selectCaptions(t, s, &Query{Tags: []string{"video"}}))
+
+		dog := f["dog photo"]
+		updated, err = s.UpdateItem(ctx, &Item{TopicID: dog.TopicID, OriginKey: dog.OriginKey, Caption: "dog photo", Thumbnail: "http://c/new.jpg"})
+		a.NoError(err)
+		if a.Len(updated, 1) {
+			a.Nil(updated[0].PHash)
+			a.Empty(updated[0].Tags)
+		}
+		unhashed, err := s.UnhashedItems(ctx, 0, 1)
+		a.NoError(err)
+		a.Equal(dog.ID, unhashed[0].ID)
+
+		_, err = s.UpdateItem(ctx, &Item{TopicID: cat.TopicID, OriginKey: 999})
+		a.Equal(ErrNotFound, err)
+	})
+}
+
+func TestStorageDeleteItem(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		a := assert.New(t)
+		ctx := context.Background()
+		f := newConformanceFixture(t, s)
+		at := time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)
+		dog := f["dog photo"]
+
+		deleted, err := s.DeleteItem(ctx, "/c/twitter/a", dog.OriginKey, &Tombstone{At: at, Reason: "removed"})
+		a.NoError(err)
+		if a.Len(deleted, 1) && a.NotNil(deleted[0].Deleted) {
+			a.Equal(dog.ID, deleted[0].ID)
+			a.Equal("dog photo", deleted[0].Caption)
+			a.True(at.Equal(deleted[0].Deleted.At))
+			a.Equal("removed", deleted[0].Deleted.Reason)
+		}
+		// excluded unless ShowDeleted, including aggregations
+		a.Equal([]string{"cat photo"}, selectCaptions(t, s, &Query{Topics: []string{"/c/twitter/a"}}))
+		a.Equal([]string{"dog photo", "cat photo"}, selectCaptions(t, s, &Query{Topics: []string{"/c/twitter/a"}, ShowDeleted: true}))
+		counts, err := s.CountByTopic(ctx, &Query{Topics: []string{"/c/twitter/a"}})
+		a.NoError(err)
+		a.Equal(map[string]int64{"/c/twitter/a": 1}, counts)
+		tags, err := s.TagCounts(ctx, &Query{}, 10)
+		a.NoError(err)
+		for _, tc := range tags {
+			if tc.Tag == "dog" {
+				// "cat and dog" remains
+				a.Equal(int64(1), tc.Count)
+			}
+		}
+
+		_, err = s.DeleteItem(ctx, "/c/twitter/a", dog.OriginKey, &Tombstone{At: at})
+		a.Equal(ErrNotFound, err)
+		_, err = s.UpdateItem(ctx, &Item{TopicID: dog.TopicID, OriginKey: dog.OriginKey, Caption: "x"})
+		a.Equal(ErrNotFound, err)
+		_, err = s.DeleteItem(ctx, "/c/none", 1, nil)
+		a.Equal(ErrNotFound, err)
+
+		// purge removes tombstones too
+		deleted, err = s.DeleteItem(ctx, "/c/twitter/a", dog.OriginKey, nil)
+		a.NoError(err)
+		a.Len(deleted, 1)
+		a.Equal([]string{"cat photo"}, selectCaptions(t, s, &Query{Topics: []string{"/c/twitter/a"}, ShowDeleted: true}))
+
+		// retention deletes tombstones regardless of ShowDeleted
+		_, err = s.DeleteItem(ctx, "/c/pixiv", f["ranking 1"].OriginKey, &Tombstone{At: at})
+		a.NoError(err)
+		n, err := s.DeleteItems(ctx, &Query{Topics: []string{"/c/pixiv"}}, nil, 10)
+		a.NoError(err)
+		a.Equal(int64(2), n)
+	})
+}
@@ -0,0 +1,362 @@
+package timeline
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrTagAliasCycle = errors.New("Tag alias makes a cycle")
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int64  `json:"count"`
+}
+
+// Lower case without surrounding spaces and leading "#".
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(tag), "#")))
+}
+
+// Normalize and remove empty and duplicated tags, order is kept.
+func NormalizeTags(tags []string) []string {
+	seen := make(map[string]struct{}, len(tags))
+	ret := make([]string, 0, len(tags))
+	for _, t := range tags {
+		n := NormalizeTag(t)
+		if _, ok := seen[n]; ok || n == "" {
+			continue
+		}
+		seen[n] = struct{}{}
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+// Shared by *sql.DB and *sql.Tx
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Resolve tag names to canonical tag ids and names, missing tags are created.
+func resolveTags(ctx context.Context, ex sqlExecutor, tags []string) ([]int64, []string, error) {
+	tags = NormalizeTags(tags)
+	ids := make([]int64, 0, len(tags))
+	names := make([]string, 0, len(tags))
+	seen := make(map[int64]struct{}, len(tags))
+	for _, t := range tags {
+		if _, err := ex.ExecContext(ctx, `INSERT OR IGNORE INTO tag(name) VALUES (?)`, t); err != nil {
+			return nil, nil, err
+		}
+		var id int64
+		var name string
+		row := ex.QueryRowContext(ctx, `SELECT canonical.id, canonical.name FROM tag
+			JOIN tag canonical on canonical.id = COALESCE(tag.alias_of, tag.id) WHERE tag.name = ?`, t)
+		if err := row.Scan(&id, &name); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+		names = append(names, name)
+	}
+	return ids, names, nil
+}
+
+func (s *SQLiteStorage) insertTags(ctx context.Context, ex sqlExecutor, itemID int64, tags []string) ([]string, error) {
+	ids, names, err := resolveTags(ctx, ex, tags)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, err := ex.ExecContext(ctx, `INSERT OR IGNORE INTO item_tag(item_id, tag_id) VALUES (?, ?)`, itemID, id); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// Fill Tags of items.
+func (s *SQLiteStorage) loadTags(ctx context.Context, items []*Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	byID := make(map[int64]*Item, len(items))
+	placeholders := make([]string, len(items))
+	params := make([]interface{}, len(items))
+	for i, it := range items {
+		byID[it.ID] = it
+		placeholders[i] = "?"
+		params[i] = it.ID
+	}
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`SELECT item_tag.item_id, tag.name
+		FROM item_tag JOIN tag on item_tag.tag_id = tag.id
+		WHERE item_tag.item_id IN (%s) ORDER BY tag.name`, strings.Join(placeholders, ", ")), params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		byID[id].Tags = append(byID[id].Tags, name)
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteStorage) itemTags(ctx context.Context, itemID int64) ([]string, error) {
+	it := &Item{ID: itemID}
+	if err := s.loadTags(ctx, []*Item{it}); err != nil {
+		return nil, err
+	}
+	return it.Tags, nil
+}
+
+func (s *SQLiteStorage) AddTags(ctx context.Context, itemID int64, tags []string) ([]string, error) {
+	var exists int
+	row := s.db.QueryRowContext(ctx, `SELECT 1 FROM timeline WHERE id = ?`, itemID)
+	if err := row.Scan(&exists); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if _, err := s.insertTags(ctx, s.db, itemID, tags); err != nil {
+		return nil, err
+	}
+	return s.itemTags(ctx, itemID)
+}
+
+func (s *SQLiteStorage) RemoveTags(ctx context.Context, itemID int64, tags []string) ([]string, error) {
+	for _, t := range NormalizeTags(tags) {
+		_, err := s.db.ExecContext(ctx, `DELETE FROM item_tag WHERE item_id = ? AND tag_id IN (
+			SELECT COALESCE(alias_of, id) FROM tag WHERE name = ?)`, itemID, t)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.itemTags(ctx, itemID)
+}
+
+func (s *SQLiteStorage) SetTagAlias(ctx context.Context, alias, canonical string) error {
+	alias = NormalizeTag(alias)
+	if canonical == "" {
+		_, err := s.db.ExecContext(ctx, `UPDATE tag SET alias_of = NULL WHERE name = ?`, alias)
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := setTagAlias(ctx, tx, alias, NormalizeTag(canonical)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func setTagAlias(ctx context.Context, tx *sql.Tx, alias, canonical string) error {
+	if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO tag(name) VALUES (?)`, alias); err != nil {
+		return err
+	}
+	var aliasID int64
+	if err := tx.QueryRowContext(ctx, `SELECT id FROM tag WHERE name = ?`, alias).Scan(&aliasID); err != nil {
+		return err
+	}
+	ids, _, err := resolveTags(ctx, tx, []string{canonical})
+	if err != nil {
+		return err
+	}
+	canonicalID := ids[0]
+	if canonicalID == aliasID {
+		return ErrTagAliasCycle
+	}
+	statements := []string{
+		// aliases of alias are moved to canonical
+		`UPDATE tag SET alias_of = ?2 WHERE id = ?1 OR alias_of = ?1`,
+		`INSERT OR IGNORE INTO item_tag(item_id, tag_id) SELECT item_id, ?2 FROM item_tag WHERE tag_id = ?1`,
+		`DELETE FROM item_tag WHERE tag_id = ?1`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt, aliasID, canonicalID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) TagCounts(ctx context.Context, q *Query, limit int) ([]TagCount, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	q = s.resolveTopics(q)
+	if q == nil {
+		return nil, nil
+	}
+	where, params := q.ToCondition()
+	query := `SELECT tag.name, COUNT(*) AS n
+		FROM item_tag JOIN tag on item_tag.tag_id = tag.id
+		JOIN timeline on item_tag.item_id = timeline.id
+		JOIN topic on timeline.topic_id = topic.id
+		JOIN origin on topic.origin_id = origin.id ` + where + `
+		GROUP BY tag.id ORDER BY n DESC, tag.name`
+	if limit > 0 {
+		query += " LIMIT ?"
+		params = append(params, limit)
+	}
+	rows, err := s.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []TagCount
+	for rows.Next() {
+		var tc TagCount
+		if err := rows.Scan(&tc.Tag, &tc.Count); err != nil {
+			return nil, err
+		}
+		ret = append(ret, tc)
+	}
+	return ret, rows.Err()
+}
+
+// SQL term matching items tagged with any of tags, including aliases.
+func tagTerm(tags []string) (string, []interface{}) {
+	placeholders := make([]string, len(tags))
+	params := make([]interface{}, len(tags))
+	for i, t := range tags {
+		placeholders[i] = "?"
+		params[i] = t
+	}
+	return fmt.Sprintf(`EXISTS (SELECT 1 FROM item_tag WHERE item_tag.item_id = timeline.id AND item_tag.tag_id IN (
+		SELECT COALESCE(tag.alias_of, tag.id) FROM tag WHERE tag.name IN (%s)))`, strings.Join(placeholders, ", ")), params
+}
+
+func (s *SQLiteStorage) TagAliases(ctx context.Context) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT tag.name, canonical.name FROM tag JOIN tag canonical ON canonical.id = tag.alias_of`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make(map[string]string)
+	for rows.Next() {
+		var alias, canonical string
+		if err := rows.Scan(&alias, &canonical); err != nil {
+			return nil, err
+		}
+		ret[alias] = canonical
+	}
+	return ret, rows.Err()
+}
+
+// Canonical tag name for each alias, to evaluate tags of live items as tagTerm of SQL.
+// Replaced as a whole on change, so that it can be read without lock.
+type tagAliases map[string]string
+
+// Canonical names of tags, which should be normalized.
+func (a tagAliases) resolve(tags []string) []string {
+	if len(a) == 0 {
+		return tags
+	}
+	ret := make([]string, len(tags))
+	for i, t := range tags {
+		if c, ok := a[t]; ok {
+			ret[i] = c
+		} else {
+			ret[i] = t
+		}
+	}
+	return ret
+}
+
+func hasAnyTag(it *Item, tags []string) bool {
+	for _, t := range it.Tags {
+		for _, want := range tags {
+			if t == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Attach tags to the item, then deliver ItemUpdated to listeners. Returns tags of the item.
+func (s *Service) AddTags(ctx context.Context, itemID int64, tags ...string) ([]string, error) {
+	ret, err := s.persistent.AddTags(ctx, itemID, tags)
+	if err != nil {
+		return nil, err
+	}
+	return ret, s.notifyTagsChanged(ctx, itemID)
+}
+
+// Detach tags from the item, then deliver ItemUpdated to listeners. Returns remaining tags of the item.
+func (s *Service) RemoveTags(ctx context.Context, itemID int64, tags ...string) ([]string, error) {
+	ret, err := s.persistent.RemoveTags(ctx, itemID, tags)
+	if err != nil {
+		return nil, err
+	}
+	return ret, s.notifyTagsChanged(ctx, itemID)
+}
+
+// Deliver the reloaded item to listeners, tag filters of listeners and saved searches see the new tags.
+func (s *Service) notifyTagsChanged(ctx context.Context, itemID int64) error {
+	it, err := s.Get(ctx, itemID)
+	if err == ErrNotFound {
+		// nothing to deliver for missing or deleted items
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.topicsMu.RLock()
+	defer s.topicsMu.RUnlock()
+	if t, ok := s.topics[it.TopicKey]; ok {
+		s.notifyItem(t, ItemEvent{Kind: ItemUpdated, Item: it})
+	}
+	return nil
+}
+
+func (s *Service) SetTagAlias(ctx context.Context, alias, canonical string) error {
+	if err := s.persistent.SetTagAlias(ctx, alias, canonical); err != nil {
+		return err
+	}
+	defer advanceClock(&s.modified)
+	return s.LoadTagAliases(ctx)
+}
+
+// Load tag aliases in storage, which are resolved in filters of listeners and saved searches.
+// Should be called once after NewService, and aliases are reloaded by SetTagAlias.
+func (s *Service) LoadTagAliases(ctx context.Context) error {
+	if s.persistent == nil {
+		return nil
+	}
+	aliases, err := s.persistent.TagAliases(ctx)
+	if err != nil {
+		return err
+	}
+	s.aliasesMu.Lock()
+	s.aliases = aliases
+	s.aliasesMu.Unlock()
+	return nil
+}
+
+func (s *Service) tagAliases() tagAliases {
+	s.aliasesMu.Lock()
+	defer s.aliasesMu.Unlock()
+	return s.aliases
+}
+
+// Tag cloud of items matched to q. Saved searches in q.Topics are expanded to their queries.
+func (s *Service) TagCounts(ctx context.Context, q *Query, limit int) ([]TagCount, error) {
+	s.topicsMu.RLock()
+	plan := s.planFetch(q)
+	s.topicsMu.RUnlock()
+	return s.runTagCounts(ctx, q, plan, limit)
+}
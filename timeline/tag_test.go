@@ -0,0 +1,102 @@
+package timeline
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	assert.Equal(t, []string{"cat", "イラスト"}, NormalizeTags([]string{" #Cat", "cat", "", "イラスト"}))
+}
+
+func TestTags(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("tag/test", "/tag/a"))
+	a.NoError(s.NewTopic("tag/test", "/tag/b"))
+	items := []*Item{
+		{OriginKey: 1, Tags: []string{"Cat", "photo"}},
+		{OriginKey: 2, Tags: []string{"dog", "photo"}},
+		{OriginKey: 3, Tags: []string{"cat", "nsfw"}},
+		{OriginKey: 4},
+	}
+	a.NoError(s.Publish("/tag/a", items[0], items[1], items[2]))
+	a.NoError(s.Publish("/tag/b", items[3]))
+	a.Equal([]string{"cat", "photo"}, items[0].Tags)
+
+	testPairs := []struct {
+		q          Query
+		originKeys []int64
+	}{
+		{Query{Tags: []string{"cat"}}, []int64{3, 1}},
+		{Query{Tags: []string{"cat", "photo"}}, []int64{1}},
+		{Query{AnyTags: []string{"cat", "dog"}}, []int64{3, 2, 1}},
+		{Query{ExcludeTags: []string{"nsfw"}}, []int64{4, 2, 1}},
+		{Query{AnyTags: []string{"cat", "dog"}, ExcludeTags: []string{"nsfw"}}, []int64{2, 1}},
+	}
+	for _, pair := range testPairs {
+		q := pair.q
+		fetched, err := s.Fetch(ctx, &q)
+		a.NoError(err)
+		a.Equal(pair.originKeys, mapOriginKey(fetched), "%+v", pair.q)
+	}
+	f, err := ParseFilter("tag:cat,dog -tag:nsfw")
+	a.NoError(err)
+	fetched, err := s.Fetch(ctx, &Query{Filter: f})
+	a.NoError(err)
+	a.Equal([]int64{2, 1}, mapOriginKey(fetched))
+	a.True(f.Match(&Item{Tags: []string{"dog"}}))
+	a.False(f.Match(&Item{Tags: []string{"dog", "nsfw"}}))
+	a.Equal("tag:cat,dog -tag:nsfw", f.String())
+
+	// manual tags
+	tags, err := s.AddTags(ctx, items[3].ID, "Landscape", "photo")
+	a.NoError(err)
+	a.Equal([]string{"landscape", "photo"}, tags)
+	tags, err = s.RemoveTags(ctx, items[3].ID, "photo")
+	a.NoError(err)
+	a.Equal([]string{"landscape"}, tags)
+	_, err = s.AddTags(ctx, 99999, "cat")
+	a.Equal(ErrNotFound, err)
+
+	// aliases
+	a.NoError(s.SetTagAlias(ctx, "kitty", "cat"))
+	kitty := &Item{OriginKey: 5, Tags: []string{"kitty"}}
+	a.NoError(s.Publish("/tag/b", kitty))
+	a.Equal([]string{"cat"}, kitty.Tags)
+	fetched, err = s.Fetch(ctx, &Query{Tags: []string{"kitty"}})
+	a.NoError(err)
+	a.Equal([]int64{5, 3, 1}, mapOriginKey(fetched))
+	// existing items are moved to canonical tag
+	a.NoError(s.SetTagAlias(ctx, "puppy", "dog"))
+	a.NoError(s.SetTagAlias(ctx, "dog", "cat"))
+	fetched, err = s.Fetch(ctx, &Query{Tags: []string{"puppy"}})
+	a.NoError(err)
+	a.Equal([]int64{5, 3, 2, 1}, mapOriginKey(fetched))
+	a.Equal(ErrTagAliasCycle, s.SetTagAlias(ctx, "cat", "puppy"))
+
+	// aliases are resolved for live items, as in queries
+	f, err = ParseFilter("tag:puppy")
+	a.NoError(err)
+	lis, err := s.Listen("/tag/**", WithFilter(f))
+	a.NoError(err)
+	defer lis.Close()
+	_, err = s.NewSavedSearch("tag-kitty", "tag:kitty", TopicInfo{})
+	a.NoError(err)
+	saved, err := s.Listen("/saved/tag-kitty")
+	a.NoError(err)
+	defer saved.Close()
+	a.NoError(s.Publish("/tag/b", &Item{OriginKey: 6, Tags: []string{"cat"}}, &Item{OriginKey: 7, Tags: []string{"photo"}}))
+	a.Equal([]int64{6}, mapOriginKey(eventItems(lis.Fetch(0))))
+	a.Equal([]int64{6}, mapOriginKey(eventItems(saved.Fetch(0))))
+	restarted := NewService(s.persistent)
+	a.NoError(restarted.LoadTagAliases(ctx))
+	a.Equal(tagAliases{"kitty": "cat", "puppy": "cat", "dog": "cat"}, restarted.tagAliases())
+
+	counts, err := s.TagCounts(ctx, &Query{Topics: []string{"/tag/a"}}, 2)
+	a.NoError(err)
+	a.Equal([]TagCount{{"cat", 3}, {"photo", 2}}, counts)
+}
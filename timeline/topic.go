@@ -2,55 +2,234 @@ package timeline
 
 import (
 	"container/list"
+	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Metadata of a topic, stored in topic table.
+type TopicInfo struct {
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	IconURL     string    `json:"iconURL"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// Name of the module which creates the topic.
+	Module string `json:"module"`
+	// Archived topic is read-only, and hidden from Service.Topics.
+	Archived bool `json:"archived"`
+}
+
+// Key and TopicInfo are modified with Service.topicsMu write locked.
 type Topic struct {
-	Key         string
-	ID          int
+	Key    string `json:"key"`
+	ID     int    `json:"id"`
+	Origin string `json:"origin"`
+	TopicInfo
+	// Saved search, nil for ordinary topics. Modified with infoMu and Service.topicsMu write locked.
+	search      *Query
+	searchExpr  string
+	infoMu      sync.RWMutex
 	s           *Service
 	history     *list.List
 	historyMu   sync.Mutex
 	listeners   []*Listener
 	listenersMu sync.Mutex
+	// Unix time in nanoseconds of the last change of items, accessed atomically.
+	modified int64
+}
+
+type TopicEventKind int
+
+const (
+	TopicCreated TopicEventKind = iota
+	TopicUpdated
+	TopicRenamed
+	TopicArchived
+	TopicUnarchived
+	TopicDeleted
+)
+
+var topicEventKindNames = map[TopicEventKind]string{
+	TopicCreated:    "created",
+	TopicUpdated:    "updated",
+	TopicRenamed:    "renamed",
+	TopicArchived:   "archived",
+	TopicUnarchived: "unarchived",
+	TopicDeleted:    "deleted",
+}
+
+func (k TopicEventKind) String() string {
+	return topicEventKindNames[k]
+}
+
+func (k TopicEventKind) MarshalJSON() ([]byte, error) {
+	return json.Marshal(k.String())
+}
+
+// Notified to listeners matched to the topic, via Listener.TopicC.
+type TopicEvent struct {
+	Kind TopicEventKind `json:"kind"`
+	// Snapshot of the topic after the change.
+	Key    string    `json:"key"`
+	Origin string    `json:"origin"`
+	Info   TopicInfo `json:"info"`
+	// Key before rename, empty for other kinds.
+	OldKey string `json:"oldKey,omitempty"`
+}
+
+func (t *Topic) Info() TopicInfo {
+	t.infoMu.RLock()
+	defer t.infoMu.RUnlock()
+	return t.TopicInfo
+}
+
+func (t *Topic) setInfo(info TopicInfo) {
+	t.infoMu.Lock()
+	defer t.infoMu.Unlock()
+	t.TopicInfo = info
+}
+
+func (t *Topic) setKey(key string) {
+	t.infoMu.Lock()
+	defer t.infoMu.Unlock()
+	t.Key = key
+}
+
+func (t *Topic) MarshalJSON() ([]byte, error) {
+	t.infoMu.RLock()
+	defer t.infoMu.RUnlock()
+	return json.Marshal(struct {
+		Key    string `json:"key"`
+		ID     int    `json:"id"`
+		Origin string `json:"origin"`
+		TopicInfo
+		Query string `json:"query,omitempty"`
+	}{t.Key, t.ID, t.Origin, t.TopicInfo, t.searchExpr})
+}
+
+func (t *Topic) event(kind TopicEventKind, oldKey string) TopicEvent {
+	t.infoMu.RLock()
+	defer t.infoMu.RUnlock()
+	return TopicEvent{
+		Kind:   kind,
+		Key:    t.Key,
+		Origin: t.Origin,
+		Info:   t.TopicInfo,
+		OldKey: oldKey,
+	}
+}
+
+// Time of the last publish, update or delete of items in the topic, or of any topic for saved searches.
+// Changes before the service is started are regarded as made at the start.
+func (t *Topic) Modified() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.modified))
+}
+
+func (t *Topic) hasListener(l *Listener) bool {
+	t.listenersMu.Lock()
+	defer t.listenersMu.Unlock()
+	for _, tl := range t.listeners {
+		if tl == l {
+			return true
+		}
+	}
+	return false
 }
 
 func (t *Topic) pushHistory(item *Item) {
 	t.historyMu.Lock()
 	defer t.historyMu.Unlock()
 	t.history.PushBack(item)
-	for t.history.Len() >= t.s.HistorySize {
+	for t.history.Len() > t.s.HistorySize {
 		t.history.Remove(t.history.Front())
 	}
 }
 
-func (t *Topic) publish(item *Item, published map[*Listener]struct{}) {
-	closedCount := 0
-	for _, l := range t.listeners {
-		if l.closed {
-			closedCount++
+// Replace or remove the item in history, which is looked up by ID.
+func (t *Topic) updateHistory(item *Item, remove bool) {
+	t.historyMu.Lock()
+	defer t.historyMu.Unlock()
+	for e := t.history.Front(); e != nil; e = e.Next() {
+		// digest items have ID of the summarized item
+		if cur := e.Value.(*Item); cur.ID != item.ID || cur.IsDigest() {
 			continue
 		}
-		if _, ok := published[l]; ok {
+		if remove {
+			t.history.Remove(e)
+		} else {
+			e.Value = item
+		}
+		return
+	}
+}
+
+// History is kept for the stream seen by listeners without WithRaw.
+func (t *Topic) publish(ev ItemEvent, published map[*Listener]struct{}, st stream) {
+	t.listenersMu.Lock()
+	listeners := t.listeners
+	t.listenersMu.Unlock()
+	aliases := t.s.tagAliases()
+	for _, l := range listeners {
+		if _, ok := published[l]; ok || !st.accepts(l) {
+			continue
+		}
+		if l.filter != nil && !l.filter.match(ev.Item, aliases) {
 			continue
 		}
-		l.Push(item)
+		l.Push(ev)
 		published[l] = struct{}{}
 	}
-	t.pushHistory(item)
-	if closedCount > ListenerCleanupThresh {
-		t.listenersMu.Lock()
-		defer t.listenersMu.Unlock()
-		cleanedListeners := make([]*Listener, 0, len(t.listeners)-closedCount)
-		for _, l := range t.listeners {
-			if l.closed {
+	if st == streamRaw {
+		return
+	}
+	switch ev.Kind {
+	case ItemAdded:
+		t.pushHistory(ev.Item)
+	case ItemUpdated:
+		t.updateHistory(ev.Item, false)
+	case ItemDeleted:
+		t.updateHistory(ev.Item, true)
+	}
+}
+
+// Deliver a digest of items to listeners without WithRaw. Listeners with a filter receive
+// a digest of matched items, or nothing if no item is matched. History keeps the digest of all items.
+func (t *Topic) publishDigest(items []*Item, digest func([]*Item) *Item, published map[*Listener]struct{}) {
+	t.listenersMu.Lock()
+	listeners := t.listeners
+	t.listenersMu.Unlock()
+	all := digest(items)
+	aliases := t.s.tagAliases()
+	for _, l := range listeners {
+		if _, ok := published[l]; ok || l.raw {
+			continue
+		}
+		d := all
+		if l.filter != nil {
+			matched := matchedItems(items, func(it *Item) bool { return l.filter.match(it, aliases) })
+			if len(matched) == 0 {
 				continue
 			}
-			cleanedListeners = append(cleanedListeners, l)
+			if len(matched) < len(items) {
+				d = digest(matched)
+			}
 		}
-		t.listeners = cleanedListeners
+		l.Push(ItemEvent{Kind: ItemAdded, Item: d})
+		published[l] = struct{}{}
 	}
+	t.pushHistory(all)
+}
+
+func matchedItems(items []*Item, match func(*Item) bool) []*Item {
+	var ret []*Item
+	for _, it := range items {
+		if match(it) {
+			ret = append(ret, it)
+		}
+	}
+	return ret
 }
 
 func (t *Topic) addListener(l *Listener) {
@@ -59,6 +238,19 @@ func (t *Topic) addListener(l *Listener) {
 	t.listeners = append(t.listeners, l)
 }
 
+func (t *Topic) removeListener(l *Listener) {
+	t.listenersMu.Lock()
+	defer t.listenersMu.Unlock()
+	// copy on write, publish may iterate old slice
+	listeners := make([]*Listener, 0, len(t.listeners))
+	for _, tl := range t.listeners {
+		if tl != l {
+			listeners = append(listeners, tl)
+		}
+	}
+	t.listeners = listeners
+}
+
 func (t *Topic) PrintStatus() {
 	fmt.Printf("%v history: %d, listeners: %d\n", t.Key, t.history.Len(), len(t.listeners))
 	for _, l := range t.listeners {
@@ -0,0 +1,159 @@
+package timeline
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicInfo(t *testing.T) {
+	a := assert.New(t)
+	storage := newPrivateStorage(t)
+	s := NewService(storage)
+	a.NoError(s.NewTopicWithInfo("topic/test", "/topic/info", TopicInfo{Title: "Info", Module: "test"}))
+	tp, ok := s.Topic("/topic/info")
+	if !a.True(ok) {
+		return
+	}
+	a.Equal("Info", tp.Info().Title)
+	a.False(tp.Info().CreatedAt.IsZero())
+
+	a.NoError(s.UpdateTopic("/topic/info", TopicInfo{Title: "Renamed", Description: "desc", IconURL: "http://example.com/icon.png", Module: "test"}))
+	stored, err := storage.TopicInfo(context.Background(), "/topic/info")
+	a.NoError(err)
+	a.Equal("Renamed", stored.Title)
+	a.Equal("desc", stored.Description)
+	a.Equal(tp.Info().CreatedAt.Unix(), stored.CreatedAt.Unix())
+
+	// edited metadata is kept on restart, module defaults fill empty fields only
+	s2 := NewService(storage)
+	a.NoError(s2.NewTopicWithInfo("topic/test", "/topic/info", TopicInfo{Title: "Info", Module: "test"}))
+	tp2, _ := s2.Topic("/topic/info")
+	a.Equal("Renamed", tp2.Info().Title)
+}
+
+func TestTopicRename(t *testing.T) {
+	a := assert.New(t)
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("topic/test", "/topic/old"))
+	a.NoError(s.NewTopic("topic/test", "/topic/other"))
+	a.NoError(s.Publish("/topic/old", &Item{Caption: "1", OriginKey: 1}, &Item{Caption: "2", OriginKey: 2}))
+	oldLis, err := s.Listen("/topic/old")
+	a.NoError(err)
+	newLis, err := s.Listen("/topic/new/**")
+	a.NoError(err)
+
+	a.Equal(ErrTopicExists, s.RenameTopic("/topic/old", "/topic/other"))
+	a.NoError(s.RenameTopic("/topic/old", "/topic/new/a"))
+	_, ok := s.Topic("/topic/old")
+	a.False(ok)
+
+	items, err := s.Fetch(context.Background(), &Query{Topics: []string{"/topic/new/a"}})
+	a.NoError(err)
+	a.Equal([]string{"2", "1"}, mapItemCaption(items))
+
+	for _, lis := range []*Listener{oldLis, newLis} {
+		ev := <-lis.TopicC
+		a.Equal(TopicRenamed, ev.Kind)
+		a.Equal("/topic/old", ev.OldKey)
+		a.Equal("/topic/new/a", ev.Key)
+	}
+	a.NoError(s.Publish("/topic/new/a", &Item{Caption: "3", OriginKey: 3}))
+	a.Empty(oldLis.Fetch(0))
+	a.Equal([]string{"3"}, mapItemCaption(eventItems(newLis.Fetch(0))))
+}
+
+func TestTopicArchive(t *testing.T) {
+	a := assert.New(t)
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("topic/test", "/topic/archive"))
+	lis, err := s.Listen("/topic/archive")
+	a.NoError(err)
+
+	a.NoError(s.ArchiveTopic("/topic/archive", true))
+	a.Equal(TopicArchived, (<-lis.TopicC).Kind)
+	a.Equal(ErrTopicArchived, s.Publish("/topic/archive", &Item{Caption: "1"}))
+	a.Empty(s.Topics("/topic/archive"))
+	a.Len(s.ArchivedTopics("/topic/archive"), 1)
+	_, err = s.Listen("/topic/archive")
+	a.Equal(ErrNoTopic, err)
+
+	a.NoError(s.ArchiveTopic("/topic/archive", false))
+	a.Equal(TopicUnarchived, (<-lis.TopicC).Kind)
+	a.NoError(s.Publish("/topic/archive", &Item{Caption: "2"}))
+	a.Equal([]string{"2"}, mapItemCaption(eventItems(lis.Fetch(0))))
+}
+
+func TestTopicDelete(t *testing.T) {
+	a := assert.New(t)
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("topic/test", "/topic/delete"))
+	a.NoError(s.NewTopic("topic/test", "/topic/keep"))
+	a.NoError(s.Publish("/topic/delete", &Item{Caption: "1", OriginKey: 1}, &Item{Caption: "2", OriginKey: 2}))
+	a.NoError(s.Publish("/topic/keep", &Item{Caption: "3", OriginKey: 3}))
+	lis, err := s.Listen("/topic/**")
+	a.NoError(err)
+
+	deleted, err := s.DeleteTopic("/topic/delete")
+	a.NoError(err)
+	a.Equal(int64(2), deleted)
+	ev := <-lis.TopicC
+	a.Equal(TopicDeleted, ev.Kind)
+	a.Equal("/topic/delete", ev.Key)
+
+	items, err := s.Fetch(context.Background(), &Query{})
+	a.NoError(err)
+	a.Equal([]string{"3"}, mapItemCaption(items))
+	a.Equal(ErrNoTopic, s.Publish("/topic/delete", &Item{Caption: "4"}))
+	// key can be reused
+	a.NoError(s.NewTopic("topic/test", "/topic/delete"))
+	a.Equal(TopicCreated, (<-lis.TopicC).Kind)
+}
+
+func TestMigrateTimelineForeignKey(t *testing.T) {
+	a := assert.New(t)
+	db, err := sql.Open(sqliteDriver, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	// schema of older versions
+	oldDDLs := []string{
+		`CREATE TABLE origin (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL UNIQUE)`,
+		`CREATE TABLE topic(id INTEGER PRIMARY KEY, key TEXT NOT NULL UNIQUE, origin_id INTEGER NOT NULL, FOREIGN KEY(origin_id) REFERENCES origin(id))`,
+		`CREATE TABLE timeline (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, topic_id INTEGER NOT NULL, caption TEXT NOT NULL, thumbnail TEXT NOT NULL,
+			origin_key INTEGER NOT NULL, timestamp INTEGER NOT NULL, meta BLOB,
+			FOREIGN KEY(topic_id) REFERENCES timeline(id))`,
+		`INSERT INTO origin(name) VALUES ('migrate')`,
+		`INSERT INTO topic(id, key, origin_id) VALUES (1, '/migrate', 1)`,
+		`INSERT INTO timeline(topic_id, caption, thumbnail, origin_key, timestamp) VALUES (1, 'a', '', 1, 0), (1, 'b', '', 2, 0)`,
+	}
+	for _, ddl := range oldDDLs {
+		if _, err := db.Exec(ddl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage, err := NewSQLiteStorage(db)
+	if !a.NoError(err) {
+		return
+	}
+	items, err := storage.Select(context.Background(), &Query{Topics: []string{"/migrate"}})
+	a.NoError(err)
+	a.Equal([]string{"b", "a"}, mapItemCaption(items))
+	var indexes []string
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = 'timeline' AND name LIKE 'timeline_%' ORDER BY name`)
+	a.NoError(err)
+	for rows.Next() {
+		var name string
+		a.NoError(rows.Scan(&name))
+		indexes = append(indexes, name)
+	}
+	rows.Close()
+	a.Equal([]string{"timeline_origin_key", "timeline_phash_pending", "timeline_topic_id", "timeline_topic_timestamp"}, indexes)
+	deleted, err := storage.DeleteTopic(context.Background(), "/migrate")
+	a.NoError(err)
+	a.Equal(int64(2), deleted)
+}
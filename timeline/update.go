@@ -0,0 +1,249 @@
+package timeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kanosaki/dumper/common"
+)
+
+var (
+	// Reason of Tombstone when WithReason is not given.
+	DefaultDeleteReason = "deleted"
+)
+
+func (s *SQLiteStorage) UpdateItem(ctx context.Context, item *Item) ([]*Item, error) {
+	metaBytes, err := json.Marshal(item.Meta)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := originItemIDs(ctx, tx, item.TopicID, item.OriginKey, false)
+	if err == nil && len(ids) == 0 {
+		err = ErrNotFound
+	}
+	for _, id := range ids {
+		if err != nil {
+			break
+		}
+		// hash is computed again by Hasher if thumbnail is changed
+		_, err = tx.ExecContext(ctx, `UPDATE timeline SET caption = ?, meta = ?,
+			phash = CASE WHEN thumbnail = ? THEN phash END,
+			phash_at = CASE WHEN thumbnail = ? THEN phash_at END,
+			thumbnail = ? WHERE id = ?`,
+			item.Caption, metaBytes, item.Thumbnail, item.Thumbnail, item.Thumbnail, id)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, `DELETE FROM item_tag WHERE item_id = ?`, id)
+		}
+		if err == nil && len(item.Tags) > 0 {
+			_, err = s.insertTags(ctx, tx, id, item.Tags)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.selectIDs(ctx, ids)
+}
+
+func (s *SQLiteStorage) DeleteItem(ctx context.Context, topicKey string, originKey int64, tombstone *Tombstone) ([]*Item, error) {
+	s.topicsMu.Lock()
+	tMeta, ok := s.topics[topicKey]
+	s.topicsMu.Unlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	ids, err := originItemIDs(ctx, s.db, tMeta.ID, originKey, tombstone == nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, ErrNotFound
+	}
+	placeholders := make([]string, len(ids))
+	params := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		params[i] = id
+	}
+	if tombstone != nil {
+		params = append([]interface{}{common.Timestamp(tombstone.At), tombstone.Reason}, params...)
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf(`UPDATE timeline SET deleted_at = ?, deleted_reason = ? WHERE id IN (%s)`,
+			strings.Join(placeholders, ", ")), params...); err != nil {
+			return nil, err
+		}
+		return s.selectIDs(ctx, ids)
+	}
+	// loaded before removal
+	items, err := s.selectIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM timeline WHERE id IN (%s)`,
+		strings.Join(placeholders, ", ")), params...); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// IDs of items of the topic which have the origin key, in descending order.
+func originItemIDs(ctx context.Context, ex sqlExecutor, topicID int, originKey int64, includeDeleted bool) ([]int64, error) {
+	query := `SELECT id FROM timeline WHERE topic_id = ? AND origin_key = ?`
+	if !includeDeleted {
+		query += ` AND deleted_at IS NULL`
+	}
+	rows, err := ex.QueryContext(ctx, query+` ORDER BY id DESC`, topicID, originKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Items of ids including deleted ones, in the same order.
+func (s *SQLiteStorage) selectIDs(ctx context.Context, ids []int64) ([]*Item, error) {
+	ret := make([]*Item, 0, len(ids))
+	for _, id := range ids {
+		items, err := s.Select(ctx, &Query{MinID: int(id), MaxID: int(id), ShowDeleted: true})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, items...)
+	}
+	return ret, nil
+}
+
+type deleteOptions struct {
+	reason string
+	purge  bool
+}
+
+type DeleteOption func(*deleteOptions)
+
+// Reason recorded in Tombstone, DefaultDeleteReason by default.
+func WithReason(reason string) DeleteOption {
+	return func(o *deleteOptions) {
+		o.reason = reason
+	}
+}
+
+// Remove items from Storage instead of keeping tombstones.
+func WithPurge() DeleteOption {
+	return func(o *deleteOptions) {
+		o.purge = true
+	}
+}
+
+// Replace content of published items identified by TopicKey and OriginKey of item,
+// then deliver ItemUpdated to listeners. Timestamp of item is ignored.
+// Listeners and saved searches are notified if the new content is matched to their filters.
+// ErrNotFound if the item is missing or deleted.
+func (s *Service) Update(item *Item) error {
+	s.topicsMu.RLock()
+	defer s.topicsMu.RUnlock()
+	t, err := s.changedTopic(item.TopicKey)
+	if err != nil {
+		return err
+	}
+	item.TopicID = t.ID
+	item.Origin = t.Origin
+	if len(item.Tags) > 0 {
+		item.Tags = NormalizeTags(item.Tags)
+	}
+	updated, err := s.persistent.UpdateItem(context.Background(), item)
+	if err != nil {
+		return err
+	}
+	for _, it := range updated {
+		s.notifyItem(t, ItemEvent{Kind: ItemUpdated, Item: it})
+	}
+	return nil
+}
+
+// Delete published items of the topic which have the origin key, then deliver ItemDeleted to listeners.
+// Items are kept with Tombstone unless WithPurge, and excluded from queries unless Query.ShowDeleted.
+// ErrNotFound if the item is missing or already deleted.
+func (s *Service) Delete(topic string, originKey int64, opts ...DeleteOption) error {
+	o := deleteOptions{reason: DefaultDeleteReason}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	s.topicsMu.RLock()
+	defer s.topicsMu.RUnlock()
+	t, err := s.changedTopic(topic)
+	if err != nil {
+		return err
+	}
+	tombstone := &Tombstone{At: time.Now(), Reason: o.reason}
+	stored := tombstone
+	if o.purge {
+		stored = nil
+	}
+	deleted, err := s.persistent.DeleteItem(context.Background(), t.Key, originKey, stored)
+	if err != nil {
+		return err
+	}
+	for _, it := range deleted {
+		if it.Deleted == nil {
+			it.Deleted = tombstone
+		}
+		s.notifyItem(t, ItemEvent{Kind: ItemDeleted, Item: it})
+	}
+	return nil
+}
+
+// Topic whose items are updated or deleted. Items of archived topics can be changed.
+// Should be called with topicsMu locked.
+func (s *Service) changedTopic(key string) (*Topic, error) {
+	t, ok := s.topics[key]
+	if !ok {
+		return nil, ErrNoTopic
+	}
+	if t.search != nil {
+		return nil, ErrSavedSearch
+	}
+	if s.persistent == nil {
+		// published items are not stored
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+// Deliver the event to listeners of the topic and matched saved searches.
+// The event is shaped by the publish policy of the topic, except for WithRaw listeners.
+// Should be called with topicsMu locked.
+func (s *Service) notifyItem(t *Topic, ev ItemEvent) {
+	s.touchItems(t)
+	if sh := s.shaperOf(t); sh != nil {
+		s.deliverItem(t, ev, streamRaw)
+		if !sh.offer(ev) {
+			s.deliverItem(t, ev, streamShaped)
+		}
+		return
+	}
+	s.deliverItem(t, ev, streamAll)
+}
+
+// Should be called with topicsMu locked.
+func (s *Service) deliverItem(t *Topic, ev ItemEvent, st stream) {
+	published := make(map[*Listener]struct{})
+	t.publish(ev, published, st)
+	s.publishSearches(ev, published, st)
+}
@@ -0,0 +1,123 @@
+package timeline
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceUpdateDelete(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("twitter.tweet", "/change/a"))
+	a.NoError(s.NewTopic("twitter.tweet", "/change/b"))
+	_, err := s.NewSavedSearch("change-cats", "topic:/change/** tag:cat", TopicInfo{})
+	a.NoError(err)
+	a.NoError(s.Publish("/change/a",
+		&Item{Caption: "cat 1", OriginKey: 1, Tags: []string{"cat"}},
+		&Item{Caption: "dog 1", OriginKey: 2, Tags: []string{"dog"}}))
+	a.NoError(s.Publish("/change/b", &Item{Caption: "cat 2", OriginKey: 3, Tags: []string{"cat"}}))
+
+	lis, err := s.Listen("/change/a")
+	a.NoError(err)
+	defer lis.Close()
+	cats, err := s.Listen("/saved/change-cats")
+	a.NoError(err)
+	defer cats.Close()
+
+	a.NoError(s.Update(&Item{TopicKey: "/change/a", OriginKey: 2, Caption: "dog 1 edited", Tags: []string{"Dog"}}))
+	events := lis.Fetch(0)
+	if a.Len(events, 1) {
+		a.Equal(ItemUpdated, events[0].Kind)
+		a.Equal("dog 1 edited", events[0].Item.Caption)
+		a.Equal([]string{"dog"}, events[0].Item.Tags)
+	}
+	a.Empty(cats.Fetch(0))
+
+	a.NoError(s.Delete("/change/a", 1, WithReason("removed by author")))
+	events = lis.Fetch(0)
+	if a.Len(events, 1) && a.NotNil(events[0].Item.Deleted) {
+		a.Equal(ItemDeleted, events[0].Kind)
+		a.Equal("cat 1", events[0].Item.Caption)
+		a.Equal("removed by author", events[0].Item.Deleted.Reason)
+	}
+	events = cats.Fetch(0)
+	if a.Len(events, 1) {
+		a.Equal(ItemDeleted, events[0].Kind)
+	}
+
+	// kept as a tombstone
+	items, err := s.Fetch(ctx, &Query{Topics: []string{"/saved/change-cats"}})
+	a.NoError(err)
+	a.Equal([]string{"cat 2"}, captions(items))
+	items, err = s.Fetch(ctx, &Query{Topics: []string{"/change/a"}, ShowDeleted: true})
+	a.NoError(err)
+	a.Equal([]string{"dog 1 edited", "cat 1"}, captions(items))
+	a.NoError(s.Delete("/change/b", 3))
+	items, err = s.Fetch(ctx, &Query{Topics: []string{"/change/b"}, ShowDeleted: true})
+	a.NoError(err)
+	if a.Len(items, 1) && a.NotNil(items[0].Deleted) {
+		a.Equal(DefaultDeleteReason, items[0].Deleted.Reason)
+	}
+
+	// history is replayed with changes applied
+	replayed, err := s.Listen("/change/**", WithHistory(10))
+	a.NoError(err)
+	defer replayed.Close()
+	a.Equal([]string{"dog 1 edited"}, receiveCaptions(replayed))
+
+	a.NoError(s.Delete("/change/a", 2, WithPurge()))
+	events = lis.Fetch(0)
+	if a.Len(events, 1) && a.NotNil(events[0].Item.Deleted) {
+		a.Equal(DefaultDeleteReason, events[0].Item.Deleted.Reason)
+	}
+	items, err = s.Fetch(ctx, &Query{Topics: []string{"/change/a"}, ShowDeleted: true})
+	a.NoError(err)
+	a.Equal([]string{"cat 1"}, captions(items))
+
+	a.Equal(ErrNotFound, s.Delete("/change/a", 1))
+	a.Equal(ErrNotFound, s.Update(&Item{TopicKey: "/change/a", OriginKey: 1}))
+	a.Equal(ErrNoTopic, s.Delete("/change/none", 1))
+	a.Equal(ErrSavedSearch, s.Delete("/saved/change-cats", 1))
+}
+
+func TestServiceTagsNotify(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	s := NewService(newPrivateStorage(t))
+	a.NoError(s.NewTopic("twitter.tweet", "/retag/a"))
+	_, err := s.NewSavedSearch("retag-cats", "topic:/retag/** tag:cat", TopicInfo{})
+	a.NoError(err)
+	it := &Item{Caption: "photo 1", OriginKey: 1}
+	a.NoError(s.Publish("/retag/a", it))
+
+	lis, err := s.Listen("/retag/a")
+	a.NoError(err)
+	defer lis.Close()
+	cats, err := s.Listen("/saved/retag-cats")
+	a.NoError(err)
+	defer cats.Close()
+
+	_, err = s.AddTags(ctx, it.ID, "Cat")
+	a.NoError(err)
+	events := lis.Fetch(0)
+	if a.Len(events, 1) {
+		a.Equal(ItemUpdated, events[0].Kind)
+		a.Equal([]string{"cat"}, events[0].Item.Tags)
+	}
+	events = cats.Fetch(0)
+	if a.Len(events, 1) {
+		a.Equal(ItemUpdated, events[0].Kind)
+		a.Equal("photo 1", events[0].Item.Caption)
+	}
+
+	_, err = s.RemoveTags(ctx, it.ID, "cat")
+	a.NoError(err)
+	events = lis.Fetch(0)
+	if a.Len(events, 1) {
+		a.Equal(ItemUpdated, events[0].Kind)
+		a.Empty(events[0].Item.Tags)
+	}
+}
@@ -40,7 +40,10 @@ func (t *Twitter) Init(id string, c *core.Context) error {
 			target: wl,
 			tw:     t,
 		}
-		c.Timeline().NewTopic(OriginTwitterTweet, lw.Key())
+		c.Timeline().NewTopicWithInfo(OriginTwitterTweet, lw.Key(), timeline.TopicInfo{
+			Title:  fmt.Sprintf("@%s/%s", wl.OwnerScreenName, wl.Slug),
+			Module: id,
+		})
 		t.wbl.Add(lw.Refresh)
 	}
 	return nil
@@ -71,10 +74,18 @@ func (t *Twitter) Next(key string, tweet []twitter.Tweet) {
 		}
 		media := tw.Entities.Media
 		thumbnailURL := fmt.Sprintf("%s:thumb", media[0].MediaURL)
+		var tags []string
+		for _, h := range tw.Entities.Hashtags {
+			tags = append(tags, h.Text)
+		}
+		// zero timestamp on parse failure is replaced with publish time
+		createdAt, _ := tw.CreatedAtTime()
 		err := tl.Publish(key, &timeline.Item{
 			Caption:   fmt.Sprintf("%s / %s", tw.User.ScreenName, tw.Text),
 			OriginKey: tw.ID,
 			Thumbnail: thumbnailURL,
+			Timestamp: createdAt,
+			Tags:      tags,
 		})
 		if err != nil {
 			log.Errorf("Failed to publish twitter item: %v", err)
@@ -0,0 +1,98 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/kanosaki/dumper/activitypub"
+	"github.com/labstack/echo"
+)
+
+// ActivityPub actors of topics
+//   GET  /.well-known/webfinger?resource=acct:name@host
+//   GET  /ap/actors/:name                                    actor document
+//   GET  /ap/actors/:name/outbox?page=true&max_id=100
+//   GET  /ap/actors/:name/followers
+//   GET  /ap/actors/:name/notes/:id
+//   POST /ap/actors/:name/inbox                              signed Follow and Undo
+func (w *Server) MountActivityPub(p *activitypub.Publisher) {
+	w.Echo.GET("/.well-known/webfinger", func(c echo.Context) error {
+		jrd, err := p.WebFinger(c.QueryParam("resource"))
+		if err != nil {
+			return activityPubError(err)
+		}
+		return activityPubJSON(c, activitypub.JRDContentType, jrd)
+	})
+	g := w.Echo.Group("/ap/actors/:name")
+	g.GET("", func(c echo.Context) error {
+		doc, err := p.Actor(c.Request().Context(), c.Param("name"))
+		if err != nil {
+			return activityPubError(err)
+		}
+		return activityPubJSON(c, activitypub.ContentType, doc)
+	})
+	g.GET("/outbox", func(c echo.Context) error {
+		var maxID int64
+		if s := c.QueryParam("max_id"); s != "" {
+			var err error
+			if maxID, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid max_id")
+			}
+		}
+		col, err := p.Outbox(c.Request().Context(), c.Param("name"), c.QueryParam("page") == "true", maxID)
+		if err != nil {
+			return activityPubError(err)
+		}
+		return activityPubJSON(c, activitypub.ContentType, col)
+	})
+	g.GET("/followers", func(c echo.Context) error {
+		col, err := p.Followers(c.Request().Context(), c.Param("name"))
+		if err != nil {
+			return activityPubError(err)
+		}
+		return activityPubJSON(c, activitypub.ContentType, col)
+	})
+	g.GET("/notes/:id", func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusNotFound, activitypub.ErrNotFound.Error())
+		}
+		note, err := p.Note(c.Request().Context(), c.Param("name"), id)
+		if err != nil {
+			return activityPubError(err)
+		}
+		return activityPubJSON(c, activitypub.ContentType, note)
+	})
+	g.POST("/inbox", func(c echo.Context) error {
+		if err := p.HandleInbox(c.Request().Context(), c.Param("name"), c.Request()); err != nil {
+			return activityPubError(err)
+		}
+		return c.NoContent(http.StatusAccepted)
+	})
+}
+
+func activityPubJSON(c echo.Context, contentType string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, contentType+"; charset=utf-8", b)
+}
+
+func activityPubError(err error) error {
+	switch err.(type) {
+	case *activitypub.SignatureError:
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	switch err {
+	case activitypub.ErrUnknownActor, activitypub.ErrNotFound:
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case activitypub.ErrBadActivity:
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case activitypub.ErrQueueFull:
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	default:
+		return err
+	}
+}
@@ -0,0 +1,75 @@
+package web
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kanosaki/dumper/activitypub"
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActivityPubAPI(t *testing.T) {
+	a := assert.New(t)
+	_, tl := newTestServer(t)
+	a.NoError(tl.NewTopic("web/test", "/webap/daily"))
+	a.NoError(tl.Publish("/webap/daily", &timeline.Item{Caption: "ranked", OriginKey: 1, Thumbnail: "http://img.local/1.png"}))
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "activitypub.db"))
+	a.NoError(err)
+	defer db.Close()
+	activitypub.KeySize = 1024
+	p, err := activitypub.New(db, tl, activitypub.Config{
+		BaseURL: "https://dumper.example.com",
+		Actors:  []activitypub.ActorConfig{{Name: "daily", Topic: "/webap/daily"}},
+	})
+	a.NoError(err)
+	s := &Server{Echo: echo.New()}
+	s.MountActivityPub(p)
+
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/webfinger?resource=acct:daily@dumper.example.com", nil)
+	rec := httptest.NewRecorder()
+	s.Echo.ServeHTTP(rec, req)
+	a.Equal(http.StatusOK, rec.Code)
+	a.True(strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), activitypub.JRDContentType))
+	a.Contains(rec.Body.String(), "https://dumper.example.com/ap/actors/daily")
+	a.Equal(http.StatusNotFound, getJSON(t, s, "/.well-known/webfinger?resource=acct:none@dumper.example.com", nil))
+
+	var actor activitypub.Actor
+	a.Equal(http.StatusOK, getJSON(t, s, "/ap/actors/daily", &actor))
+	a.Equal("daily", actor.PreferredUsername)
+	a.Equal("https://dumper.example.com/ap/actors/daily/outbox", actor.Outbox)
+	a.Equal(http.StatusNotFound, getJSON(t, s, "/ap/actors/none", nil))
+
+	var page struct {
+		Type  string `json:"type"`
+		Items []struct {
+			Type   string           `json:"type"`
+			Object activitypub.Note `json:"object"`
+		} `json:"orderedItems"`
+	}
+	a.Equal(http.StatusOK, getJSON(t, s, "/ap/actors/daily/outbox?page=true", &page))
+	a.Equal("OrderedCollectionPage", page.Type)
+	if a.Len(page.Items, 1) {
+		a.Equal("Create", page.Items[0].Type)
+		a.Equal("http://img.local/1.png", page.Items[0].Object.Attachment[0].URL)
+	}
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/ap/actors/daily/outbox?page=true&max_id=x", nil))
+
+	var note activitypub.Note
+	a.Equal(http.StatusOK, getJSON(t, s, strings.TrimPrefix(page.Items[0].Object.ID, "https://dumper.example.com"), &note))
+	a.Equal("<p>ranked</p>", note.Content)
+	a.Equal(http.StatusNotFound, getJSON(t, s, "/ap/actors/daily/notes/100", nil))
+
+	var followers activitypub.OrderedCollection
+	a.Equal(http.StatusOK, getJSON(t, s, "/ap/actors/daily/followers", &followers))
+	a.Zero(followers.TotalItems)
+
+	a.Equal(http.StatusBadRequest, requestJSON(t, s, http.MethodPost, "/ap/actors/daily/inbox", "{}", nil))
+	a.Equal(http.StatusUnauthorized, requestJSON(t, s, http.MethodPost, "/ap/actors/daily/inbox",
+		`{"type": "Follow", "actor": "http://remote.local/users/alice", "object": "https://dumper.example.com/ap/actors/daily"}`, nil))
+}
@@ -0,0 +1,34 @@
+package web
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+)
+
+// Implemented by esindex.Indexer
+type Backfiller interface {
+	Backfill(ctx context.Context, q *timeline.Query) (int64, error)
+}
+
+// Index stored items into Elasticsearch mirror
+//   POST /api/timeline/es/backfill?topic=/twitter/**&min_id=1000    accepts items parameters
+// Responds after all matched items are indexed.
+func (w *Server) MountBackfill(b Backfiller) {
+	w.Echo.POST("/api/timeline/es/backfill", func(c echo.Context) error {
+		q, err := parseQuery(c)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		n, err := b.Backfill(c.Request().Context(), q)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, map[string]interface{}{
+				"message": err.Error(),
+				"indexed": n,
+			})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"indexed": n})
+	})
+}
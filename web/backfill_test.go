@@ -0,0 +1,38 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeBackfiller struct {
+	q   *timeline.Query
+	err error
+}
+
+func (b *fakeBackfiller) Backfill(ctx context.Context, q *timeline.Query) (int64, error) {
+	b.q = q
+	return 3, b.err
+}
+
+func TestBackfillAPI(t *testing.T) {
+	a := assert.New(t)
+	s := &Server{Echo: echo.New()}
+	b := &fakeBackfiller{}
+	s.MountBackfill(b)
+	var res map[string]int64
+	a.Equal(http.StatusOK, requestJSON(t, s, http.MethodPost, "/api/timeline/es/backfill?topic=/a/**&min_id=10", "", &res))
+	a.Equal(int64(3), res["indexed"])
+	a.Equal([]string{"/a/**"}, b.q.Topics)
+	a.Equal(10, b.q.MinID)
+
+	b.err = errors.New("unavailable")
+	a.Equal(http.StatusInternalServerError, requestJSON(t, s, http.MethodPost, "/api/timeline/es/backfill", "", nil))
+	a.Equal(http.StatusBadRequest, requestJSON(t, s, http.MethodPost, "/api/timeline/es/backfill?min_id=x", "", nil))
+}
@@ -0,0 +1,48 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+)
+
+// NDJSON archive, see timeline.ExportRecord
+//   GET  /api/timeline/export?topic=/twitter/**    accepts items parameters
+//   POST /api/timeline/import                      body is NDJSON written by export
+// Instances can be merged by
+//   curl http://laptop/api/timeline/export | curl --data-binary @- http://server/api/timeline/import
+func (w *Server) mountExport(api *timelineAPI) {
+	w.Echo.GET("/api/timeline/export", api.export)
+	w.Echo.POST("/api/timeline/import", api.importItems)
+}
+
+func (a *timelineAPI) export(c echo.Context) error {
+	q, err := parseQuery(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	res.WriteHeader(http.StatusOK)
+	if _, err := a.tl.Export(c.Request().Context(), res, q); err != nil {
+		// headers are already sent
+		c.Logger().Warnf("Timeline export aborted: %v", err)
+	}
+	return nil
+}
+
+func (a *timelineAPI) importItems(c echo.Context) error {
+	stats, err := a.tl.Import(c.Request().Context(), c.Request().Body)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(*timeline.RecordError); ok {
+			status = http.StatusBadRequest
+		}
+		return echo.NewHTTPError(status, map[string]interface{}{
+			"message": err.Error(),
+			"stats":   stats,
+		})
+	}
+	return c.JSON(http.StatusOK, stats)
+}
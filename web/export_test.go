@@ -0,0 +1,41 @@
+package web
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportAPI(t *testing.T) {
+	a := assert.New(t)
+	s, tl := newTestServer(t)
+	a.NoError(tl.NewTopic("web/test", "/webexport/a"))
+	a.NoError(tl.Publish("/webexport/a", &timeline.Item{Caption: "E1", OriginKey: 1}, &timeline.Item{Caption: "E2", OriginKey: 2}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/timeline/export?topic=/webexport/a", nil)
+	rec := httptest.NewRecorder()
+	s.Echo.ServeHTTP(rec, req)
+	a.Equal(http.StatusOK, rec.Code)
+	a.Equal("application/x-ndjson", rec.Header().Get("Content-Type"))
+	archive := rec.Body.String()
+	a.Len(strings.Split(strings.TrimSpace(archive), "\n"), 3)
+
+	var stats timeline.ImportStats
+	a.Equal(http.StatusOK, requestJSON(t, s, http.MethodPost, "/api/timeline/import", archive, &stats))
+	a.Equal(int64(2), stats.Skipped)
+	a.Equal(http.StatusBadRequest, requestJSON(t, s, http.MethodPost, "/api/timeline/import", "{broken", nil))
+
+	// failure other than malformed records, such as disconnection
+	body := io.MultiReader(strings.NewReader(archive), iotest.TimeoutReader(strings.NewReader("{")))
+	req = httptest.NewRequest(http.MethodPost, "/api/timeline/import", body)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rec = httptest.NewRecorder()
+	s.Echo.ServeHTTP(rec, req)
+	a.Equal(http.StatusInternalServerError, rec.Code)
+}
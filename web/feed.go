@@ -0,0 +1,342 @@
+package web
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+)
+
+var (
+	FeedDefaultLimit = 50
+	FeedMaxLimit     = 500
+	// Captions longer than this are truncated in entry titles, full text is in the content.
+	FeedTitleLength = 100
+)
+
+// Syndication feeds of latest items under a topic prefix
+//   GET /api/timeline/feed/atom?topic=/twitter/list/foo     Atom 1.0
+//   GET /api/timeline/feed/rss?topic=/pixiv/ranking/**      RSS 2.0
+//   GET /api/timeline/feed/json?topic=/tumblr                JSON Feed 1.1
+// Other parameters are same as items. Responses carry ETag and Last-Modified of the last change
+// of matched topics, such as published, updated and deleted items, see timeline.Service.LastModified.
+// 304 is returned for conditional requests if unchanged. Validators are not sent for per-user
+// or collapsed feeds, which are changed by states and hashes of items.
+func (w *Server) mountFeed(api *timelineAPI) {
+	w.Echo.GET("/api/timeline/feed/:format", api.feed)
+}
+
+type feedRenderer func(c echo.Context, f *feed) error
+
+var feedRenderers = map[string]feedRenderer{
+	"atom": renderAtom,
+	"rss":  renderRSS,
+	"json": renderJSONFeed,
+}
+
+type feed struct {
+	Title       string
+	Description string
+	IconURL     string
+	SelfURL     string
+	Updated     time.Time
+	Items       []*timeline.Item
+}
+
+// Stable across instances, as long as the topic is not renamed.
+//   urn:dumper:item:/twitter/list/foo:881234567890
+func itemGUID(it *timeline.Item) string {
+	return fmt.Sprintf("urn:dumper:item:%s:%d", it.TopicKey, it.OriginKey)
+}
+
+func itemTitle(it *timeline.Item) string {
+	title := strings.TrimSpace(it.Caption)
+	if i := strings.IndexByte(title, '\n'); i >= 0 {
+		title = strings.TrimSpace(title[:i])
+	}
+	if utf8.RuneCountInString(title) > FeedTitleLength {
+		title = string([]rune(title)[:FeedTitleLength]) + "…"
+	}
+	return title
+}
+
+func itemHTML(it *timeline.Item) string {
+	var b strings.Builder
+	if it.Thumbnail != "" {
+		fmt.Fprintf(&b, `<p><img src="%s"></p>`, html.EscapeString(it.Thumbnail))
+	}
+	fmt.Fprintf(&b, "<p>%s</p>", strings.Replace(html.EscapeString(it.Caption), "\n", "<br>", -1))
+	return b.String()
+}
+
+func (a *timelineAPI) feed(c echo.Context) error {
+	format := c.Param("format")
+	render, ok := feedRenderers[format]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Unknown feed format")
+	}
+	q, err := parseQuery(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if q.Limit <= 0 {
+		q.Limit = FeedDefaultLimit
+	} else if q.Limit > FeedMaxLimit {
+		q.Limit = FeedMaxLimit
+	}
+	prefix := c.QueryParam("topic")
+	if prefix == "" {
+		prefix = "/"
+	}
+	topics := a.tl.Topics(prefixParam(c, "topic"))
+	f := &feed{
+		Title:   "dumper " + prefix,
+		SelfURL: c.Scheme() + "://" + c.Request().Host + c.Request().URL.RequestURI(),
+	}
+	if len(topics) == 1 {
+		info := topics[0].Info()
+		if info.Title != "" {
+			f.Title = info.Title
+		}
+		f.Description = info.Description
+		f.IconURL = info.IconURL
+	}
+	q.Topics = nil
+	for _, t := range topics {
+		q.Topics = append(q.Topics, t.Key)
+	}
+	if q.User == "" && !q.Collapse {
+		// taken before fetch, so that changes during fetch are not hidden by validators
+		modified := a.tl.LastModified(topics)
+		if notModified(c, feedETag(format, q.Topics, modified), modified) {
+			return c.NoContent(http.StatusNotModified)
+		}
+	}
+	if len(q.Topics) > 0 {
+		if f.Items, err = a.tl.Fetch(c.Request().Context(), q); err != nil {
+			return err
+		}
+	}
+	for _, it := range f.Items {
+		if it.Timestamp.After(f.Updated) {
+			f.Updated = it.Timestamp
+		}
+	}
+	if f.Updated.IsZero() {
+		f.Updated = time.Now()
+	}
+	return render(c, f)
+}
+
+// Validator of the page, topic keys are hashed since topics matched to the pattern may be changed.
+func feedETag(format string, keys []string, modified time.Time) string {
+	h := fnv.New64a()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s\n", k)
+	}
+	return fmt.Sprintf(`"%s-%x-%x"`, format, modified.UnixNano(), h.Sum64())
+}
+
+// Set validators, and report whether the request is satisfied by them.
+// If-None-Match precedes If-Modified-Since as RFC 7232.
+// Last-Modified is the end of the second of the change, and is sent only after the second is over,
+// so that later changes are after it even in precision of HTTP date.
+func notModified(c echo.Context, etag string, modified time.Time) bool {
+	res := c.Response().Header()
+	res.Set("ETag", etag)
+	if lastModified := modified.Truncate(time.Second).Add(time.Second); !time.Now().Before(lastModified) {
+		res.Set(echo.HeaderLastModified, lastModified.UTC().Format(http.TimeFormat))
+	}
+	req := c.Request().Header
+	if inm := req.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := req.Get(echo.HeaderIfModifiedSince); ims != "" {
+		t, err := http.ParseTime(ims)
+		return err == nil && modified.Before(t)
+	}
+	return false
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Icon    string      `xml:"icon,omitempty"`
+	Link    atomLink    `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published"`
+	Author    *atomAuthor `xml:"author,omitempty"`
+	Content   atomContent `xml:"content"`
+}
+
+func renderAtom(c echo.Context, f *feed) error {
+	af := &atomFeed{
+		ID:      f.SelfURL,
+		Title:   f.Title,
+		Updated: f.Updated.UTC().Format(time.RFC3339),
+		Icon:    f.IconURL,
+		Link:    atomLink{Rel: "self", Href: f.SelfURL},
+		Author:  atomAuthor{Name: "dumper"},
+	}
+	for _, it := range f.Items {
+		ts := it.Timestamp.UTC().Format(time.RFC3339)
+		e := atomEntry{
+			ID:        itemGUID(it),
+			Title:     itemTitle(it),
+			Updated:   ts,
+			Published: ts,
+			Content:   atomContent{Type: "html", Body: itemHTML(it)},
+		}
+		if it.Origin != "" {
+			e.Author = &atomAuthor{Name: it.Origin}
+		}
+		af.Entries = append(af.Entries, e)
+	}
+	return renderXML(c, "application/atom+xml; charset=UTF-8", af)
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Description string   `xml:"description"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Category    []string `xml:"category,omitempty"`
+}
+
+func renderRSS(c echo.Context, f *feed) error {
+	description := f.Description
+	if description == "" {
+		// required by RSS 2.0
+		description = f.Title
+	}
+	rf := &rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         f.Title,
+			Link:          f.SelfURL,
+			Description:   description,
+			LastBuildDate: f.Updated.UTC().Format(time.RFC1123Z),
+		},
+	}
+	for _, it := range f.Items {
+		rf.Channel.Items = append(rf.Channel.Items, rssItem{
+			Title:       itemTitle(it),
+			Description: itemHTML(it),
+			GUID:        rssGUID{Value: itemGUID(it)},
+			PubDate:     it.Timestamp.UTC().Format(time.RFC1123Z),
+			Category:    it.Tags,
+		})
+	}
+	return renderXML(c, "application/rss+xml; charset=UTF-8", rf)
+}
+
+func renderXML(c echo.Context, contentType string, v interface{}) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, contentType, append([]byte(xml.Header), b...))
+}
+
+// https://jsonfeed.org/version/1.1
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	FeedURL     string         `json:"feed_url"`
+	Description string         `json:"description,omitempty"`
+	Icon        string         `json:"icon,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string   `json:"id"`
+	Title         string   `json:"title,omitempty"`
+	ContentHTML   string   `json:"content_html"`
+	ContentText   string   `json:"content_text"`
+	Image         string   `json:"image,omitempty"`
+	DatePublished string   `json:"date_published"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+func renderJSONFeed(c echo.Context, f *feed) error {
+	jf := &jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		FeedURL:     f.SelfURL,
+		Description: f.Description,
+		Icon:        f.IconURL,
+		Items:       []jsonFeedItem{},
+	}
+	for _, it := range f.Items {
+		jf.Items = append(jf.Items, jsonFeedItem{
+			ID:            itemGUID(it),
+			Title:         itemTitle(it),
+			ContentHTML:   itemHTML(it),
+			ContentText:   it.Caption,
+			Image:         it.Thumbnail,
+			DatePublished: it.Timestamp.UTC().Format(time.RFC3339),
+			Tags:          it.Tags,
+		})
+	}
+	b, err := json.Marshal(jf)
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, "application/feed+json; charset=UTF-8", b)
+}
@@ -0,0 +1,124 @@
+package web
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func getFeed(s *Server, path string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	s.Echo.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestFeed(t *testing.T) {
+	a := assert.New(t)
+	s, tl := newTestServer(t)
+	a.NoError(tl.NewTopicWithInfo("web/test", "/webfeed/a", timeline.TopicInfo{Title: "Feed A"}))
+	ts := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	a.NoError(tl.Publish("/webfeed/a",
+		&timeline.Item{Caption: "first\nbody", Thumbnail: "http://example.com/1.jpg", OriginKey: 11, Timestamp: ts},
+		&timeline.Item{Caption: "<second>", OriginKey: 12, Timestamp: ts.Add(time.Hour)}))
+
+	rec := getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/a", nil)
+	a.Equal(http.StatusOK, rec.Code)
+	a.True(strings.HasPrefix(rec.Header().Get("Content-Type"), "application/atom+xml"))
+	var af atomFeed
+	a.NoError(xml.Unmarshal(rec.Body.Bytes(), &af))
+	a.Equal("Feed A", af.Title)
+	a.Len(af.Entries, 2)
+	a.Equal("urn:dumper:item:/webfeed/a:12", af.Entries[0].ID)
+	a.Equal("<second>", af.Entries[0].Title)
+	a.Equal("first", af.Entries[1].Title)
+	a.Contains(af.Entries[1].Content.Body, `<img src="http://example.com/1.jpg">`)
+	etag := rec.Header().Get("ETag")
+
+	rec = getFeed(s, "/api/timeline/feed/rss?topic=/webfeed/a&limit=1", nil)
+	a.Equal(http.StatusOK, rec.Code)
+	var rf rssFeed
+	a.NoError(xml.Unmarshal(rec.Body.Bytes(), &rf))
+	a.Len(rf.Channel.Items, 1)
+	a.Equal("urn:dumper:item:/webfeed/a:12", rf.Channel.Items[0].GUID.Value)
+	a.False(rf.Channel.Items[0].GUID.IsPermaLink)
+
+	rec = getFeed(s, "/api/timeline/feed/json?topic=/webfeed/a", nil)
+	a.Equal(http.StatusOK, rec.Code)
+	var jf jsonFeed
+	a.NoError(json.Unmarshal(rec.Body.Bytes(), &jf))
+	a.Equal("https://jsonfeed.org/version/1.1", jf.Version)
+	a.Len(jf.Items, 2)
+	a.Equal("http://example.com/1.jpg", jf.Items[1].Image)
+
+	// conditional requests
+	a.Equal(http.StatusNotModified, getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/a", map[string]string{"If-None-Match": etag}).Code)
+	// Last-Modified is sent after the second of the last change is over
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	rec = getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/a", nil)
+	a.Equal(etag, rec.Header().Get("ETag"))
+	lastModified := rec.Header().Get("Last-Modified")
+	a.NotEmpty(lastModified)
+	a.Equal(http.StatusNotModified, getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/a", map[string]string{"If-Modified-Since": lastModified}).Code)
+	a.NoError(tl.Publish("/webfeed/a", &timeline.Item{Caption: "third", OriginKey: 13, Timestamp: ts.Add(2 * time.Hour)}))
+	rec = getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/a", map[string]string{"If-None-Match": etag})
+	a.Equal(http.StatusOK, rec.Code)
+	a.NotEqual(etag, rec.Header().Get("ETag"))
+
+	// updated and deleted items change validators
+	etag = rec.Header().Get("ETag")
+	a.NoError(tl.Update(&timeline.Item{TopicKey: "/webfeed/a", OriginKey: 13, Caption: "third edited", Timestamp: ts.Add(2 * time.Hour)}))
+	rec = getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/a", map[string]string{"If-None-Match": etag})
+	a.Equal(http.StatusOK, rec.Code)
+	etag = rec.Header().Get("ETag")
+	a.NoError(tl.Delete("/webfeed/a", 13))
+	rec = getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/a", map[string]string{"If-None-Match": etag})
+	a.Equal(http.StatusOK, rec.Code)
+	// regardless of timestamps of items
+	a.Equal(http.StatusOK, getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/a", map[string]string{"If-Modified-Since": lastModified}).Code)
+
+	// not changed by other topics, but by topics newly matched to the pattern
+	a.NoError(tl.NewTopic("web/test", "/webfeed/b"))
+	rec = getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/a", nil)
+	etag = rec.Header().Get("ETag")
+	globEtag := getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/*", nil).Header().Get("ETag")
+	a.NoError(tl.Publish("/webfeed/b", &timeline.Item{Caption: "other", OriginKey: 21}))
+	a.Equal(http.StatusNotModified, getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/a", map[string]string{"If-None-Match": etag}).Code)
+	a.Equal(http.StatusOK, getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/*", map[string]string{"If-None-Match": globEtag}).Code)
+	a.NoError(tl.NewTopic("web/test", "/webfeed/c"))
+	globEtag = getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/*", nil).Header().Get("ETag")
+	_, err := tl.DeleteTopic("/webfeed/c")
+	a.NoError(err)
+	a.Equal(http.StatusOK, getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/*", map[string]string{"If-None-Match": globEtag}).Code)
+
+	// per-user feeds are not validated
+	rec = getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/a&starred=true&user=alice", nil)
+	a.Equal(http.StatusOK, rec.Code)
+	a.Empty(rec.Header().Get("ETag"))
+
+	// items after min_id are fetched in ascending order
+	rec = getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/a&min_id=1", nil)
+	a.Equal(http.StatusOK, rec.Code)
+	etag = rec.Header().Get("ETag")
+	a.NoError(tl.Publish("/webfeed/a", &timeline.Item{Caption: "fourth", OriginKey: 14, Timestamp: ts.Add(3 * time.Hour)}))
+	rec = getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/a&min_id=1", map[string]string{"If-None-Match": etag})
+	a.Equal(http.StatusOK, rec.Code)
+	a.Equal(http.StatusNotModified, getFeed(s, "/api/timeline/feed/atom?topic=/webfeed/a&min_id=1",
+		map[string]string{"If-None-Match": rec.Header().Get("ETag")}).Code)
+
+	a.Equal(http.StatusNotFound, getFeed(s, "/api/timeline/feed/xml?topic=/webfeed/a", nil).Code)
+	rec = getFeed(s, "/api/timeline/feed/json?topic=/webfeed/missing", nil)
+	a.Equal(http.StatusOK, rec.Code)
+	a.NoError(json.Unmarshal(rec.Body.Bytes(), &jf))
+	a.Empty(jf.Items)
+}
@@ -0,0 +1,63 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+)
+
+// Merged feed, topics take turns by weight instead of being ordered by time, see timeline.MergeQuery
+//   GET /api/timeline/merged?topic=/twitter/**&topic=/pixiv/**&weight=/pixiv/**:3&limit=50
+//   GET /api/timeline/merged?topic=/twitter/**&burst=user&max_burst=2&cursor=<next of the previous page>
+// Accepts items parameters except offset. weight is <TopicPattern>:<weight>, and the first matched one is applied.
+func (w *Server) mountMerged(api *timelineAPI) {
+	w.Echo.GET("/api/timeline/merged", api.merged)
+}
+
+func (a *timelineAPI) merged(c echo.Context) error {
+	q, err := parseQuery(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	mq := &timeline.MergeQuery{
+		Query:      q,
+		Cursor:     c.QueryParam("cursor"),
+		BurstField: c.QueryParam("burst"),
+	}
+	if mq.MaxBurst, err = intParam(c, "max_burst"); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	for _, v := range c.QueryParams()["weight"] {
+		w, err := parseWeight(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		mq.Weights = append(mq.Weights, w)
+	}
+	if err := mq.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	page, err := a.tl.FetchMerged(c.Request().Context(), mq)
+	if err == timeline.ErrInvalidCursor {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	} else if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+func parseWeight(v string) (timeline.TopicWeight, error) {
+	i := strings.LastIndex(v, ":")
+	if i < 0 {
+		return timeline.TopicWeight{}, fmt.Errorf("Invalid weight: %v", v)
+	}
+	n, err := strconv.Atoi(v[i+1:])
+	if err != nil {
+		return timeline.TopicWeight{}, fmt.Errorf("Invalid weight: %v", v)
+	}
+	return timeline.TopicWeight{Pattern: timeline.ParsePattern(v[:i]), Weight: n}, nil
+}
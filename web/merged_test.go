@@ -0,0 +1,46 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergedAPI(t *testing.T) {
+	a := assert.New(t)
+	s, tl := newTestServer(t)
+	a.NoError(tl.NewTopic("web/test", "/webmerged/a"))
+	a.NoError(tl.NewTopic("web/test", "/webmerged/b"))
+	a.NoError(tl.Publish("/webmerged/a", &timeline.Item{Caption: "A1", OriginKey: 1}))
+	a.NoError(tl.Publish("/webmerged/b",
+		&timeline.Item{Caption: "B1", OriginKey: 2},
+		&timeline.Item{Caption: "B2", OriginKey: 3},
+		&timeline.Item{Caption: "B3", OriginKey: 4}))
+
+	var page timeline.MergedPage
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/merged?topic=/webmerged/**&limit=2", &page))
+	if a.Len(page.Items, 2) {
+		a.Equal("A1", page.Items[0].Caption)
+		a.Equal("B3", page.Items[1].Caption)
+	}
+	next := page.Next
+	page = timeline.MergedPage{}
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/merged?topic=/webmerged/**&limit=2&cursor="+url.QueryEscape(next), &page))
+	if a.Len(page.Items, 2) {
+		a.Equal("B2", page.Items[0].Caption)
+		a.Equal("B1", page.Items[1].Caption)
+	}
+	a.Empty(page.Next)
+
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/merged?topic=/webmerged/**&limit=2&weight=/webmerged/b:2", &page))
+	if a.Len(page.Items, 2) {
+		a.Equal("B3", page.Items[0].Caption)
+	}
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/api/timeline/merged?weight=/webmerged/b", nil))
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/api/timeline/merged?weight=/webmerged/b:0", nil))
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/api/timeline/merged?offset=10", nil))
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/api/timeline/merged?cursor=x", nil))
+}
@@ -0,0 +1,23 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+)
+
+// Timeline retention status
+//   GET /api/timeline/retention    rules and stats of recent pruning runs
+func (w *Server) MountRetention(r *timeline.Retention) {
+	w.Echo.GET("/api/timeline/retention", func(c echo.Context) error {
+		stats := r.Stats()
+		if stats == nil {
+			stats = []*timeline.PruneStats{}
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"rules": r.Rules(),
+			"stats": stats,
+		})
+	})
+}
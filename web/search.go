@@ -0,0 +1,52 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+)
+
+// Saved search API, saved search is a topic keyed /saved/<name>
+//   PUT /api/timeline/saved?name=cats    (body: {"query": "tag:cat -tag:nsfw", "title": "Cats"})
+// Query is replaced if exists, and title and so on are used only on creation.
+// Saved searches are listed, fetched, streamed, renamed and deleted as ordinary topics,
+// such as GET /api/timeline/items?topic=/saved/cats&unread=true
+func (w *Server) mountSearch(api *timelineAPI) {
+	w.Echo.PUT("/api/timeline/saved", api.saveSearch)
+}
+
+type savedSearchRequest struct {
+	Query string `json:"query"`
+	timeline.TopicInfo
+}
+
+func (a *timelineAPI) saveSearch(c echo.Context) error {
+	var req savedSearchRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	name := c.QueryParam("name")
+	key := timeline.SavedSearchKey(name)
+	if t, ok := a.tl.Topic(key); ok {
+		if t.SavedSearch() == "" {
+			return echo.NewHTTPError(http.StatusConflict, timeline.ErrTopicExists.Error())
+		}
+		if err := a.tl.UpdateSavedSearch(key, req.Query); err != nil {
+			return searchError(err)
+		}
+		return c.JSON(http.StatusOK, t)
+	}
+	t, err := a.tl.NewSavedSearch(name, req.Query, req.TopicInfo)
+	if err != nil {
+		return searchError(err)
+	}
+	return c.JSON(http.StatusCreated, t)
+}
+
+func searchError(err error) error {
+	if _, ok := err.(*timeline.SyntaxError); ok || err == timeline.ErrSearchName {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return topicError(err)
+}
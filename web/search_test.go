@@ -0,0 +1,41 @@
+package web
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSavedSearchAPI(t *testing.T) {
+	a := assert.New(t)
+	s, tl := newTestServer(t)
+	a.NoError(tl.NewTopic("web/test", "/websearch/a"))
+	a.NoError(tl.Publish("/websearch/a",
+		&timeline.Item{Caption: "A1", OriginKey: 1, Tags: []string{"cat"}},
+		&timeline.Item{Caption: "A2", OriginKey: 2}))
+
+	a.Equal(http.StatusCreated, requestJSON(t, s, http.MethodPut, "/api/timeline/saved?name=webcats", `{"query":"topic:/websearch/** tag:cat","title":"Cats"}`, nil))
+	var topic map[string]interface{}
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/topic?key=/saved/webcats", &topic))
+	a.Equal("Cats", topic["title"])
+	a.Equal("topic:/websearch/** tag:cat", topic["query"])
+
+	var items []*timeline.Item
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items?topic=/saved/webcats", &items))
+	if a.Len(items, 1) {
+		a.Equal("A1", items[0].Caption)
+	}
+
+	a.Equal(http.StatusOK, requestJSON(t, s, http.MethodPut, "/api/timeline/saved?name=webcats", `{"query":"topic:/websearch/**"}`, &topic))
+	a.Equal("topic:/websearch/**", topic["query"])
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items?topic=/saved/webcats", &items))
+	a.Len(items, 2)
+
+	a.Equal(http.StatusBadRequest, requestJSON(t, s, http.MethodPut, "/api/timeline/saved?name=webcats", `{"query":"limit:"}`, nil))
+	a.Equal(http.StatusBadRequest, requestJSON(t, s, http.MethodPut, "/api/timeline/saved?name=", `{"query":"tag:cat"}`, nil))
+	a.Equal(http.StatusBadRequest, requestJSON(t, s, http.MethodPut, "/api/timeline/saved?name=webdogs", `{"query":"is:unread"}`, nil))
+	a.Equal(http.StatusOK, requestJSON(t, s, http.MethodDelete, "/api/timeline/topic?key=/saved/webcats", "", nil))
+	a.Equal(http.StatusNotFound, getJSON(t, s, "/api/timeline/topic?key=/saved/webcats", nil))
+}
@@ -0,0 +1,43 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+)
+
+// Near-duplicates by perceptual hash of thumbnails, see timeline.Hasher
+//   GET /api/timeline/items/:id/similar?distance=8    accepts items parameters, nearest first
+//   GET /api/timeline/items?topic=/pixiv/**&collapse=true&collapse_distance=8
+func (w *Server) mountSimilar(api *timelineAPI) {
+	w.Echo.GET("/api/timeline/items/:id/similar", api.similar)
+}
+
+func (a *timelineAPI) similar(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid id")
+	}
+	q, err := parseQuery(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	distance := timeline.DefaultSimilarDistance
+	if c.QueryParam("distance") != "" {
+		if distance, err = intParam(c, "distance"); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	items, err := a.tl.SimilarItems(c.Request().Context(), id, distance, q)
+	if err == timeline.ErrNotFound {
+		return echo.NewHTTPError(http.StatusNotFound)
+	} else if err != nil {
+		return err
+	}
+	if items == nil {
+		items = []*timeline.Item{}
+	}
+	return c.JSON(http.StatusOK, items)
+}
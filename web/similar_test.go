@@ -0,0 +1,53 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimilarAPI(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	storage, err := timeline.NewStorage("sqlite3", filepath.Join(t.TempDir(), "timeline.db"))
+	a.NoError(err)
+	tl := timeline.NewService(storage)
+	s := &Server{Echo: echo.New()}
+	s.MountTimeline(tl)
+
+	a.NoError(tl.NewTopic("web/test", "/websimilar/a"))
+	items := []*timeline.Item{
+		{Caption: "original", OriginKey: 1},
+		{Caption: "resized", OriginKey: 2},
+		{Caption: "other", OriginKey: 3},
+	}
+	a.NoError(tl.Publish("/websimilar/a", items...))
+	for i, hash := range []timeline.PHash{0xff00ff00ff00ff00, 0xff00ff00ff00ff01, 0x00ff00ff00ff00ff} {
+		h := hash
+		a.NoError(storage.SetItemHash(ctx, items[i].ID, &h))
+	}
+
+	var similar []*timeline.Item
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items/"+strconv.FormatInt(items[0].ID, 10)+"/similar", &similar))
+	a.Len(similar, 1)
+	a.Equal("resized", similar[0].Caption)
+	a.Equal(timeline.PHash(0xff00ff00ff00ff01), *similar[0].PHash)
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items/"+strconv.FormatInt(items[0].ID, 10)+"/similar?distance=64", &similar))
+	a.Len(similar, 2)
+	a.Equal(http.StatusNotFound, getJSON(t, s, "/api/timeline/items/12345/similar", nil))
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/api/timeline/items/x/similar", nil))
+
+	var collapsed []*timeline.Item
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items?topic=/websimilar/a&collapse=true", &collapsed))
+	a.Len(collapsed, 2)
+	a.Equal("other", collapsed[0].Caption)
+	a.Equal([]int64{items[0].ID}, collapsed[1].Duplicates)
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items?topic=/websimilar/a&collapse=true&collapse_distance=0", &collapsed))
+	a.Len(collapsed, 3)
+}
@@ -0,0 +1,92 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+)
+
+// User for per-user state if user parameter is not given.
+var DefaultUser = "default"
+
+// Per-user read state and flags, user is given by user parameter
+//   GET    /api/timeline/unread?prefix=/twitter           unread counts for each topic
+//   GET    /api/timeline/read                             read markers for each topic
+//   POST   /api/timeline/read?topic=/twitter&up_to=123    mark read, all items if up_to is omitted
+//   PUT    /api/timeline/items/:id/star                   DELETE to unstar
+//   PUT    /api/timeline/items/:id/hide                   DELETE to unhide
+// Items API also accepts user, starred, unread and show_hidden parameters.
+func (w *Server) mountState(api *timelineAPI) {
+	g := w.Echo.Group("/api/timeline")
+	g.GET("/unread", api.unread)
+	g.GET("/read", api.readMarkers)
+	g.POST("/read", api.markRead)
+	g.PUT("/items/:id/star", api.setFlag(timeline.FlagStarred, true))
+	g.DELETE("/items/:id/star", api.setFlag(timeline.FlagStarred, false))
+	g.PUT("/items/:id/hide", api.setFlag(timeline.FlagHidden, true))
+	g.DELETE("/items/:id/hide", api.setFlag(timeline.FlagHidden, false))
+}
+
+func userParam(c echo.Context) string {
+	if u := c.QueryParam("user"); u != "" {
+		return u
+	}
+	return DefaultUser
+}
+
+func (a *timelineAPI) unread(c echo.Context) error {
+	counts, err := a.tl.UnreadCounts(c.Request().Context(), userParam(c), prefixParam(c, "prefix"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, counts)
+}
+
+func (a *timelineAPI) readMarkers(c echo.Context) error {
+	markers, err := a.tl.ReadMarkers(c.Request().Context(), userParam(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, markers)
+}
+
+func (a *timelineAPI) markRead(c echo.Context) error {
+	topic := prefixParam(c, "topic")
+	if topic == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Missing topic")
+	}
+	var upTo int64
+	if v := c.QueryParam("up_to"); v != "" {
+		var err error
+		if upTo, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid up_to")
+		}
+	}
+	if err := a.tl.MarkRead(c.Request().Context(), userParam(c), topic, upTo); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (a *timelineAPI) setFlag(flag timeline.ItemFlag, value bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid id")
+		}
+		ctx, user := c.Request().Context(), userParam(c)
+		if flag == timeline.FlagStarred {
+			err = a.tl.Star(ctx, user, id, value)
+		} else {
+			err = a.tl.Hide(ctx, user, id, value)
+		}
+		if err == timeline.ErrNotFound {
+			return echo.NewHTTPError(http.StatusNotFound)
+		} else if err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
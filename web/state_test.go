@@ -0,0 +1,42 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateAPI(t *testing.T) {
+	a := assert.New(t)
+	s, tl := newTestServer(t)
+	a.NoError(tl.NewTopic("web/test", "/webstate/a"))
+	first := &timeline.Item{Caption: "S1", OriginKey: 1}
+	second := &timeline.Item{Caption: "S2", OriginKey: 2}
+	a.NoError(tl.Publish("/webstate/a", first, second))
+
+	var counts map[string]int64
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/unread?prefix=/webstate&user=carol", &counts))
+	a.Equal(map[string]int64{"/webstate/a": 2}, counts)
+	a.Equal(http.StatusNoContent, requestJSON(t, s, http.MethodPost, "/api/timeline/read?topic=/webstate/a&user=carol&up_to="+strconv.FormatInt(first.ID, 10), "", nil))
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/unread?prefix=/webstate&user=carol", &counts))
+	a.Equal(map[string]int64{"/webstate/a": 1}, counts)
+
+	a.Equal(http.StatusNoContent, requestJSON(t, s, http.MethodPut, "/api/timeline/items/"+strconv.FormatInt(first.ID, 10)+"/star?user=carol", "", nil))
+	a.Equal(http.StatusNotFound, requestJSON(t, s, http.MethodPut, "/api/timeline/items/999999/star?user=carol", "", nil))
+	var items []*timeline.Item
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items?topic=/webstate/a&starred=true&user=carol", &items))
+	if a.Len(items, 1) {
+		a.Equal("S1", items[0].Caption)
+		a.True(items[0].State.Starred)
+		a.True(items[0].State.Read)
+	}
+
+	a.Equal(http.StatusNoContent, requestJSON(t, s, http.MethodPut, "/api/timeline/items/"+strconv.FormatInt(second.ID, 10)+"/hide?user=carol", "", nil))
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items?topic=/webstate/a&user=carol", &items))
+	a.Len(items, 1)
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items?topic=/webstate/a&user=carol&show_hidden=true", &items))
+	a.Len(items, 2)
+}
@@ -0,0 +1,68 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+)
+
+// Stats API, item counts in buckets of time
+//   GET /api/timeline/stats?interval=day&group=topic&topic=/twitter/**&after=2026-10-01T00:00:00Z
+//   GET /api/timeline/stats?interval=week&group=meta.user&origin=twitter.tweet&limit=10&tz=+09:00
+// interval is hour, day (default) or week. group is topic, origin or meta.<field>, total if omitted.
+// Accepts items parameters, limit is for groups.
+func (w *Server) mountStats(api *timelineAPI) {
+	w.Echo.GET("/api/timeline/stats", api.stats)
+}
+
+func (a *timelineAPI) stats(c echo.Context) error {
+	q, err := parseQuery(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	sq := &timeline.StatsQuery{
+		Query:    q,
+		Interval: timeline.StatsInterval(c.QueryParam("interval")),
+		GroupBy:  c.QueryParam("group"),
+		Limit:    q.Limit,
+	}
+	q.Limit = 0
+	if sq.Interval == "" {
+		sq.Interval = timeline.StatsDay
+	}
+	if sq.UTCOffset, err = utcOffsetParam(c, "tz"); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := sq.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	stats, err := a.tl.Stats(c.Request().Context(), sq)
+	if err == timeline.ErrTooManyBuckets || err == timeline.ErrStatsRange {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	} else if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+// Accepts offset such as +09:00 or Z.
+func utcOffsetParam(c echo.Context, name string) (time.Duration, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return 0, nil
+	}
+	// unescaped + is decoded as space
+	if strings.HasPrefix(v, " ") {
+		v = "+" + v[1:]
+	}
+	t, err := time.Parse("Z07:00", v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %v", name, v)
+	}
+	_, offset := t.Zone()
+	return time.Duration(offset) * time.Second, nil
+}
@@ -0,0 +1,38 @@
+package web
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsAPI(t *testing.T) {
+	a := assert.New(t)
+	s, tl := newTestServer(t)
+	a.NoError(tl.NewTopic("web/test", "/webstats/a"))
+	a.NoError(tl.NewTopic("web/test", "/webstats/b"))
+	day := time.Date(2026, 10, 5, 0, 0, 0, 0, time.UTC)
+	a.NoError(tl.Publish("/webstats/a",
+		&timeline.Item{OriginKey: 1, Timestamp: day.Add(time.Hour)},
+		&timeline.Item{OriginKey: 2, Timestamp: day.Add(25 * time.Hour)}))
+
+	var stats timeline.Stats
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/stats?topic=/webstats/**&group=topic&after=2026-10-05T00:00:00Z&before=2026-10-06T23:00:00Z", &stats))
+	a.Equal(timeline.StatsDay, stats.Interval)
+	a.Len(stats.Buckets, 2)
+	a.Len(stats.Groups, 2)
+	a.Equal("/webstats/a", stats.Groups[0].Key)
+	a.Equal([]int64{1, 1}, stats.Groups[0].Counts)
+	a.Equal(int64(0), stats.Groups[1].Total)
+
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/stats?topic=/webstats/**&interval=hour&limit=1&tz=%2B09:00&after=2026-10-05T00:00:00Z&before=2026-10-05T02:00:00Z", &stats))
+	a.Len(stats.Buckets, 3)
+	a.Equal([]int64{0, 1, 0}, stats.Groups[0].Counts)
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/api/timeline/stats?interval=month", nil))
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/api/timeline/stats?group=user", nil))
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/api/timeline/stats?tz=JST", nil))
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/api/timeline/stats?interval=hour&after=2020-01-01T00:00:00Z", nil))
+}
@@ -0,0 +1,270 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+	"golang.org/x/net/websocket"
+)
+
+var (
+	StreamKeepAlive   = 30 * time.Second
+	StreamReplayBatch = 100
+)
+
+// Live timeline streaming
+//   GET /api/timeline/stream?topic=/twitter    (Server-Sent Events)
+//   GET /api/timeline/ws?topic=/twitter        (WebSocket, JSON text frames)
+// Both resumes from Last-Event-ID header (or last_event_id parameter),
+// or starts with latest items given by history parameter.
+// Items can be selected by filter parameter, see timeline.Filter.
+// SSE events are "item" for published items, and "update" and "delete" for changed items,
+// whose data is the item. Only "item" has id. SSE stream also notifies changes of matched topics as "topic" event.
+// WebSocket frames are timeline.ItemEvent, such as {"kind": "deleted", "item": {...}}.
+func (w *Server) mountStream(api *timelineAPI) {
+	w.Echo.GET("/api/timeline/stream", api.sse)
+	w.Echo.GET("/api/timeline/ws", api.websocket)
+}
+
+// Live subscription requested by client
+type subscription struct {
+	lis    *timeline.Listener
+	prefix string
+	lastID int64
+	filter *timeline.Filter
+}
+
+func (a *timelineAPI) listen(c echo.Context) (*subscription, error) {
+	prefix := prefixParam(c, "topic")
+	if prefix == "" {
+		prefix = "/**"
+	}
+	// plain prefix should match existing topic, as Listen does for a plain key
+	if !timeline.ParsePattern(c.QueryParam("topic")).IsGlob() && len(a.tl.Topics(prefix)) == 0 {
+		return nil, echo.NewHTTPError(http.StatusNotFound, timeline.ErrNoTopic.Error())
+	}
+	var lastID int64
+	lastEventID := c.Request().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.QueryParam("last_event_id")
+	}
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid Last-Event-ID")
+		}
+		lastID = id
+	}
+	filter, err := filterParam(c)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	var opts []timeline.ListenOption
+	if filter != nil {
+		opts = append(opts, timeline.WithFilter(filter))
+	}
+	if lastID == 0 {
+		history, err := intParam(c, "history")
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if history > timeline.MaxHistory {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("history should be %d at most", timeline.MaxHistory))
+		}
+		if history > 0 {
+			opts = append(opts, timeline.WithHistory(history))
+		}
+	}
+	lis, err := a.tl.Listen(prefix, opts...)
+	if err == timeline.ErrNoTopic {
+		return nil, echo.NewHTTPError(http.StatusNotFound, err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+	return &subscription{
+		lis:    lis,
+		prefix: prefix,
+		lastID: lastID,
+		filter: filter,
+	}, nil
+}
+
+// Send items after lastID from storage, then live events from lis until ctx is done.
+// Listener is subscribed before replay, so that no items are lost between them.
+// Items discarded by listener overflow are also re-sent from storage.
+// Topic events are sent by sendTopic, or ignored if it is nil.
+func (a *timelineAPI) pump(ctx context.Context, sub *subscription, send func(timeline.ItemEvent) error, sendTopic func(timeline.TopicEvent) error, keepAlive func() error) error {
+	lis := sub.lis
+	topicC := lis.TopicC
+	sent := sub.lastID
+	replay := func() error {
+		for {
+			items, err := a.tl.FetchSince(ctx, sub.prefix, sent, StreamReplayBatch, sub.filter)
+			if err != nil {
+				return err
+			}
+			for _, it := range items {
+				if err := send(timeline.ItemEvent{Kind: timeline.ItemAdded, Item: it}); err != nil {
+					return err
+				}
+				sent = it.ID
+			}
+			if len(items) < StreamReplayBatch {
+				return nil
+			}
+		}
+	}
+	if sent > 0 {
+		if err := replay(); err != nil {
+			return err
+		}
+	}
+	ticker := time.NewTicker(StreamKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-lis.C:
+			if !ok {
+				return lis.Err()
+			}
+			if sinceID, missed := lis.Missed(); missed {
+				lis.ClearMissed()
+				if sent == 0 {
+					// nothing sent yet, re-send from the oldest of discarded and current items
+					if ev.Kind == timeline.ItemAdded && ev.Item.ID < sinceID {
+						sinceID = ev.Item.ID
+					}
+					sent = sinceID - 1
+				}
+				if err := replay(); err != nil {
+					return err
+				}
+			}
+			if ev.Kind != timeline.ItemAdded {
+				// changes of sent items, IDs may be older than sent
+				if err := send(ev); err != nil {
+					return err
+				}
+				continue
+			}
+			if sent > 0 && ev.Item.ID <= sent {
+				// already sent in replay
+				continue
+			}
+			if err := send(ev); err != nil {
+				return err
+			}
+			sent = ev.Item.ID
+		case ev, ok := <-topicC:
+			if !ok {
+				// closed with lis.C
+				topicC = nil
+				continue
+			}
+			if sendTopic == nil {
+				continue
+			}
+			if err := sendTopic(ev); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if keepAlive == nil {
+				continue
+			}
+			if err := keepAlive(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (a *timelineAPI) sse(c echo.Context) error {
+	sub, err := a.listen(c)
+	if err != nil {
+		return err
+	}
+	defer sub.lis.Close()
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+	send := func(ev timeline.ItemEvent) error {
+		data, err := json.Marshal(ev.Item)
+		if err != nil {
+			return err
+		}
+		switch ev.Kind {
+		case timeline.ItemUpdated:
+			_, err = fmt.Fprintf(res, "event: update\ndata: %s\n\n", data)
+		case timeline.ItemDeleted:
+			_, err = fmt.Fprintf(res, "event: delete\ndata: %s\n\n", data)
+		default:
+			_, err = fmt.Fprintf(res, "id: %d\nevent: item\ndata: %s\n\n", ev.Item.ID, data)
+		}
+		if err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	}
+	sendTopic := func(ev timeline.TopicEvent) error {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(res, "event: topic\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	}
+	keepAlive := func() error {
+		if _, err := fmt.Fprint(res, ": keepalive\n\n"); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	}
+	return a.pump(c.Request().Context(), sub, send, sendTopic, keepAlive)
+}
+
+func (a *timelineAPI) websocket(c echo.Context) error {
+	sub, err := a.listen(c)
+	if err != nil {
+		return err
+	}
+	defer sub.lis.Close()
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		ctx, cancel := context.WithCancel(c.Request().Context())
+		defer cancel()
+		go func() {
+			// Incoming messages are ignored, read only to detect disconnection.
+			var msg string
+			for {
+				if err := websocket.Message.Receive(ws, &msg); err != nil {
+					cancel()
+					return
+				}
+			}
+		}()
+		err := a.pump(ctx, sub, func(ev timeline.ItemEvent) error {
+			return websocket.JSON.Send(ws, ev)
+		}, nil, nil)
+		if err != nil {
+			// connection is hijacked, error response cannot be sent
+			c.Logger().Warnf("Timeline websocket closed: %v", err)
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+	return nil
+}
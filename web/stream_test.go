@@ -0,0 +1,155 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+// Read next SSE event of an item, returns id and decoded item.
+func readEvent(t *testing.T, r *bufio.Reader) (string, *timeline.Item) {
+	id, _, item := readItemEvent(t, r)
+	return id, item
+}
+
+// Read next SSE event of an item, returns id, name of the event and decoded item.
+func readItemEvent(t *testing.T, r *bufio.Reader) (string, string, *timeline.Item) {
+	var id, event string
+	var item timeline.Item
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			if event == "item" || event == "update" || event == "delete" {
+				return id, event, &item
+			}
+			id, event = "", ""
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &item); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestTimelineSSE(t *testing.T) {
+	a := assert.New(t)
+	s, tl := newTestServer(t)
+	ts := httptest.NewServer(s.Echo)
+	defer ts.Close()
+	a.NoError(tl.NewTopic("web/test", "/sse/a"))
+	first := &timeline.Item{Caption: "old1", OriginKey: 1}
+	a.NoError(tl.Publish("/sse/a", first, &timeline.Item{Caption: "old2", OriginKey: 2}))
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/api/timeline/stream?topic=/sse/&history=1000000000", nil))
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/timeline/stream?topic=/sse/", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatInt(first.ID, 10))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	a.Equal("text/event-stream", res.Header.Get("Content-Type"))
+	r := bufio.NewReader(res.Body)
+	_, replayed := readEvent(t, r)
+	a.Equal("old2", replayed.Caption)
+
+	a.NoError(tl.Publish("/sse/a", &timeline.Item{Caption: "live", OriginKey: 3}))
+	id, live := readEvent(t, r)
+	a.Equal("live", live.Caption)
+	a.Equal(strconv.FormatInt(live.ID, 10), id)
+
+	a.NoError(tl.Update(&timeline.Item{TopicKey: "/sse/a", Caption: "edited", OriginKey: 2}))
+	id, event, updated := readItemEvent(t, r)
+	a.Equal("update", event)
+	a.Equal("", id)
+	a.Equal("edited", updated.Caption)
+
+	a.NoError(tl.Delete("/sse/a", 3, timeline.WithReason("removed by author")))
+	_, event, deleted := readItemEvent(t, r)
+	a.Equal("delete", event)
+	a.Equal(live.ID, deleted.ID)
+	if a.NotNil(deleted.Deleted) {
+		a.Equal("removed by author", deleted.Deleted.Reason)
+	}
+
+	res404, err := http.Get(ts.URL + "/api/timeline/stream?topic=/nosuchtopic")
+	if a.NoError(err) {
+		res404.Body.Close()
+		a.Equal(http.StatusNotFound, res404.StatusCode)
+	}
+}
+
+func TestTimelineWebSocket(t *testing.T) {
+	a := assert.New(t)
+	s, tl := newTestServer(t)
+	ts := httptest.NewServer(s.Echo)
+	defer ts.Close()
+	a.NoError(tl.NewTopic("web/test", "/ws/a"))
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/timeline/ws?topic=/ws/"
+	ws, err := websocket.Dial(wsURL, "", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	// Listener is registered before handshake completes
+	a.NoError(tl.Publish("/ws/a", &timeline.Item{Caption: "live", OriginKey: 1}))
+	var ev timeline.ItemEvent
+	a.NoError(websocket.JSON.Receive(ws, &ev))
+	a.Equal(timeline.ItemAdded, ev.Kind)
+	a.Equal("live", ev.Item.Caption)
+
+	a.NoError(tl.Delete("/ws/a", 1))
+	ev = timeline.ItemEvent{}
+	a.NoError(websocket.JSON.Receive(ws, &ev))
+	a.Equal(timeline.ItemDeleted, ev.Kind)
+	a.Equal("live", ev.Item.Caption)
+}
+
+func TestPumpOverflowBeforeFirstSend(t *testing.T) {
+	a := assert.New(t)
+	_, tl := newTestServer(t)
+	tl.ListenerBuffer = 2
+	a.NoError(tl.NewTopic("web/test", "/pump/a"))
+	lis, err := tl.Listen("/pump/**", timeline.WithOverflowPolicy(timeline.DropOldest))
+	a.NoError(err)
+	defer lis.Close()
+	for i := 1; i <= 5; i++ {
+		a.NoError(tl.Publish("/pump/a", &timeline.Item{Caption: strconv.Itoa(i), OriginKey: int64(i)}))
+	}
+
+	// pump returns when all items are sent, or on timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var captions []string
+	api := &timelineAPI{tl: tl}
+	err = api.pump(ctx, &subscription{lis: lis, prefix: "/pump/**"}, func(ev timeline.ItemEvent) error {
+		captions = append(captions, ev.Item.Caption)
+		if len(captions) == 5 {
+			cancel()
+		}
+		return nil
+	}, nil, func() error { return nil })
+	a.NoError(err)
+	// discarded items are re-sent from storage
+	a.Equal([]string{"1", "2", "3", "4", "5"}, captions)
+}
@@ -0,0 +1,88 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+)
+
+// Tag API
+//   GET    /api/timeline/tags?topic=/twitter/**&limit=50    tag cloud, accepts items parameters
+//   PUT    /api/timeline/items/:id/tags?tag=cat&tag=dog     DELETE to remove tags
+//   PUT    /api/timeline/tags/alias?alias=kitty&tag=cat     DELETE to remove alias
+// Items API also accepts tag (all of), any_tag and exclude_tag parameters.
+func (w *Server) mountTag(api *timelineAPI) {
+	g := w.Echo.Group("/api/timeline")
+	g.GET("/tags", api.tagCounts)
+	g.PUT("/items/:id/tags", api.updateTags(true))
+	g.DELETE("/items/:id/tags", api.updateTags(false))
+	g.PUT("/tags/alias", api.tagAlias(true))
+	g.DELETE("/tags/alias", api.tagAlias(false))
+}
+
+func (a *timelineAPI) tagCounts(c echo.Context) error {
+	q, err := parseQuery(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	// limit is for tags
+	limit := q.Limit
+	q.Limit = 0
+	counts, err := a.tl.TagCounts(c.Request().Context(), q, limit)
+	if err != nil {
+		return err
+	}
+	if counts == nil {
+		counts = []timeline.TagCount{}
+	}
+	return c.JSON(http.StatusOK, counts)
+}
+
+func (a *timelineAPI) updateTags(add bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid id")
+		}
+		tags := c.QueryParams()["tag"]
+		if len(tags) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Missing tag")
+		}
+		var current []string
+		if add {
+			current, err = a.tl.AddTags(c.Request().Context(), id, tags...)
+		} else {
+			current, err = a.tl.RemoveTags(c.Request().Context(), id, tags...)
+		}
+		if err == timeline.ErrNotFound {
+			return echo.NewHTTPError(http.StatusNotFound)
+		} else if err != nil {
+			return err
+		}
+		if current == nil {
+			current = []string{}
+		}
+		return c.JSON(http.StatusOK, current)
+	}
+}
+
+func (a *timelineAPI) tagAlias(set bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		alias, tag := c.QueryParam("alias"), c.QueryParam("tag")
+		if alias == "" || (set && tag == "") {
+			return echo.NewHTTPError(http.StatusBadRequest, "Missing alias or tag")
+		}
+		if !set {
+			tag = ""
+		}
+		err := a.tl.SetTagAlias(c.Request().Context(), alias, tag)
+		if err == timeline.ErrTagAliasCycle {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		} else if err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,35 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagAPI(t *testing.T) {
+	a := assert.New(t)
+	s, tl := newTestServer(t)
+	a.NoError(tl.NewTopic("web/test", "/webtag/a"))
+	first := &timeline.Item{Caption: "T1", OriginKey: 1, Tags: []string{"webtag-cat"}}
+	second := &timeline.Item{Caption: "T2", OriginKey: 2, Tags: []string{"webtag-dog"}}
+	a.NoError(tl.Publish("/webtag/a", first, second))
+
+	var tags []string
+	a.Equal(http.StatusOK, requestJSON(t, s, http.MethodPut, "/api/timeline/items/"+strconv.FormatInt(second.ID, 10)+"/tags?tag=webtag-cute", "", &tags))
+	a.Equal([]string{"webtag-cute", "webtag-dog"}, tags)
+	a.Equal(http.StatusNotFound, requestJSON(t, s, http.MethodPut, "/api/timeline/items/999999/tags?tag=x", "", nil))
+
+	var items []*timeline.Item
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items?topic=/webtag/a&any_tag=webtag-cat&any_tag=webtag-dog&exclude_tag=webtag-cute", &items))
+	if a.Len(items, 1) {
+		a.Equal("T1", items[0].Caption)
+	}
+
+	a.Equal(http.StatusNoContent, requestJSON(t, s, http.MethodPut, "/api/timeline/tags/alias?alias=webtag-dog&tag=webtag-cat", "", nil))
+	var counts []timeline.TagCount
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/tags?topic=/webtag/a", &counts))
+	a.Equal([]timeline.TagCount{{Tag: "webtag-cat", Count: 2}, {Tag: "webtag-cute", Count: 1}}, counts)
+}
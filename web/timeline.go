@@ -0,0 +1,217 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kanosaki/dumper/common"
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+)
+
+// Timeline HTTP API
+//   GET /api/timeline/topics?prefix=/twitter&archived=false
+//   GET /api/timeline/items?topic=/pixiv/ranking/daily&limit=20
+//   GET /api/timeline/items/:id
+//   GET /api/timeline/counts?topic=/pixiv/ranking/daily
+//   GET /api/timeline/policies    publish policies, and queued items by topic
+// prefix and topic parameters accept timeline.TopicPattern, such as /twitter/list/**,
+// and plain prefix parameter selects topics under it.
+// filter parameter accepts timeline.Filter expression, such as meta.user:foo
+// q parameter accepts timeline.ParseQuery expression, such as topic:/twitter/** tag:cat limit:50
+type timelineAPI struct {
+	tl *timeline.Service
+}
+
+func (w *Server) MountTimeline(tl *timeline.Service) {
+	api := &timelineAPI{tl: tl}
+	g := w.Echo.Group("/api/timeline")
+	g.GET("/topics", api.topics)
+	g.GET("/items", api.items)
+	g.GET("/items/:id", api.item)
+	g.GET("/counts", api.counts)
+	g.GET("/policies", api.policies)
+	w.mountStream(api)
+	w.mountTopic(api)
+	w.mountState(api)
+	w.mountTag(api)
+	w.mountExport(api)
+	w.mountFeed(api)
+	w.mountSimilar(api)
+	w.mountStats(api)
+	w.mountSearch(api)
+	w.mountMerged(api)
+}
+
+func (a *timelineAPI) topics(c echo.Context) error {
+	var topics []*timeline.Topic
+	if c.QueryParam("archived") == "true" {
+		topics = a.tl.ArchivedTopics(prefixParam(c, "prefix"))
+	} else {
+		topics = a.tl.Topics(prefixParam(c, "prefix"))
+	}
+	if topics == nil {
+		topics = []*timeline.Topic{}
+	}
+	return c.JSON(http.StatusOK, topics)
+}
+
+func (a *timelineAPI) items(c echo.Context) error {
+	q, err := parseQuery(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	items, err := a.tl.Fetch(c.Request().Context(), q)
+	if err != nil {
+		return err
+	}
+	if items == nil {
+		items = []*timeline.Item{}
+	}
+	return c.JSON(http.StatusOK, items)
+}
+
+func (a *timelineAPI) item(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid id")
+	}
+	item, err := a.tl.Get(c.Request().Context(), id)
+	if err == timeline.ErrNotFound {
+		return echo.NewHTTPError(http.StatusNotFound)
+	} else if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, item)
+}
+
+func (a *timelineAPI) counts(c echo.Context) error {
+	q, err := parseQuery(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	counts, err := a.tl.Count(c.Request().Context(), q)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, counts)
+}
+
+func (a *timelineAPI) policies(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"policies": a.tl.PublishPolicies(),
+		"status":   a.tl.PolicyStatus(),
+	})
+}
+
+// Build timeline.Query from URL parameters, which are combined with q expression.
+func parseQuery(c echo.Context) (*timeline.Query, error) {
+	params := c.QueryParams()
+	q := &timeline.Query{}
+	var err error
+	if expr := c.QueryParam("q"); expr != "" {
+		if q, err = timeline.ParseQueryFor(expr, userParam(c)); err != nil {
+			return nil, err
+		}
+	}
+	q.Topics = append(q.Topics, params["topic"]...)
+	q.Origins = append(q.Origins, params["origin"]...)
+	q.Tags = append(q.Tags, params["tag"]...)
+	q.AnyTags = append(q.AnyTags, params["any_tag"]...)
+	q.ExcludeTags = append(q.ExcludeTags, params["exclude_tag"]...)
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"min_id", &q.MinID}, {"max_id", &q.MaxID}, {"limit", &q.Limit}, {"offset", &q.Offset},
+	}
+	for _, p := range ints {
+		if c.QueryParam(p.name) == "" {
+			continue
+		}
+		if *p.dst, err = intParam(c, p.name); err != nil {
+			return nil, err
+		}
+	}
+	if c.QueryParam("before") != "" {
+		if q.Before, err = timeParam(c, "before"); err != nil {
+			return nil, err
+		}
+	}
+	if c.QueryParam("after") != "" {
+		if q.After, err = timeParam(c, "after"); err != nil {
+			return nil, err
+		}
+	}
+	f, err := filterParam(c)
+	if err != nil {
+		return nil, err
+	}
+	q.Filter = q.Filter.And(f)
+	if c.QueryParam("collapse") == "true" {
+		q.Collapse = true
+		q.CollapseDistance = timeline.DefaultSimilarDistance
+		if c.QueryParam("collapse_distance") != "" {
+			if q.CollapseDistance, err = intParam(c, "collapse_distance"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	q.Starred = q.Starred || c.QueryParam("starred") == "true"
+	q.Unread = q.Unread || c.QueryParam("unread") == "true"
+	q.ShowHidden = q.ShowHidden || c.QueryParam("show_hidden") == "true"
+	q.ShowDeleted = q.ShowDeleted || c.QueryParam("show_deleted") == "true"
+	if c.QueryParam("user") != "" || (q.User == "" && (q.Unread || q.Starred)) {
+		q.User = userParam(c)
+	}
+	return q, nil
+}
+
+func filterParam(c echo.Context) (*timeline.Filter, error) {
+	v := c.QueryParam("filter")
+	if v == "" {
+		return nil, nil
+	}
+	return timeline.ParseFilter(v)
+}
+
+// Topic pattern of a parameter which is a prefix. Plain value selects the topic and
+// topics under it by path segments, such as /twitter for /twitter/list/foo.
+func prefixParam(c echo.Context, name string) string {
+	v := c.QueryParam(name)
+	if v == "" || strings.ContainsAny(v, "*?[!, \t\n") {
+		return v
+	}
+	return strings.TrimSuffix(v, "/") + "/**"
+}
+
+func intParam(c echo.Context, name string) (int, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %v", name, v)
+	}
+	return n, nil
+}
+
+// Accepts RFC3339 or milliseconds from unix epoch.
+func timeParam(c echo.Context, name string) (time.Time, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return common.FromTimestamp(ms), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid %s: %v", name, v)
+	}
+	return t, nil
+}
@@ -0,0 +1,102 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T) (*Server, *timeline.Service) {
+	storage, err := timeline.NewStorage("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := timeline.NewService(storage)
+	s := &Server{Echo: echo.New()}
+	s.MountTimeline(tl)
+	return s, tl
+}
+
+func getJSON(t *testing.T, s *Server, path string, v interface{}) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	rec := httptest.NewRecorder()
+	s.Echo.ServeHTTP(rec, req)
+	if rec.Code == http.StatusOK && v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code
+}
+
+func TestTimelineAPI(t *testing.T) {
+	a := assert.New(t)
+	s, tl := newTestServer(t)
+	a.NoError(tl.NewTopic("web/test", "/webapi/a"))
+	a.NoError(tl.NewTopic("web/test", "/webapi/b"))
+	a.NoError(tl.Publish("/webapi/a", &timeline.Item{Caption: "A1", OriginKey: 1}, &timeline.Item{Caption: "A2", OriginKey: 2}))
+	a.NoError(tl.Publish("/webapi/b", &timeline.Item{Caption: "B1", OriginKey: 3}))
+
+	var topics []map[string]interface{}
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/topics?prefix=/webapi", &topics))
+	a.Len(topics, 2)
+
+	var items []*timeline.Item
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items?topic=/webapi/a&topic=/webapi/b&limit=2", &items))
+	if a.Len(items, 2) {
+		a.Equal("B1", items[0].Caption)
+		a.Equal("A2", items[1].Caption)
+	}
+
+	var item timeline.Item
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items/"+strconv.FormatInt(items[1].ID, 10), &item))
+	a.Equal("A2", item.Caption)
+	a.Equal(http.StatusNotFound, getJSON(t, s, "/api/timeline/items/999999", nil))
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/api/timeline/items?limit=x", nil))
+
+	var filtered []*timeline.Item
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items?topic=/webapi/**&filter=caption:%5EA", &filtered))
+	a.Equal([]string{"A2", "A1"}, []string{filtered[0].Caption, filtered[1].Caption})
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/api/timeline/items?filter=unknown:1", nil))
+
+	// query expression, combined with other parameters
+	expr := url.QueryEscape(`topic:/webapi/** -"1" limit:5`)
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items?q="+expr+"&filter=caption:A", &filtered))
+	a.Equal([]string{"A2"}, []string{filtered[0].Caption})
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items?q=topic:/webapi/**+limit:5&limit=1", &filtered))
+	a.Equal([]string{"B1"}, []string{filtered[0].Caption})
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/items?q=is:unread+topic:/webapi/a", &filtered))
+	a.Len(filtered, 2)
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/api/timeline/items?q=limit:x", nil))
+
+	var counts map[string]int64
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/counts?topic=/webapi/a&topic=/webapi/b", &counts))
+	a.Equal(map[string]int64{"/webapi/a": 2, "/webapi/b": 1}, counts)
+}
+
+func TestPoliciesAPI(t *testing.T) {
+	a := assert.New(t)
+	s, tl := newTestServer(t)
+	a.NoError(tl.NewTopic("web/test", "/webpolicy/list"))
+	a.NoError(tl.SetPublishPolicies([]timeline.PublishPolicy{{Pattern: "/webpolicy/**", Rate: 1, Per: time.Hour}}))
+	defer tl.SetPublishPolicies(nil)
+	a.NoError(tl.Publish("/webpolicy/list", &timeline.Item{Caption: "1", OriginKey: 1}, &timeline.Item{Caption: "2", OriginKey: 2}))
+
+	var res struct {
+		Policies []timeline.PublishPolicy         `json:"policies"`
+		Status   map[string]timeline.PolicyStatus `json:"status"`
+	}
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/policies", &res))
+	if a.Len(res.Policies, 1) {
+		a.Equal("/webpolicy/**", res.Policies[0].Pattern)
+	}
+	a.Equal(1, res.Status["/webpolicy/list"].Queued)
+}
@@ -0,0 +1,86 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+)
+
+// Topic management API, topic is given by key parameter
+//   GET    /api/timeline/topic?key=/twitter/list/foo
+//   PUT    /api/timeline/topic?key=/twitter/list/foo              (body: timeline.TopicInfo)
+//   POST   /api/timeline/topic/rename?key=/twitter/list/foo&to=/twitter/list/bar
+//   POST   /api/timeline/topic/archive?key=/twitter/list/foo
+//   POST   /api/timeline/topic/unarchive?key=/twitter/list/foo
+//   DELETE /api/timeline/topic?key=/twitter/list/foo               (items are also deleted)
+// Archived topics are listed by GET /api/timeline/topics?archived=true
+func (w *Server) mountTopic(api *timelineAPI) {
+	g := w.Echo.Group("/api/timeline/topic")
+	g.GET("", api.topic)
+	g.PUT("", api.updateTopic)
+	g.DELETE("", api.deleteTopic)
+	g.POST("/rename", api.renameTopic)
+	g.POST("/archive", api.archiveTopic(true))
+	g.POST("/unarchive", api.archiveTopic(false))
+}
+
+func topicError(err error) error {
+	switch err {
+	case timeline.ErrNoTopic:
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case timeline.ErrTopicExists:
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	default:
+		return err
+	}
+}
+
+func (a *timelineAPI) topic(c echo.Context) error {
+	t, ok := a.tl.Topic(c.QueryParam("key"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, timeline.ErrNoTopic.Error())
+	}
+	return c.JSON(http.StatusOK, t)
+}
+
+func (a *timelineAPI) updateTopic(c echo.Context) error {
+	var info timeline.TopicInfo
+	if err := c.Bind(&info); err != nil {
+		return err
+	}
+	key := c.QueryParam("key")
+	if err := a.tl.UpdateTopic(key, info); err != nil {
+		return topicError(err)
+	}
+	return a.topic(c)
+}
+
+func (a *timelineAPI) renameTopic(c echo.Context) error {
+	key, to := c.QueryParam("key"), c.QueryParam("to")
+	if to == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Missing to")
+	}
+	if err := a.tl.RenameTopic(key, to); err != nil {
+		return topicError(err)
+	}
+	t, _ := a.tl.Topic(to)
+	return c.JSON(http.StatusOK, t)
+}
+
+func (a *timelineAPI) archiveTopic(archived bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := a.tl.ArchiveTopic(c.QueryParam("key"), archived); err != nil {
+			return topicError(err)
+		}
+		return a.topic(c)
+	}
+}
+
+func (a *timelineAPI) deleteTopic(c echo.Context) error {
+	deleted, err := a.tl.DeleteTopic(c.QueryParam("key"))
+	if err != nil {
+		return topicError(err)
+	}
+	return c.JSON(http.StatusOK, map[string]int64{"deletedItems": deleted})
+}
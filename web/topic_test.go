@@ -0,0 +1,62 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func requestJSON(t *testing.T, s *Server, method, path, body string, v interface{}) int {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, r)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	s.Echo.ServeHTTP(rec, req)
+	if rec.Code == http.StatusOK && v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code
+}
+
+func TestTopicAPI(t *testing.T) {
+	a := assert.New(t)
+	s, tl := newTestServer(t)
+	a.NoError(tl.NewTopic("web/test", "/webtopic/a"))
+	a.NoError(tl.NewTopic("web/test", "/webtopic/b"))
+	a.NoError(tl.Publish("/webtopic/a", &timeline.Item{Caption: "A1", OriginKey: 1}))
+
+	var topic map[string]interface{}
+	a.Equal(http.StatusOK, requestJSON(t, s, http.MethodPut, "/api/timeline/topic?key=/webtopic/a", `{"title":"Topic A","iconURL":"http://example.com/a.png"}`, &topic))
+	a.Equal("Topic A", topic["title"])
+	a.Equal("http://example.com/a.png", topic["iconURL"])
+
+	a.Equal(http.StatusConflict, requestJSON(t, s, http.MethodPost, "/api/timeline/topic/rename?key=/webtopic/a&to=/webtopic/b", "", nil))
+	a.Equal(http.StatusOK, requestJSON(t, s, http.MethodPost, "/api/timeline/topic/rename?key=/webtopic/a&to=/webtopic/c", "", &topic))
+	a.Equal("/webtopic/c", topic["key"])
+	a.Equal("Topic A", topic["title"])
+
+	a.Equal(http.StatusOK, requestJSON(t, s, http.MethodPost, "/api/timeline/topic/archive?key=/webtopic/c", "", &topic))
+	a.Equal(true, topic["archived"])
+	var topics []map[string]interface{}
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/topics?prefix=/webtopic", &topics))
+	a.Len(topics, 1)
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/timeline/topics?prefix=/webtopic&archived=true", &topics))
+	a.Len(topics, 1)
+
+	var deleted map[string]int64
+	a.Equal(http.StatusOK, requestJSON(t, s, http.MethodDelete, "/api/timeline/topic?key=/webtopic/c", "", &deleted))
+	a.Equal(int64(1), deleted["deletedItems"])
+	a.Equal(http.StatusNotFound, getJSON(t, s, "/api/timeline/topic?key=/webtopic/c", nil))
+}
@@ -0,0 +1,52 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/kanosaki/dumper/webhook"
+	"github.com/labstack/echo"
+)
+
+// Webhook status and delivery log
+//   GET  /api/webhooks                                       configured hooks
+//   GET  /api/webhooks/deliveries?hook=bot&status=failed&limit=50
+//   POST /api/webhooks/deliveries/:id/redeliver
+func (w *Server) MountWebhooks(d *webhook.Dispatcher) {
+	g := w.Echo.Group("/api/webhooks")
+	g.GET("", func(c echo.Context) error {
+		hooks := d.Hooks()
+		if hooks == nil {
+			hooks = []webhook.HookConfig{}
+		}
+		return c.JSON(http.StatusOK, hooks)
+	})
+	g.GET("/deliveries", func(c echo.Context) error {
+		limit, err := intParam(c, "limit")
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		dls, err := d.Deliveries(c.Request().Context(), c.QueryParam("hook"), c.QueryParam("status"), limit)
+		if err != nil {
+			return err
+		}
+		if dls == nil {
+			dls = []*webhook.Delivery{}
+		}
+		return c.JSON(http.StatusOK, dls)
+	})
+	g.POST("/deliveries/:id/redeliver", func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid id")
+		}
+		switch err := d.Redeliver(c.Request().Context(), id); err {
+		case nil:
+			return c.NoContent(http.StatusNoContent)
+		case webhook.ErrNoDelivery, webhook.ErrUnknownHook:
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		default:
+			return err
+		}
+	})
+}
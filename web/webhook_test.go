@@ -0,0 +1,38 @@
+package web
+
+import (
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/kanosaki/dumper/webhook"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookAPI(t *testing.T) {
+	a := assert.New(t)
+	_, tl := newTestServer(t)
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "webhook.db"))
+	a.NoError(err)
+	defer db.Close()
+	d, err := webhook.New(db, tl, webhook.Config{Hooks: []webhook.HookConfig{
+		{Name: "bot", URL: "http://localhost/", Pattern: "/**", Secret: "s3cr3t"},
+	}})
+	a.NoError(err)
+	s := &Server{Echo: echo.New()}
+	s.MountWebhooks(d)
+
+	var hooks []map[string]interface{}
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/webhooks", &hooks))
+	a.Len(hooks, 1)
+	a.Equal("bot", hooks[0]["name"])
+	a.NotContains(hooks[0], "secret")
+
+	var dls []*webhook.Delivery
+	a.Equal(http.StatusOK, getJSON(t, s, "/api/webhooks/deliveries?hook=bot", &dls))
+	a.Empty(dls)
+	a.Equal(http.StatusBadRequest, getJSON(t, s, "/api/webhooks/deliveries?limit=x", nil))
+	a.Equal(http.StatusNotFound, requestJSON(t, s, http.MethodPost, "/api/webhooks/deliveries/1/redeliver", "", nil))
+}
@@ -0,0 +1,195 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/kanosaki/dumper/common"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+var queueDDLs = []string{
+	`CREATE TABLE IF NOT EXISTS webhook_delivery (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		hook TEXT NOT NULL,
+		payload BLOB NOT NULL,
+		items INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		response_status INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhook_delivery_hook_status ON webhook_delivery(hook, status, id)`,
+	// last queued item for each hook
+	`CREATE TABLE IF NOT EXISTS webhook_cursor (
+		hook TEXT PRIMARY KEY,
+		last_item_id INTEGER NOT NULL
+	)`,
+}
+
+// Entry of the delivery log.
+type Delivery struct {
+	ID             int64     `json:"id"`
+	Hook           string    `json:"hook"`
+	Items          int       `json:"items"`
+	Status         string    `json:"status"`
+	Attempts       int       `json:"attempts"`
+	NextAttemptAt  time.Time `json:"nextAttemptAt"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+	ResponseStatus int       `json:"responseStatus,omitempty"`
+	LastError      string    `json:"lastError,omitempty"`
+}
+
+func initQueue(ctx context.Context, db *sql.DB) error {
+	for _, ddl := range queueDDLs {
+		if _, err := db.ExecContext(ctx, ddl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadCursor(ctx context.Context, db *sql.DB, hook string) (int64, error) {
+	var id int64
+	err := db.QueryRowContext(ctx, `SELECT last_item_id FROM webhook_cursor WHERE hook = ?`, hook).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// Queue a payload and advance the cursor atomically.
+func insertDelivery(ctx context.Context, db *sql.DB, hook string, payload []byte, items int, lastItemID int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	now := common.Timestamp(time.Now())
+	_, err = tx.ExecContext(ctx, `INSERT INTO webhook_delivery(hook, payload, items, status, next_attempt_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, hook, payload, items, StatusPending, now, now, now)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO webhook_cursor(hook, last_item_id) VALUES (?, ?)
+		ON CONFLICT(hook) DO UPDATE SET last_item_id = MAX(last_item_id, excluded.last_item_id)`, hook, lastItemID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+const deliveryColumns = `id, hook, items, status, attempts, next_attempt_at, created_at, updated_at, response_status, last_error`
+
+func scanDelivery(row interface {
+	Scan(dest ...interface{}) error
+}, extra ...interface{}) (*Delivery, error) {
+	var dl Delivery
+	var next, created, updated int64
+	dest := append([]interface{}{&dl.ID, &dl.Hook, &dl.Items, &dl.Status, &dl.Attempts,
+		&next, &created, &updated, &dl.ResponseStatus, &dl.LastError}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	dl.NextAttemptAt = common.FromTimestamp(next)
+	dl.CreatedAt = common.FromTimestamp(created)
+	dl.UpdatedAt = common.FromTimestamp(updated)
+	return &dl, nil
+}
+
+// Oldest pending delivery of the hook, which may not be due yet.
+func nextDelivery(ctx context.Context, db *sql.DB, hook string) (*Delivery, []byte, error) {
+	var payload []byte
+	row := db.QueryRowContext(ctx, `SELECT `+deliveryColumns+`, payload FROM webhook_delivery
+		WHERE hook = ? AND status = ? ORDER BY next_attempt_at, id LIMIT 1`, hook, StatusPending)
+	dl, err := scanDelivery(row, &payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dl, payload, nil
+}
+
+// Record result of an attempt. Finished deliveries older than logSize are removed.
+func updateDelivery(ctx context.Context, db *sql.DB, dl *Delivery, logSize int) error {
+	_, err := db.ExecContext(ctx, `UPDATE webhook_delivery SET status = ?, attempts = ?, next_attempt_at = ?,
+		updated_at = ?, response_status = ?, last_error = ? WHERE id = ?`,
+		dl.Status, dl.Attempts, common.Timestamp(dl.NextAttemptAt), common.Timestamp(time.Now()),
+		dl.ResponseStatus, dl.LastError, dl.ID)
+	if err != nil || dl.Status == StatusPending {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM webhook_delivery WHERE hook = ?1 AND status != ?2 AND id NOT IN (
+		SELECT id FROM webhook_delivery WHERE hook = ?1 AND status != ?2 ORDER BY id DESC LIMIT ?3)`,
+		dl.Hook, StatusPending, logSize)
+	return err
+}
+
+// Delivery log, newest first. Empty hook and status match all.
+func (d *Dispatcher) Deliveries(ctx context.Context, hook, status string, limit int) ([]*Delivery, error) {
+	query := `SELECT ` + deliveryColumns + ` FROM webhook_delivery WHERE 1 = 1`
+	var params []interface{}
+	if hook != "" {
+		query += ` AND hook = ?`
+		params = append(params, hook)
+	}
+	if status != "" {
+		query += ` AND status = ?`
+		params = append(params, status)
+	}
+	query += ` ORDER BY id DESC`
+	if limit > 0 {
+		query += ` LIMIT ?`
+		params = append(params, limit)
+	}
+	rows, err := d.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []*Delivery
+	for rows.Next() {
+		dl, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, dl)
+	}
+	return ret, rows.Err()
+}
+
+// Queue a finished delivery again, attempts are reset.
+func (d *Dispatcher) Redeliver(ctx context.Context, id int64) error {
+	var hook string
+	err := d.db.QueryRowContext(ctx, `SELECT hook FROM webhook_delivery WHERE id = ?`, id).Scan(&hook)
+	if err == sql.ErrNoRows {
+		return ErrNoDelivery
+	} else if err != nil {
+		return err
+	}
+	h, ok := d.hooks[hook]
+	if !ok {
+		return ErrUnknownHook
+	}
+	now := common.Timestamp(time.Now())
+	_, err = d.db.ExecContext(ctx, `UPDATE webhook_delivery SET status = ?, attempts = 0, next_attempt_at = ?, updated_at = ?
+		WHERE id = ?`, StatusPending, now, now, id)
+	if err != nil {
+		return err
+	}
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,424 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kanosaki/dumper/timeline"
+)
+
+const (
+	HeaderSignature = "X-Dumper-Signature"
+	HeaderDelivery  = "X-Dumper-Delivery"
+	HeaderHook      = "X-Dumper-Hook"
+)
+
+var (
+	DefaultBatchSize     = 50
+	DefaultBatchInterval = 2 * time.Second
+	DefaultMaxAttempts   = 10
+	DefaultRetryBackoff  = 1 * time.Second
+	DefaultMaxBackoff    = 1 * time.Hour
+	DefaultTimeout       = 10 * time.Second
+	DefaultLogSize       = 1000
+	// Upper bound of sleep of a delivery worker, pending deliveries are re-checked by this.
+	PollInterval = 1 * time.Minute
+
+	ErrUnknownHook = errors.New("Unknown webhook")
+	ErrNoDelivery  = errors.New("No such delivery")
+)
+
+// A receiver of items published to topics matched to Pattern.
+type HookConfig struct {
+	Name string `yaml:"name" json:"name"`
+	URL  string `yaml:"url" json:"url"`
+	// TopicPattern, glob is required to subscribe topics created later.
+	Pattern string `yaml:"pattern" json:"pattern"`
+	// Filter expression, see timeline.Filter.
+	Filter string `yaml:"filter" json:"filter,omitempty"`
+	// Key of HMAC-SHA256 signature of the body, sent in X-Dumper-Signature.
+	Secret string `yaml:"secret" json:"-"`
+}
+
+// webhooks.yaml
+//   batch_interval: 2s
+//   hooks:
+//     - name: chatbot
+//       url: http://bot.local/dumper
+//       pattern: /twitter/**
+//       filter: tag:cat -tag:nsfw
+//       secret: s3cr3t
+type Config struct {
+	// Items are sent by BatchSize at most, and waited BatchInterval at most.
+	BatchSize     int           `yaml:"batch_size"`
+	BatchInterval time.Duration `yaml:"batch_interval"`
+	// Failed deliveries are retried with exponential backoff, up to MaxAttempts.
+	MaxAttempts  int           `yaml:"max_attempts"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	MaxBackoff   time.Duration `yaml:"max_backoff"`
+	Timeout      time.Duration `yaml:"timeout"`
+	// Number of finished deliveries kept for the log, for each hook.
+	LogSize int          `yaml:"log_size"`
+	Hooks   []HookConfig `yaml:"hooks"`
+}
+
+// Body of POST request.
+type Payload struct {
+	Hook  string         `json:"hook"`
+	Items []*PayloadItem `json:"items"`
+}
+
+type PayloadItem struct {
+	Topic string `json:"topic"`
+	// added, updated or deleted, see timeline.ItemEventKind
+	Event timeline.ItemEventKind `json:"event"`
+	// Set for a digest of timeline.PublishPolicy, whose id is shared with the last summarized item.
+	IsDigest bool `json:"isDigest,omitempty"`
+	*timeline.Item
+}
+
+// Hex encoded HMAC-SHA256 of body, with "sha256=" prefix.
+// Receivers should compare it with X-Dumper-Signature by hmac.Equal.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher delivers items to hooks. Payloads are queued in database before
+// delivery, and last queued item is recorded for each hook, so that items
+// published while stopped are queued on next Start.
+type Dispatcher struct {
+	db     *sql.DB
+	tl     *timeline.Service
+	conf   Config
+	hooks  map[string]*hook
+	client *http.Client
+}
+
+type hook struct {
+	HookConfig
+	filter *timeline.Filter
+	// notified when deliveries are queued
+	wake chan struct{}
+}
+
+// Tables are created in db, which should be SQLite.
+func New(db *sql.DB, tl *timeline.Service, conf Config) (*Dispatcher, error) {
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = DefaultBatchSize
+	}
+	if conf.BatchInterval <= 0 {
+		conf.BatchInterval = DefaultBatchInterval
+	}
+	if conf.MaxAttempts <= 0 {
+		conf.MaxAttempts = DefaultMaxAttempts
+	}
+	if conf.RetryBackoff <= 0 {
+		conf.RetryBackoff = DefaultRetryBackoff
+	}
+	if conf.MaxBackoff <= 0 {
+		conf.MaxBackoff = DefaultMaxBackoff
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = DefaultTimeout
+	}
+	if conf.LogSize <= 0 {
+		conf.LogSize = DefaultLogSize
+	}
+	d := &Dispatcher{
+		db:     db,
+		tl:     tl,
+		conf:   conf,
+		hooks:  make(map[string]*hook),
+		client: &http.Client{Timeout: conf.Timeout},
+	}
+	for _, hc := range conf.Hooks {
+		if hc.Name == "" || hc.URL == "" || hc.Pattern == "" {
+			return nil, fmt.Errorf("name, url and pattern are required for webhook")
+		}
+		if _, ok := d.hooks[hc.Name]; ok {
+			return nil, fmt.Errorf("Duplicated webhook name: %s", hc.Name)
+		}
+		h := &hook{HookConfig: hc, wake: make(chan struct{}, 1)}
+		if hc.Filter != "" {
+			f, err := timeline.ParseFilter(hc.Filter)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid filter of webhook %s: %v", hc.Name, err)
+			}
+			h.filter = f
+		}
+		d.hooks[hc.Name] = h
+	}
+	if err := initQueue(context.Background(), db); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Replace HTTP client, used for delivery.
+func (d *Dispatcher) SetClient(c *http.Client) {
+	d.client = c
+}
+
+// Configured hooks, Secret is not marshaled to JSON.
+func (d *Dispatcher) Hooks() []HookConfig {
+	return d.conf.Hooks
+}
+
+// Listen timeline and deliver queued payloads for all hooks until ctx is done.
+// Errors which don't stop the dispatcher are passed to onError if not nil.
+func (d *Dispatcher) Start(ctx context.Context, onError func(error)) error {
+	report := func(h *hook, err error) {
+		if err != nil && err != context.Canceled && onError != nil {
+			onError(fmt.Errorf("webhook %s: %v", h.Name, err))
+		}
+	}
+	listeners := make(map[*hook]*timeline.Listener, len(d.hooks))
+	for _, h := range d.hooks {
+		var opts []timeline.ListenOption
+		if h.filter != nil {
+			opts = append(opts, timeline.WithFilter(h.filter))
+		}
+		lis, err := d.tl.Listen(h.Pattern, opts...)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("webhook %s: %v", h.Name, err)
+		}
+		listeners[h] = lis
+	}
+	var wg sync.WaitGroup
+	for h, lis := range listeners {
+		wg.Add(2)
+		go func(h *hook, lis *timeline.Listener) {
+			defer wg.Done()
+			defer lis.Close()
+			report(h, d.collect(ctx, h, lis))
+		}(h, lis)
+		go func(h *hook) {
+			defer wg.Done()
+			d.deliverLoop(ctx, h, func(err error) { report(h, err) })
+		}(h)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Queue published items in batches. Items after the cursor of the hook
+// are read from storage first, and also when listener overflows.
+func (d *Dispatcher) collect(ctx context.Context, h *hook, lis *timeline.Listener) error {
+	cursor, err := loadCursor(ctx, d.db, h.Name)
+	if err != nil {
+		return err
+	}
+	catchUp := func() error {
+		for cursor > 0 {
+			items, err := d.tl.FetchSince(ctx, h.Pattern, cursor, d.conf.BatchSize, h.filter)
+			if err != nil {
+				return err
+			}
+			if len(items) == 0 {
+				return nil
+			}
+			events := make([]timeline.ItemEvent, len(items))
+			for i, it := range items {
+				events[i] = timeline.ItemEvent{Kind: timeline.ItemAdded, Item: it}
+			}
+			if err := d.enqueue(ctx, h, events); err != nil {
+				return err
+			}
+			cursor = items[len(items)-1].ID
+		}
+		return nil
+	}
+	if err := catchUp(); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(d.conf.BatchInterval)
+	defer ticker.Stop()
+	var buf []timeline.ItemEvent
+	flush := func(ctx context.Context) error {
+		if len(buf) > 0 {
+			if err := d.enqueue(ctx, h, buf); err != nil {
+				return err
+			}
+			if last := lastAddedID(buf); last > cursor {
+				cursor = last
+			}
+			buf = nil
+		}
+		if sinceID, missed := lis.Missed(); missed {
+			lis.ClearMissed()
+			if cursor == 0 {
+				cursor = sinceID - 1
+			}
+			return catchUp()
+		}
+		return nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			// buffered items are queued, to be delivered on next start
+			return flush(context.Background())
+		case ev, ok := <-lis.C:
+			if !ok {
+				return lis.Err()
+			}
+			if ev.Kind == timeline.ItemAdded && ev.Item.ID <= cursor {
+				// already queued by catch up
+				continue
+			}
+			buf = append(buf, ev)
+			if len(buf) >= d.conf.BatchSize {
+				if err := flush(ctx); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			if err := flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) enqueue(ctx context.Context, h *hook, events []timeline.ItemEvent) error {
+	p := &Payload{Hook: h.Name}
+	for _, ev := range events {
+		p.Items = append(p.Items, &PayloadItem{Topic: ev.Item.TopicKey, Event: ev.Kind, IsDigest: ev.Item.IsDigest(), Item: ev.Item})
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := insertDelivery(ctx, d.db, h.Name, body, len(events), lastAddedID(events)); err != nil {
+		return err
+	}
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// ID of the newest added item, which is the cursor after the events.
+// Updated and deleted items may be older than the cursor.
+func lastAddedID(events []timeline.ItemEvent) int64 {
+	var last int64
+	for _, ev := range events {
+		if ev.Kind == timeline.ItemAdded && ev.Item.ID > last {
+			last = ev.Item.ID
+		}
+	}
+	return last
+}
+
+// Deliver due payloads of the hook in order of queueing, and sleep until next one is due.
+func (d *Dispatcher) deliverLoop(ctx context.Context, h *hook, report func(error)) {
+	for {
+		wait, err := d.deliverDue(ctx, h)
+		report(err)
+		if err != nil {
+			wait = d.conf.RetryBackoff
+		}
+		if wait > PollInterval {
+			wait = PollInterval
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-h.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Returns duration until the next pending delivery is due.
+func (d *Dispatcher) deliverDue(ctx context.Context, h *hook) (time.Duration, error) {
+	for {
+		if ctx.Err() != nil {
+			return 0, nil
+		}
+		dl, body, err := nextDelivery(ctx, d.db, h.Name)
+		if err == sql.ErrNoRows {
+			return PollInterval, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if wait := time.Until(dl.NextAttemptAt); wait > 0 {
+			return wait, nil
+		}
+		status, err := d.post(ctx, h, dl.ID, body)
+		if ctx.Err() != nil {
+			// stopped while sending, delivery is tried again on next start
+			return 0, nil
+		}
+		dl.Attempts++
+		dl.ResponseStatus = status
+		dl.LastError = ""
+		if err != nil {
+			dl.LastError = err.Error()
+			if dl.Attempts >= d.conf.MaxAttempts {
+				dl.Status = StatusFailed
+			} else {
+				dl.NextAttemptAt = time.Now().Add(d.backoff(dl.Attempts))
+			}
+		} else {
+			dl.Status = StatusDelivered
+		}
+		if err := updateDelivery(ctx, d.db, dl, d.conf.LogSize); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	b := d.conf.RetryBackoff
+	for i := 1; i < attempts && b < d.conf.MaxBackoff; i++ {
+		b *= 2
+	}
+	if b > d.conf.MaxBackoff {
+		b = d.conf.MaxBackoff
+	}
+	return b
+}
+
+// Send a payload, non-2xx responses are regarded as failure.
+func (d *Dispatcher) post(ctx context.Context, h *hook, id int64, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderHook, h.Name)
+	req.Header.Set(HeaderDelivery, fmt.Sprint(id))
+	if h.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(h.Secret, body))
+	}
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("Receiver responded %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
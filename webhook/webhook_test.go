@@ -0,0 +1,270 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kanosaki/dumper/timeline"
+	"github.com/stretchr/testify/assert"
+)
+
+type receiver struct {
+	mu       sync.Mutex
+	payloads []*Payload
+	requests int
+	// responded status codes in order, then 200
+	statuses []int
+	secret   string
+	badSig   int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	body, _ := ioutil.ReadAll(req.Body)
+	if r.secret != "" && req.Header.Get(HeaderSignature) != Sign(r.secret, body) {
+		r.badSig++
+	}
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	var p Payload
+	json.Unmarshal(body, &p)
+	r.payloads = append(r.payloads, &p)
+}
+
+func (r *receiver) captions() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ret []string
+	for _, p := range r.payloads {
+		for _, it := range p.Items {
+			ret = append(ret, it.Caption)
+		}
+	}
+	return ret
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+type fixture struct {
+	db *sql.DB
+	tl *timeline.Service
+}
+
+func newFixture(t *testing.T) *fixture {
+	dir := t.TempDir()
+	storage, err := timeline.NewStorage("sqlite3", filepath.Join(dir, "timeline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "webhook.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	tl := timeline.NewService(storage)
+	if err := tl.NewTopic("test", "/wh/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.NewTopic("test", "/wh/b"); err != nil {
+		t.Fatal(err)
+	}
+	return &fixture{db: db, tl: tl}
+}
+
+// Start a dispatcher, returned function stops it.
+func (f *fixture) start(t *testing.T, conf Config) (*Dispatcher, func()) {
+	if conf.BatchInterval == 0 {
+		conf.BatchInterval = 10 * time.Millisecond
+	}
+	if conf.RetryBackoff == 0 {
+		conf.RetryBackoff = 5 * time.Millisecond
+	}
+	d, err := New(f.db, f.tl, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := d.Start(ctx, nil); err != nil {
+			t.Error(err)
+		}
+	}()
+	// wait for subscription
+	time.Sleep(30 * time.Millisecond)
+	return d, func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	a := assert.New(t)
+	f := newFixture(t)
+	r := &receiver{secret: "s3cr3t"}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	d, stop := f.start(t, Config{Hooks: []HookConfig{
+		{Name: "bot", URL: srv.URL, Pattern: "/wh/**", Filter: "-caption:skip", Secret: "s3cr3t"},
+	}})
+	defer stop()
+	a.NoError(f.tl.Publish("/wh/a", &timeline.Item{Caption: "one", OriginKey: 1}, &timeline.Item{Caption: "skip", OriginKey: 2}))
+	a.NoError(f.tl.Publish("/wh/b", &timeline.Item{Caption: "two", OriginKey: 3}))
+	waitFor(t, func() bool { return len(r.captions()) >= 2 })
+	a.Equal([]string{"one", "two"}, r.captions())
+	a.Equal(0, r.badSig)
+	r.mu.Lock()
+	a.Equal("bot", r.payloads[0].Hook)
+	a.Equal("/wh/a", r.payloads[0].Items[0].Topic)
+	a.Equal(timeline.ItemAdded, r.payloads[0].Items[0].Event)
+	r.mu.Unlock()
+
+	// changes of queued items are delivered, though they are older than the cursor
+	a.NoError(f.tl.Delete("/wh/a", 1))
+	waitFor(t, func() bool { return len(r.captions()) >= 3 })
+	a.Equal([]string{"one", "two", "one"}, r.captions())
+	r.mu.Lock()
+	last := r.payloads[len(r.payloads)-1].Items[0]
+	a.Equal(timeline.ItemDeleted, last.Event)
+	a.NotNil(last.Deleted)
+	r.mu.Unlock()
+
+	// the status is recorded after the response is received
+	waitFor(t, func() bool {
+		all, _ := d.Deliveries(context.Background(), "bot", "", 0)
+		delivered, _ := d.Deliveries(context.Background(), "bot", StatusDelivered, 0)
+		return len(all) > 0 && len(delivered) == len(all)
+	})
+	dls, err := d.Deliveries(context.Background(), "bot", StatusDelivered, 0)
+	a.NoError(err)
+	for _, dl := range dls {
+		a.Equal(http.StatusOK, dl.ResponseStatus)
+		a.Equal(1, dl.Attempts)
+	}
+}
+
+func TestDeliverDigest(t *testing.T) {
+	a := assert.New(t)
+	f := newFixture(t)
+	a.NoError(f.tl.SetPublishPolicies([]timeline.PublishPolicy{{Pattern: "/wh/a", Digest: 20 * time.Millisecond}}))
+	r := &receiver{}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	_, stop := f.start(t, Config{Hooks: []HookConfig{{Name: "bot", URL: srv.URL, Pattern: "/wh/**"}}})
+	defer stop()
+	first := &timeline.Item{Caption: "one", OriginKey: 1}
+	last := &timeline.Item{Caption: "two", OriginKey: 2}
+	a.NoError(f.tl.Publish("/wh/a", first, last))
+	waitFor(t, func() bool { return len(r.captions()) >= 1 })
+	a.NoError(f.tl.Update(&timeline.Item{TopicKey: "/wh/a", OriginKey: 2, Caption: "two edited"}))
+	waitFor(t, func() bool { return len(r.captions()) >= 2 })
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	digest, updated := r.payloads[0].Items[0], r.payloads[1].Items[0]
+	a.True(digest.IsDigest)
+	a.Equal([]int64{first.ID, last.ID}, digest.Digest)
+	// the update of the last item is told apart from the digest
+	a.Equal(digest.ID, updated.ID)
+	a.False(updated.IsDigest)
+}
+
+func TestRetry(t *testing.T) {
+	a := assert.New(t)
+	f := newFixture(t)
+	r := &receiver{statuses: []int{500, 502}}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	d, stop := f.start(t, Config{MaxAttempts: 3, Hooks: []HookConfig{
+		{Name: "flaky", URL: srv.URL, Pattern: "/wh/a"},
+	}})
+	defer stop()
+	a.NoError(f.tl.Publish("/wh/a", &timeline.Item{Caption: "retried", OriginKey: 1}))
+	waitFor(t, func() bool { return len(r.captions()) == 1 })
+	waitFor(t, func() bool {
+		dls, _ := d.Deliveries(context.Background(), "flaky", StatusDelivered, 0)
+		return len(dls) == 1 && dls[0].Attempts == 3
+	})
+
+	// give up after MaxAttempts, then redeliver by hand
+	r.mu.Lock()
+	r.statuses = []int{500, 500, 500}
+	r.mu.Unlock()
+	a.NoError(f.tl.Publish("/wh/a", &timeline.Item{Caption: "failed", OriginKey: 2}))
+	var failed []*Delivery
+	waitFor(t, func() bool {
+		failed, _ = d.Deliveries(context.Background(), "flaky", StatusFailed, 0)
+		return len(failed) == 1
+	})
+	a.Equal(3, failed[0].Attempts)
+	a.Equal(500, failed[0].ResponseStatus)
+	a.NotEmpty(failed[0].LastError)
+	a.NoError(d.Redeliver(context.Background(), failed[0].ID))
+	waitFor(t, func() bool { return len(r.captions()) == 2 })
+	a.Equal(ErrNoDelivery, d.Redeliver(context.Background(), 12345))
+}
+
+func TestRestart(t *testing.T) {
+	a := assert.New(t)
+	f := newFixture(t)
+	r := &receiver{statuses: []int{503}}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	conf := Config{RetryBackoff: time.Hour, Hooks: []HookConfig{
+		{Name: "bot", URL: srv.URL, Pattern: "/wh/**"},
+	}}
+	d, stop := f.start(t, conf)
+	a.NoError(f.tl.Publish("/wh/a", &timeline.Item{Caption: "queued", OriginKey: 1}))
+	waitFor(t, func() bool {
+		dls, _ := d.Deliveries(context.Background(), "bot", StatusPending, 0)
+		return len(dls) == 1 && dls[0].Attempts == 1
+	})
+	stop()
+	// published while stopped
+	a.NoError(f.tl.Publish("/wh/b", &timeline.Item{Caption: "missed", OriginKey: 2}))
+
+	// queued delivery is retried immediately after restart
+	conf.RetryBackoff = 0
+	_, err := f.db.Exec(`UPDATE webhook_delivery SET next_attempt_at = 0`)
+	a.NoError(err)
+	_, stop = f.start(t, conf)
+	defer stop()
+	waitFor(t, func() bool { return len(r.captions()) == 2 })
+	a.Equal([]string{"queued", "missed"}, r.captions())
+}
+
+func TestInvalidConfig(t *testing.T) {
+	a := assert.New(t)
+	f := newFixture(t)
+	_, err := New(f.db, f.tl, Config{Hooks: []HookConfig{{Name: "a", URL: "http://localhost/"}}})
+	a.Error(err)
+	_, err = New(f.db, f.tl, Config{Hooks: []HookConfig{{Name: "a", URL: "http://localhost/", Pattern: "/", Filter: "("}}})
+	a.Error(err)
+	_, err = New(f.db, f.tl, Config{Hooks: []HookConfig{
+		{Name: "a", URL: "http://localhost/", Pattern: "/"},
+		{Name: "a", URL: "http://localhost/", Pattern: "/"},
+	}})
+	a.Error(err)
+}